@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/surfiniaburger/api-go/configs"
+	"github.com/surfiniaburger/api-go/db"
+	"github.com/surfiniaburger/api-go/services/auth"
+	"github.com/surfiniaburger/api-go/services/privacy"
+	"github.com/surfiniaburger/api-go/services/user"
+	"github.com/surfiniaburger/api-go/types"
+)
+
+const usage = `usage: go run cmd/admin/main.go <command> [flags]
+
+commands:
+  bootstrap -email EMAIL [-first NAME] [-last NAME] [-force]
+      makes EMAIL an admin, creating the account if it does not exist. The
+      password of a new account is read from ADMIN_PASSWORD or stdin. It
+      refuses to run once an admin exists unless -force is given.
+
+  export -user ID [-format json|zip] [-out FILE]
+      writes everything stored about the user to FILE, or stdout.
+
+  erase -user ID [-yes]
+      anonymizes the user and removes their personal data, keeping their
+      orders. It asks for confirmation unless -yes is given.`
+
+func main() {
+	if len(os.Args) < 2 {
+		exitWithUsage()
+	}
+
+	switch os.Args[1] {
+	case "bootstrap":
+		bootstrap(os.Args[2:])
+	case "export":
+		export(os.Args[2:])
+	case "erase":
+		erase(os.Args[2:])
+	default:
+		exitWithUsage()
+	}
+}
+
+func bootstrap(args []string) {
+	flags := flag.NewFlagSet("bootstrap", flag.ExitOnError)
+	email := flags.String("email", "", "email address of the admin")
+	firstName := flags.String("first", "Admin", "first name of a new account")
+	lastName := flags.String("last", "Admin", "last name of a new account")
+	force := flags.Bool("force", false, "run even if an admin already exists")
+	flags.Parse(args)
+
+	if *email == "" {
+		exitWithUsage()
+	}
+
+	store := user.NewStore(openDB())
+
+	admins, err := store.CountUsersByRole("admin")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if admins > 0 && !*force {
+		log.Fatalf("there already is an admin, use -force to make another one")
+	}
+
+	userID, err := findOrCreateUser(store, *email, *firstName, *lastName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := store.UpdateRole(userID, "admin", 0); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("user %d (%s) is now an admin, they have to enable two-factor authentication at /api/v1/me/mfa/enroll", userID, *email)
+}
+
+func export(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	userID := flags.Int("user", 0, "ID of the user")
+	format := flags.String("format", "json", "json or zip")
+	out := flags.String("out", "", "file to write, stdout if empty")
+	flags.Parse(args)
+
+	if *userID == 0 || (*format != "json" && *format != "zip") {
+		exitWithUsage()
+	}
+
+	data, err := privacy.NewStore(openDB()).ExportUserData(*userID)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if *format == "zip" {
+		err = privacy.WriteArchive(w, data)
+	} else {
+		err = privacy.WriteJSON(w, data)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("exported the data of user %d", *userID)
+}
+
+func erase(args []string) {
+	flags := flag.NewFlagSet("erase", flag.ExitOnError)
+	userID := flags.Int("user", 0, "ID of the user")
+	yes := flags.Bool("yes", false, "do not ask for confirmation")
+	flags.Parse(args)
+
+	if *userID == 0 {
+		exitWithUsage()
+	}
+
+	database := openDB()
+
+	u, err := user.NewStore(database).GetUserByID(*userID)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if !*yes && !confirm(fmt.Sprintf("Erase user %d (%s)? This cannot be undone. Type yes to continue: ", u.ID, u.Email)) {
+		log.Fatal("aborted")
+	}
+
+	if err := privacy.NewStore(database).EraseUser(u.ID); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("erased user %d", u.ID)
+}
+
+func openDB() *sql.DB {
+	cfg := mysql.Config{
+		User:                 configs.Envs.DBUser,
+		Passwd:               configs.Envs.DBPassword,
+		Addr:                 configs.Envs.DBAddress,
+		DBName:               configs.Envs.DBName,
+		Net:                  "tcp",
+		AllowNativePasswords: true,
+		ParseTime:            true,
+	}
+
+	db, err := db.NewMySQLStorage(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return db
+}
+
+func exitWithUsage() {
+	fmt.Fprintln(os.Stderr, usage)
+	os.Exit(2)
+}
+
+func confirm(prompt string) bool {
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+
+	return strings.TrimSpace(line) == "yes"
+}
+
+func findOrCreateUser(store *user.Store, email, firstName, lastName string) (int, error) {
+	if u, err := store.GetUserByEmail(email); err == nil {
+		return u.ID, nil
+	}
+
+	password, err := readPassword()
+	if err != nil {
+		return 0, err
+	}
+
+	policy, err := auth.LoadPasswordPolicy(configs.Envs)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := policy.Check(password); err != nil {
+		return 0, err
+	}
+
+	hasher, err := auth.LoadPasswordHasher(configs.Envs)
+	if err != nil {
+		return 0, err
+	}
+
+	hashedPassword, err := hasher.Hash(password)
+	if err != nil {
+		return 0, err
+	}
+
+	// the account is created as a user so that the promotion is recorded in
+	// the audit trail like any other role change
+	return store.CreateUser(types.User{
+		FirstName:     firstName,
+		LastName:      lastName,
+		Email:         email,
+		Password:      hashedPassword,
+		Role:          "user",
+		EmailVerified: true,
+	})
+}
+
+func readPassword() (string, error) {
+	if password := os.Getenv("ADMIN_PASSWORD"); password != "" {
+		return password, nil
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("failed to read the password: %v", err)
+	}
+
+	return strings.TrimSpace(line), nil
+}
@@ -2,15 +2,27 @@
 package api
 
 import (
+	"context"
 	"database/sql"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/surfiniaburger/api-go/configs"
+	"github.com/surfiniaburger/api-go/services/address"
+	"github.com/surfiniaburger/api-go/services/apikey"
+	"github.com/surfiniaburger/api-go/services/auth"
 	"github.com/surfiniaburger/api-go/services/cart"
+	"github.com/surfiniaburger/api-go/services/category"
+	"github.com/surfiniaburger/api-go/services/impersonation"
 	"github.com/surfiniaburger/api-go/services/library"
+	"github.com/surfiniaburger/api-go/services/notify"
 	"github.com/surfiniaburger/api-go/services/order"
+	"github.com/surfiniaburger/api-go/services/preferences"
+	"github.com/surfiniaburger/api-go/services/privacy"
 	"github.com/surfiniaburger/api-go/services/product"
+	"github.com/surfiniaburger/api-go/services/token"
 	"github.com/surfiniaburger/api-go/services/user"
 )
 
@@ -27,18 +39,75 @@ func NewAPIServer(addr string, db *sql.DB) *APIServer {
 }
 
 func (s *APIServer) Run() error {
+	keys, err := auth.LoadKeySet(configs.Envs)
+	if err != nil {
+		return err
+	}
+	auth.SetKeySet(keys)
+
+	hasher, err := auth.LoadPasswordHasher(configs.Envs)
+	if err != nil {
+		return err
+	}
+	auth.SetPasswordHasher(hasher)
+
+	policy, err := auth.LoadPasswordPolicy(configs.Envs)
+	if err != nil {
+		return err
+	}
+	auth.SetPasswordPolicy(policy)
+
 	router := mux.NewRouter()
+	router.HandleFunc("/.well-known/jwks.json", auth.HandleJWKS).Methods(http.MethodGet)
+
 	subrouter := router.PathPrefix("/api/v1").Subrouter()
 
 	userStore := user.NewStore(s.db)
-	userHandler := user.NewHandler(userStore)
+	tokenStore := token.NewStore(s.db)
+	auth.SetRevocationStore(tokenStore)
+	auth.SetRoleStore(userStore)
+	auth.SetSessionStore(tokenStore)
+	go auth.PruneRevocations(context.Background(), tokenStore, time.Hour)
+	go auth.PruneLoginAttempts(context.Background(), userStore, time.Hour)
+
+	sender, err := notify.NewNotifier(configs.Envs)
+	if err != nil {
+		return err
+	}
+
+	preferencesStore := preferences.NewStore(s.db)
+	notifier := notify.NewPreferencesNotifier(sender, preferencesStore)
+	preferencesHandler := preferences.NewHandler(preferencesStore, userStore)
+	preferencesHandler.RegisterRoutes(subrouter)
+
+	userHandler := user.NewHandler(user.HandlerConfig{
+		Users:              userStore,
+		RefreshTokens:      tokenStore,
+		Sessions:           tokenStore,
+		PasswordResets:     tokenStore,
+		EmailVerifications: tokenStore,
+		EmailChanges:       tokenStore,
+		MFA:                userStore,
+		LoginAttempts:      userStore,
+		Identities:         userStore,
+		OIDCStates:         tokenStore,
+		Notifier:           notifier,
+	})
 	userHandler.RegisterRoutes(subrouter)
 
+	apiKeyStore := apikey.NewStore(s.db)
+	auth.SetAPIKeyStore(apiKeyStore)
+	apiKeyHandler := apikey.NewHandler(apiKeyStore, userStore)
+	apiKeyHandler.RegisterRoutes(subrouter)
+
 	productStore := product.NewStore(s.db)
-	productHandler := product.NewHandler(productStore, userStore)
+	sweepInterval := time.Second * time.Duration(configs.Envs.ReservationSweepIntervalInSeconds)
+	go product.PruneReservations(context.Background(), productStore, sweepInterval)
+	productHandler := product.NewHandler(productStore, productStore, userStore)
 	productHandler.RegisterRoutes(subrouter)
 
-	orderStore := order.NewStore(s.db)
+	categoryHandler := category.NewHandler(category.NewStore(s.db), productStore, userStore)
+	categoryHandler.RegisterRoutes(subrouter)
 
 	bookStore, err := library.NewBookStore(s.db)
 	if err != nil {
@@ -47,7 +116,21 @@ func (s *APIServer) Run() error {
 	bookHandler := library.NewBookHandler(bookStore, userStore)
 	bookHandler.RegisterRoutes(subrouter)
 
-	cartHandler := cart.NewHandler(productStore, orderStore, userStore)
+	orderHandler := order.NewHandler(order.NewStore(s.db), userStore)
+	orderHandler.RegisterRoutes(subrouter)
+
+	impersonationHandler := impersonation.NewHandler(impersonation.NewStore(s.db), userStore)
+	impersonationHandler.RegisterRoutes(subrouter)
+
+	privacyHandler := privacy.NewHandler(privacy.NewStore(s.db), userStore)
+	privacyHandler.RegisterRoutes(subrouter)
+
+	addressStore := address.NewStore(s.db)
+	addressHandler := address.NewHandler(addressStore, userStore)
+	addressHandler.RegisterRoutes(subrouter)
+
+	cartStore := cart.NewStore(s.db)
+	cartHandler := cart.NewHandler(productStore, productStore, cartStore, productStore, addressStore, userStore, notifier)
 	cartHandler.RegisterRoutes(subrouter)
 
 	// Serve static files
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+  `jti` VARCHAR(64) NOT NULL,
+  `userId` INT UNSIGNED NOT NULL,
+  `expiresAt` TIMESTAMP NOT NULL,
+  `createdAt` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  PRIMARY KEY (`jti`),
+  KEY (`expiresAt`)
+);
+
+CREATE TABLE IF NOT EXISTS user_token_revocations (
+  `userId` INT UNSIGNED NOT NULL,
+  `revokedBefore` TIMESTAMP NOT NULL,
+  `expiresAt` TIMESTAMP NOT NULL,
+
+  PRIMARY KEY (`userId`),
+  KEY (`expiresAt`),
+  FOREIGN KEY (`userId`) REFERENCES users(`id`)
+);
@@ -0,0 +1,18 @@
+ALTER TABLE users ADD COLUMN `emailVerified` BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- accounts created before verification existed are trusted as they are
+UPDATE users SET emailVerified = TRUE;
+
+CREATE TABLE IF NOT EXISTS email_verification_tokens (
+  `id` INT UNSIGNED NOT NULL AUTO_INCREMENT,
+  `userId` INT UNSIGNED NOT NULL,
+  `tokenHash` CHAR(64) NOT NULL,
+  `expiresAt` TIMESTAMP NOT NULL,
+  `usedAt` TIMESTAMP NULL DEFAULT NULL,
+  `createdAt` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  PRIMARY KEY (`id`),
+  UNIQUE KEY (`tokenHash`),
+  KEY (`userId`, `createdAt`),
+  FOREIGN KEY (`userId`) REFERENCES users(`id`)
+);
@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS user_mfa (
+  `userId` INT UNSIGNED NOT NULL,
+  `secret` VARCHAR(64) NOT NULL,
+  `enabled` BOOLEAN NOT NULL DEFAULT FALSE,
+  -- last TOTP time step that was accepted, so a code cannot be used twice
+  `lastUsedStep` BIGINT NOT NULL DEFAULT 0,
+  `confirmedAt` TIMESTAMP NULL DEFAULT NULL,
+  `createdAt` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  PRIMARY KEY (`userId`),
+  FOREIGN KEY (`userId`) REFERENCES users(`id`)
+);
+
+CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+  `id` INT UNSIGNED NOT NULL AUTO_INCREMENT,
+  `userId` INT UNSIGNED NOT NULL,
+  `codeHash` CHAR(64) NOT NULL,
+  `usedAt` TIMESTAMP NULL DEFAULT NULL,
+  `createdAt` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  PRIMARY KEY (`id`),
+  UNIQUE KEY (`userId`, `codeHash`),
+  FOREIGN KEY (`userId`) REFERENCES users(`id`)
+);
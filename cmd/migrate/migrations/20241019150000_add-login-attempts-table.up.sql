@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS login_attempts (
+  -- "account:<email>" or "ip:<address>"
+  `attemptKey` VARCHAR(320) NOT NULL,
+  `failures` INT UNSIGNED NOT NULL DEFAULT 0,
+  `lastFailureAt` DATETIME(3) NOT NULL,
+
+  PRIMARY KEY (`attemptKey`),
+  KEY (`lastFailureAt`)
+);
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS role_changes (
+  `id` INT UNSIGNED NOT NULL AUTO_INCREMENT,
+  `userId` INT UNSIGNED NOT NULL,
+  -- NULL when the role was changed from the command line
+  `actorId` INT UNSIGNED NULL DEFAULT NULL,
+  `oldRole` VARCHAR(32) NOT NULL,
+  `newRole` VARCHAR(32) NOT NULL,
+  `createdAt` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  PRIMARY KEY (`id`),
+  KEY (`userId`, `createdAt`),
+  FOREIGN KEY (`userId`) REFERENCES users(`id`),
+  FOREIGN KEY (`actorId`) REFERENCES users(`id`)
+);
@@ -0,0 +1,38 @@
+CREATE TABLE IF NOT EXISTS roles (
+  `name` VARCHAR(32) NOT NULL,
+  -- the role inherits every permission of its parent
+  `parent` VARCHAR(32) NULL DEFAULT NULL,
+  `createdAt` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  PRIMARY KEY (`name`),
+  FOREIGN KEY (`parent`) REFERENCES roles(`name`)
+);
+
+CREATE TABLE IF NOT EXISTS role_permissions (
+  `role` VARCHAR(32) NOT NULL,
+  `permission` VARCHAR(64) NOT NULL,
+
+  PRIMARY KEY (`role`, `permission`),
+  FOREIGN KEY (`role`) REFERENCES roles(`name`) ON DELETE CASCADE
+);
+
+INSERT INTO roles (name, parent) VALUES ('user', NULL), ('admin', 'user');
+
+INSERT INTO role_permissions (role, permission) VALUES
+  ('user', 'books:read'),
+  ('user', 'reviews:write'),
+  ('user', 'reviews:delete:own'),
+  ('user', 'favorites:write'),
+  ('user', 'orders:create'),
+  ('user', 'orders:read:own'),
+  ('user', 'users:read:own'),
+  ('admin', 'books:write'),
+  ('admin', 'reviews:delete'),
+  ('admin', 'products:write'),
+  ('admin', 'orders:read'),
+  ('admin', 'users:read'),
+  ('admin', 'users:manage');
+
+-- roles are no longer a fixed list
+ALTER TABLE users MODIFY `role` VARCHAR(32) NOT NULL DEFAULT 'user';
+ALTER TABLE users ADD CONSTRAINT `users_role_fk` FOREIGN KEY (`role`) REFERENCES roles(`name`);
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS api_keys (
+  `id` INT UNSIGNED NOT NULL AUTO_INCREMENT,
+  `userId` INT UNSIGNED NOT NULL,
+  `name` VARCHAR(100) NOT NULL,
+  `prefix` VARCHAR(16) NOT NULL,
+  `keyHash` CHAR(64) NOT NULL,
+  -- space separated permissions
+  `scopes` TEXT NOT NULL,
+  `lastUsedAt` TIMESTAMP NULL DEFAULT NULL,
+  `revokedAt` TIMESTAMP NULL DEFAULT NULL,
+  `createdAt` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  PRIMARY KEY (`id`),
+  UNIQUE KEY (`keyHash`),
+  KEY (`userId`),
+  FOREIGN KEY (`userId`) REFERENCES users(`id`)
+);
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS sessions (
+  -- the ID of the refresh token family started at login
+  `id` CHAR(32) NOT NULL,
+  `userId` INT UNSIGNED NOT NULL,
+  `userAgent` VARCHAR(255) NOT NULL,
+  `ip` VARCHAR(45) NOT NULL,
+  `lastSeenAt` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `revokedAt` TIMESTAMP NULL DEFAULT NULL,
+  `createdAt` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  PRIMARY KEY (`id`),
+  KEY (`userId`, `lastSeenAt`),
+  FOREIGN KEY (`userId`) REFERENCES users(`id`)
+);
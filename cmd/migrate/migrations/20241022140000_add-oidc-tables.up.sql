@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS user_identities (
+  `id` INT UNSIGNED NOT NULL AUTO_INCREMENT,
+  `userId` INT UNSIGNED NOT NULL,
+  `provider` VARCHAR(50) NOT NULL,
+  -- the sub claim, unique per provider
+  `subject` VARCHAR(255) NOT NULL,
+  `email` VARCHAR(255) NOT NULL,
+  `createdAt` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  PRIMARY KEY (`id`),
+  UNIQUE KEY (`provider`, `subject`),
+  KEY (`userId`),
+  FOREIGN KEY (`userId`) REFERENCES users(`id`)
+);
+
+CREATE TABLE IF NOT EXISTS oidc_login_states (
+  `stateHash` CHAR(64) NOT NULL,
+  `provider` VARCHAR(50) NOT NULL,
+  `codeVerifier` VARCHAR(128) NOT NULL,
+  `nonce` VARCHAR(64) NOT NULL,
+  `expiresAt` TIMESTAMP NOT NULL,
+  `createdAt` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  PRIMARY KEY (`stateHash`),
+  KEY (`expiresAt`)
+);
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS addresses (
+  `id` INT UNSIGNED NOT NULL AUTO_INCREMENT,
+  `userId` INT UNSIGNED NOT NULL,
+  `line1` VARCHAR(255) NOT NULL,
+  `line2` VARCHAR(255) NOT NULL DEFAULT '',
+  `city` VARCHAR(100) NOT NULL,
+  `region` VARCHAR(100) NOT NULL DEFAULT '',
+  `postalCode` VARCHAR(20) NOT NULL,
+  `country` CHAR(2) NOT NULL,
+  `isDefaultShipping` BOOLEAN NOT NULL DEFAULT FALSE,
+  `isDefaultBilling` BOOLEAN NOT NULL DEFAULT FALSE,
+  `createdAt` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  PRIMARY KEY (`id`),
+  KEY (`userId`),
+  FOREIGN KEY (`userId`) REFERENCES users(`id`)
+);
@@ -0,0 +1,4 @@
+ALTER TABLE users
+  DROP KEY `createdAt`,
+  DROP COLUMN `deletedAt`,
+  DROP COLUMN `status`;
@@ -0,0 +1,4 @@
+ALTER TABLE users
+  ADD COLUMN `status` ENUM('active', 'suspended') NOT NULL DEFAULT 'active',
+  ADD COLUMN `deletedAt` TIMESTAMP NULL DEFAULT NULL,
+  ADD KEY (`createdAt`);
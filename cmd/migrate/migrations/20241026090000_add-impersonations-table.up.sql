@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS impersonations (
+  `id` INT UNSIGNED NOT NULL AUTO_INCREMENT,
+  `actorId` INT UNSIGNED NOT NULL,
+  `userId` INT UNSIGNED NOT NULL,
+  `reason` VARCHAR(255) NOT NULL,
+  `expiresAt` TIMESTAMP NOT NULL,
+  `createdAt` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  PRIMARY KEY (`id`),
+  KEY (`userId`, `createdAt`),
+  FOREIGN KEY (`actorId`) REFERENCES users(`id`),
+  FOREIGN KEY (`userId`) REFERENCES users(`id`)
+);
+
+INSERT INTO role_permissions (role, permission) VALUES ('admin', 'users:impersonate');
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS user_preferences (
+  `userId` INT UNSIGNED NOT NULL,
+  `locale` VARCHAR(35) NOT NULL DEFAULT 'en',
+  `currency` CHAR(3) NOT NULL DEFAULT 'USD',
+  `orderUpdates` BOOLEAN NOT NULL DEFAULT TRUE,
+  `reviewReplies` BOOLEAN NOT NULL DEFAULT TRUE,
+  `loanReminders` BOOLEAN NOT NULL DEFAULT TRUE,
+  `updatedAt` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+
+  PRIMARY KEY (`userId`),
+  FOREIGN KEY (`userId`) REFERENCES users(`id`)
+);
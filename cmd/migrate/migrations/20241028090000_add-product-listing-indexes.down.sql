@@ -0,0 +1,4 @@
+ALTER TABLE products
+  DROP KEY `products_createdAt_id`,
+  DROP KEY `products_price_id`,
+  DROP KEY `products_name_id`;
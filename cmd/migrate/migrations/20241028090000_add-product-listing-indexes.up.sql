@@ -0,0 +1,4 @@
+ALTER TABLE products
+  ADD KEY `products_createdAt_id` (`createdAt`, `id`),
+  ADD KEY `products_price_id` (`price`, `id`),
+  ADD KEY `products_name_id` (`name`, `id`);
@@ -0,0 +1,3 @@
+ALTER TABLE products
+  DROP COLUMN `deletedAt`,
+  DROP COLUMN `version`;
@@ -0,0 +1,3 @@
+ALTER TABLE products
+  ADD COLUMN `version` INT UNSIGNED NOT NULL DEFAULT 1,
+  ADD COLUMN `deletedAt` TIMESTAMP NULL DEFAULT NULL;
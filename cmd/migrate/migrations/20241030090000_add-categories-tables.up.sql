@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS categories (
+  `id` INT UNSIGNED NOT NULL AUTO_INCREMENT,
+  `parentId` INT UNSIGNED NULL DEFAULT NULL,
+  `name` VARCHAR(100) NOT NULL,
+  `slug` VARCHAR(100) NOT NULL,
+  -- the IDs from the root down to the category, e.g. /1/4/9/
+  `path` VARCHAR(255) CHARACTER SET ascii NOT NULL DEFAULT '',
+  `createdAt` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  PRIMARY KEY (`id`),
+  UNIQUE KEY (`slug`),
+  KEY (`path`),
+  FOREIGN KEY (`parentId`) REFERENCES categories(`id`)
+);
+
+CREATE TABLE IF NOT EXISTS product_categories (
+  `productId` INT UNSIGNED NOT NULL,
+  `categoryId` INT UNSIGNED NOT NULL,
+
+  PRIMARY KEY (`productId`, `categoryId`),
+  KEY (`categoryId`),
+  FOREIGN KEY (`productId`) REFERENCES products(`id`),
+  FOREIGN KEY (`categoryId`) REFERENCES categories(`id`)
+);
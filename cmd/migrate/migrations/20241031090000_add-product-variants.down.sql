@@ -0,0 +1,13 @@
+ALTER TABLE products ADD COLUMN `quantity` INT UNSIGNED NOT NULL DEFAULT 0 AFTER `price`;
+
+UPDATE products p SET p.quantity = (
+  SELECT COALESCE(SUM(v.quantity), 0) FROM product_variants v WHERE v.productId = p.id AND v.deletedAt IS NULL
+);
+
+ALTER TABLE products ALTER COLUMN `quantity` DROP DEFAULT;
+
+ALTER TABLE order_items DROP FOREIGN KEY `order_items_variant_fk`;
+
+ALTER TABLE order_items DROP COLUMN `variantId`;
+
+DROP TABLE IF EXISTS product_variants;
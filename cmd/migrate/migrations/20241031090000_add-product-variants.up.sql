@@ -0,0 +1,31 @@
+CREATE TABLE IF NOT EXISTS product_variants (
+  `id` INT UNSIGNED NOT NULL AUTO_INCREMENT,
+  `productId` INT UNSIGNED NOT NULL,
+  `sku` VARCHAR(64) NOT NULL,
+  -- the value of each option axis of the product, e.g. {"size": "M", "color": "red"}
+  `options` JSON NOT NULL,
+  -- overrides the price of the product if set
+  `price` DECIMAL(10, 2) NULL DEFAULT NULL,
+  `quantity` INT UNSIGNED NOT NULL,
+  `createdAt` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `deletedAt` TIMESTAMP NULL DEFAULT NULL,
+
+  PRIMARY KEY (`id`),
+  UNIQUE KEY (`sku`),
+  KEY (`productId`),
+  FOREIGN KEY (`productId`) REFERENCES products(`id`)
+);
+
+-- every existing product becomes a single variant holding its stock
+INSERT INTO product_variants (productId, sku, options, quantity, deletedAt)
+SELECT id, CONCAT('P', id), JSON_OBJECT(), quantity, deletedAt FROM products;
+
+ALTER TABLE order_items ADD COLUMN `variantId` INT UNSIGNED NULL DEFAULT NULL AFTER `productId`;
+
+UPDATE order_items oi JOIN product_variants v ON v.productId = oi.productId SET oi.variantId = v.id;
+
+ALTER TABLE order_items
+  MODIFY COLUMN `variantId` INT UNSIGNED NOT NULL,
+  ADD CONSTRAINT `order_items_variant_fk` FOREIGN KEY (`variantId`) REFERENCES product_variants(`id`);
+
+ALTER TABLE products DROP COLUMN `quantity`;
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS inventory_reservations (
+  `userId` INT UNSIGNED NOT NULL,
+  `variantId` INT UNSIGNED NOT NULL,
+  `quantity` INT UNSIGNED NOT NULL,
+  `expiresAt` TIMESTAMP NOT NULL,
+  `createdAt` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  PRIMARY KEY (`userId`, `variantId`),
+  KEY (`variantId`, `expiresAt`),
+  KEY (`expiresAt`),
+  FOREIGN KEY (`userId`) REFERENCES users(`id`),
+  FOREIGN KEY (`variantId`) REFERENCES product_variants(`id`)
+);
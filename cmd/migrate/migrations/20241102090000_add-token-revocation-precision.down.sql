@@ -0,0 +1,2 @@
+ALTER TABLE user_token_revocations
+  MODIFY `revokedBefore` TIMESTAMP NOT NULL;
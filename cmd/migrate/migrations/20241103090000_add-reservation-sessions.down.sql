@@ -0,0 +1,6 @@
+-- the reservations of several sessions would collide, they only last minutes
+DELETE FROM inventory_reservations;
+ALTER TABLE inventory_reservations
+  DROP PRIMARY KEY,
+  DROP COLUMN `sessionId`,
+  ADD PRIMARY KEY (`userId`, `variantId`);
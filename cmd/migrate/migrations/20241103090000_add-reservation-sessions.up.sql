@@ -0,0 +1,6 @@
+-- every login session of a user reserves stock for its own cart, tokens
+-- without a session share the empty one
+ALTER TABLE inventory_reservations
+  ADD COLUMN `sessionId` VARCHAR(32) NOT NULL DEFAULT '' AFTER `userId`,
+  DROP PRIMARY KEY,
+  ADD PRIMARY KEY (`userId`, `sessionId`, `variantId`);
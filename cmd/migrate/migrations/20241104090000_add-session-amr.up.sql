@@ -0,0 +1,4 @@
+-- the methods the user logged in with, separated by spaces, which the
+-- tokens of the session keep claiming when refreshed
+ALTER TABLE sessions
+  ADD COLUMN `amr` VARCHAR(64) NOT NULL DEFAULT '' AFTER `ip`;
@@ -2,21 +2,64 @@ package configs
 
 import (
 	"fmt"
+	"log"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/joho/godotenv"
 )
 
 type Config struct {
-	PublicHost             string
-	Port                   string
-	DBUser                 string
-	DBPassword             string
-	DBAddress              string
-	DBName                 string
-	JWTSecret              string
-	JWTExpirationInSeconds int64
+	PublicHost                               string
+	Port                                     string
+	DBUser                                   string
+	DBPassword                               string
+	DBAddress                                string
+	DBName                                   string
+	JWTSecret                                string
+	JWTExpirationInSeconds                   int64
+	JWTAlgorithm                             string
+	JWTPrivateKeyFile                        string
+	JWTPublicKeyFiles                        string
+	JWTIssuer                                string
+	JWTAudience                              string
+	RefreshTokenExpirationInSeconds          int64
+	PasswordResetExpirationInSeconds         int64
+	EmailVerificationExpirationInSeconds     int64
+	EmailVerificationResendIntervalInSeconds int64
+	ImpersonationExpirationInSeconds         int64
+	ReservationTTLInSeconds                  int64
+	ReservationSweepIntervalInSeconds        int64
+	PasswordHashAlgorithm                    string
+	PasswordBcryptCost                       int64
+	PasswordArgon2Memory                     int64
+	PasswordArgon2Iterations                 int64
+	PasswordArgon2Parallelism                int64
+	PasswordMinLength                        int64
+	PasswordBreachedListFile                 string
+	MFARequiredForAdmins                     bool
+	LoginMaxAccountFailures                  int64
+	LoginMaxIPFailures                       int64
+	LoginLockoutInSeconds                    int64
+	LoginBackoffMaxInSeconds                 int64
+	MFAIssuer                                string
+	Notifier                                 string
+	NotifierFile                             string
+	OIDCProviders                            []OIDCProvider
+}
+
+// OIDCProvider is an OpenID Connect provider users can log in with.
+type OIDCProvider struct {
+	// Name identifies the provider in the login URLs
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is where the provider sends the user back to with the
+	// authorization code, usually a page of the frontend
+	RedirectURL string
+	Scopes      []string
 }
 
 var Envs = initConfig()
@@ -25,17 +68,69 @@ func initConfig() Config {
 	godotenv.Load()
 
 	return Config{
-		PublicHost:             getEnv("PUBLIC_HOST", "http://localhost"),
-		Port:                   getEnv("PORT", "8080"),
-		DBUser:                 getEnv("DB_USER", "root"),
-		DBPassword:             getEnv("DB_PASSWORD", "mypassword"),
-		DBAddress:              fmt.Sprintf("%s:%s", getEnv("DB_HOST", "127.0.0.1"), getEnv("DB_PORT", "3306")),
-		DBName:                 getEnv("DB_NAME", "ecom"),
-		JWTSecret:              getEnv("JWT_SECRET", "not-so-secret-now-is-it?"),
-		JWTExpirationInSeconds: getEnvAsInt("JWT_EXPIRATION_IN_SECONDS", 3600 * 24 * 7),
+		PublicHost:                               getEnv("PUBLIC_HOST", "http://localhost"),
+		Port:                                     getEnv("PORT", "8080"),
+		DBUser:                                   getEnv("DB_USER", "root"),
+		DBPassword:                               getEnv("DB_PASSWORD", "mypassword"),
+		DBAddress:                                fmt.Sprintf("%s:%s", getEnv("DB_HOST", "127.0.0.1"), getEnv("DB_PORT", "3306")),
+		DBName:                                   getEnv("DB_NAME", "ecom"),
+		JWTSecret:                                getEnv("JWT_SECRET", "not-so-secret-now-is-it?"),
+		JWTExpirationInSeconds:                   getEnvAsInt("JWT_EXPIRATION_IN_SECONDS", 60*15),
+		JWTAlgorithm:                             getEnv("JWT_ALGORITHM", "HS256"),
+		JWTPrivateKeyFile:                        getEnv("JWT_PRIVATE_KEY_FILE", ""),
+		JWTPublicKeyFiles:                        getEnv("JWT_PUBLIC_KEY_FILES", ""),
+		JWTIssuer:                                getEnv("JWT_ISSUER", getEnv("PUBLIC_HOST", "http://localhost")),
+		JWTAudience:                              getEnv("JWT_AUDIENCE", "api-go"),
+		RefreshTokenExpirationInSeconds:          getEnvAsInt("REFRESH_TOKEN_EXPIRATION_IN_SECONDS", 3600*24*30),
+		PasswordResetExpirationInSeconds:         getEnvAsInt("PASSWORD_RESET_EXPIRATION_IN_SECONDS", 3600),
+		EmailVerificationExpirationInSeconds:     getEnvAsInt("EMAIL_VERIFICATION_EXPIRATION_IN_SECONDS", 3600*24),
+		EmailVerificationResendIntervalInSeconds: getEnvAsInt("EMAIL_VERIFICATION_RESEND_INTERVAL_IN_SECONDS", 60),
+		ImpersonationExpirationInSeconds:         getEnvAsInt("IMPERSONATION_EXPIRATION_IN_SECONDS", 60*15),
+		ReservationTTLInSeconds:                  getEnvAsPositiveInt("RESERVATION_TTL_IN_SECONDS", 60*15),
+		ReservationSweepIntervalInSeconds:        getEnvAsPositiveInt("RESERVATION_SWEEP_INTERVAL_IN_SECONDS", 60),
+		PasswordHashAlgorithm:                    getEnv("PASSWORD_HASH_ALGORITHM", "argon2id"),
+		PasswordBcryptCost:                       getEnvAsInt("PASSWORD_BCRYPT_COST", 10),
+		PasswordArgon2Memory:                     getEnvAsInt("PASSWORD_ARGON2_MEMORY", 64*1024),
+		PasswordArgon2Iterations:                 getEnvAsInt("PASSWORD_ARGON2_ITERATIONS", 3),
+		PasswordArgon2Parallelism:                getEnvAsInt("PASSWORD_ARGON2_PARALLELISM", 2),
+		PasswordMinLength:                        getEnvAsInt("PASSWORD_MIN_LENGTH", 8),
+		PasswordBreachedListFile:                 getEnv("PASSWORD_BREACHED_LIST_FILE", ""),
+		MFARequiredForAdmins:                     getEnvAsBool("MFA_REQUIRED_FOR_ADMINS", true),
+		MFAIssuer:                                getEnv("MFA_ISSUER", "api-go"),
+		LoginMaxAccountFailures:                  getEnvAsInt("LOGIN_MAX_ACCOUNT_FAILURES", 10),
+		LoginMaxIPFailures:                       getEnvAsInt("LOGIN_MAX_IP_FAILURES", 100),
+		LoginLockoutInSeconds:                    getEnvAsInt("LOGIN_LOCKOUT_IN_SECONDS", 60*15),
+		LoginBackoffMaxInSeconds:                 getEnvAsInt("LOGIN_BACKOFF_MAX_IN_SECONDS", 60),
+		Notifier:                                 getEnv("NOTIFIER", "log"),
+		NotifierFile:                             getEnv("NOTIFIER_FILE", "notifications.log"),
+		OIDCProviders:                            getOIDCProviders(),
 	}
 }
 
+// getOIDCProviders reads the providers listed in OIDC_PROVIDERS, each one
+// configured with OIDC_<NAME>_* variables.
+func getOIDCProviders() []OIDCProvider {
+	providers := []OIDCProvider{}
+	for _, name := range strings.Split(getEnv("OIDC_PROVIDERS", ""), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		providers = append(providers, OIDCProvider{
+			Name:         name,
+			Issuer:       getEnv(prefix+"ISSUER", ""),
+			ClientID:     getEnv(prefix+"CLIENT_ID", ""),
+			ClientSecret: getEnv(prefix+"CLIENT_SECRET", ""),
+			RedirectURL:  getEnv(prefix+"REDIRECT_URL", ""),
+			Scopes:       strings.Fields(getEnv(prefix+"SCOPES", "openid email profile")),
+		})
+	}
+
+	return providers
+}
+
 // Gets the env by key or fallbacks
 func getEnv(key, fallback string) string {
 	if value, ok := os.LookupEnv(key); ok {
@@ -57,3 +152,28 @@ func getEnvAsInt(key string, fallback int64) int64 {
 
 	return fallback
 }
+
+// getEnvAsPositiveInt is getEnvAsInt for values such as intervals that must be
+// above zero, it falls back for the others.
+func getEnvAsPositiveInt(key string, fallback int64) int64 {
+	i := getEnvAsInt(key, fallback)
+	if i <= 0 {
+		log.Printf("%s must be above zero, using %d", key, fallback)
+		return fallback
+	}
+
+	return i
+}
+
+func getEnvAsBool(key string, fallback bool) bool {
+	if value, ok := os.LookupEnv(key); ok {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fallback
+		}
+
+		return b
+	}
+
+	return fallback
+}
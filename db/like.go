@@ -0,0 +1,8 @@
+package db
+
+import "strings"
+
+// EscapeLike escapes the wildcards of a LIKE pattern so they match literally.
+func EscapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
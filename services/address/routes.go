@@ -0,0 +1,188 @@
+// address/routes.go
+package address
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/mux"
+	"github.com/surfiniaburger/api-go/services/auth"
+	"github.com/surfiniaburger/api-go/types"
+	"github.com/surfiniaburger/api-go/utils"
+)
+
+type Handler struct {
+	store     types.AddressStore
+	userStore types.UserGetter
+}
+
+func NewHandler(store types.AddressStore, userStore types.UserGetter) *Handler {
+	return &Handler{store: store, userStore: userStore}
+}
+
+func (h *Handler) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/me/addresses", auth.WithJWTAuth(h.handleCreateAddress, h.userStore)).Methods(http.MethodPost)
+	router.HandleFunc("/me/addresses", auth.WithJWTAuth(h.handleGetAddresses, h.userStore)).Methods(http.MethodGet)
+	router.HandleFunc("/me/addresses/{addressID}", auth.WithJWTAuth(h.handleGetAddress, h.userStore)).Methods(http.MethodGet)
+	router.HandleFunc("/me/addresses/{addressID}", auth.WithJWTAuth(auth.DenyImpersonation(h.handleUpdateAddress), h.userStore)).Methods(http.MethodPut)
+	router.HandleFunc("/me/addresses/{addressID}", auth.WithJWTAuth(auth.DenyImpersonation(h.handleDeleteAddress), h.userStore)).Methods(http.MethodDelete)
+}
+
+// handleCreateAddress adds an address to the address book. The first address
+// of a user becomes their default shipping and billing address.
+func (h *Handler) handleCreateAddress(w http.ResponseWriter, r *http.Request) {
+	payload, ok := parseAddressPayload(w, r)
+	if !ok {
+		return
+	}
+
+	userID := auth.GetUserIDFromContext(r.Context())
+
+	addresses, err := h.store.GetUserAddresses(userID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	address := applyAddressPayload(types.Address{UserID: userID}, payload)
+	address.CreatedAt = time.Now()
+	if len(addresses) == 0 {
+		address.IsDefaultShipping = true
+		address.IsDefaultBilling = true
+	}
+
+	address.ID, err = h.store.CreateAddress(address)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, address)
+}
+
+func (h *Handler) handleGetAddresses(w http.ResponseWriter, r *http.Request) {
+	addresses, err := h.store.GetUserAddresses(auth.GetUserIDFromContext(r.Context()))
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, addresses)
+}
+
+func (h *Handler) handleGetAddress(w http.ResponseWriter, r *http.Request) {
+	address, ok := h.getAddress(w, r)
+	if !ok {
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, address)
+}
+
+// handleUpdateAddress replaces an address, keeping the default flags left out
+// of the payload. Orders already placed keep the address they were placed with.
+func (h *Handler) handleUpdateAddress(w http.ResponseWriter, r *http.Request) {
+	existing, ok := h.getAddress(w, r)
+	if !ok {
+		return
+	}
+
+	payload, ok := parseAddressPayload(w, r)
+	if !ok {
+		return
+	}
+
+	address := applyAddressPayload(*existing, payload)
+
+	if err := h.store.UpdateAddress(address); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, address)
+}
+
+// handleDeleteAddress removes an address. Another address becomes the default
+// in its place, so checking out without an address keeps working.
+func (h *Handler) handleDeleteAddress(w http.ResponseWriter, r *http.Request) {
+	addressID, err := strconv.Atoi(mux.Vars(r)["addressID"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid address ID"))
+		return
+	}
+
+	deleted, err := h.store.DeleteAddress(auth.GetUserIDFromContext(r.Context()), addressID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if !deleted {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("address not found"))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "address deleted"})
+}
+
+// getAddress returns the address of the authenticated user named in the path.
+// It writes the error response if it fails.
+func (h *Handler) getAddress(w http.ResponseWriter, r *http.Request) (*types.Address, bool) {
+	addressID, err := strconv.Atoi(mux.Vars(r)["addressID"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid address ID"))
+		return nil, false
+	}
+
+	address, err := h.store.GetAddress(auth.GetUserIDFromContext(r.Context()), addressID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return nil, false
+	}
+
+	if address.ID == 0 {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("address not found"))
+		return nil, false
+	}
+
+	return address, true
+}
+
+func parseAddressPayload(w http.ResponseWriter, r *http.Request) (types.AddressPayload, bool) {
+	var payload types.AddressPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return payload, false
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return payload, false
+	}
+
+	return payload, true
+}
+
+// applyAddressPayload returns the address with the fields of the payload. The
+// default flags are only changed if the payload sets them.
+func applyAddressPayload(address types.Address, payload types.AddressPayload) types.Address {
+	address.Line1 = payload.Line1
+	address.Line2 = payload.Line2
+	address.City = payload.City
+	address.Region = payload.Region
+	address.PostalCode = payload.PostalCode
+	address.Country = payload.Country
+
+	if payload.IsDefaultShipping != nil {
+		address.IsDefaultShipping = *payload.IsDefaultShipping
+	}
+	if payload.IsDefaultBilling != nil {
+		address.IsDefaultBilling = *payload.IsDefaultBilling
+	}
+
+	return address
+}
@@ -0,0 +1,275 @@
+package address
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/surfiniaburger/api-go/services/auth"
+	"github.com/surfiniaburger/api-go/services/auth/authtest"
+	"github.com/surfiniaburger/api-go/types"
+)
+
+func TestAddresses(t *testing.T) {
+	auth.SetRevocationStore(auth.NewMemoryRevocationStore())
+
+	store := &mockAddressStore{}
+	handler := NewHandler(store, &authtest.Users{Roles: map[int]string{adminID: "admin"}})
+
+	router := mux.NewRouter()
+	handler.RegisterRoutes(router)
+
+	request := func(method, path string, userID int, payload any) *httptest.ResponseRecorder {
+		token, err := auth.CreateJWT(userID, auth.AMRPassword)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		marshalled, err := json.Marshal(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest(method, path, bytes.NewBuffer(marshalled))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	home := types.AddressPayload{Line1: "1 Main Street", City: "Springfield", Region: "IL", PostalCode: "62701", Country: "US"}
+	work := types.AddressPayload{Line1: "10 Rue de Rivoli", City: "Paris", PostalCode: "75001", Country: "FR"}
+
+	t.Run("should fail to create an invalid address", func(t *testing.T) {
+		invalid := home
+		invalid.Country = "USA"
+
+		rr := request(http.MethodPost, "/me/addresses", 1, invalid)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+
+	t.Run("should make the first address the default", func(t *testing.T) {
+		rr := request(http.MethodPost, "/me/addresses", 1, home)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("expected status code %d, got %d", http.StatusCreated, rr.Code)
+		}
+
+		rr = request(http.MethodPost, "/me/addresses", 1, work)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("expected status code %d, got %d", http.StatusCreated, rr.Code)
+		}
+
+		if !store.addresses[0].IsDefaultShipping || !store.addresses[0].IsDefaultBilling {
+			t.Error("expected the first address to be the default")
+		}
+
+		if store.addresses[1].IsDefaultShipping || store.addresses[1].IsDefaultBilling {
+			t.Error("expected the second address not to be the default")
+		}
+	})
+
+	t.Run("should move the default to an updated address", func(t *testing.T) {
+		isDefault := true
+		updated := work
+		updated.IsDefaultShipping = &isDefault
+
+		rr := request(http.MethodPut, "/me/addresses/2", 1, updated)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if store.addresses[0].IsDefaultShipping || !store.addresses[0].IsDefaultBilling || !store.addresses[1].IsDefaultShipping {
+			t.Errorf("expected only the default shipping address to change, got %+v", store.addresses)
+		}
+	})
+
+	t.Run("should keep the default flags left out of an update", func(t *testing.T) {
+		updated := work
+		updated.Line2 = "Apt 4"
+
+		rr := request(http.MethodPut, "/me/addresses/2", 1, updated)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if !store.addresses[1].IsDefaultShipping || store.addresses[1].Line2 != "Apt 4" || !store.addresses[0].IsDefaultBilling {
+			t.Errorf("expected the default flags to be kept, got %+v", store.addresses)
+		}
+	})
+
+	t.Run("should not expose the addresses of other users", func(t *testing.T) {
+		rr := request(http.MethodGet, "/me/addresses", 2, nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		var addresses []types.Address
+		if err := json.NewDecoder(rr.Body).Decode(&addresses); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(addresses) != 0 {
+			t.Errorf("expected no addresses, got %d", len(addresses))
+		}
+
+		for _, method := range []string{http.MethodGet, http.MethodDelete} {
+			if rr := request(method, "/me/addresses/1", 2, nil); rr.Code != http.StatusNotFound {
+				t.Errorf("%s: expected status code %d, got %d", method, http.StatusNotFound, rr.Code)
+			}
+		}
+
+		if rr := request(http.MethodPut, "/me/addresses/1", 2, work); rr.Code != http.StatusNotFound {
+			t.Errorf("expected status code %d, got %d", http.StatusNotFound, rr.Code)
+		}
+	})
+
+	t.Run("should not change addresses while impersonating", func(t *testing.T) {
+		token, err := auth.CreateImpersonationJWT(adminID, 1, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		impersonating := func(method string, payload any) int {
+			marshalled, err := json.Marshal(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req, err := http.NewRequest(method, "/me/addresses/1", bytes.NewBuffer(marshalled))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			return rr.Code
+		}
+
+		if code := impersonating(http.MethodGet, nil); code != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, code)
+		}
+
+		if code := impersonating(http.MethodPut, home); code != http.StatusForbidden {
+			t.Errorf("expected status code %d, got %d", http.StatusForbidden, code)
+		}
+
+		if code := impersonating(http.MethodDelete, nil); code != http.StatusForbidden {
+			t.Errorf("expected status code %d, got %d", http.StatusForbidden, code)
+		}
+
+		if len(store.addresses) != 2 {
+			t.Errorf("expected the addresses to be kept, got %+v", store.addresses)
+		}
+	})
+
+	t.Run("should delete an address", func(t *testing.T) {
+		rr := request(http.MethodDelete, "/me/addresses/1", 1, nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if rr := request(http.MethodGet, "/me/addresses/1", 1, nil); rr.Code != http.StatusNotFound {
+			t.Errorf("expected status code %d, got %d", http.StatusNotFound, rr.Code)
+		}
+
+		// the deleted address was the default billing address
+		if !store.addresses[0].IsDefaultBilling || !store.addresses[0].IsDefaultShipping {
+			t.Errorf("expected the remaining address to become the default, got %+v", store.addresses[0])
+		}
+	})
+}
+
+// mockAddressStore clears and hands over the default flags of addresses like
+// the database store does.
+type mockAddressStore struct {
+	addresses []*types.Address
+}
+
+func (m *mockAddressStore) CreateAddress(a types.Address) (int, error) {
+	a.ID = len(m.addresses) + 1
+	m.addresses = append(m.addresses, &a)
+	m.clearOtherDefaults(a)
+	return a.ID, nil
+}
+
+func (m *mockAddressStore) GetAddress(userID, id int) (*types.Address, error) {
+	for _, a := range m.addresses {
+		if a.ID == id && a.UserID == userID {
+			copied := *a
+			return &copied, nil
+		}
+	}
+
+	return &types.Address{}, nil
+}
+
+func (m *mockAddressStore) GetUserAddresses(userID int) ([]types.Address, error) {
+	addresses := []types.Address{}
+	for _, a := range m.addresses {
+		if a.UserID == userID {
+			addresses = append(addresses, *a)
+		}
+	}
+
+	return addresses, nil
+}
+
+func (m *mockAddressStore) UpdateAddress(address types.Address) error {
+	for i, a := range m.addresses {
+		if a.ID == address.ID && a.UserID == address.UserID {
+			m.addresses[i] = &address
+		}
+	}
+
+	m.clearOtherDefaults(address)
+	return nil
+}
+
+func (m *mockAddressStore) DeleteAddress(userID, id int) (bool, error) {
+	for i, a := range m.addresses {
+		if a.ID == id && a.UserID == userID {
+			m.addresses = append(m.addresses[:i], m.addresses[i+1:]...)
+			m.promoteDefaults(*a)
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// promoteDefaults gives the default flags of a deleted address to the oldest
+// remaining address of the user.
+func (m *mockAddressStore) promoteDefaults(deleted types.Address) {
+	for _, a := range m.addresses {
+		if a.UserID == deleted.UserID {
+			a.IsDefaultShipping = a.IsDefaultShipping || deleted.IsDefaultShipping
+			a.IsDefaultBilling = a.IsDefaultBilling || deleted.IsDefaultBilling
+			return
+		}
+	}
+}
+
+func (m *mockAddressStore) clearOtherDefaults(address types.Address) {
+	for _, a := range m.addresses {
+		if a.ID == address.ID || a.UserID != address.UserID {
+			continue
+		}
+
+		a.IsDefaultShipping = a.IsDefaultShipping && !address.IsDefaultShipping
+		a.IsDefaultBilling = a.IsDefaultBilling && !address.IsDefaultBilling
+	}
+}
+
+// adminID is the admin impersonating users in the tests
+const adminID = 99
@@ -0,0 +1,164 @@
+// address/store.go
+package address
+
+import (
+	"database/sql"
+
+	"github.com/surfiniaburger/api-go/db"
+	"github.com/surfiniaburger/api-go/types"
+)
+
+const addressColumns = "id, userId, line1, line2, city, region, postalCode, country, isDefaultShipping, isDefaultBilling, createdAt"
+
+type Store struct {
+	db *sql.DB
+}
+
+func NewStore(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+func (s *Store) CreateAddress(address types.Address) (int, error) {
+	var id int
+	err := db.WithTx(s.db, func(tx *sql.Tx) error {
+		res, err := tx.Exec(
+			"INSERT INTO addresses (userId, line1, line2, city, region, postalCode, country, isDefaultShipping, isDefaultBilling) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			address.UserID, address.Line1, address.Line2, address.City, address.Region, address.PostalCode, address.Country, address.IsDefaultShipping, address.IsDefaultBilling,
+		)
+		if err != nil {
+			return err
+		}
+
+		lastID, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		id = int(lastID)
+
+		address.ID = id
+		return clearOtherDefaults(tx, address)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+func (s *Store) GetAddress(userID, id int) (*types.Address, error) {
+	rows, err := s.db.Query("SELECT "+addressColumns+" FROM addresses WHERE id = ? AND userId = ?", id, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return &types.Address{}, rows.Err()
+	}
+
+	return scanRowsIntoAddress(rows)
+}
+
+func (s *Store) GetUserAddresses(userID int) ([]types.Address, error) {
+	rows, err := s.db.Query("SELECT "+addressColumns+" FROM addresses WHERE userId = ? ORDER BY id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	addresses := []types.Address{}
+	for rows.Next() {
+		a, err := scanRowsIntoAddress(rows)
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, *a)
+	}
+
+	return addresses, rows.Err()
+}
+
+func (s *Store) UpdateAddress(address types.Address) error {
+	return db.WithTx(s.db, func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			"UPDATE addresses SET line1 = ?, line2 = ?, city = ?, region = ?, postalCode = ?, country = ?, isDefaultShipping = ?, isDefaultBilling = ? WHERE id = ? AND userId = ?",
+			address.Line1, address.Line2, address.City, address.Region, address.PostalCode, address.Country, address.IsDefaultShipping, address.IsDefaultBilling, address.ID, address.UserID,
+		)
+		if err != nil {
+			return err
+		}
+
+		return clearOtherDefaults(tx, address)
+	})
+}
+
+func (s *Store) DeleteAddress(userID, id int) (bool, error) {
+	deleted := false
+	err := db.WithTx(s.db, func(tx *sql.Tx) error {
+		var isDefaultShipping, isDefaultBilling bool
+		err := tx.QueryRow("SELECT isDefaultShipping, isDefaultBilling FROM addresses WHERE id = ? AND userId = ? FOR UPDATE", id, userID).Scan(&isDefaultShipping, &isDefaultBilling)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec("DELETE FROM addresses WHERE id = ? AND userId = ?", id, userID); err != nil {
+			return err
+		}
+		deleted = true
+
+		if isDefaultShipping {
+			_, err := tx.Exec("UPDATE addresses SET isDefaultShipping = TRUE WHERE userId = ? ORDER BY id LIMIT 1", userID)
+			if err != nil {
+				return err
+			}
+		}
+
+		if isDefaultBilling {
+			_, err := tx.Exec("UPDATE addresses SET isDefaultBilling = TRUE WHERE userId = ? ORDER BY id LIMIT 1", userID)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return deleted, nil
+}
+
+// clearOtherDefaults keeps a single default shipping and billing address per
+// user by clearing the flags the address takes over.
+func clearOtherDefaults(tx *sql.Tx, address types.Address) error {
+	if address.IsDefaultShipping {
+		_, err := tx.Exec("UPDATE addresses SET isDefaultShipping = FALSE WHERE userId = ? AND id <> ?", address.UserID, address.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	if address.IsDefaultBilling {
+		_, err := tx.Exec("UPDATE addresses SET isDefaultBilling = FALSE WHERE userId = ? AND id <> ?", address.UserID, address.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func scanRowsIntoAddress(rows *sql.Rows) (*types.Address, error) {
+	a := new(types.Address)
+
+	err := rows.Scan(&a.ID, &a.UserID, &a.Line1, &a.Line2, &a.City, &a.Region, &a.PostalCode, &a.Country, &a.IsDefaultShipping, &a.IsDefaultBilling, &a.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
@@ -0,0 +1,115 @@
+// apikey/routes.go
+package apikey
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/mux"
+	"github.com/surfiniaburger/api-go/services/auth"
+	"github.com/surfiniaburger/api-go/types"
+	"github.com/surfiniaburger/api-go/utils"
+)
+
+type Handler struct {
+	store     types.APIKeyStore
+	userStore types.UserGetter
+}
+
+func NewHandler(store types.APIKeyStore, userStore types.UserGetter) *Handler {
+	return &Handler{store: store, userStore: userStore}
+}
+
+func (h *Handler) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/me/api-keys", auth.WithJWTAuth(auth.DenyImpersonation(h.handleCreateAPIKey), h.userStore)).Methods(http.MethodPost)
+	router.HandleFunc("/me/api-keys", auth.WithJWTAuth(h.handleGetAPIKeys, h.userStore)).Methods(http.MethodGet)
+	router.HandleFunc("/me/api-keys/{keyID}", auth.WithJWTAuth(auth.DenyImpersonation(h.handleRevokeAPIKey), h.userStore)).Methods(http.MethodDelete)
+}
+
+// handleCreateAPIKey creates a key with some of the permissions of the user.
+// The key is only part of this response, only its hash is kept.
+func (h *Handler) handleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var payload types.CreateAPIKeyPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	for _, scope := range payload.Scopes {
+		if !auth.IsAPIKeyScope(scope) {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("API keys cannot have the %s permission", scope))
+			return
+		}
+
+		if !auth.HasPermission(r.Context(), scope) {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("you do not have the %s permission", scope))
+			return
+		}
+	}
+
+	key, prefix, hash, err := auth.NewAPIKey()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	apiKey := types.APIKey{
+		UserID:    auth.GetUserIDFromContext(r.Context()),
+		Name:      payload.Name,
+		Prefix:    prefix,
+		KeyHash:   hash,
+		Scopes:    payload.Scopes,
+		CreatedAt: time.Now(),
+	}
+
+	apiKey.ID, err = h.store.CreateAPIKey(apiKey)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	log.Printf("user %d created API key %s", apiKey.UserID, prefix)
+
+	utils.WriteJSON(w, http.StatusCreated, types.CreateAPIKeyResponse{APIKey: apiKey, Key: key})
+}
+
+func (h *Handler) handleGetAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := h.store.GetUserAPIKeys(auth.GetUserIDFromContext(r.Context()))
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, keys)
+}
+
+func (h *Handler) handleRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	keyID, err := strconv.Atoi(mux.Vars(r)["keyID"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid API key ID"))
+		return
+	}
+
+	revoked, err := h.store.RevokeAPIKey(auth.GetUserIDFromContext(r.Context()), keyID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if !revoked {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("API key not found"))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "API key revoked"})
+}
@@ -0,0 +1,196 @@
+package apikey
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/surfiniaburger/api-go/services/auth"
+	"github.com/surfiniaburger/api-go/services/auth/authtest"
+	"github.com/surfiniaburger/api-go/types"
+)
+
+func TestAPIKeys(t *testing.T) {
+	auth.SetRevocationStore(auth.NewMemoryRevocationStore())
+
+	store := &mockAPIKeyStore{}
+	auth.SetAPIKeyStore(store)
+	defer auth.SetAPIKeyStore(nil)
+
+	userStore := &authtest.Users{}
+	handler := NewHandler(store, userStore)
+
+	router := mux.NewRouter()
+	handler.RegisterRoutes(router)
+	router.HandleFunc("/books", auth.WithJWTAuth(func(w http.ResponseWriter, r *http.Request) {}, userStore, auth.PermBooksRead)).Methods(http.MethodGet)
+	router.HandleFunc("/favorites", auth.WithJWTAuth(func(w http.ResponseWriter, r *http.Request) {}, userStore, auth.PermFavoritesWrite)).Methods(http.MethodPost)
+
+	token, err := auth.CreateJWT(1, auth.AMRPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(method, path string, headers map[string]string, payload any) *httptest.ResponseRecorder {
+		marshalled, err := json.Marshal(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest(method, path, bytes.NewBuffer(marshalled))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	bearer := map[string]string{"Authorization": "Bearer " + token}
+
+	t.Run("should not create keys with permissions the user does not have", func(t *testing.T) {
+		rr := request(http.MethodPost, "/me/api-keys", bearer, types.CreateAPIKeyPayload{Name: "ci", Scopes: []string{auth.PermBooksWrite}})
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+
+	var created types.CreateAPIKeyResponse
+
+	t.Run("should create a key shown once", func(t *testing.T) {
+		rr := request(http.MethodPost, "/me/api-keys", bearer, types.CreateAPIKeyPayload{Name: "ci", Scopes: []string{auth.PermBooksRead}})
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("expected status code %d, got %d", http.StatusCreated, rr.Code)
+		}
+
+		if err := json.NewDecoder(rr.Body).Decode(&created); err != nil {
+			t.Fatal(err)
+		}
+
+		if created.Key == "" || created.Prefix == "" || store.keys[0].KeyHash != auth.HashToken(created.Key) {
+			t.Errorf("expected the key and its hash to be stored, got %+v", created)
+		}
+
+		rr = request(http.MethodGet, "/me/api-keys", bearer, nil)
+		if bytes.Contains(rr.Body.Bytes(), []byte(created.Key)) {
+			t.Error("expected the key not to be listed")
+		}
+	})
+
+	keyHeader := func() map[string]string {
+		return map[string]string{auth.APIKeyHeader: created.Key}
+	}
+
+	t.Run("should authenticate with the key within its scopes", func(t *testing.T) {
+		if rr := request(http.MethodGet, "/books", keyHeader(), nil); rr.Code != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if rr := request(http.MethodPost, "/favorites", keyHeader(), nil); rr.Code != http.StatusForbidden {
+			t.Errorf("expected status code %d, got %d", http.StatusForbidden, rr.Code)
+		}
+
+		if store.keys[0].LastUsedAt == nil {
+			t.Error("expected the last use to be recorded")
+		}
+	})
+
+	t.Run("should not create keys with a key", func(t *testing.T) {
+		rr := request(http.MethodPost, "/me/api-keys", keyHeader(), types.CreateAPIKeyPayload{Name: "other", Scopes: []string{auth.PermBooksRead}})
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected status code %d, got %d", http.StatusForbidden, rr.Code)
+		}
+	})
+
+	t.Run("should not reach routes that require no permission with a key", func(t *testing.T) {
+		if rr := request(http.MethodGet, "/me/api-keys", keyHeader(), nil); rr.Code != http.StatusForbidden {
+			t.Errorf("expected status code %d, got %d", http.StatusForbidden, rr.Code)
+		}
+
+		rr := request(http.MethodDelete, fmt.Sprintf("/me/api-keys/%d", created.ID), keyHeader(), nil)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected status code %d, got %d", http.StatusForbidden, rr.Code)
+		}
+
+		if store.keys[0].RevokedAt != nil {
+			t.Error("expected the key not to be revoked")
+		}
+	})
+
+	t.Run("should reject revoked keys", func(t *testing.T) {
+		rr := request(http.MethodDelete, fmt.Sprintf("/me/api-keys/%d", created.ID), bearer, nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if rr := request(http.MethodGet, "/books", keyHeader(), nil); rr.Code != http.StatusForbidden {
+			t.Errorf("expected status code %d, got %d", http.StatusForbidden, rr.Code)
+		}
+
+		rr = request(http.MethodDelete, fmt.Sprintf("/me/api-keys/%d", created.ID), bearer, nil)
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("expected status code %d, got %d", http.StatusNotFound, rr.Code)
+		}
+	})
+}
+
+type mockAPIKeyStore struct {
+	keys []*types.APIKey
+}
+
+func (m *mockAPIKeyStore) CreateAPIKey(k types.APIKey) (int, error) {
+	k.ID = len(m.keys) + 1
+	m.keys = append(m.keys, &k)
+	return k.ID, nil
+}
+
+func (m *mockAPIKeyStore) GetAPIKeyByHash(hash string) (*types.APIKey, error) {
+	for _, k := range m.keys {
+		if k.KeyHash == hash {
+			copied := *k
+			return &copied, nil
+		}
+	}
+
+	return nil, fmt.Errorf("API key not found")
+}
+
+func (m *mockAPIKeyStore) GetUserAPIKeys(userID int) ([]types.APIKey, error) {
+	keys := []types.APIKey{}
+	for _, k := range m.keys {
+		if k.UserID == userID {
+			keys = append(keys, *k)
+		}
+	}
+
+	return keys, nil
+}
+
+func (m *mockAPIKeyStore) RevokeAPIKey(userID, id int) (bool, error) {
+	for _, k := range m.keys {
+		if k.ID == id && k.UserID == userID && k.RevokedAt == nil {
+			now := time.Now()
+			k.RevokedAt = &now
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (m *mockAPIKeyStore) TouchAPIKey(id int, usedAt time.Time) error {
+	for _, k := range m.keys {
+		if k.ID == id {
+			k.LastUsedAt = &usedAt
+		}
+	}
+
+	return nil
+}
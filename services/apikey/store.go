@@ -0,0 +1,111 @@
+// apikey/store.go
+package apikey
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/surfiniaburger/api-go/types"
+)
+
+const apiKeyColumns = "id, userId, name, prefix, keyHash, scopes, lastUsedAt, revokedAt, createdAt"
+
+type Store struct {
+	db *sql.DB
+}
+
+func NewStore(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+func (s *Store) CreateAPIKey(key types.APIKey) (int, error) {
+	res, err := s.db.Exec(
+		"INSERT INTO api_keys (userId, name, prefix, keyHash, scopes) VALUES (?, ?, ?, ?, ?)",
+		key.UserID, key.Name, key.Prefix, key.KeyHash, strings.Join(key.Scopes, " "),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+func (s *Store) GetAPIKeyByHash(hash string) (*types.APIKey, error) {
+	rows, err := s.db.Query("SELECT "+apiKeyColumns+" FROM api_keys WHERE keyHash = ?", hash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, fmt.Errorf("API key not found")
+	}
+
+	return scanRowsIntoAPIKey(rows)
+}
+
+func (s *Store) GetUserAPIKeys(userID int) ([]types.APIKey, error) {
+	rows, err := s.db.Query("SELECT "+apiKeyColumns+" FROM api_keys WHERE userId = ? ORDER BY id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []types.APIKey{}
+	for rows.Next() {
+		k, err := scanRowsIntoAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *k)
+	}
+
+	return keys, rows.Err()
+}
+
+func (s *Store) RevokeAPIKey(userID, id int) (bool, error) {
+	res, err := s.db.Exec("UPDATE api_keys SET revokedAt = NOW() WHERE id = ? AND userId = ? AND revokedAt IS NULL", id, userID)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected == 1, nil
+}
+
+func (s *Store) TouchAPIKey(id int, usedAt time.Time) error {
+	_, err := s.db.Exec("UPDATE api_keys SET lastUsedAt = ? WHERE id = ?", usedAt, id)
+	return err
+}
+
+func scanRowsIntoAPIKey(rows *sql.Rows) (*types.APIKey, error) {
+	k := new(types.APIKey)
+
+	var scopes string
+	var lastUsedAt, revokedAt sql.NullTime
+	err := rows.Scan(&k.ID, &k.UserID, &k.Name, &k.Prefix, &k.KeyHash, &scopes, &lastUsedAt, &revokedAt, &k.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	k.Scopes = strings.Fields(scopes)
+	if lastUsedAt.Valid {
+		k.LastUsedAt = &lastUsedAt.Time
+	}
+	if revokedAt.Valid {
+		k.RevokedAt = &revokedAt.Time
+	}
+
+	return k, nil
+}
@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/surfiniaburger/api-go/types"
+)
+
+// APIKeyHeader is the header API keys are sent in, instead of a bearer token.
+const APIKeyHeader = "X-API-Key"
+
+const apiKeyPrefix = "ak_"
+
+// apiKeyTouchInterval limits how often the last use of a key is written.
+const apiKeyTouchInterval = time.Minute
+
+// apiKeys looks up the API keys sent to WithJWTAuth. API keys are rejected
+// until SetAPIKeyStore is called.
+var apiKeys types.APIKeyStore
+
+// SetAPIKeyStore sets the store API keys are looked up in.
+func SetAPIKeyStore(store types.APIKeyStore) {
+	apiKeys = store
+}
+
+// NewAPIKey returns a new API key, its public prefix and the hash to store.
+// The prefix is part of the key so users can tell their keys apart.
+func NewAPIKey() (key, prefix, hash string, err error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", "", err
+	}
+	prefix = apiKeyPrefix + hex.EncodeToString(b)
+
+	secret, err := RandomString(32)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	key = prefix + "_" + secret
+	return key, prefix, HashToken(key), nil
+}
+
+func authenticateAPIKey(key string) (*types.APIKey, error) {
+	if apiKeys == nil {
+		return nil, fmt.Errorf("API keys are not enabled")
+	}
+
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		return nil, fmt.Errorf("malformed API key")
+	}
+
+	k, err := apiKeys.GetAPIKeyByHash(HashToken(key))
+	if err != nil {
+		return nil, err
+	}
+
+	if k.RevokedAt != nil {
+		return nil, fmt.Errorf("API key %s of user %d is revoked", k.Prefix, k.UserID)
+	}
+
+	now := time.Now()
+	if k.LastUsedAt == nil || now.Sub(*k.LastUsedAt) > apiKeyTouchInterval {
+		if err := apiKeys.TouchAPIKey(k.ID, now); err != nil {
+			log.Printf("failed to record use of API key %s: %v", k.Prefix, err)
+		}
+	}
+
+	return k, nil
+}
+
+// IsAPIKeyScope reports whether API keys can be given the permission. Users
+// can only be impersonated by an admin holding an access token.
+func IsAPIKeyScope(permission string) bool {
+	return permission != PermUsersImpersonate
+}
+
+// restrict returns the permissions of the set that are also in scopes. A key
+// never grants more than its user has, even if their role changed since.
+func (ps PermissionSet) restrict(scopes []string) PermissionSet {
+	restricted := PermissionSet{}
+	for _, scope := range scopes {
+		if IsAPIKeyScope(scope) && ps.Has(scope) {
+			restricted[scope] = true
+		}
+	}
+
+	return restricted
+}
+
+// GetAPIKeyFromContext returns the API key the request was authenticated
+// with, nil if it used an access token.
+func GetAPIKeyFromContext(ctx context.Context) *types.APIKey {
+	key, ok := ctx.Value(APIKeyKey).(*types.APIKey)
+	if !ok {
+		return nil
+	}
+
+	return key
+}
@@ -0,0 +1,39 @@
+// Package authtest provides the user lookup of the authentication middleware
+// for the tests of routes behind it.
+package authtest
+
+import (
+	"time"
+
+	"github.com/surfiniaburger/api-go/types"
+)
+
+// Users is a types.UserGetter in which every user exists. Users are active,
+// have verified their email address me@me.com and have the user role, unless
+// Roles, Statuses or Deleted say otherwise.
+type Users struct {
+	Roles    map[int]string
+	Statuses map[int]string
+	// Deleted reports the users to return as deleted
+	Deleted func(userID int) bool
+}
+
+func (u *Users) GetUserByID(id int) (*types.User, error) {
+	role, ok := u.Roles[id]
+	if !ok {
+		role = "user"
+	}
+
+	status, ok := u.Statuses[id]
+	if !ok {
+		status = types.UserStatusActive
+	}
+
+	user := &types.User{ID: id, Email: "me@me.com", Role: role, Status: status, EmailVerified: true}
+	if u.Deleted != nil && u.Deleted(id) {
+		deletedAt := time.Now()
+		user.DeletedAt = &deletedAt
+	}
+
+	return user, nil
+}
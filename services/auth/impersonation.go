@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/surfiniaburger/api-go/types"
+	"github.com/surfiniaburger/api-go/utils"
+)
+
+// ActorClaim is the act claim of RFC 8693, naming who acts on behalf of the
+// subject of the token.
+type ActorClaim struct {
+	Subject string `json:"sub"`
+}
+
+// CreateImpersonationJWT creates an access token for the user on behalf of the
+// admin actorID. The token is not tied to a session, it can be revoked by
+// logging out with it.
+func CreateImpersonationJWT(actorID, userID int, expiration time.Duration) (string, error) {
+	return keys.createToken(userID, expiration, Claims{Act: &ActorClaim{Subject: strconv.Itoa(actorID)}})
+}
+
+// CanBeImpersonated reports whether users with the role may be impersonated.
+// Users who can manage or impersonate others cannot, so an admin can never
+// act with the rights of another admin.
+func CanBeImpersonated(role string) (bool, error) {
+	for _, permission := range []string{PermUsersManage, PermUsersImpersonate} {
+		has, err := RoleHasPermission(role, permission)
+		if err != nil || has {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// checkActor makes impersonation tokens stop working as soon as the admin is
+// suspended or loses the permission to impersonate.
+func checkActor(store types.UserGetter, actorID int) error {
+	actor, err := store.GetUserByID(actorID)
+	if err != nil {
+		return err
+	}
+
+	if err := CheckUserStatus(actor); err != nil {
+		return err
+	}
+
+	allowed, err := RoleHasPermission(actor.Role, PermUsersImpersonate)
+	if err != nil {
+		return err
+	}
+
+	if !allowed {
+		return fmt.Errorf("admin %d does not have the %s permission", actorID, PermUsersImpersonate)
+	}
+
+	return nil
+}
+
+// DenyImpersonation refuses requests made while impersonating a user, for
+// actions only the user may take such as changing their password or paying.
+// It goes inside WithJWTAuth.
+func DenyImpersonation(handlerFunc http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if actorID := GetActorIDFromContext(r.Context()); actorID != 0 {
+			utils.WriteError(w, http.StatusForbidden, fmt.Errorf("not allowed while impersonating a user"))
+			return
+		}
+
+		handlerFunc(w, r)
+	}
+}
+
+// GetActorIDFromContext returns the admin impersonating the authenticated
+// user, or 0 if the user acts for themselves. GetUserIDFromContext returns
+// the impersonated user.
+func GetActorIDFromContext(ctx context.Context) int {
+	actorID, ok := ctx.Value(ActorKey).(int)
+	if !ok {
+		return 0
+	}
+
+	return actorID
+}
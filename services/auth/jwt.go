@@ -3,9 +3,11 @@ package auth
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -19,52 +21,164 @@ import (
 type contextKey string
 
 const UserKey contextKey = "userID"
+const TokenKey contextKey = "token"
+const PermissionsKey contextKey = "permissions"
+const APIKeyKey contextKey = "apiKey"
+const ActorKey contextKey = "actorID"
 
-func WithJWTAuth(handlerFunc http.HandlerFunc, store types.UserStore, requiredRoles ...string) http.HandlerFunc {
+// Authentication methods recorded in the amr claim (RFC 8176). fed is not
+// registered, it marks a login at an external OpenID Connect provider.
+const (
+	AMRPassword  = "pwd"
+	AMROTP       = "otp"
+	AMRFederated = "fed"
+)
+
+// TokenInfo describes the access token a request was authenticated with.
+type TokenInfo struct {
+	ID        string
+	UserID    int
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+	// SessionID is the login session the token was issued for, empty for
+	// tokens that do not belong to one
+	SessionID string
+	// MFA is true if the user passed a second factor to obtain the token
+	MFA bool
+	// ActorID is the admin impersonating the user, 0 for the user's own
+	// tokens
+	ActorID int
+}
+
+// authOptions are the requirements a route puts on the authenticated user.
+type authOptions struct {
+	permissions     []string
+	requireVerified bool
+	allowWithoutMFA bool
+}
+
+// WithJWTAuth only lets through requests with a valid access token or API key
+// of a user having every one of the required permissions. Routes for resources with an
+// owner require the :own permission and check the owner with CanAccess. API
+// keys only grant their scopes, so routes that require no permission, such as
+// the account routes, only accept access tokens.
+func WithJWTAuth(handlerFunc http.HandlerFunc, store types.UserGetter, requiredPermissions ...string) http.HandlerFunc {
+	return withJWTAuth(handlerFunc, store, authOptions{permissions: requiredPermissions})
+}
+
+// WithVerifiedJWTAuth works like WithJWTAuth but also requires the user to
+// have verified their email address.
+func WithVerifiedJWTAuth(handlerFunc http.HandlerFunc, store types.UserGetter, requiredPermissions ...string) http.HandlerFunc {
+	return withJWTAuth(handlerFunc, store, authOptions{permissions: requiredPermissions, requireVerified: true})
+}
+
+// WithMFAEnrollmentAuth works like WithJWTAuth but also lets through admins
+// who still have to set up multi-factor authentication, so they can enroll.
+func WithMFAEnrollmentAuth(handlerFunc http.HandlerFunc, store types.UserGetter, requiredPermissions ...string) http.HandlerFunc {
+	return withJWTAuth(handlerFunc, store, authOptions{permissions: requiredPermissions, allowWithoutMFA: true})
+}
+
+func withJWTAuth(handlerFunc http.HandlerFunc, store types.UserGetter, opts authOptions) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		tokenString := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		var info *TokenInfo
+		var key *types.APIKey
+		var err error
+
+		var userID int
+		if apiKey := r.Header.Get(APIKeyHeader); apiKey != "" {
+			if len(opts.permissions) == 0 {
+				log.Printf("API key used on %s %s, which requires no permission", r.Method, r.URL.Path)
+				permissionDenied(w)
+				return
+			}
 
-		token, err := validateJWT(tokenString)
+			key, err = authenticateAPIKey(apiKey)
+			if err != nil {
+				log.Printf("failed to authenticate API key: %v", err)
+				permissionDenied(w)
+				return
+			}
+			userID = key.UserID
+		} else {
+			info, err = authenticateToken(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+			if err != nil {
+				log.Printf("failed to authenticate token: %v", err)
+				permissionDenied(w)
+				return
+			}
+			userID = info.UserID
+		}
+
+		u, err := store.GetUserByID(userID)
 		if err != nil {
-			log.Printf("failed to validate token: %v", err)
+			log.Printf("failed to get user by id: %v", err)
 			permissionDenied(w)
 			return
 		}
 
-		if !token.Valid {
-			log.Println("invalid token")
+		if err := CheckUserStatus(u); err != nil {
+			log.Printf("user %d cannot authenticate: %v", userID, err)
 			permissionDenied(w)
 			return
 		}
 
-		claims := token.Claims.(jwt.MapClaims)
-		str := claims["userID"].(string)
-
-		userID, err := strconv.Atoi(str)
-		if err != nil {
-			log.Printf("failed to convert userID to int: %v", err)
+		role, err := roles.get(u.Role)
+		if err != nil || role == nil {
+			log.Printf("failed to get permissions of role %q: %v", u.Role, err)
 			permissionDenied(w)
 			return
 		}
 
-		u, err := store.GetUserByID(userID)
-		if err != nil {
-			log.Printf("failed to get user by id: %v", err)
-			permissionDenied(w)
+		permissions := role.permissions
+		if key != nil {
+			permissions = permissions.restrict(key.Scopes)
+		}
+
+		for _, permission := range opts.permissions {
+			if !permissions.Has(permission) {
+				log.Printf("user %d does not have the %s permission", userID, permission)
+				permissionDenied(w)
+				return
+			}
+		}
+
+		// API keys can only be created from an access token that passed the
+		// second factor, so only tokens are checked
+		if info != nil && role.ancestors["admin"] && configs.Envs.MFARequiredForAdmins && !info.MFA && !opts.allowWithoutMFA {
+			log.Printf("admin %d did not use multi-factor authentication", userID)
+			utils.WriteError(w, http.StatusForbidden, fmt.Errorf("multi-factor authentication required"))
 			return
 		}
 
-		// Check if the user has one of the required roles
-		userRole := u.Role
-		if !roleIsAllowed(userRole, requiredRoles) {
-			log.Printf("user %d does not have the required permissions", userID)
-			permissionDenied(w)
+		if info != nil && info.ActorID != 0 {
+			if err := checkActor(store, info.ActorID); err != nil {
+				log.Printf("impersonation of user %d by %d refused: %v", userID, info.ActorID, err)
+				permissionDenied(w)
+				return
+			}
+
+			log.Printf("admin %d impersonating user %d: %s %s", info.ActorID, userID, r.Method, r.URL.Path)
+		}
+
+		if opts.requireVerified && !u.EmailVerified {
+			log.Printf("user %d has not verified their email address", userID)
+			utils.WriteError(w, http.StatusForbidden, fmt.Errorf("email address not verified"))
 			return
 		}
 
 		// Add the user to the context
 		ctx := r.Context()
 		ctx = context.WithValue(ctx, UserKey, u.ID)
+		if info != nil {
+			ctx = context.WithValue(ctx, TokenKey, info)
+		}
+		if info != nil && info.ActorID != 0 {
+			ctx = context.WithValue(ctx, ActorKey, info.ActorID)
+		}
+		if key != nil {
+			ctx = context.WithValue(ctx, APIKeyKey, key)
+		}
+		ctx = context.WithValue(ctx, PermissionsKey, permissions)
 		r = r.WithContext(ctx)
 
 		// Call the function if the token is valid
@@ -72,40 +186,224 @@ func WithJWTAuth(handlerFunc http.HandlerFunc, store types.UserStore, requiredRo
 	}
 }
 
-func roleIsAllowed(userRole string, requiredRoles []string) bool {
-	for _, role := range requiredRoles {
-		if userRole == role {
-			return true
+// Claims are the claims of our tokens. The user ID is carried in the standard
+// sub claim. Access tokens have no purpose, other tokens such as MFA
+// challenges set it so they cannot be used as access tokens.
+type Claims struct {
+	jwt.RegisteredClaims
+	// IssuedAt replaces the iat claim of RegisteredClaims to keep the issue
+	// time in microseconds, see issuedAt
+	IssuedAt  *issuedAt `json:"iat,omitempty"`
+	AMR       []string  `json:"amr,omitempty"`
+	Purpose   string    `json:"purpose,omitempty"`
+	SessionID string    `json:"sid,omitempty"`
+	// Act is set on impersonation tokens, see CreateImpersonationJWT
+	Act *ActorClaim `json:"act,omitempty"`
+}
+
+// GetIssuedAt returns the iat claim to the parser, which checks it is not in
+// the future.
+func (c Claims) GetIssuedAt() (*jwt.NumericDate, error) {
+	if c.IssuedAt == nil {
+		return nil, nil
+	}
+
+	return &jwt.NumericDate{Time: c.IssuedAt.Time}, nil
+}
+
+// issuedAt is the issue time of our tokens in seconds with a microsecond
+// fraction, so the tokens revoked by RevokeAllUserTokens can be told apart
+// from those issued right after. jwt.NumericDate is cut to the package-wide
+// jwt.TimePrecision, which is left alone for the other users of the library.
+type issuedAt struct {
+	time.Time
+}
+
+func (t issuedAt) MarshalJSON() ([]byte, error) {
+	truncated := t.Truncate(time.Microsecond)
+	return []byte(fmt.Sprintf("%d.%06d", truncated.Unix(), truncated.Nanosecond()/int(time.Microsecond))), nil
+}
+
+// UnmarshalJSON reads the fraction from the digits rather than a float64,
+// which cannot hold a current time to the microsecond.
+func (t *issuedAt) UnmarshalJSON(b []byte) error {
+	var number json.Number
+	if err := json.Unmarshal(b, &number); err != nil {
+		return fmt.Errorf("invalid iat claim: %v", err)
+	}
+
+	secondsPart, fractionPart, _ := strings.Cut(number.String(), ".")
+	seconds, err := strconv.ParseInt(secondsPart, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid iat claim: %v", err)
+	}
+
+	var nanoseconds int64
+	if fractionPart != "" {
+		nanoseconds, err = strconv.ParseInt((fractionPart + "000000000")[:9], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid iat claim: %v", err)
 		}
 	}
-	return false
+
+	t.Time = time.Unix(seconds, nanoseconds)
+	return nil
 }
 
-func CreateJWT(secret []byte, userID int) (string, error) {
+// CreateJWT creates an access token for the user signed with the active keys.
+// methods are the authentication methods the user went through.
+func CreateJWT(userID int, methods ...string) (string, error) {
+	return keys.CreateJWT(userID, methods...)
+}
+
+// CreateSessionJWT creates an access token that is only valid as long as the
+// login session it was issued for is not revoked.
+func CreateSessionJWT(userID int, sessionID string, methods ...string) (string, error) {
 	expiration := time.Second * time.Duration(configs.Envs.JWTExpirationInSeconds)
+	return keys.createToken(userID, expiration, Claims{AMR: methods, SessionID: sessionID})
+}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"userID":    strconv.Itoa(int(userID)),
-		"expiresAt": time.Now().Add(expiration).Unix(),
-	})
+// CreateJWT creates an access token for the user signed with the key set.
+func (ks *KeySet) CreateJWT(userID int, methods ...string) (string, error) {
+	expiration := time.Second * time.Duration(configs.Envs.JWTExpirationInSeconds)
+	return ks.createToken(userID, expiration, Claims{AMR: methods})
+}
 
-	tokenString, err := token.SignedString(secret)
+// createToken fills in the registered claims and signs the token.
+func (ks *KeySet) createToken(userID int, expiration time.Duration, claims Claims) (string, error) {
+	jti, err := RandomString(16)
 	if err != nil {
 		return "", err
 	}
 
-	return tokenString, err
+	now := time.Now()
+	claims.RegisteredClaims = jwt.RegisteredClaims{
+		ID:        jti,
+		Subject:   strconv.Itoa(userID),
+		Issuer:    configs.Envs.JWTIssuer,
+		Audience:  jwt.ClaimStrings{configs.Envs.JWTAudience},
+		NotBefore: jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(expiration)),
+	}
+	claims.IssuedAt = &issuedAt{now}
+
+	return ks.Sign(&claims)
+}
+
+const mfaChallengePurpose = "mfa"
+
+// CreateMFAChallenge creates a short-lived token proving the user passed
+// their first factor with method, to be exchanged for an access token with a
+// second factor.
+func CreateMFAChallenge(userID int, method string) (string, error) {
+	return keys.createToken(userID, 5*time.Minute, Claims{AMR: []string{method}, Purpose: mfaChallengePurpose})
+}
+
+// ValidateMFAChallenge returns the user ID of a valid MFA challenge token and
+// the method of the first factor they passed.
+func ValidateMFAChallenge(tokenString string) (int, string, error) {
+	token, err := validateJWT(tokenString)
+	if err != nil {
+		return 0, "", err
+	}
+
+	claims := token.Claims.(*Claims)
+	if claims.Purpose != mfaChallengePurpose || len(claims.AMR) != 1 {
+		return 0, "", fmt.Errorf("not an MFA challenge token")
+	}
+
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return userID, claims.AMR[0], nil
+}
+
+// authenticateToken validates an access token and checks it was not revoked.
+func authenticateToken(tokenString string) (*TokenInfo, error) {
+	token, err := validateJWT(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	if !token.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	info, err := tokenInfoFromClaims(token.Claims.(*Claims))
+	if err != nil {
+		return nil, fmt.Errorf("invalid token claims: %v", err)
+	}
+
+	revoked, err := revocations.IsTokenRevoked(info.ID, info.UserID, info.IssuedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check token revocation: %v", err)
+	}
+
+	if revoked {
+		return nil, fmt.Errorf("token %s of user %d is revoked", info.ID, info.UserID)
+	}
+
+	if err := checkSession(info); err != nil {
+		return nil, err
+	}
+
+	return info, nil
 }
 
 func validateJWT(tokenString string) (*jwt.Token, error) {
+	return keys.validateJWT(tokenString)
+}
+
+// validateJWT checks the signature against the key named by the kid header and
+// validates exp, nbf, iat, iss and aud.
+func (ks *KeySet) validateJWT(tokenString string) (*jwt.Token, error) {
+	return jwt.ParseWithClaims(tokenString, &Claims{}, ks.keyFunc,
+		jwt.WithValidMethods(ks.algorithms()),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithIssuer(configs.Envs.JWTIssuer),
+		jwt.WithAudience(configs.Envs.JWTAudience),
+		jwt.WithLeeway(30*time.Second),
+	)
+}
+
+func tokenInfoFromClaims(claims *Claims) (*TokenInfo, error) {
+	if claims.ID == "" {
+		return nil, fmt.Errorf("missing jti claim")
+	}
+
+	if claims.Purpose != "" {
+		return nil, fmt.Errorf("%s token used as an access token", claims.Purpose)
+	}
 
-	return jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert sub to a user ID: %v", err)
+	}
+
+	if claims.IssuedAt == nil {
+		return nil, fmt.Errorf("missing iat claim")
+	}
+
+	info := &TokenInfo{
+		ID:        claims.ID,
+		UserID:    userID,
+		IssuedAt:  claims.IssuedAt.Time,
+		ExpiresAt: claims.ExpiresAt.Time,
+		SessionID: claims.SessionID,
+		MFA:       slices.Contains(claims.AMR, AMROTP),
+	}
+
+	if claims.Act != nil {
+		info.ActorID, err = strconv.Atoi(claims.Act.Subject)
+		if err != nil || info.ActorID == 0 {
+			return nil, fmt.Errorf("invalid act claim")
 		}
+	}
 
-		return []byte(configs.Envs.JWTSecret), nil
-	})
+	return info, nil
 }
 
 func permissionDenied(w http.ResponseWriter) {
@@ -120,3 +418,12 @@ func GetUserIDFromContext(ctx context.Context) int {
 
 	return userID
 }
+
+func GetTokenFromContext(ctx context.Context) *TokenInfo {
+	token, ok := ctx.Value(TokenKey).(*TokenInfo)
+	if !ok {
+		return nil
+	}
+
+	return token
+}
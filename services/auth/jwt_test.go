@@ -1,13 +1,19 @@
 package auth
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/surfiniaburger/api-go/types"
 )
 
 func TestCreateJWT(t *testing.T) {
 	secret := []byte("secret")
 
-	token, err := CreateJWT(secret, 1)
+	token, err := NewHMACKeySet(secret).CreateJWT(1)
 	if err != nil {
 		t.Errorf("error creating JWT: %v", err)
 	}
@@ -16,3 +22,200 @@ func TestCreateJWT(t *testing.T) {
 		t.Error("expected token to be not empty")
 	}
 }
+
+func TestWithJWTAuth(t *testing.T) {
+	SetRevocationStore(NewMemoryRevocationStore())
+
+	var token *TokenInfo
+	handler := WithJWTAuth(func(w http.ResponseWriter, r *http.Request) {
+		token = GetTokenFromContext(r.Context())
+	}, &mockUserStore{}, PermBooksRead)
+
+	request := func(tokenString string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+
+	tokenString, err := CreateJWT(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("should accept a valid token", func(t *testing.T) {
+		rr := request(tokenString)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if token == nil || token.ID == "" || token.UserID != 1 {
+			t.Errorf("expected token info in the context, got %+v", token)
+		}
+	})
+
+	t.Run("should reject a token signed with another secret", func(t *testing.T) {
+		other, err := NewHMACKeySet([]byte("other")).CreateJWT(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := request(other)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected status code %d, got %d", http.StatusForbidden, rr.Code)
+		}
+	})
+
+	t.Run("should reject a revoked token", func(t *testing.T) {
+		if err := RevokeToken(token); err != nil {
+			t.Fatal(err)
+		}
+
+		rr := request(tokenString)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected status code %d, got %d", http.StatusForbidden, rr.Code)
+		}
+	})
+
+	t.Run("should reject tokens issued before the user tokens were revoked", func(t *testing.T) {
+		other, err := CreateJWT(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := RevokeAllUserTokens(1); err != nil {
+			t.Fatal(err)
+		}
+
+		rr := request(other)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected status code %d, got %d", http.StatusForbidden, rr.Code)
+		}
+	})
+
+	t.Run("should accept tokens issued right after the user tokens were revoked", func(t *testing.T) {
+		if err := RevokeAllUserTokens(1); err != nil {
+			t.Fatal(err)
+		}
+
+		// issued within the same second as the revocation
+		other, err := CreateJWT(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := request(other)
+		if rr.Code != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if jwt.TimePrecision != time.Second {
+			t.Errorf("expected the precision of the jwt package to be left alone, got %v", jwt.TimePrecision)
+		}
+	})
+}
+
+func TestWithVerifiedJWTAuth(t *testing.T) {
+	SetRevocationStore(NewMemoryRevocationStore())
+
+	handler := WithVerifiedJWTAuth(func(w http.ResponseWriter, r *http.Request) {}, &mockUserStore{}, PermOrdersCreate)
+
+	tests := map[int]int{
+		1:              http.StatusForbidden,
+		verifiedUserID: http.StatusOK,
+	}
+
+	for userID, code := range tests {
+		tokenString, err := CreateJWT(userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+
+		if rr.Code != code {
+			t.Errorf("expected status code %d for user %d, got %d", code, userID, rr.Code)
+		}
+	}
+}
+
+func TestAdminMFA(t *testing.T) {
+	SetRevocationStore(NewMemoryRevocationStore())
+
+	handler := func(w http.ResponseWriter, r *http.Request) {}
+	request := func(handler http.HandlerFunc, tokenString string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr.Code
+	}
+
+	withoutMFA, err := CreateJWT(adminUserID, AMRPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withMFA, err := CreateJWT(adminUserID, AMRPassword, AMROTP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("should require admins to use MFA", func(t *testing.T) {
+		if code := request(WithJWTAuth(handler, &mockUserStore{}, PermUsersManage), withoutMFA); code != http.StatusForbidden {
+			t.Errorf("expected status code %d, got %d", http.StatusForbidden, code)
+		}
+
+		if code := request(WithJWTAuth(handler, &mockUserStore{}, PermUsersManage), withMFA); code != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, code)
+		}
+	})
+
+	t.Run("should let admins without MFA enroll", func(t *testing.T) {
+		if code := request(WithMFAEnrollmentAuth(handler, &mockUserStore{}, PermUsersManage), withoutMFA); code != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, code)
+		}
+	})
+
+	t.Run("should reject MFA challenges as access tokens", func(t *testing.T) {
+		challenge, err := CreateMFAChallenge(adminUserID, AMRFederated)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if code := request(WithMFAEnrollmentAuth(handler, &mockUserStore{}, PermUsersManage), challenge); code != http.StatusForbidden {
+			t.Errorf("expected status code %d, got %d", http.StatusForbidden, code)
+		}
+
+		userID, method, err := ValidateMFAChallenge(challenge)
+		if err != nil || userID != adminUserID || method != AMRFederated {
+			t.Errorf("expected challenge of user %d after %q, got %d after %q (%v)", adminUserID, AMRFederated, userID, method, err)
+		}
+
+		if _, _, err := ValidateMFAChallenge(withMFA); err == nil {
+			t.Error("expected an access token to be rejected as an MFA challenge")
+		}
+	})
+}
+
+const (
+	verifiedUserID = 2
+	adminUserID    = 3
+)
+
+type mockUserStore struct{}
+
+func (m *mockUserStore) GetUserByID(id int) (*types.User, error) {
+	if id == adminUserID {
+		return &types.User{ID: id, Role: "admin", EmailVerified: true}, nil
+	}
+
+	return &types.User{ID: id, Role: "user", EmailVerified: id == verifiedUserID}, nil
+}
@@ -0,0 +1,295 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/surfiniaburger/api-go/configs"
+	"github.com/surfiniaburger/api-go/utils"
+)
+
+// keys signs and verifies every token. It defaults to HS256 with the
+// configured secret and is replaced at startup with SetKeySet.
+var keys = NewHMACKeySet([]byte(configs.Envs.JWTSecret))
+
+// SetKeySet replaces the keys used to sign and verify tokens.
+func SetKeySet(ks *KeySet) {
+	keys = ks
+}
+
+type key struct {
+	id     string
+	method jwt.SigningMethod
+	// private is only set for the signing key
+	private any
+	public  any
+}
+
+// KeySet holds the key used to sign new tokens and every key that is still
+// accepted when verifying them, indexed by key ID. Keeping the previous public
+// keys around lets us rotate the signing key without logging everyone out.
+type KeySet struct {
+	signing   *key
+	verifying map[string]*key
+}
+
+// NewHMACKeySet returns a key set signing and verifying with a shared secret.
+// HMAC keys have no key ID and are never published in the JWKS.
+func NewHMACKeySet(secret []byte) *KeySet {
+	k := &key{method: jwt.SigningMethodHS256, private: secret, public: secret}
+	return &KeySet{signing: k, verifying: map[string]*key{"": k}}
+}
+
+// NewKeySet returns a key set signing with an RSA (RS256) or Ed25519 (EdDSA)
+// private key. Any extra public keys are accepted for verification only.
+func NewKeySet(private crypto.Signer, previous ...crypto.PublicKey) (*KeySet, error) {
+	signing, err := newKey(private.Public())
+	if err != nil {
+		return nil, err
+	}
+	signing.private = private
+
+	ks := &KeySet{signing: signing, verifying: map[string]*key{signing.id: signing}}
+	for _, public := range previous {
+		k, err := newKey(public)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := ks.verifying[k.id]; !ok {
+			ks.verifying[k.id] = k
+		}
+	}
+
+	return ks, nil
+}
+
+// LoadKeySet builds the key set described by the configuration.
+func LoadKeySet(cfg configs.Config) (*KeySet, error) {
+	if cfg.JWTAlgorithm == jwt.SigningMethodHS256.Alg() {
+		return NewHMACKeySet([]byte(cfg.JWTSecret)), nil
+	}
+
+	if cfg.JWTPrivateKeyFile == "" {
+		return nil, fmt.Errorf("JWT_PRIVATE_KEY_FILE is required for %s", cfg.JWTAlgorithm)
+	}
+
+	private, err := readPrivateKey(cfg.JWTPrivateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var previous []crypto.PublicKey
+	for _, path := range strings.Split(cfg.JWTPublicKeyFiles, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+
+		public, err := readPublicKey(path)
+		if err != nil {
+			return nil, err
+		}
+		previous = append(previous, public)
+	}
+
+	ks, err := NewKeySet(private, previous...)
+	if err != nil {
+		return nil, err
+	}
+
+	if ks.signing.method.Alg() != cfg.JWTAlgorithm {
+		return nil, fmt.Errorf("JWT_ALGORITHM is %s but the private key is for %s", cfg.JWTAlgorithm, ks.signing.method.Alg())
+	}
+
+	return ks, nil
+}
+
+// Sign signs the claims with the signing key, setting the kid header.
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ks.signing.method, claims)
+	if ks.signing.id != "" {
+		token.Header["kid"] = ks.signing.id
+	}
+
+	return token.SignedString(ks.signing.private)
+}
+
+// keyFunc picks the verification key named by the kid header of the token.
+func (ks *KeySet) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	k, ok := ks.verifying[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key ID: %q", kid)
+	}
+
+	if token.Method.Alg() != k.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+
+	return k.public, nil
+}
+
+func (ks *KeySet) algorithms() []string {
+	seen := make(map[string]bool)
+	algs := []string{}
+	for _, k := range ks.verifying {
+		if !seen[k.method.Alg()] {
+			seen[k.method.Alg()] = true
+			algs = append(algs, k.method.Alg())
+		}
+	}
+
+	return algs
+}
+
+// JWK is a public key in the JSON Web Key format (RFC 7517).
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKS returns the public verification keys. It is empty for HMAC key sets.
+func (ks *KeySet) JWKS() []JWK {
+	jwks := []JWK{}
+	for _, k := range ks.verifying {
+		if k.id == "" {
+			continue
+		}
+
+		jwk := publicJWK(k.public)
+		jwk.Kid = k.id
+		jwk.Use = "sig"
+		jwk.Alg = k.method.Alg()
+		jwks = append(jwks, jwk)
+	}
+
+	sort.Slice(jwks, func(i, j int) bool {
+		return jwks[i].Kid < jwks[j].Kid
+	})
+
+	return jwks
+}
+
+// HandleJWKS serves the public keys so other services can verify our tokens.
+func HandleJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	utils.WriteJSON(w, http.StatusOK, map[string][]JWK{"keys": keys.JWKS()})
+}
+
+func newKey(public crypto.PublicKey) (*key, error) {
+	var method jwt.SigningMethod
+	switch public.(type) {
+	case *rsa.PublicKey:
+		method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", public)
+	}
+
+	return &key{id: thumbprint(publicJWK(public)), method: method, public: public}, nil
+}
+
+func publicJWK(public crypto.PublicKey) JWK {
+	switch pub := public.(type) {
+	case *rsa.PublicKey:
+		return JWK{
+			Kty: "RSA",
+			N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}
+	case ed25519.PublicKey:
+		return JWK{Kty: "OKP", Crv: "Ed25519", X: base64.RawURLEncoding.EncodeToString(pub)}
+	}
+
+	return JWK{}
+}
+
+// thumbprint computes the RFC 7638 thumbprint of a key, used as its key ID so
+// the same key always gets the same ID without extra configuration.
+func thumbprint(jwk JWK) string {
+	var members string
+	if jwk.Kty == "RSA" {
+		members = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, jwk.E, jwk.N)
+	} else {
+		members = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q}`, jwk.Crv, jwk.Kty, jwk.X)
+	}
+
+	sum := sha256.Sum256([]byte(members))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+
+	return block, nil
+}
+
+func readPrivateKey(path string) (crypto.Signer, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+
+	private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key %s: %v", path, err)
+	}
+
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key in %s", path)
+	}
+
+	return signer, nil
+}
+
+func readPublicKey(path string) (crypto.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+
+	public, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key %s: %v", path, err)
+	}
+
+	return public, nil
+}
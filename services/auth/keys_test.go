@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/surfiniaburger/api-go/configs"
+)
+
+func TestKeySet(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldKeys, err := NewKeySet(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the signing key was rotated from RSA to Ed25519
+	newKeys, err := NewKeySet(edKey, rsaKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("should sign with the kid header and registered claims", func(t *testing.T) {
+		tokenString, err := newKeys.CreateJWT(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		token, err := newKeys.validateJWT(tokenString)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if token.Method.Alg() != "EdDSA" {
+			t.Errorf("expected EdDSA, got %s", token.Method.Alg())
+		}
+
+		if token.Header["kid"] != newKeys.signing.id {
+			t.Errorf("expected kid %s, got %v", newKeys.signing.id, token.Header["kid"])
+		}
+
+		claims := token.Claims.(*Claims)
+		if claims.Subject != "1" || claims.Issuer != configs.Envs.JWTIssuer || claims.ID == "" {
+			t.Errorf("unexpected claims %+v", claims)
+		}
+	})
+
+	t.Run("should verify tokens signed with a previous key", func(t *testing.T) {
+		tokenString, err := oldKeys.CreateJWT(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := newKeys.validateJWT(tokenString); err != nil {
+			t.Errorf("expected token to be valid, got %v", err)
+		}
+	})
+
+	t.Run("should reject tokens signed with an unknown key", func(t *testing.T) {
+		tokenString, err := newKeys.CreateJWT(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := oldKeys.validateJWT(tokenString); err == nil {
+			t.Error("expected token to be rejected")
+		}
+	})
+
+	t.Run("should reject expired tokens and tokens for another audience", func(t *testing.T) {
+		now := time.Now()
+		tests := map[string]jwt.RegisteredClaims{
+			"expired": {
+				ID:        "expired",
+				Subject:   "1",
+				Issuer:    configs.Envs.JWTIssuer,
+				Audience:  jwt.ClaimStrings{configs.Envs.JWTAudience},
+				IssuedAt:  jwt.NewNumericDate(now.Add(-time.Hour)),
+				ExpiresAt: jwt.NewNumericDate(now.Add(-time.Minute)),
+			},
+			"other audience": {
+				ID:        "audience",
+				Subject:   "1",
+				Issuer:    configs.Envs.JWTIssuer,
+				Audience:  jwt.ClaimStrings{"other-service"},
+				IssuedAt:  jwt.NewNumericDate(now),
+				ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+			},
+			"no expiration": {
+				ID:       "forever",
+				Subject:  "1",
+				Issuer:   configs.Envs.JWTIssuer,
+				Audience: jwt.ClaimStrings{configs.Envs.JWTAudience},
+				IssuedAt: jwt.NewNumericDate(now),
+			},
+		}
+
+		for name, claims := range tests {
+			tokenString, err := newKeys.Sign(&Claims{RegisteredClaims: claims})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := newKeys.validateJWT(tokenString); err == nil {
+				t.Errorf("expected %s token to be rejected", name)
+			}
+		}
+	})
+
+	t.Run("should serve every verification key in the JWKS", func(t *testing.T) {
+		previous := keys
+		SetKeySet(newKeys)
+		defer SetKeySet(previous)
+
+		rr := httptest.NewRecorder()
+		HandleJWKS(rr, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+
+		var response struct {
+			Keys []JWK `json:"keys"`
+		}
+		if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(response.Keys) != 2 {
+			t.Fatalf("expected 2 keys, got %d", len(response.Keys))
+		}
+
+		for _, k := range response.Keys {
+			if k.Kid == "" || k.Use != "sig" {
+				t.Errorf("unexpected key %+v", k)
+			}
+		}
+	})
+
+	t.Run("should not publish HMAC secrets", func(t *testing.T) {
+		if jwks := NewHMACKeySet([]byte("secret")).JWKS(); len(jwks) != 0 {
+			t.Errorf("expected no keys, got %d", len(jwks))
+		}
+	})
+}
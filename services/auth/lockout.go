@@ -0,0 +1,210 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/surfiniaburger/api-go/configs"
+	"github.com/surfiniaburger/api-go/types"
+)
+
+// backoffBase is the delay after the first failed login, it doubles with
+// every further failure.
+const backoffBase = time.Second
+
+// LoginThrottledError is returned by LoginLimiter.Check when a login must not
+// be attempted yet. Locked is set when the account itself is locked out.
+type LoginThrottledError struct {
+	Locked     bool
+	RetryAfter time.Duration
+}
+
+func (e *LoginThrottledError) Error() string {
+	if e.Locked {
+		return fmt.Sprintf("account locked, try again in %s", e.RetryAfter)
+	}
+
+	return fmt.Sprintf("too many failed login attempts, try again in %s", e.RetryAfter)
+}
+
+// LoginLimiter slows down password guessing. Every failed login of an account
+// doubles the time before the next attempt is allowed and the account is
+// locked after too many failures. Failures are also counted per IP so one
+// client cannot spread its guesses over many accounts.
+type LoginLimiter struct {
+	store              types.LoginAttemptStore
+	maxAccountFailures int
+	maxIPFailures      int
+	lockout            time.Duration
+	maxBackoff         time.Duration
+}
+
+func NewLoginLimiter(store types.LoginAttemptStore, cfg configs.Config) *LoginLimiter {
+	return &LoginLimiter{
+		store:              store,
+		maxAccountFailures: int(cfg.LoginMaxAccountFailures),
+		maxIPFailures:      int(cfg.LoginMaxIPFailures),
+		lockout:            time.Second * time.Duration(cfg.LoginLockoutInSeconds),
+		maxBackoff:         time.Second * time.Duration(cfg.LoginBackoffMaxInSeconds),
+	}
+}
+
+// Check returns a *LoginThrottledError if the email or the IP must wait before
+// trying to log in again.
+func (l *LoginLimiter) Check(email, ip string, now time.Time) error {
+	account, err := l.store.GetLoginAttempts(accountKey(email))
+	if err != nil {
+		return err
+	}
+
+	if account.Failures >= l.maxAccountFailures {
+		if wait := account.LastFailureAt.Add(l.lockout).Sub(now); wait > 0 {
+			return &LoginThrottledError{Locked: true, RetryAfter: wait}
+		}
+	} else if account.Failures > 0 {
+		if wait := account.LastFailureAt.Add(l.backoff(account.Failures)).Sub(now); wait > 0 {
+			return &LoginThrottledError{RetryAfter: wait}
+		}
+	}
+
+	client, err := l.store.GetLoginAttempts(ipKey(ip))
+	if err != nil {
+		return err
+	}
+
+	if client.Failures >= l.maxIPFailures {
+		if wait := client.LastFailureAt.Add(l.lockout).Sub(now); wait > 0 {
+			return &LoginThrottledError{RetryAfter: wait}
+		}
+	}
+
+	return nil
+}
+
+// RecordFailure counts a failed login against the email and the IP. Failures
+// older than the lockout duration are forgotten.
+func (l *LoginLimiter) RecordFailure(email, ip string, now time.Time) error {
+	account, err := l.store.RecordLoginFailure(accountKey(email), now, now.Add(-l.lockout))
+	if err != nil {
+		return err
+	}
+
+	if account.Failures == l.maxAccountFailures {
+		log.Printf("locking out %s for %s after %d failed logins", account.Key, l.lockout, account.Failures)
+	}
+
+	_, err = l.store.RecordLoginFailure(ipKey(ip), now, now.Add(-l.lockout))
+	return err
+}
+
+// RecordSuccess forgets the failures of the account. The failures of the IP
+// are kept, otherwise logging into an account of your own would reset them.
+func (l *LoginLimiter) RecordSuccess(email string) error {
+	return l.store.ResetLoginAttempts(accountKey(email))
+}
+
+// Unlock lifts the lockout of an account.
+func (l *LoginLimiter) Unlock(email string) error {
+	return l.store.ResetLoginAttempts(accountKey(email))
+}
+
+func (l *LoginLimiter) backoff(failures int) time.Duration {
+	wait := backoffBase
+	for i := 1; i < failures && wait < l.maxBackoff; i++ {
+		wait *= 2
+	}
+
+	return min(wait, l.maxBackoff)
+}
+
+func accountKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// PruneLoginAttempts removes the failures that no longer count from the store
+// every interval until the context is cancelled.
+func PruneLoginAttempts(ctx context.Context, store types.LoginAttemptStore, interval time.Duration) {
+	lockout := time.Second * time.Duration(configs.Envs.LoginLockoutInSeconds)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := store.PruneLoginAttempts(now.Add(-lockout)); err != nil {
+				log.Printf("failed to prune login attempts: %v", err)
+			}
+		}
+	}
+}
+
+// MemoryLoginAttemptStore is an in-memory types.LoginAttemptStore. It is only
+// suitable for a single API instance as the counters are lost on restart.
+type MemoryLoginAttemptStore struct {
+	mu       sync.Mutex
+	attempts map[string]types.LoginAttempts
+}
+
+func NewMemoryLoginAttemptStore() *MemoryLoginAttemptStore {
+	return &MemoryLoginAttemptStore{attempts: make(map[string]types.LoginAttempts)}
+}
+
+func (s *MemoryLoginAttemptStore) GetLoginAttempts(key string) (*types.LoginAttempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.attempts[key]
+	if !ok {
+		a = types.LoginAttempts{Key: key}
+	}
+
+	return &a, nil
+}
+
+func (s *MemoryLoginAttemptStore) RecordLoginFailure(key string, at time.Time, resetBefore time.Time) (*types.LoginAttempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.attempts[key]
+	if !ok || a.LastFailureAt.Before(resetBefore) {
+		a = types.LoginAttempts{Key: key}
+	}
+
+	a.Failures++
+	a.LastFailureAt = at
+	s.attempts[key] = a
+
+	return &a, nil
+}
+
+func (s *MemoryLoginAttemptStore) ResetLoginAttempts(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.attempts, key)
+	return nil
+}
+
+func (s *MemoryLoginAttemptStore) PruneLoginAttempts(before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, a := range s.attempts {
+		if a.LastFailureAt.Before(before) {
+			delete(s.attempts, key)
+		}
+	}
+
+	return nil
+}
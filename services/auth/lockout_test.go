@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/surfiniaburger/api-go/configs"
+)
+
+func TestLoginLimiter(t *testing.T) {
+	cfg := configs.Config{
+		LoginMaxAccountFailures:  5,
+		LoginMaxIPFailures:       8,
+		LoginLockoutInSeconds:    900,
+		LoginBackoffMaxInSeconds: 4,
+	}
+	now := time.Date(2024, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	throttled := func(err error) *LoginThrottledError {
+		var throttled *LoginThrottledError
+		if !errors.As(err, &throttled) {
+			return nil
+		}
+		return throttled
+	}
+
+	t.Run("should back off exponentially", func(t *testing.T) {
+		limiter := NewLoginLimiter(NewMemoryLoginAttemptStore(), cfg)
+
+		for i, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+			if err := limiter.RecordFailure("me@me.com", "1.2.3.4", now); err != nil {
+				t.Fatal(err)
+			}
+
+			e := throttled(limiter.Check("me@me.com", "1.2.3.4", now))
+			if e == nil || e.Locked || e.RetryAfter != expected {
+				t.Fatalf("expected to wait %s after %d failures, got %v", expected, i+1, e)
+			}
+
+			now = now.Add(expected)
+			if err := limiter.Check("me@me.com", "1.2.3.4", now); err != nil {
+				t.Fatalf("expected login to be allowed after %s, got %v", expected, err)
+			}
+		}
+	})
+
+	t.Run("should lock the account and unlock it", func(t *testing.T) {
+		limiter := NewLoginLimiter(NewMemoryLoginAttemptStore(), cfg)
+
+		for i := 0; i < 5; i++ {
+			limiter.RecordFailure("ME@me.com", "1.2.3.4", now)
+		}
+
+		e := throttled(limiter.Check("me@me.com", "5.6.7.8", now.Add(time.Minute)))
+		if e == nil || !e.Locked || e.RetryAfter != 14*time.Minute {
+			t.Fatalf("expected the account to be locked for 14 more minutes, got %v", e)
+		}
+
+		if err := limiter.Check("me@me.com", "5.6.7.8", now.Add(15*time.Minute)); err != nil {
+			t.Errorf("expected the lockout to expire, got %v", err)
+		}
+
+		if err := limiter.Unlock("me@me.com"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := limiter.Check("me@me.com", "5.6.7.8", now.Add(time.Minute)); err != nil {
+			t.Errorf("expected the account to be unlocked, got %v", err)
+		}
+	})
+
+	t.Run("should throttle an IP guessing many accounts", func(t *testing.T) {
+		limiter := NewLoginLimiter(NewMemoryLoginAttemptStore(), cfg)
+
+		for i := 0; i < 8; i++ {
+			limiter.RecordFailure(string(rune('a'+i))+"@me.com", "1.2.3.4", now)
+		}
+
+		e := throttled(limiter.Check("other@me.com", "1.2.3.4", now))
+		if e == nil || e.Locked {
+			t.Fatalf("expected the IP to be throttled, got %v", e)
+		}
+
+		if err := limiter.Check("other@me.com", "5.6.7.8", now); err != nil {
+			t.Errorf("expected other IPs to be allowed, got %v", err)
+		}
+	})
+
+	t.Run("should forget old failures", func(t *testing.T) {
+		limiter := NewLoginLimiter(NewMemoryLoginAttemptStore(), cfg)
+
+		for i := 0; i < 4; i++ {
+			limiter.RecordFailure("me@me.com", "1.2.3.4", now)
+		}
+		limiter.RecordFailure("me@me.com", "1.2.3.4", now.Add(time.Hour))
+
+		e := throttled(limiter.Check("me@me.com", "1.2.3.4", now.Add(time.Hour)))
+		if e == nil || e.Locked || e.RetryAfter != time.Second {
+			t.Errorf("expected the count to start over, got %v", e)
+		}
+	})
+}
@@ -1,11 +1,106 @@
 package auth
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/surfiniaburger/api-go/configs"
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
 )
 
+const (
+	PasswordAlgorithmBcrypt   = "bcrypt"
+	PasswordAlgorithmArgon2id = "argon2id"
+)
+
+// argon2idPrefix starts argon2id hashes, which are stored in the PHC string
+// format: $argon2id$v=19$m=<memory>,t=<iterations>,p=<parallelism>$<salt>$<key>
+// with the salt and key in unpadded base64.
+const argon2idPrefix = "$argon2id$"
+
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+// Argon2Params are the cost parameters of argon2id, Memory is in KiB.
+type Argon2Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+}
+
+// PasswordHasher hashes new passwords with the configured algorithm. Hashes
+// carry their algorithm and parameters, so passwords hashed with previous
+// settings keep working and are rehashed when the user logs in.
+type PasswordHasher struct {
+	Algorithm  string
+	BcryptCost int
+	Argon2     Argon2Params
+}
+
+// hasher hashes every new password. It is built from the configuration and
+// replaced at startup with SetPasswordHasher, once the settings are checked.
+var hasher = newPasswordHasher(configs.Envs)
+
+// SetPasswordHasher replaces the hasher used for new passwords.
+func SetPasswordHasher(h *PasswordHasher) {
+	hasher = h
+}
+
+func newPasswordHasher(cfg configs.Config) *PasswordHasher {
+	return &PasswordHasher{
+		Algorithm:  cfg.PasswordHashAlgorithm,
+		BcryptCost: int(cfg.PasswordBcryptCost),
+		Argon2: Argon2Params{
+			Memory:      uint32(cfg.PasswordArgon2Memory),
+			Iterations:  uint32(cfg.PasswordArgon2Iterations),
+			Parallelism: uint8(cfg.PasswordArgon2Parallelism),
+		},
+	}
+}
+
+// LoadPasswordHasher builds the hasher described by the configuration.
+func LoadPasswordHasher(cfg configs.Config) (*PasswordHasher, error) {
+	h := newPasswordHasher(cfg)
+
+	switch h.Algorithm {
+	case PasswordAlgorithmBcrypt:
+		if h.BcryptCost < bcrypt.MinCost || h.BcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("PASSWORD_BCRYPT_COST must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	case PasswordAlgorithmArgon2id:
+		if cfg.PasswordArgon2Memory < 8*cfg.PasswordArgon2Parallelism || cfg.PasswordArgon2Memory > 1<<32-1 {
+			return nil, fmt.Errorf("PASSWORD_ARGON2_MEMORY must be at least 8 KiB per thread")
+		}
+		if cfg.PasswordArgon2Iterations < 1 || cfg.PasswordArgon2Iterations > 1<<32-1 {
+			return nil, fmt.Errorf("PASSWORD_ARGON2_ITERATIONS must be at least 1")
+		}
+		if cfg.PasswordArgon2Parallelism < 1 || cfg.PasswordArgon2Parallelism > 255 {
+			return nil, fmt.Errorf("PASSWORD_ARGON2_PARALLELISM must be between 1 and 255")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported PASSWORD_HASH_ALGORITHM %q, use %s or %s", h.Algorithm, PasswordAlgorithmArgon2id, PasswordAlgorithmBcrypt)
+	}
+
+	return h, nil
+}
+
 func HashPassword(password string) (string, error) {
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return hasher.Hash(password)
+}
+
+// Hash hashes the password with the algorithm and parameters of the hasher.
+func (h *PasswordHasher) Hash(password string) (string, error) {
+	if h.Algorithm == PasswordAlgorithmArgon2id {
+		return hashArgon2id(password, h.Argon2)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
 	if err != nil {
 		return "", err
 	}
@@ -13,7 +108,81 @@ func HashPassword(password string) (string, error) {
 	return string(hash), nil
 }
 
+// ComparePasswords checks the password against a bcrypt or argon2id hash.
 func ComparePasswords(hashed string, plain []byte) bool {
+	if strings.HasPrefix(hashed, argon2idPrefix) {
+		params, salt, key, err := parseArgon2id(hashed)
+		if err != nil {
+			return false
+		}
+
+		other := argon2.IDKey(plain, salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+		return subtle.ConstantTimeCompare(key, other) == 1
+	}
+
 	err := bcrypt.CompareHashAndPassword([]byte(hashed), plain)
 	return err == nil
 }
+
+// PasswordNeedsRehash reports whether the hash was made with another algorithm
+// or other parameters than new passwords are, in which case it should be
+// replaced the next time the password is known, i.e. when the user logs in.
+func PasswordNeedsRehash(hashed string) bool {
+	return hasher.NeedsRehash(hashed)
+}
+
+// NeedsRehash reports whether the hash differs from the ones the hasher makes.
+func (h *PasswordHasher) NeedsRehash(hashed string) bool {
+	if strings.HasPrefix(hashed, argon2idPrefix) {
+		params, _, _, err := parseArgon2id(hashed)
+		return err != nil || h.Algorithm != PasswordAlgorithmArgon2id || params != h.Argon2
+	}
+
+	cost, err := bcrypt.Cost([]byte(hashed))
+	return err != nil || h.Algorithm != PasswordAlgorithmBcrypt || cost != h.BcryptCost
+}
+
+func hashArgon2id(password string, params Argon2Params) (string, error) {
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, argon2KeyLength)
+
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix, argon2.Version, params.Memory, params.Iterations, params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func parseArgon2id(hashed string) (Argon2Params, []byte, []byte, error) {
+	var params Argon2Params
+
+	// "", "argon2id", version, parameters, salt, key
+	parts := strings.Split(hashed, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, fmt.Errorf("invalid argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2 version %q", parts[2])
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2id parameters: %w", err)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2id salt: %w", err)
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, fmt.Errorf("invalid argon2id key")
+	}
+
+	return params, salt, key, nil
+}
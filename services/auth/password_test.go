@@ -1,7 +1,10 @@
 package auth
 
 import (
+	"strings"
 	"testing"
+
+	"github.com/surfiniaburger/api-go/configs"
 )
 
 func TestHashPassword(t *testing.T) {
@@ -32,3 +35,78 @@ func TestComparePasswords(t *testing.T) {
 		t.Errorf("expected password to not match hash")
 	}
 }
+
+func TestPasswordHasher(t *testing.T) {
+	argon2id := &PasswordHasher{Algorithm: PasswordAlgorithmArgon2id, Argon2: Argon2Params{Memory: 1024, Iterations: 1, Parallelism: 1}}
+	bcryptHasher := &PasswordHasher{Algorithm: PasswordAlgorithmBcrypt, BcryptCost: 4}
+
+	t.Run("should verify argon2id hashes", func(t *testing.T) {
+		hash, err := argon2id.Hash("password")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$") {
+			t.Errorf("unexpected hash %q", hash)
+		}
+
+		if !ComparePasswords(hash, []byte("password")) {
+			t.Error("expected password to match hash")
+		}
+		if ComparePasswords(hash, []byte("notpassword")) {
+			t.Error("expected password to not match hash")
+		}
+	})
+
+	t.Run("should reject malformed argon2id hashes", func(t *testing.T) {
+		for _, hash := range []string{"$argon2id$", "$argon2id$v=18$m=1024,t=1,p=1$c2FsdA$a2V5", "$argon2id$v=19$m=1024$c2FsdA$a2V5", "$argon2id$v=19$m=1024,t=1,p=1$c2FsdA$"} {
+			if ComparePasswords(hash, []byte("password")) {
+				t.Errorf("%q: expected password to not match hash", hash)
+			}
+		}
+	})
+
+	t.Run("should rehash hashes made with other settings", func(t *testing.T) {
+		bcryptHash, err := bcryptHasher.Hash("password")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		argon2idHash, err := argon2id.Hash("password")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stronger := &PasswordHasher{Algorithm: PasswordAlgorithmArgon2id, Argon2: Argon2Params{Memory: 2048, Iterations: 1, Parallelism: 1}}
+		tests := []struct {
+			hasher *PasswordHasher
+			hash   string
+			want   bool
+		}{
+			{argon2id, argon2idHash, false},
+			{argon2id, bcryptHash, true},
+			{stronger, argon2idHash, true},
+			{bcryptHasher, bcryptHash, false},
+			{bcryptHasher, argon2idHash, true},
+			{&PasswordHasher{Algorithm: PasswordAlgorithmBcrypt, BcryptCost: 5}, bcryptHash, true},
+		}
+
+		for i, test := range tests {
+			if got := test.hasher.NeedsRehash(test.hash); got != test.want {
+				t.Errorf("%d: expected NeedsRehash to be %v, got %v", i, test.want, got)
+			}
+		}
+	})
+
+	t.Run("should reject invalid settings", func(t *testing.T) {
+		for _, cfg := range []configs.Config{
+			{PasswordHashAlgorithm: "md5"},
+			{PasswordHashAlgorithm: PasswordAlgorithmBcrypt, PasswordBcryptCost: 100},
+			{PasswordHashAlgorithm: PasswordAlgorithmArgon2id, PasswordArgon2Memory: 64 * 1024, PasswordArgon2Iterations: 3},
+		} {
+			if _, err := LoadPasswordHasher(cfg); err == nil {
+				t.Errorf("%+v: expected an error", cfg)
+			}
+		}
+	})
+}
@@ -0,0 +1,207 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/surfiniaburger/api-go/types"
+)
+
+// Permissions are named resource:action. A permission ending in :own only
+// covers the resources of the user, e.g. orders:read:own lets users read their
+// own orders while orders:read lets them read any order.
+const (
+	PermBooksRead        = "books:read"
+	PermBooksWrite       = "books:write"
+	PermReviewsWrite     = "reviews:write"
+	PermReviewsDelete    = "reviews:delete"
+	PermFavoritesWrite   = "favorites:write"
+	PermProductsWrite    = "products:write"
+	PermOrdersCreate     = "orders:create"
+	PermOrdersRead       = "orders:read"
+	PermUsersRead        = "users:read"
+	PermUsersManage      = "users:manage"
+	PermUsersImpersonate = "users:impersonate"
+
+	PermReviewsDeleteOwn = PermReviewsDelete + ownSuffix
+	PermOrdersReadOwn    = PermOrdersRead + ownSuffix
+	PermUsersReadOwn     = PermUsersRead + ownSuffix
+)
+
+const ownSuffix = ":own"
+
+// DefaultRoles are used until SetRoleStore is called and match the roles the
+// migrations create. Admins inherit every permission of users.
+var DefaultRoles = []types.Role{
+	{
+		Name: "user",
+		Permissions: []string{
+			PermBooksRead, PermReviewsWrite, PermReviewsDeleteOwn, PermFavoritesWrite,
+			PermOrdersCreate, PermOrdersReadOwn, PermUsersReadOwn,
+		},
+	},
+	{
+		Name:   "admin",
+		Parent: "user",
+		Permissions: []string{
+			PermBooksWrite, PermReviewsDelete, PermProductsWrite, PermOrdersRead,
+			PermUsersRead, PermUsersManage, PermUsersImpersonate,
+		},
+	},
+}
+
+// roleCacheTTL is how long role changes in the database take to apply.
+const roleCacheTTL = time.Minute
+
+// roles resolves the permissions of a role on every authenticated request.
+var roles = newRoleCache(staticRoleStore(DefaultRoles))
+
+// SetRoleStore replaces the store the roles and their permissions are read from.
+func SetRoleStore(store types.RoleStore) {
+	roles = newRoleCache(store)
+}
+
+type staticRoleStore []types.Role
+
+func (s staticRoleStore) GetRoles() ([]types.Role, error) {
+	return s, nil
+}
+
+// PermissionSet is the set of permissions of a user.
+type PermissionSet map[string]bool
+
+// Has reports whether the set grants the permission. A permission covering
+// every resource also grants its :own variant.
+func (ps PermissionSet) Has(permission string) bool {
+	if ps[permission] {
+		return true
+	}
+
+	base, own := strings.CutSuffix(permission, ownSuffix)
+	return own && ps[base]
+}
+
+type resolvedRole struct {
+	permissions PermissionSet
+	// ancestors are the role itself and every role it inherits from
+	ancestors map[string]bool
+}
+
+// roleCache holds the roles with their inherited permissions resolved. All
+// roles are reloaded at once when the cache expires, there are only a few.
+type roleCache struct {
+	store    types.RoleStore
+	mu       sync.Mutex
+	roles    map[string]*resolvedRole
+	loadedAt time.Time
+}
+
+func newRoleCache(store types.RoleStore) *roleCache {
+	return &roleCache{store: store}
+}
+
+// get returns the resolved role, nil if the role does not exist.
+func (c *roleCache) get(role string) (*resolvedRole, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.roles == nil || time.Since(c.loadedAt) > roleCacheTTL {
+		defined, err := c.store.GetRoles()
+		if err != nil {
+			return nil, err
+		}
+
+		resolved, err := resolveRoles(defined)
+		if err != nil {
+			return nil, err
+		}
+
+		c.roles = resolved
+		c.loadedAt = time.Now()
+	}
+
+	return c.roles[role], nil
+}
+
+func resolveRoles(defined []types.Role) (map[string]*resolvedRole, error) {
+	byName := make(map[string]types.Role, len(defined))
+	for _, r := range defined {
+		byName[r.Name] = r
+	}
+
+	resolved := make(map[string]*resolvedRole, len(defined))
+	for _, r := range defined {
+		rr := &resolvedRole{permissions: PermissionSet{}, ancestors: map[string]bool{}}
+
+		for name := r.Name; name != ""; name = byName[name].Parent {
+			if rr.ancestors[name] {
+				return nil, fmt.Errorf("role %s inherits from itself", r.Name)
+			}
+
+			current, ok := byName[name]
+			if !ok {
+				return nil, fmt.Errorf("role %s inherits from unknown role %s", r.Name, name)
+			}
+
+			rr.ancestors[name] = true
+			for _, p := range current.Permissions {
+				rr.permissions[p] = true
+			}
+		}
+
+		resolved[r.Name] = rr
+	}
+
+	return resolved, nil
+}
+
+// RoleExists reports whether the role is defined.
+func RoleExists(role string) (bool, error) {
+	r, err := roles.get(role)
+	if err != nil {
+		return false, err
+	}
+
+	return r != nil, nil
+}
+
+// RoleHasPermission reports whether the role grants the permission, directly
+// or through the roles it inherits from.
+func RoleHasPermission(role, permission string) (bool, error) {
+	r, err := roles.get(role)
+	if err != nil {
+		return false, err
+	}
+
+	return r != nil && r.permissions.Has(permission), nil
+}
+
+// GetPermissionsFromContext returns the permissions of the authenticated user.
+func GetPermissionsFromContext(ctx context.Context) PermissionSet {
+	permissions, ok := ctx.Value(PermissionsKey).(PermissionSet)
+	if !ok {
+		return PermissionSet{}
+	}
+
+	return permissions
+}
+
+// HasPermission reports whether the authenticated user has the permission.
+func HasPermission(ctx context.Context, permission string) bool {
+	return GetPermissionsFromContext(ctx).Has(permission)
+}
+
+// CanAccess reports whether the authenticated user may use the permission on
+// a resource owned by ownerID, either because the permission covers every
+// resource or because they own it and have the :own variant.
+func CanAccess(ctx context.Context, permission string, ownerID int) bool {
+	permissions := GetPermissionsFromContext(ctx)
+	if permissions.Has(permission) {
+		return true
+	}
+
+	return ownerID == GetUserIDFromContext(ctx) && permissions.Has(permission+ownSuffix)
+}
@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"context"
+	"testing"
+
+	"github.com/surfiniaburger/api-go/types"
+)
+
+func TestResolveRoles(t *testing.T) {
+	t.Run("should inherit the permissions of parent roles", func(t *testing.T) {
+		resolved, err := resolveRoles([]types.Role{
+			{Name: "user", Permissions: []string{"books:read"}},
+			{Name: "moderator", Parent: "user", Permissions: []string{"reviews:delete"}},
+			{Name: "admin", Parent: "moderator", Permissions: []string{"books:write"}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		admin := resolved["admin"]
+		for _, p := range []string{"books:read", "reviews:delete", "books:write"} {
+			if !admin.permissions.Has(p) {
+				t.Errorf("expected admin to have %s", p)
+			}
+		}
+
+		if !admin.ancestors["user"] || resolved["user"].permissions.Has("books:write") {
+			t.Error("expected permissions to only be inherited downwards")
+		}
+	})
+
+	t.Run("should reject cycles and unknown parents", func(t *testing.T) {
+		if _, err := resolveRoles([]types.Role{{Name: "a", Parent: "b"}, {Name: "b", Parent: "a"}}); err == nil {
+			t.Error("expected a cycle to be rejected")
+		}
+
+		if _, err := resolveRoles([]types.Role{{Name: "a", Parent: "unknown"}}); err == nil {
+			t.Error("expected an unknown parent to be rejected")
+		}
+	})
+}
+
+func TestCanAccess(t *testing.T) {
+	withPermissions := func(userID int, permissions ...string) context.Context {
+		ps := PermissionSet{}
+		for _, p := range permissions {
+			ps[p] = true
+		}
+
+		ctx := context.WithValue(context.Background(), UserKey, userID)
+		return context.WithValue(ctx, PermissionsKey, ps)
+	}
+
+	owner := withPermissions(1, PermOrdersReadOwn)
+	if !CanAccess(owner, PermOrdersRead, 1) || CanAccess(owner, PermOrdersRead, 2) {
+		t.Error("expected the :own permission to only cover the orders of the user")
+	}
+
+	admin := withPermissions(3, PermOrdersRead)
+	if !CanAccess(admin, PermOrdersRead, 1) || !HasPermission(admin, PermOrdersReadOwn) {
+		t.Error("expected the permission to cover every order")
+	}
+}
+
+func TestRestrict(t *testing.T) {
+	ps := PermissionSet{PermBooksRead: true, PermUsersManage: true, PermUsersImpersonate: true}
+
+	restricted := ps.restrict([]string{PermBooksRead, PermBooksWrite, PermUsersImpersonate})
+	if !restricted.Has(PermBooksRead) || len(restricted) != 1 {
+		t.Errorf("expected only %s, got %v", PermBooksRead, restricted)
+	}
+}
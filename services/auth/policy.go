@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/surfiniaburger/api-go/configs"
+)
+
+var ErrPasswordBreached = errors.New("password appears in a known data breach, choose another one")
+
+// PasswordPolicy decides which passwords users may choose. Breached holds the
+// SHA-1 hashes of passwords leaked in data breaches, which attackers try first.
+type PasswordPolicy struct {
+	MinLength int
+	Breached  map[[sha1.Size]byte]struct{}
+}
+
+// policy checks every new password. It is built from the configuration without
+// any breached password and replaced at startup with SetPasswordPolicy.
+var policy = &PasswordPolicy{MinLength: int(configs.Envs.PasswordMinLength)}
+
+// SetPasswordPolicy replaces the policy new passwords are checked against.
+func SetPasswordPolicy(p *PasswordPolicy) {
+	policy = p
+}
+
+// LoadPasswordPolicy builds the policy described by the configuration, reading
+// the breached passwords from PASSWORD_BREACHED_LIST_FILE if it is set.
+func LoadPasswordPolicy(cfg configs.Config) (*PasswordPolicy, error) {
+	p := &PasswordPolicy{MinLength: int(cfg.PasswordMinLength)}
+	if cfg.PasswordBreachedListFile == "" {
+		return p, nil
+	}
+
+	breached, err := readBreachedList(cfg.PasswordBreachedListFile)
+	if err != nil {
+		return nil, err
+	}
+	p.Breached = breached
+
+	return p, nil
+}
+
+// CheckPassword returns an error explaining why the password may not be used.
+func CheckPassword(password string) error {
+	return policy.Check(password)
+}
+
+// Check returns an error if the password is too short or was breached.
+func (p *PasswordPolicy) Check(password string) error {
+	if utf8.RuneCountInString(password) < p.MinLength {
+		return fmt.Errorf("password must be at least %d characters long", p.MinLength)
+	}
+
+	if _, ok := p.Breached[sha1.Sum([]byte(password))]; ok {
+		return ErrPasswordBreached
+	}
+
+	return nil
+}
+
+// readBreachedList reads a file of hex encoded SHA-1 hashes, one per line. The
+// lines may end with a ":count" like in the Have I Been Pwned downloads, so a
+// slice of those can be used as is.
+func readBreachedList(path string) (map[[sha1.Size]byte]struct{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	breached := make(map[[sha1.Size]byte]struct{})
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		hash, _, _ := strings.Cut(text, ":")
+
+		var sum [sha1.Size]byte
+		if len(hash) != hex.EncodedLen(sha1.Size) {
+			return nil, fmt.Errorf("%s:%d: invalid SHA-1 hash", path, line)
+		}
+		if _, err := hex.Decode(sum[:], []byte(hash)); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid SHA-1 hash", path, line)
+		}
+		breached[sum] = struct{}{}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return breached, nil
+}
@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/surfiniaburger/api-go/configs"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	// SHA-1 of "password1" and "qwertyuiop"
+	list := "# top passwords\nE38AD214943DAAD1D64C102FAEC29DE4AFE9DA3D:2413945\nb0399d2029f64d445bd131ffaa399a42d2f8e7dc\n"
+	if err := os.WriteFile(path, []byte(list), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := LoadPasswordPolicy(configs.Config{PasswordMinLength: 8, PasswordBreachedListFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := policy.Check("password1"); !errors.Is(err, ErrPasswordBreached) {
+		t.Errorf("expected a breached password, got %v", err)
+	}
+
+	if err := policy.Check("qwertyuiop"); !errors.Is(err, ErrPasswordBreached) {
+		t.Errorf("expected a breached password, got %v", err)
+	}
+
+	if err := policy.Check("pässwörd"); err != nil {
+		t.Errorf("expected the password to be allowed, got %v", err)
+	}
+
+	if err := policy.Check("short"); err == nil {
+		t.Error("expected a too short password to be refused")
+	}
+
+	if err := os.WriteFile(path, []byte("not a hash\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadPasswordPolicy(configs.Config{PasswordBreachedListFile: path}); err == nil {
+		t.Error("expected an invalid list to be refused")
+	}
+}
@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/surfiniaburger/api-go/configs"
+	"github.com/surfiniaburger/api-go/types"
+)
+
+// revocations is consulted by WithJWTAuth on every request. It defaults to an
+// in-memory store so tests and single instance setups work out of the box.
+var revocations types.TokenRevocationStore = NewMemoryRevocationStore()
+
+// SetRevocationStore replaces the store used to check for revoked tokens.
+func SetRevocationStore(store types.TokenRevocationStore) {
+	revocations = store
+}
+
+// RevokeToken revokes a single access token until it expires.
+func RevokeToken(token *TokenInfo) error {
+	return revocations.RevokeToken(token.ID, token.UserID, token.ExpiresAt)
+}
+
+// RevokeAllUserTokens revokes every access token issued to the user so far.
+// Tokens issued from now on, e.g. by a login right after a password reset, are
+// still accepted.
+func RevokeAllUserTokens(userID int) error {
+	// the precision of the iat claim and of the stored revocation time
+	now := time.Now().Truncate(time.Microsecond)
+	expiration := time.Second * time.Duration(configs.Envs.JWTExpirationInSeconds)
+
+	return revocations.RevokeUserTokens(userID, now, now.Add(expiration))
+}
+
+// PruneRevocations removes expired entries from the store every interval until
+// the context is cancelled.
+func PruneRevocations(ctx context.Context, store types.TokenRevocationStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := store.PruneExpired(now); err != nil {
+				log.Printf("failed to prune revoked tokens: %v", err)
+			}
+		}
+	}
+}
+
+type userRevocation struct {
+	issuedBefore time.Time
+	expiresAt    time.Time
+}
+
+// MemoryRevocationStore is an in-memory types.TokenRevocationStore. It is only
+// suitable for a single API instance as revocations are lost on restart.
+type MemoryRevocationStore struct {
+	mu     sync.RWMutex
+	tokens map[string]time.Time
+	users  map[int]userRevocation
+}
+
+func NewMemoryRevocationStore() *MemoryRevocationStore {
+	return &MemoryRevocationStore{
+		tokens: make(map[string]time.Time),
+		users:  make(map[int]userRevocation),
+	}
+}
+
+func (s *MemoryRevocationStore) RevokeToken(jti string, userID int, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tokens[jti] = expiresAt
+	return nil
+}
+
+func (s *MemoryRevocationStore) RevokeUserTokens(userID int, issuedBefore time.Time, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.users[userID] = userRevocation{issuedBefore: issuedBefore, expiresAt: expiresAt}
+	return nil
+}
+
+func (s *MemoryRevocationStore) IsTokenRevoked(jti string, userID int, issuedAt time.Time) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, ok := s.tokens[jti]; ok {
+		return true, nil
+	}
+
+	if u, ok := s.users[userID]; ok && issuedAt.Before(u.issuedBefore) {
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func (s *MemoryRevocationStore) PruneExpired(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for jti, expiresAt := range s.tokens {
+		if expiresAt.Before(now) {
+			delete(s.tokens, jti)
+		}
+	}
+
+	for userID, u := range s.users {
+		if u.expiresAt.Before(now) {
+			delete(s.users, userID)
+		}
+	}
+
+	return nil
+}
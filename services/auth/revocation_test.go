@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryRevocationStore(t *testing.T) {
+	store := NewMemoryRevocationStore()
+	now := time.Now()
+
+	if err := store.RevokeToken("revoked", 1, now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.RevokeUserTokens(2, now, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		jti      string
+		userID   int
+		issuedAt time.Time
+		revoked  bool
+	}{
+		{"revoked token", "revoked", 1, now, true},
+		{"other token", "other", 1, now, false},
+		{"token issued before user revocation", "old", 2, now.Add(-time.Second), true},
+		{"token issued after user revocation", "new", 2, now.Add(time.Second), false},
+		{"token issued right after user revocation", "new", 2, now.Add(time.Microsecond), false},
+		{"token issued right before user revocation", "old", 2, now.Add(-time.Microsecond), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			revoked, err := store.IsTokenRevoked(tt.jti, tt.userID, tt.issuedAt)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if revoked != tt.revoked {
+				t.Errorf("expected revoked to be %v, got %v", tt.revoked, revoked)
+			}
+		})
+	}
+
+	t.Run("should prune expired entries", func(t *testing.T) {
+		if err := store.PruneExpired(now.Add(2 * time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+
+		if revoked, _ := store.IsTokenRevoked("revoked", 1, now); revoked {
+			t.Error("expected expired token revocation to be pruned")
+		}
+
+		if revoked, _ := store.IsTokenRevoked("old", 2, now.Add(-time.Second)); !revoked {
+			t.Error("expected user revocation to be kept until it expires")
+		}
+	})
+}
@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/surfiniaburger/api-go/types"
+)
+
+// sessionTouchInterval limits how often the last activity of a session is
+// written.
+const sessionTouchInterval = time.Minute
+
+// sessions is consulted by WithJWTAuth for access tokens issued for a login
+// session. Sessions are not checked until SetSessionStore is called.
+var sessions types.SessionStore
+
+// SetSessionStore sets the store login sessions are looked up in.
+func SetSessionStore(store types.SessionStore) {
+	sessions = store
+}
+
+// checkSession rejects tokens whose session was revoked, e.g. because the
+// user signed out that device, and records the session as active.
+func checkSession(info *TokenInfo) error {
+	if sessions == nil || info.SessionID == "" {
+		return nil
+	}
+
+	s, err := sessions.GetSession(info.SessionID)
+	if err != nil {
+		return fmt.Errorf("failed to get session: %v", err)
+	}
+
+	if s.ID == "" || s.UserID != info.UserID {
+		return fmt.Errorf("session %s of user %d does not exist", info.SessionID, info.UserID)
+	}
+
+	if s.RevokedAt != nil {
+		return fmt.Errorf("session %s of user %d is revoked", s.ID, s.UserID)
+	}
+
+	now := time.Now()
+	if now.Sub(s.LastSeenAt) > sessionTouchInterval {
+		if err := sessions.TouchSession(s.ID, now); err != nil {
+			log.Printf("failed to record activity of session %s: %v", s.ID, err)
+		}
+	}
+
+	return nil
+}
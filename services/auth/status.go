@@ -0,0 +1,26 @@
+package auth
+
+import (
+	"errors"
+
+	"github.com/surfiniaburger/api-go/types"
+)
+
+var (
+	ErrUserSuspended = errors.New("account suspended")
+	ErrUserDeleted   = errors.New("account deleted")
+)
+
+// CheckUserStatus returns an error if the user may not log in or use tokens
+// issued before, because an admin suspended or deleted them.
+func CheckUserStatus(u *types.User) error {
+	if u.DeletedAt != nil {
+		return ErrUserDeleted
+	}
+
+	if u.Status == types.UserStatusSuspended {
+		return ErrUserSuspended
+	}
+
+	return nil
+}
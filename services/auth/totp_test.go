@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTP(t *testing.T) {
+	// RFC 6238 appendix B test vectors for SHA1, truncated to 6 digits
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+
+	for unix, expected := range vectors {
+		code, err := TOTPCode(secret, TOTPStep(time.Unix(unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if code != expected {
+			t.Errorf("expected code %s at %d, got %s", expected, unix, code)
+		}
+	}
+
+	now := time.Unix(1111111111, 0)
+
+	t.Run("should accept codes of adjacent periods", func(t *testing.T) {
+		for _, offset := range []time.Duration{-30 * time.Second, 0, 30 * time.Second} {
+			code, _ := TOTPCode(secret, TOTPStep(now.Add(offset)))
+
+			step, ok := ValidateTOTP(secret, code, now)
+			if !ok {
+				t.Errorf("expected code for offset %s to be valid", offset)
+			}
+
+			if step != TOTPStep(now.Add(offset)) {
+				t.Errorf("expected step %d, got %d", TOTPStep(now.Add(offset)), step)
+			}
+		}
+	})
+
+	t.Run("should reject old and malformed codes", func(t *testing.T) {
+		code, _ := TOTPCode(secret, TOTPStep(now.Add(-2*time.Minute)))
+		if _, ok := ValidateTOTP(secret, code, now); ok {
+			t.Error("expected old code to be rejected")
+		}
+
+		if _, ok := ValidateTOTP(secret, "12345", now); ok {
+			t.Error("expected short code to be rejected")
+		}
+	})
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri := TOTPURI("JBSWY3DPEHPK3PXP", "api-go", "me@me.com")
+
+	if !strings.HasPrefix(uri, "otpauth://totp/api-go:me@me.com?") {
+		t.Errorf("unexpected URI %s", uri)
+	}
+
+	if !strings.Contains(uri, "secret=JBSWY3DPEHPK3PXP") || !strings.Contains(uri, "issuer=api-go") {
+		t.Errorf("expected URI to contain the secret and issuer, got %s", uri)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := GenerateRecoveryCodes(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	for _, code := range codes {
+		if len(code) != 11 || seen[code] {
+			t.Errorf("unexpected recovery code %s", code)
+		}
+		seen[code] = true
+	}
+
+	if HashRecoveryCode(codes[0]) != HashRecoveryCode(" "+strings.ToUpper(strings.ReplaceAll(codes[0], "-", ""))) {
+		t.Error("expected recovery codes to be normalized before hashing")
+	}
+}
@@ -2,36 +2,55 @@
 package cart
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"time"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/gorilla/mux"
+	"github.com/surfiniaburger/api-go/configs"
 	"github.com/surfiniaburger/api-go/services/auth"
 	"github.com/surfiniaburger/api-go/types"
 	"github.com/surfiniaburger/api-go/utils"
 )
 
 type Handler struct {
-	store      types.ProductStore
-	orderStore types.OrderStore
-	userStore  types.UserStore
+	store            types.ProductStore
+	variantStore     types.VariantStore
+	checkoutStore    types.CheckoutStore
+	reservationStore types.ReservationStore
+	addressStore     types.AddressStore
+	userStore        types.UserGetter
+	notifier         types.Notifier
 }
 
 func NewHandler(
 	store types.ProductStore,
-	orderStore types.OrderStore,
-	userStore types.UserStore,
+	variantStore types.VariantStore,
+	checkoutStore types.CheckoutStore,
+	reservationStore types.ReservationStore,
+	addressStore types.AddressStore,
+	userStore types.UserGetter,
+	notifier types.Notifier,
 ) *Handler {
 	return &Handler{
-		store:      store,
-		orderStore: orderStore,
-		userStore:  userStore,
+		store:            store,
+		variantStore:     variantStore,
+		checkoutStore:    checkoutStore,
+		reservationStore: reservationStore,
+		addressStore:     addressStore,
+		userStore:        userStore,
+		notifier:         notifier,
 	}
 }
 
 func (h *Handler) RegisterRoutes(router *mux.Router) {
-	router.HandleFunc("/cart/checkout", auth.WithJWTAuth(h.handleCheckout, h.userStore, "user", "admin")).Methods(http.MethodPost)
+	router.HandleFunc("/cart/checkout", auth.WithVerifiedJWTAuth(auth.DenyImpersonation(h.handleCheckout), h.userStore, auth.PermOrdersCreate)).Methods(http.MethodPost)
+	router.HandleFunc("/cart/reservation", auth.WithVerifiedJWTAuth(h.handleGetReservation, h.userStore, auth.PermOrdersCreate)).Methods(http.MethodGet)
+	router.HandleFunc("/cart/reservation", auth.WithVerifiedJWTAuth(auth.DenyImpersonation(h.handleReserve), h.userStore, auth.PermOrdersCreate)).Methods(http.MethodPut)
+	router.HandleFunc("/cart/reservation", auth.WithVerifiedJWTAuth(auth.DenyImpersonation(h.handleReleaseReservation), h.userStore, auth.PermOrdersCreate)).Methods(http.MethodDelete)
 }
 
 func (h *Handler) handleCheckout(w http.ResponseWriter, r *http.Request) {
@@ -49,27 +68,167 @@ func (h *Handler) handleCheckout(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	productIds, err := getCartItemsIDs(cart.Items)
+	address, err := h.getShippingAddress(userID, cart.AddressID)
 	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if address == nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("address not found, add an address or choose one of yours"))
+		return
+	}
+
+	variantsMap, productsMap, ok := h.getCartItems(w, cart.Items)
+	if !ok {
+		return
+	}
+
+	orderID, totalPrice, err := h.createOrder(productsMap, variantsMap, cart.Items, userID, cartSession(r), *address)
+	if errors.Is(err, types.ErrInsufficientStock) {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("some products are not available in the quantity requested, please refresh your cart"))
+		return
+	}
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	h.notifyOrderPlaced(userID, orderID, totalPrice, *address)
+
+	utils.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"total_price": totalPrice,
+		"order_id":    orderID,
+	})
+}
+
+func (h *Handler) handleGetReservation(w http.ResponseWriter, r *http.Request) {
+	reservations, err := h.reservationStore.GetReservations(auth.GetUserIDFromContext(r.Context()), cartSession(r))
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, reservations)
+}
+
+// handleReserve holds the stock of the items for the cart of the session until
+// the reservation expires, replacing what the cart reserved before. The
+// checkout turns the reserved items it orders into the order.
+func (h *Handler) handleReserve(w http.ResponseWriter, r *http.Request) {
+	var payload types.ReservationPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
 		utils.WriteError(w, http.StatusBadRequest, err)
 		return
 	}
 
-	// get products
-	products, err := h.store.GetProductsByID(productIds)
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	if _, _, ok := h.getCartItems(w, payload.Items); !ok {
+		return
+	}
+
+	ttl := time.Second * time.Duration(configs.Envs.ReservationTTLInSeconds)
+	reservations, err := h.reservationStore.ReserveItems(auth.GetUserIDFromContext(r.Context()), cartSession(r), payload.Items, ttl)
+	if errors.Is(err, types.ErrInsufficientStock) {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("some products are not available in the quantity requested, please refresh your cart"))
+		return
+	}
 	if err != nil {
 		utils.WriteError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	orderID, totalPrice, err := h.createOrder(products, cart.Items, userID)
+	utils.WriteJSON(w, http.StatusOK, reservations)
+}
+
+func (h *Handler) handleReleaseReservation(w http.ResponseWriter, r *http.Request) {
+	if err := h.reservationStore.ReleaseReservations(auth.GetUserIDFromContext(r.Context()), cartSession(r)); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "reservation released"})
+}
+
+// cartSession is the login session the cart of the request belongs to, so the
+// devices of a user do not replace each other's reservations. It is empty for
+// tokens and API keys without a session.
+func cartSession(r *http.Request) string {
+	if token := auth.GetTokenFromContext(r.Context()); token != nil {
+		return token.SessionID
+	}
+
+	return ""
+}
+
+// getCartItems returns the variants of the items and their products, writing
+// the error response if one of them is not available.
+func (h *Handler) getCartItems(w http.ResponseWriter, items []types.CartCheckoutItem) (map[int]types.ProductVariant, map[int]types.Product, bool) {
+	variantIds, err := getCartItemsIDs(items)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return nil, nil, false
+	}
+
+	// get variants
+	variants, err := h.variantStore.GetVariantsByID(variantIds)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return nil, nil, false
+	}
+
+	// create a map of variants for easier access
+	variantsMap := make(map[int]types.ProductVariant)
+	productIds := make([]int, 0, len(variants))
+	for _, variant := range variants {
+		variantsMap[variant.ID] = variant
+		productIds = append(productIds, variant.ProductID)
+	}
+
+	// get the products of the variants, for their names and prices
+	products, err := h.store.GetProductsByID(productIds)
 	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return nil, nil, false
+	}
+
+	productsMap := make(map[int]types.Product)
+	for _, product := range products {
+		productsMap[product.ID] = product
+	}
+
+	// check if all variants are available, this is only a fast path as the
+	// stock may still change before the order is placed
+	if err := checkIfCartIsInStock(items, variantsMap, productsMap); err != nil {
 		utils.WriteError(w, http.StatusBadRequest, err)
+		return nil, nil, false
+	}
+
+	return variantsMap, productsMap, true
+}
+
+// notifyOrderPlaced confirms the order to the user unless they turned order
+// updates off. The order is placed either way, so failures are only logged.
+func (h *Handler) notifyOrderPlaced(userID, orderID int, total float64, address types.Address) {
+	u, err := h.userStore.GetUserByID(userID)
+	if err != nil {
+		log.Printf("failed to send the confirmation of order %d: %v", orderID, err)
 		return
 	}
 
-	utils.WriteJSON(w, http.StatusOK, map[string]interface{}{
-		"total_price": totalPrice,
-		"order_id":    orderID,
+	err = h.notifier.Notify(types.Notification{
+		Kind:    types.NotificationOrderUpdate,
+		UserID:  userID,
+		To:      u.Email,
+		Subject: fmt.Sprintf("Order #%d confirmed", orderID),
+		Body:    fmt.Sprintf("Thank you for your order of %.2f. It will be shipped to:\n\n%s", total, formatAddress(address)),
 	})
+	if err != nil {
+		log.Printf("failed to send the confirmation of order %d: %v", orderID, err)
+	}
 }
@@ -2,32 +2,53 @@ package cart
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"runtime"
+	"sort"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/surfiniaburger/api-go/services/auth"
+	"github.com/surfiniaburger/api-go/services/auth/authtest"
 	"github.com/surfiniaburger/api-go/types"
 )
 
 var mockProducts = []types.Product{
-	{ID: 1, Name: "product 1", Price: 10, Quantity: 100},
-	{ID: 2, Name: "product 2", Price: 20, Quantity: 200},
-	{ID: 3, Name: "product 3", Price: 30, Quantity: 300},
-	{ID: 4, Name: "empty stock", Price: 30, Quantity: 0},
-	{ID: 5, Name: "almost stock", Price: 30, Quantity: 1},
+	{ID: 1, Name: "product 1", Price: 10},
+	{ID: 2, Name: "product 2", Price: 20},
+	{ID: 3, Name: "product 3", Price: 30},
+	{ID: 4, Name: "empty stock", Price: 30},
+	{ID: 5, Name: "almost stock", Price: 30},
+}
+
+var xlPrice = 15.0
+
+// mockVariants has a variant per product, with the product ID followed by 1
+// as ID, and a second variant of product 1 with its own price.
+var mockVariants = []types.ProductVariant{
+	{ID: 11, ProductID: 1, SKU: "P1", Quantity: 100},
+	{ID: 12, ProductID: 1, SKU: "P1-XL", Options: map[string]string{"size": "XL"}, Price: &xlPrice, Quantity: 5},
+	{ID: 21, ProductID: 2, SKU: "P2", Quantity: 200},
+	{ID: 31, ProductID: 3, SKU: "P3", Quantity: 300},
+	{ID: 41, ProductID: 4, SKU: "P4", Quantity: 0},
+	{ID: 51, ProductID: 5, SKU: "P5", Quantity: 1},
 }
 
 func TestCartServiceHandler(t *testing.T) {
 	productStore := &mockProductStore{}
-	orderStore := &mockOrderStore{}
-	handler := NewHandler(productStore, orderStore, nil)
+	checkoutStore := newMockCheckoutStore(mockVariants)
+	handler := NewHandler(productStore, &mockVariantStore{}, checkoutStore, checkoutStore, newMockAddressStore(), &authtest.Users{}, &mockNotifier{})
 
 	t.Run("should fail to checkout if the cart items do not exist", func(t *testing.T) {
 		payload := types.CartCheckoutPayload{
 			Items: []types.CartCheckoutItem{
-				{ProductID: 99, Quantity: 100},
+				{ProductID: 99, VariantID: 991, Quantity: 100},
 			},
 		}
 
@@ -56,7 +77,7 @@ func TestCartServiceHandler(t *testing.T) {
 	t.Run("should fail to checkout if the cart has negative quantities", func(t *testing.T) {
 		payload := types.CartCheckoutPayload{
 			Items: []types.CartCheckoutItem{
-				{ProductID: 1, Quantity: 0}, // invalid quantity
+				{ProductID: 1, VariantID: 11, Quantity: 0}, // invalid quantity
 			},
 		}
 
@@ -85,7 +106,7 @@ func TestCartServiceHandler(t *testing.T) {
 	t.Run("should fail to checkout if there is no stock for an item", func(t *testing.T) {
 		payload := types.CartCheckoutPayload{
 			Items: []types.CartCheckoutItem{
-				{ProductID: 4, Quantity: 2},
+				{ProductID: 4, VariantID: 41, Quantity: 2},
 			},
 		}
 
@@ -114,7 +135,7 @@ func TestCartServiceHandler(t *testing.T) {
 	t.Run("should fail to checkout if there is not enough stock", func(t *testing.T) {
 		payload := types.CartCheckoutPayload{
 			Items: []types.CartCheckoutItem{
-				{ProductID: 5, Quantity: 2},
+				{ProductID: 5, VariantID: 51, Quantity: 2},
 			},
 		}
 
@@ -143,9 +164,9 @@ func TestCartServiceHandler(t *testing.T) {
 	t.Run("should checkout and calculate the price correctly", func(t *testing.T) {
 		payload := types.CartCheckoutPayload{
 			Items: []types.CartCheckoutItem{
-				{ProductID: 1, Quantity: 10},
-				{ProductID: 2, Quantity: 20},
-				{ProductID: 5, Quantity: 1},
+				{ProductID: 1, VariantID: 11, Quantity: 10},
+				{ProductID: 2, VariantID: 21, Quantity: 20},
+				{ProductID: 5, VariantID: 51, Quantity: 1},
 			},
 		}
 
@@ -179,6 +200,421 @@ func TestCartServiceHandler(t *testing.T) {
 			t.Errorf("expected total price to be 530, got %f", response["total_price"])
 		}
 	})
+
+	t.Run("should use the price of the variant if it has one", func(t *testing.T) {
+		payload := types.CartCheckoutPayload{
+			Items: []types.CartCheckoutItem{
+				{ProductID: 1, VariantID: 11, Quantity: 1},
+				{ProductID: 1, VariantID: 12, Quantity: 2},
+			},
+		}
+
+		marshalled, err := json.Marshal(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest(http.MethodPost, "/cart/checkout", bytes.NewBuffer(marshalled))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		router := mux.NewRouter()
+
+		router.HandleFunc("/cart/checkout", handler.handleCheckout).Methods(http.MethodPost)
+
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body)
+		}
+
+		var response map[string]interface{}
+		if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+
+		if response["total_price"] != 40.0 {
+			t.Errorf("expected total price to be 40, got %f", response["total_price"])
+		}
+
+		if checkoutStore.stock[11] != 89 || checkoutStore.stock[12] != 3 {
+			t.Errorf("expected the stock of both variants to be decremented, got %v", checkoutStore.stock)
+		}
+
+		items := checkoutStore.items[len(checkoutStore.items)-2:]
+		if items[0].VariantID != 11 || items[0].Price != 10 || items[1].VariantID != 12 || items[1].Price != 15 {
+			t.Errorf("unexpected order items %+v", items)
+		}
+	})
+
+	t.Run("should fail to checkout without a variant or with the variant of another product", func(t *testing.T) {
+		for _, item := range []types.CartCheckoutItem{
+			{ProductID: 1, Quantity: 1},
+			{ProductID: 2, VariantID: 11, Quantity: 1},
+		} {
+			marshalled, err := json.Marshal(types.CartCheckoutPayload{Items: []types.CartCheckoutItem{item}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req, err := http.NewRequest(http.MethodPost, "/cart/checkout", bytes.NewBuffer(marshalled))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			router := mux.NewRouter()
+
+			router.HandleFunc("/cart/checkout", handler.handleCheckout).Methods(http.MethodPost)
+
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusBadRequest {
+				t.Errorf("%+v: expected status code %d, got %d", item, http.StatusBadRequest, rr.Code)
+			}
+		}
+	})
+}
+
+// TestCartCheckoutConcurrency runs checkouts in parallel for more units than
+// are left. The mock only locks the row of the variant while a transaction
+// checks and decrements it, like the conditional update of the store, so no
+// more than the stock left can be sold.
+func TestCartCheckoutConcurrency(t *testing.T) {
+	// the product store reports plenty of stock, but only 10 units are really
+	// left, as if other checkouts took them after the products were read
+	productStore := &mockProductStore{}
+	checkoutStore := newMockCheckoutStore([]types.ProductVariant{{ID: 11, ProductID: 1, Quantity: 10}})
+	handler := NewHandler(productStore, &mockVariantStore{}, checkoutStore, checkoutStore, newMockAddressStore(), &authtest.Users{}, &mockNotifier{})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/cart/checkout", handler.handleCheckout).Methods(http.MethodPost)
+
+	payload := types.CartCheckoutPayload{
+		Items: []types.CartCheckoutItem{
+			{ProductID: 1, VariantID: 11, Quantity: 1},
+		},
+	}
+
+	marshalled, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const checkouts = 50
+
+	var wg sync.WaitGroup
+	codes := make(chan int, checkouts)
+	for i := 0; i < checkouts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			req := httptest.NewRequest(http.MethodPost, "/cart/checkout", bytes.NewBuffer(marshalled))
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			codes <- rr.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	succeeded := 0
+	for code := range codes {
+		switch code {
+		case http.StatusOK:
+			succeeded++
+		case http.StatusBadRequest:
+		default:
+			t.Errorf("unexpected status code %d", code)
+		}
+	}
+
+	if succeeded != 10 {
+		t.Errorf("expected 10 successful checkouts, got %d", succeeded)
+	}
+
+	if stock := checkoutStore.stock[11]; stock != 0 {
+		t.Errorf("expected stock to be 0, got %d", stock)
+	}
+
+	if len(checkoutStore.orders) != 10 {
+		t.Errorf("expected 10 orders, got %d", len(checkoutStore.orders))
+	}
+}
+
+func TestCartCheckoutRollback(t *testing.T) {
+	productStore := &mockProductStore{}
+	checkoutStore := newMockCheckoutStore(mockVariants)
+	checkoutStore.failOrderItems = true
+	handler := NewHandler(productStore, &mockVariantStore{}, checkoutStore, checkoutStore, newMockAddressStore(), &authtest.Users{}, &mockNotifier{})
+
+	payload := types.CartCheckoutPayload{
+		Items: []types.CartCheckoutItem{
+			{ProductID: 1, VariantID: 11, Quantity: 10},
+			{ProductID: 2, VariantID: 21, Quantity: 20},
+		},
+	}
+
+	marshalled, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "/cart/checkout", bytes.NewBuffer(marshalled))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	router := mux.NewRouter()
+
+	router.HandleFunc("/cart/checkout", handler.handleCheckout).Methods(http.MethodPost)
+
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("expected status code %d, got %d", http.StatusInternalServerError, rr.Code)
+	}
+
+	if checkoutStore.stock[11] != 100 || checkoutStore.stock[21] != 200 {
+		t.Errorf("expected stock to be rolled back, got %v", checkoutStore.stock)
+	}
+
+	if len(checkoutStore.orders) != 0 || len(checkoutStore.items) != 0 {
+		t.Errorf("expected no orders, got %d orders and %d items", len(checkoutStore.orders), len(checkoutStore.items))
+	}
+}
+
+func TestCartCheckoutAddress(t *testing.T) {
+	productStore := &mockProductStore{}
+	checkoutStore := newMockCheckoutStore(mockVariants)
+	addressStore := newMockAddressStore()
+	notifier := &mockNotifier{}
+	handler := NewHandler(productStore, &mockVariantStore{}, checkoutStore, checkoutStore, addressStore, &authtest.Users{}, notifier)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/cart/checkout", handler.handleCheckout).Methods(http.MethodPost)
+
+	checkout := func(addressID int) *httptest.ResponseRecorder {
+		payload := types.CartCheckoutPayload{
+			Items:     []types.CartCheckoutItem{{ProductID: 1, VariantID: 11, Quantity: 1}},
+			AddressID: addressID,
+		}
+
+		marshalled, err := json.Marshal(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest(http.MethodPost, "/cart/checkout", bytes.NewBuffer(marshalled))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("should ship to the default shipping address", func(t *testing.T) {
+		rr := checkout(0)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		order := checkoutStore.orders[len(checkoutStore.orders)-1]
+		if order.Address != "1 Main Street\nSpringfield, IL 62701\nUS" {
+			t.Errorf("unexpected order address %q", order.Address)
+		}
+
+		if len(notifier.sent) != 1 || notifier.sent[0].Kind != types.NotificationOrderUpdate || notifier.sent[0].To != "me@me.com" {
+			t.Errorf("expected an order confirmation to me@me.com, got %+v", notifier.sent)
+		}
+	})
+
+	t.Run("should ship to the chosen address", func(t *testing.T) {
+		rr := checkout(2)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		order := checkoutStore.orders[len(checkoutStore.orders)-1]
+		if order.Address != "10 Rue de Rivoli\nApartment 3\nParis 75001\nFR" {
+			t.Errorf("unexpected order address %q", order.Address)
+		}
+	})
+
+	t.Run("should fail if the address is not the user's", func(t *testing.T) {
+		rr := checkout(3)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+
+	t.Run("should fail if the user has no default shipping address", func(t *testing.T) {
+		addressStore.addresses[1].IsDefaultShipping = false
+
+		rr := checkout(0)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+}
+
+func TestCartReservation(t *testing.T) {
+	productStore := &mockProductStore{}
+	checkoutStore := newMockCheckoutStore(mockVariants)
+	// another user holds 3 of the 5 XL variants
+	checkoutStore.reserved[cart{userID: 7}] = map[int]int{12: 3}
+	handler := NewHandler(productStore, &mockVariantStore{}, checkoutStore, checkoutStore, newMockAddressStore(), &authtest.Users{}, &mockNotifier{})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/cart/reservation", handler.handleGetReservation).Methods(http.MethodGet)
+	router.HandleFunc("/cart/reservation", handler.handleReserve).Methods(http.MethodPut)
+	router.HandleFunc("/cart/reservation", handler.handleReleaseReservation).Methods(http.MethodDelete)
+	router.HandleFunc("/cart/checkout", handler.handleCheckout).Methods(http.MethodPost)
+
+	// sendFrom sends the items from a login session of the user
+	sendFrom := func(session, method, path string, items ...types.CartCheckoutItem) *httptest.ResponseRecorder {
+		marshalled, err := json.Marshal(types.CartCheckoutPayload{Items: items})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest(method, path, bytes.NewBuffer(marshalled))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if session != "" {
+			req = req.WithContext(context.WithValue(req.Context(), auth.TokenKey, &auth.TokenInfo{SessionID: session}))
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	send := func(method, path string, quantity int) *httptest.ResponseRecorder {
+		return sendFrom("", method, path, types.CartCheckoutItem{ProductID: 1, VariantID: 12, Quantity: quantity})
+	}
+
+	t.Run("should fail to reserve more than the available stock", func(t *testing.T) {
+		rr := send(http.MethodPut, "/cart/reservation", 3)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+
+	t.Run("should reserve the available stock", func(t *testing.T) {
+		rr := send(http.MethodPut, "/cart/reservation", 2)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		var reservations []types.Reservation
+		if err := json.NewDecoder(rr.Body).Decode(&reservations); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(reservations) != 1 || reservations[0].VariantID != 12 || reservations[0].Quantity != 2 {
+			t.Errorf("unexpected reservations %+v", reservations)
+		}
+	})
+
+	t.Run("should replace the previous reservation", func(t *testing.T) {
+		rr := send(http.MethodPut, "/cart/reservation", 1)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		rr = send(http.MethodPut, "/cart/reservation", 2)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if quantity := checkoutStore.reserved[cart{userID: -1}][12]; quantity != 2 {
+			t.Errorf("expected 2 reserved, got %d", quantity)
+		}
+	})
+
+	t.Run("should turn the reservation into the order", func(t *testing.T) {
+		rr := send(http.MethodPost, "/cart/checkout", 2)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if stock := checkoutStore.stock[12]; stock != 3 {
+			t.Errorf("expected stock to be 3, got %d", stock)
+		}
+
+		if _, ok := checkoutStore.reserved[cart{userID: -1}]; ok {
+			t.Errorf("expected the reservation to be released, got %v", checkoutStore.reserved[cart{userID: -1}])
+		}
+	})
+
+	t.Run("should not sell the stock reserved by another user", func(t *testing.T) {
+		rr := send(http.MethodPost, "/cart/checkout", 1)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+
+	t.Run("should release the reservation", func(t *testing.T) {
+		delete(checkoutStore.reserved, cart{userID: 7})
+		if rr := send(http.MethodPut, "/cart/reservation", 1); rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		rr := send(http.MethodDelete, "/cart/reservation", 0)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if _, ok := checkoutStore.reserved[cart{userID: -1}]; ok {
+			t.Errorf("expected the reservation to be released, got %v", checkoutStore.reserved[cart{userID: -1}])
+		}
+	})
+
+	t.Run("should keep the reserved items left out of the order", func(t *testing.T) {
+		rr := sendFrom("", http.MethodPut, "/cart/reservation",
+			types.CartCheckoutItem{ProductID: 1, VariantID: 12, Quantity: 2},
+			types.CartCheckoutItem{ProductID: 1, VariantID: 11, Quantity: 5},
+		)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		rr = sendFrom("", http.MethodPost, "/cart/checkout", types.CartCheckoutItem{ProductID: 1, VariantID: 12, Quantity: 1})
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if reserved := checkoutStore.reserved[cart{userID: -1}]; reserved[12] != 1 || reserved[11] != 5 {
+			t.Errorf("expected 1 XL and 5 of the other variant to stay reserved, got %v", reserved)
+		}
+	})
+
+	t.Run("should hold a reservation per session", func(t *testing.T) {
+		// 2 XL are left, 1 of them reserved by the session without a name
+		if rr := sendFrom("phone", http.MethodPut, "/cart/reservation", types.CartCheckoutItem{ProductID: 1, VariantID: 12, Quantity: 1}); rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if reserved := checkoutStore.reserved[cart{userID: -1}]; reserved[12] != 1 {
+			t.Errorf("expected the reservation of the other session to be kept, got %v", reserved)
+		}
+
+		if rr := sendFrom("laptop", http.MethodPost, "/cart/checkout", types.CartCheckoutItem{ProductID: 1, VariantID: 12, Quantity: 1}); rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+
+		if rr := sendFrom("phone", http.MethodPost, "/cart/checkout", types.CartCheckoutItem{ProductID: 1, VariantID: 12, Quantity: 1}); rr.Code != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+	})
 }
 
 type mockProductStore struct{}
@@ -187,8 +623,8 @@ func (m *mockProductStore) GetProductByID(productID int) (*types.Product, error)
 	return &types.Product{}, nil
 }
 
-func (m *mockProductStore) GetProducts() ([]*types.Product, error) {
-	return []*types.Product{}, nil
+func (m *mockProductStore) GetProducts(filter types.ProductFilter) (*types.ProductPage, error) {
+	return &types.ProductPage{Products: []types.Product{}}, nil
 }
 
 func (m *mockProductStore) CreateProduct(product types.CreateProductPayload) error {
@@ -199,16 +635,382 @@ func (m *mockProductStore) GetProductsByID(ids []int) ([]types.Product, error) {
 	return mockProducts, nil
 }
 
-func (m *mockProductStore) UpdateProduct(product types.Product) error {
+func (m *mockProductStore) UpdateProduct(product types.Product) (bool, error) {
+	return true, nil
+}
+
+func (m *mockProductStore) DeleteProduct(id, version int) (bool, error) {
+	return true, nil
+}
+
+type mockVariantStore struct{}
+
+func (m *mockVariantStore) GetVariants(productID int) ([]types.ProductVariant, error) {
+	return []types.ProductVariant{}, nil
+}
+
+func (m *mockVariantStore) GetVariantsByID(ids []int) ([]types.ProductVariant, error) {
+	return mockVariants, nil
+}
+
+func (m *mockVariantStore) GetVariant(productID, id int) (*types.ProductVariant, error) {
+	return &types.ProductVariant{}, nil
+}
+
+func (m *mockVariantStore) CreateVariant(variant types.ProductVariant) (int, error) {
+	return 0, nil
+}
+
+func (m *mockVariantStore) UpdateVariant(variant types.ProductVariant) error {
+	return nil
+}
+
+func (m *mockVariantStore) DeleteVariant(productID, id int) error {
+	return nil
+}
+
+// mockCheckoutStore locks the rows a transaction touches until it ends, like
+// the database does, rather than running transactions one at a time, so
+// concurrent checkouts race for the stock left. Stock is decremented right
+// away and restored if the transaction fails, orders and released
+// reservations are only saved if it succeeds. It also holds the reservations,
+// by cart and then by variant.
+type mockCheckoutStore struct {
+	// mu guards the fields below for a single read or write, it is never held
+	// while waiting for a row
+	mu             sync.Mutex
+	rows           map[any]*sync.Mutex
+	stock          map[int]int
+	reserved       map[cart]map[int]int
+	orders         []types.Order
+	items          []types.OrderItem
+	lastOrderID    int
+	failOrderItems bool
+}
+
+func newMockCheckoutStore(variants []types.ProductVariant) *mockCheckoutStore {
+	stock := make(map[int]int)
+	for _, v := range variants {
+		stock[v.ID] = v.Quantity
+	}
+
+	return &mockCheckoutStore{rows: make(map[any]*sync.Mutex), stock: stock, reserved: make(map[cart]map[int]int)}
+}
+
+// cart is the session of a user reservations are held for.
+type cart struct {
+	userID    int
+	sessionID string
+}
+
+// row returns the lock of the row with the key, a variant ID or the cart of
+// the reservations.
+func (m *mockCheckoutStore) row(key any) *sync.Mutex {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	row, ok := m.rows[key]
+	if !ok {
+		row = new(sync.Mutex)
+		m.rows[key] = row
+	}
+
+	return row
+}
+
+func (m *mockCheckoutStore) RunInTx(fn func(products types.ProductTxStore, orders types.OrderStore) error) error {
+	tx := &mockTx{
+		store:          m,
+		locked:         make(map[any]bool),
+		decremented:    make(map[int]int),
+		released:       make(map[cart]map[int]int),
+		failOrderItems: m.failOrderItems,
+	}
+
+	err := fn(tx, tx)
+	tx.end(err == nil)
+	return err
+}
+
+func (m *mockCheckoutStore) ReserveItems(userID int, sessionID string, items []types.CartCheckoutItem, ttl time.Duration) ([]types.Reservation, error) {
+	// lock the cart and then the variants in order, like the checkout does
+	variantIDs := make([]int, 0, len(items))
+	for _, item := range items {
+		variantIDs = append(variantIDs, item.VariantID)
+	}
+	sort.Ints(variantIDs)
+
+	keys := []any{cart{userID, sessionID}}
+	for _, id := range variantIDs {
+		keys = append(keys, id)
+	}
+	for _, key := range keys {
+		row := m.row(key)
+		row.Lock()
+		defer row.Unlock()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.reserved, cart{userID, sessionID})
+
+	reserved := make(map[int]int)
+	reservations := []types.Reservation{}
+	for _, item := range items {
+		if availableStock(m.stock, m.reserved, item.VariantID) < item.Quantity {
+			return nil, fmt.Errorf("variant %d: %w", item.VariantID, types.ErrInsufficientStock)
+		}
+
+		reserved[item.VariantID] = item.Quantity
+		reservations = append(reservations, types.Reservation{
+			UserID:    userID,
+			SessionID: sessionID,
+			ProductID: item.ProductID,
+			VariantID: item.VariantID,
+			Quantity:  item.Quantity,
+			ExpiresAt: time.Now().Add(ttl),
+		})
+	}
+
+	m.reserved[cart{userID, sessionID}] = reserved
+	return reservations, nil
+}
+
+func (m *mockCheckoutStore) GetReservations(userID int, sessionID string) ([]types.Reservation, error) {
+	return []types.Reservation{}, nil
+}
+
+func (m *mockCheckoutStore) ReleaseReservations(userID int, sessionID string) error {
+	row := m.row(cart{userID, sessionID})
+	row.Lock()
+	defer row.Unlock()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.reserved, cart{userID, sessionID})
+	return nil
+}
+
+func (m *mockCheckoutStore) PruneReservations() error {
+	return nil
+}
+
+// availableStock returns the stock of the variant that no cart reserved.
+func availableStock(stock map[int]int, reserved map[cart]map[int]int, variantID int) int {
+	available := stock[variantID]
+	for _, variants := range reserved {
+		available -= variants[variantID]
+	}
+
+	return available
+}
+
+type mockTx struct {
+	store *mockCheckoutStore
+	// locked are the rows held until the transaction ends
+	locked map[any]bool
+	// decremented is restored to the stock if the transaction fails
+	decremented map[int]int
+	// released is taken off the reservations if the transaction succeeds
+	released       map[cart]map[int]int
+	orders         []types.Order
+	items          []types.OrderItem
+	failOrderItems bool
+}
+
+// lock waits for the row with the key unless the transaction holds it.
+func (m *mockTx) lock(key any) {
+	if m.locked[key] {
+		return
+	}
+
+	m.store.row(key).Lock()
+	m.locked[key] = true
+}
+
+// end saves the changes of the transaction or undoes them, then lets the
+// rows go.
+func (m *mockTx) end(commit bool) {
+	m.store.mu.Lock()
+	if commit {
+		for c, variants := range m.released {
+			reserved, ok := m.store.reserved[c]
+			if !ok {
+				continue
+			}
+
+			for id, quantity := range variants {
+				reserved[id] -= quantity
+				if reserved[id] == 0 {
+					delete(reserved, id)
+				}
+			}
+
+			if len(reserved) == 0 {
+				delete(m.store.reserved, c)
+			}
+		}
+
+		m.store.orders = append(m.store.orders, m.orders...)
+		m.store.items = append(m.store.items, m.items...)
+	} else {
+		for id, quantity := range m.decremented {
+			m.store.stock[id] += quantity
+		}
+	}
+	m.store.mu.Unlock()
+
+	for key := range m.locked {
+		m.store.row(key).Unlock()
+	}
+}
+
+func (m *mockTx) DecrementStock(variantID int, quantity int) error {
+	m.lock(variantID)
+
+	// the row lock, not mu, keeps other transactions from changing the stock
+	// between the check and the decrement
+	m.store.mu.Lock()
+	available := availableStock(m.store.stock, m.store.reserved, variantID)
+	m.store.mu.Unlock()
+
+	for _, variants := range m.released {
+		available += variants[variantID]
+	}
+
+	// let the other checkouts run, they would read the same stock if the row
+	// were not locked
+	runtime.Gosched()
+
+	if available < quantity {
+		return fmt.Errorf("variant %d: %w", variantID, types.ErrInsufficientStock)
+	}
+
+	m.store.mu.Lock()
+	m.store.stock[variantID] -= quantity
+	m.store.mu.Unlock()
+
+	m.decremented[variantID] += quantity
+	return nil
+}
+
+func (m *mockTx) ReleaseReservedItems(userID int, sessionID string, items []types.CartCheckoutItem) error {
+	c := cart{userID, sessionID}
+
+	// like the database, only a cart with reservations has rows to lock
+	m.store.mu.Lock()
+	_, ok := m.store.reserved[c]
+	m.store.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	m.lock(c)
+
+	m.store.mu.Lock()
+	reserved := make(map[int]int)
+	for id, quantity := range m.store.reserved[c] {
+		reserved[id] = quantity
+	}
+	m.store.mu.Unlock()
+
+	if m.released[c] == nil {
+		m.released[c] = make(map[int]int)
+	}
+
+	for _, item := range items {
+		left := reserved[item.VariantID] - m.released[c][item.VariantID]
+		m.released[c][item.VariantID] += min(left, item.Quantity)
+	}
+
 	return nil
 }
 
-type mockOrderStore struct{}
+func (m *mockTx) CreateOrder(order types.Order) (int, error) {
+	m.orders = append(m.orders, order)
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	// like auto increments, IDs of rolled back orders are not reused
+	m.store.lastOrderID++
+	return m.store.lastOrderID, nil
+}
 
-func (m *mockOrderStore) CreateOrder(order types.Order) (int, error) {
+func (m *mockTx) CreateOrderItem(orderItem types.OrderItem) error {
+	if m.failOrderItems {
+		return fmt.Errorf("failed to create order item")
+	}
+
+	m.items = append(m.items, orderItem)
+	return nil
+}
+
+func (m *mockTx) GetOrderByID(id int) (*types.Order, error) {
+	return nil, fmt.Errorf("order not found")
+}
+
+func (m *mockTx) GetOrderItems(orderID int) ([]types.OrderItem, error) {
+	return nil, nil
+}
+
+// mockAddressStore holds the addresses of user -1, the user of requests
+// without a token, and one address of another user.
+type mockAddressStore struct {
+	addresses map[int]*types.Address
+}
+
+func newMockAddressStore() *mockAddressStore {
+	return &mockAddressStore{addresses: map[int]*types.Address{
+		1: {ID: 1, UserID: -1, Line1: "1 Main Street", City: "Springfield", Region: "IL", PostalCode: "62701", Country: "US", IsDefaultShipping: true},
+		2: {ID: 2, UserID: -1, Line1: "10 Rue de Rivoli", Line2: "Apartment 3", City: "Paris", PostalCode: "75001", Country: "FR"},
+		3: {ID: 3, UserID: 7, Line1: "2 High Street", City: "London", PostalCode: "SW1A 1AA", Country: "GB", IsDefaultShipping: true},
+	}}
+}
+
+func (m *mockAddressStore) CreateAddress(address types.Address) (int, error) {
 	return 0, nil
 }
 
-func (m *mockOrderStore) CreateOrderItem(orderItem types.OrderItem) error {
+func (m *mockAddressStore) GetAddress(userID, id int) (*types.Address, error) {
+	address, ok := m.addresses[id]
+	if !ok || address.UserID != userID {
+		return &types.Address{}, nil
+	}
+
+	return address, nil
+}
+
+func (m *mockAddressStore) GetUserAddresses(userID int) ([]types.Address, error) {
+	addresses := []types.Address{}
+	for id := 1; id <= len(m.addresses); id++ {
+		if m.addresses[id].UserID == userID {
+			addresses = append(addresses, *m.addresses[id])
+		}
+	}
+
+	return addresses, nil
+}
+
+func (m *mockAddressStore) UpdateAddress(address types.Address) error {
+	return nil
+}
+
+func (m *mockAddressStore) DeleteAddress(userID, id int) (bool, error) {
+	return false, nil
+}
+
+type mockNotifier struct {
+	mu   sync.Mutex
+	sent []types.Notification
+}
+
+func (m *mockNotifier) Notify(notification types.Notification) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sent = append(m.sent, notification)
 	return nil
 }
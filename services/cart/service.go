@@ -3,94 +3,180 @@ package cart
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/surfiniaburger/api-go/types"
 )
 
+// getCartItemsIDs returns the IDs of the variants in the cart.
 func getCartItemsIDs(items []types.CartCheckoutItem) ([]int, error) {
-	productIds := make([]int, len(items))
+	variantIds := make([]int, len(items))
 	for i, item := range items {
+		if item.VariantID <= 0 {
+			return nil, fmt.Errorf("missing variant for product %d", item.ProductID)
+		}
+
 		if item.Quantity <= 0 {
 			return nil, fmt.Errorf("invalid quantity for product %d", item.ProductID)
 		}
 
-		productIds[i] = item.ProductID
+		variantIds[i] = item.VariantID
 	}
 
-	return productIds, nil
+	return variantIds, nil
 }
 
-func checkIfCartIsInStock(cartItems []types.CartCheckoutItem, products map[int]types.Product) error {
+func checkIfCartIsInStock(cartItems []types.CartCheckoutItem, variants map[int]types.ProductVariant, products map[int]types.Product) error {
 	if len(cartItems) == 0 {
 		return fmt.Errorf("cart is empty")
 	}
 
 	for _, item := range cartItems {
-		product, ok := products[item.ProductID]
+		variant, ok := variants[item.VariantID]
+		if !ok || variant.ProductID != item.ProductID {
+			return fmt.Errorf("variant %d of product %d is not available in the store, please refresh your cart", item.VariantID, item.ProductID)
+		}
+
+		product, ok := products[variant.ProductID]
 		if !ok {
 			return fmt.Errorf("product %d is not available in the store, please refresh your cart", item.ProductID)
 		}
 
-		if product.Quantity < item.Quantity {
-			return fmt.Errorf("product %s is not available in the quantity requested", product.Name)
+		if variant.Quantity < item.Quantity {
+			return fmt.Errorf("product %s (%s) is not available in the quantity requested", product.Name, variant.SKU)
 		}
 	}
 
 	return nil
 }
 
-func calculateTotalPrice(cartItems []types.CartCheckoutItem, products map[int]types.Product) float64 {
-	var total float64
+// variantPrice is the price of the variant, the price of its product unless
+// the variant overrides it.
+func variantPrice(product types.Product, variant types.ProductVariant) float64 {
+	if variant.Price != nil {
+		return *variant.Price
+	}
 
-	for _, item := range cartItems {
-		product := products[item.ProductID]
-		total += product.Price * float64(item.Quantity)
+	return product.Price
+}
+
+// getShippingAddress returns the address of the user to ship the order to, the
+// default shipping address if addressID is 0. It returns nil if there is none.
+func (h *Handler) getShippingAddress(userID, addressID int) (*types.Address, error) {
+	if addressID != 0 {
+		address, err := h.addressStore.GetAddress(userID, addressID)
+		if err != nil || address.ID == 0 {
+			return nil, err
+		}
+
+		return address, nil
 	}
 
-	return total
+	addresses, err := h.addressStore.GetUserAddresses(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, address := range addresses {
+		if address.IsDefaultShipping {
+			return &address, nil
+		}
+	}
+
+	return nil, nil
 }
 
-func (h *Handler) createOrder(products []types.Product, cartItems []types.CartCheckoutItem, userID int) (int, float64, error) {
-	// create a map of products for easier access
-	productsMap := make(map[int]types.Product)
-	for _, product := range products {
-		productsMap[product.ID] = product
+// formatAddress is the copy of the address kept with the order, one line per
+// part as it would be written on a parcel.
+func formatAddress(address types.Address) string {
+	lines := []string{address.Line1}
+	if address.Line2 != "" {
+		lines = append(lines, address.Line2)
 	}
 
-	// check if all products are available
-	if err := checkIfCartIsInStock(cartItems, productsMap); err != nil {
-		return 0, 0, err
+	city := address.City
+	if address.Region != "" {
+		city += ", " + address.Region
 	}
+	lines = append(lines, city+" "+address.PostalCode, address.Country)
 
-	// calculate total price
-	totalPrice := calculateTotalPrice(cartItems, productsMap)
+	return strings.Join(lines, "\n")
+}
+
+func calculateTotalPrice(cartItems []types.CartCheckoutItem, variants map[int]types.ProductVariant, products map[int]types.Product) float64 {
+	var total float64
 
-	// reduce the quantity of products in the store
 	for _, item := range cartItems {
-		product := productsMap[item.ProductID]
-		product.Quantity -= item.Quantity
-		h.store.UpdateProduct(product)
+		variant := variants[item.VariantID]
+		total += variantPrice(products[variant.ProductID], variant) * float64(item.Quantity)
 	}
 
-	// create order record
-	orderID, err := h.orderStore.CreateOrder(types.Order{
-		UserID:  userID,
-		Total:   totalPrice,
-		Status:  "pending",
-		Address: "some address", // could fetch address from a user addresses table
+	return total
+}
+
+// createOrder decrements the stock and records the order and its items in a
+// single transaction, so a failure at any step leaves the stock untouched. The
+// items ordered are taken off the reservations of the cart of the session in
+// the same transaction, which turns the stock they held into the decrements of
+// the order. Reserved items left out of the order stay held.
+func (h *Handler) createOrder(productsMap map[int]types.Product, variantsMap map[int]types.ProductVariant, cartItems []types.CartCheckoutItem, userID int, sessionID string, address types.Address) (int, float64, error) {
+	// calculate total price
+	totalPrice := calculateTotalPrice(cartItems, variantsMap, productsMap)
+
+	// lock the variant rows in a consistent order to avoid deadlocks between
+	// concurrent checkouts of the same variants
+	sortedItems := make([]types.CartCheckoutItem, len(cartItems))
+	copy(sortedItems, cartItems)
+	sort.Slice(sortedItems, func(i, j int) bool {
+		return sortedItems[i].VariantID < sortedItems[j].VariantID
 	})
-	if err != nil {
-		return 0, 0, err
-	}
 
-	// create order the items records
-	for _, item := range cartItems {
-		h.orderStore.CreateOrderItem(types.OrderItem{
-			OrderID:   orderID,
-			ProductID: item.ProductID,
-			Quantity:  item.Quantity,
-			Price:     productsMap[item.ProductID].Price,
+	var orderID int
+	err := h.checkoutStore.RunInTx(func(products types.ProductTxStore, orders types.OrderStore) error {
+		// the stock reserved for the items is now free for the order
+		if err := products.ReleaseReservedItems(userID, sessionID, sortedItems); err != nil {
+			return err
+		}
+
+		// reduce the quantity of variants in the store
+		for _, item := range sortedItems {
+			if err := products.DecrementStock(item.VariantID, item.Quantity); err != nil {
+				return err
+			}
+		}
+
+		// create order record
+		id, err := orders.CreateOrder(types.Order{
+			UserID:  userID,
+			Total:   totalPrice,
+			Status:  "pending",
+			Address: formatAddress(address),
 		})
+		if err != nil {
+			return err
+		}
+
+		// create order the items records
+		for _, item := range cartItems {
+			variant := variantsMap[item.VariantID]
+			err := orders.CreateOrderItem(types.OrderItem{
+				OrderID:   id,
+				ProductID: variant.ProductID,
+				VariantID: variant.ID,
+				Quantity:  item.Quantity,
+				Price:     variantPrice(productsMap[variant.ProductID], variant),
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		orderID = id
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
 	}
 
 	return orderID, totalPrice, nil
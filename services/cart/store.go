@@ -0,0 +1,32 @@
+// cart/store.go
+package cart
+
+import (
+	"database/sql"
+
+	"github.com/surfiniaburger/api-go/db"
+	"github.com/surfiniaburger/api-go/services/order"
+	"github.com/surfiniaburger/api-go/services/product"
+	"github.com/surfiniaburger/api-go/types"
+)
+
+// Store implements types.CheckoutStore on top of the product and order stores.
+type Store struct {
+	db       *sql.DB
+	products *product.Store
+	orders   *order.Store
+}
+
+func NewStore(db *sql.DB) *Store {
+	return &Store{
+		db:       db,
+		products: product.NewStore(db),
+		orders:   order.NewStore(db),
+	}
+}
+
+func (s *Store) RunInTx(fn func(products types.ProductTxStore, orders types.OrderStore) error) error {
+	return db.WithTx(s.db, func(tx *sql.Tx) error {
+		return fn(s.products.WithTx(tx), s.orders.WithTx(tx))
+	})
+}
@@ -0,0 +1,351 @@
+// category/routes.go
+package category
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/mux"
+	"github.com/surfiniaburger/api-go/services/auth"
+	"github.com/surfiniaburger/api-go/types"
+	"github.com/surfiniaburger/api-go/utils"
+)
+
+var slugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+type Handler struct {
+	store        types.CategoryStore
+	productStore types.ProductStore
+	userStore    types.UserGetter
+}
+
+func NewHandler(store types.CategoryStore, productStore types.ProductStore, userStore types.UserGetter) *Handler {
+	return &Handler{store: store, productStore: productStore, userStore: userStore}
+}
+
+func (h *Handler) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/categories", h.handleGetCategories).Methods(http.MethodGet)
+	router.HandleFunc("/products/{productID}/categories", h.handleGetProductCategories).Methods(http.MethodGet)
+
+	// admin routes
+	router.HandleFunc("/categories", auth.WithJWTAuth(h.handleCreateCategory, h.userStore, auth.PermProductsWrite)).Methods(http.MethodPost)
+	router.HandleFunc("/categories/{categoryID}", auth.WithJWTAuth(h.handleUpdateCategory, h.userStore, auth.PermProductsWrite)).Methods(http.MethodPut)
+	router.HandleFunc("/categories/{categoryID}/move", auth.WithJWTAuth(h.handleMoveCategory, h.userStore, auth.PermProductsWrite)).Methods(http.MethodPost)
+	router.HandleFunc("/categories/{categoryID}", auth.WithJWTAuth(h.handleDeleteCategory, h.userStore, auth.PermProductsWrite)).Methods(http.MethodDelete)
+	router.HandleFunc("/products/{productID}/categories", auth.WithJWTAuth(h.handleSetProductCategories, h.userStore, auth.PermProductsWrite)).Methods(http.MethodPut)
+}
+
+// handleGetCategories returns the roots of the category tree, each with its
+// children nested under it.
+func (h *Handler) handleGetCategories(w http.ResponseWriter, r *http.Request) {
+	categories, err := h.store.GetCategories()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, buildTree(categories))
+}
+
+func (h *Handler) handleCreateCategory(w http.ResponseWriter, r *http.Request) {
+	var payload types.CreateCategoryPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	slug, err := categorySlug(payload.Name, payload.Slug)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	category := types.Category{ParentID: payload.ParentID, Name: payload.Name, Slug: slug}
+	id, err := h.store.CreateCategory(category)
+	if errors.Is(err, types.ErrSlugTaken) {
+		utils.WriteError(w, http.StatusConflict, fmt.Errorf("the slug %s is already in use", slug))
+		return
+	}
+	if errors.Is(err, types.ErrCategoryNotFound) {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("parent category %d not found", *payload.ParentID))
+		return
+	}
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	created, err := h.store.GetCategoryByID(id)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, created)
+}
+
+func (h *Handler) handleUpdateCategory(w http.ResponseWriter, r *http.Request) {
+	category, ok := h.getCategory(w, r)
+	if !ok {
+		return
+	}
+
+	var payload types.UpdateCategoryPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	slug, err := categorySlug(payload.Name, payload.Slug)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	category.Name, category.Slug = payload.Name, slug
+	err = h.store.UpdateCategory(*category)
+	if errors.Is(err, types.ErrSlugTaken) {
+		utils.WriteError(w, http.StatusConflict, fmt.Errorf("the slug %s is already in use", slug))
+		return
+	}
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, category)
+}
+
+// handleMoveCategory moves the category, with its whole subtree, under
+// another parent.
+func (h *Handler) handleMoveCategory(w http.ResponseWriter, r *http.Request) {
+	category, ok := h.getCategory(w, r)
+	if !ok {
+		return
+	}
+
+	var payload types.MoveCategoryPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	err := h.store.MoveCategory(category.ID, payload.ParentID)
+	if errors.Is(err, types.ErrCategoryCycle) {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if errors.Is(err, types.ErrCategoryNotFound) {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("parent category not found"))
+		return
+	}
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	moved, err := h.store.GetCategoryByID(category.ID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, moved)
+}
+
+func (h *Handler) handleDeleteCategory(w http.ResponseWriter, r *http.Request) {
+	category, ok := h.getCategory(w, r)
+	if !ok {
+		return
+	}
+
+	deleted, err := h.store.DeleteCategory(category.ID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if !deleted {
+		utils.WriteError(w, http.StatusConflict, fmt.Errorf("the category has subcategories, move or delete them first"))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "category deleted"})
+}
+
+func (h *Handler) handleGetProductCategories(w http.ResponseWriter, r *http.Request) {
+	productID, ok := h.getProductID(w, r)
+	if !ok {
+		return
+	}
+
+	categories, err := h.store.GetProductCategories(productID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, categories)
+}
+
+// handleSetProductCategories replaces the categories of the product.
+func (h *Handler) handleSetProductCategories(w http.ResponseWriter, r *http.Request) {
+	productID, ok := h.getProductID(w, r)
+	if !ok {
+		return
+	}
+
+	var payload types.ProductCategoriesPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	saved, err := h.store.SetProductCategories(productID, payload.CategoryIDs)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// the product was checked, so it is one of the categories that is missing
+	// unless the product was deleted in the meantime
+	if !saved {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("one of the categories does not exist"))
+		return
+	}
+
+	categories, err := h.store.GetProductCategories(productID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, categories)
+}
+
+// getCategory returns the category of the route, writing the error response
+// if there is none.
+func (h *Handler) getCategory(w http.ResponseWriter, r *http.Request) (*types.Category, bool) {
+	categoryID, err := strconv.Atoi(mux.Vars(r)["categoryID"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid category ID"))
+		return nil, false
+	}
+
+	category, err := h.store.GetCategoryByID(categoryID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return nil, false
+	}
+
+	if category.ID == 0 {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("category not found"))
+		return nil, false
+	}
+
+	return category, true
+}
+
+// getProductID returns the ID of the product of the route, writing the error
+// response if the product does not exist.
+func (h *Handler) getProductID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	productID, err := strconv.Atoi(mux.Vars(r)["productID"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid product ID"))
+		return 0, false
+	}
+
+	product, err := h.productStore.GetProductByID(productID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return 0, false
+	}
+
+	if product.ID == 0 {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("product not found"))
+		return 0, false
+	}
+
+	return product.ID, true
+}
+
+// categorySlug returns the slug of the payload, or one made from the name if
+// it has none.
+func categorySlug(name, slug string) (string, error) {
+	if slug == "" {
+		slug = slugify(name)
+		if slug == "" {
+			return "", fmt.Errorf("a slug is required when the name has no letters or digits")
+		}
+		return slug, nil
+	}
+
+	if !slugPattern.MatchString(slug) {
+		return "", fmt.Errorf("invalid slug, use lowercase letters and digits separated by dashes")
+	}
+
+	return slug, nil
+}
+
+// slugify lowercases the name and joins its runs of ASCII letters and digits
+// with dashes, so "Books & Comics" becomes "books-comics".
+func slugify(name string) string {
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return r > unicode.MaxASCII || !(unicode.IsLetter(r) || unicode.IsDigit(r))
+	})
+
+	slug := strings.Join(words, "-")
+	if len(slug) > 100 {
+		slug = strings.TrimRight(slug[:100], "-")
+	}
+
+	return slug
+}
+
+// buildTree nests the categories under their parents and returns the roots.
+// The children keep the order of the categories.
+func buildTree(categories []types.Category) []*types.Category {
+	nodes := make(map[int]*types.Category, len(categories))
+	for i := range categories {
+		nodes[categories[i].ID] = &categories[i]
+	}
+
+	roots := []*types.Category{}
+	for i := range categories {
+		c := &categories[i]
+		if c.ParentID == nil {
+			roots = append(roots, c)
+			continue
+		}
+
+		if parent, ok := nodes[*c.ParentID]; ok {
+			parent.Children = append(parent.Children, c)
+		}
+	}
+
+	return roots
+}
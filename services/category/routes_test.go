@@ -0,0 +1,396 @@
+package category
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/surfiniaburger/api-go/services/auth"
+	"github.com/surfiniaburger/api-go/services/auth/authtest"
+	"github.com/surfiniaburger/api-go/types"
+)
+
+func TestCategories(t *testing.T) {
+	auth.SetRevocationStore(auth.NewMemoryRevocationStore())
+
+	store := &mockCategoryStore{categories: map[int]*types.Category{}, products: map[int][]int{}}
+	userStore := &authtest.Users{Roles: map[int]string{1: "admin"}}
+	handler := NewHandler(store, &mockProductStore{}, userStore)
+
+	router := mux.NewRouter()
+	handler.RegisterRoutes(router)
+
+	adminToken, err := auth.CreateJWT(1, auth.AMRPassword, auth.AMROTP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(method, path, token string, payload any) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		if payload != nil {
+			if err := json.NewEncoder(&body).Encode(payload); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		req, err := http.NewRequest(method, path, &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	create := func(name string, parentID *int) types.Category {
+		rr := request(http.MethodPost, "/categories", adminToken, types.CreateCategoryPayload{Name: name, ParentID: parentID})
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("expected status code %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body)
+		}
+
+		var c types.Category
+		if err := json.NewDecoder(rr.Body).Decode(&c); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	books := create("Books", nil)
+	fiction := create("Fiction", &books.ID)
+	comics := create("Comics & Graphic Novels", &fiction.ID)
+	music := create("Music", nil)
+
+	t.Run("should make the slug and the path of the category", func(t *testing.T) {
+		if comics.Slug != "comics-graphic-novels" {
+			t.Errorf("expected the slug comics-graphic-novels, got %s", comics.Slug)
+		}
+
+		want := fmt.Sprintf("/%d/%d/%d/", books.ID, fiction.ID, comics.ID)
+		if comics.Path != want {
+			t.Errorf("expected the path %s, got %s", want, comics.Path)
+		}
+	})
+
+	t.Run("should list the categories as a tree", func(t *testing.T) {
+		rr := request(http.MethodGet, "/categories", "", nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		var tree []*types.Category
+		if err := json.NewDecoder(rr.Body).Decode(&tree); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(tree) != 2 || tree[0].Slug != "books" || tree[1].Slug != "music" {
+			t.Fatalf("expected the roots books and music, got %+v", tree)
+		}
+		if len(tree[0].Children) != 1 || len(tree[0].Children[0].Children) != 1 || tree[0].Children[0].Children[0].ID != comics.ID {
+			t.Errorf("expected comics under fiction under books, got %+v", tree[0])
+		}
+	})
+
+	t.Run("should fail to create a category with a bad or used slug", func(t *testing.T) {
+		for _, tc := range []struct {
+			payload types.CreateCategoryPayload
+			status  int
+		}{
+			{types.CreateCategoryPayload{Name: "Books", Slug: "books"}, http.StatusConflict},
+			{types.CreateCategoryPayload{Name: "Vinyl", Slug: "Vinyl Records"}, http.StatusBadRequest},
+			{types.CreateCategoryPayload{Name: "???"}, http.StatusBadRequest},
+			{types.CreateCategoryPayload{Name: "Vinyl", ParentID: intPtr(999)}, http.StatusBadRequest},
+		} {
+			rr := request(http.MethodPost, "/categories", adminToken, tc.payload)
+			if rr.Code != tc.status {
+				t.Errorf("%+v: expected status code %d, got %d", tc.payload, tc.status, rr.Code)
+			}
+		}
+	})
+
+	t.Run("should only let admins manage the categories", func(t *testing.T) {
+		token, err := auth.CreateJWT(2, auth.AMRPassword)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := request(http.MethodPost, "/categories", token, types.CreateCategoryPayload{Name: "Games"})
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected status code %d, got %d", http.StatusForbidden, rr.Code)
+		}
+	})
+
+	t.Run("should rename the category", func(t *testing.T) {
+		rr := request(http.MethodPut, fmt.Sprintf("/categories/%d", music.ID), adminToken, types.UpdateCategoryPayload{Name: "Music & Audio"})
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body)
+		}
+
+		if c := store.categories[music.ID]; c.Name != "Music & Audio" || c.Slug != "music-audio" {
+			t.Errorf("expected the category to be renamed, got %+v", c)
+		}
+	})
+
+	t.Run("should move the subtree", func(t *testing.T) {
+		rr := request(http.MethodPost, fmt.Sprintf("/categories/%d/move", fiction.ID), adminToken, types.MoveCategoryPayload{ParentID: &music.ID})
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body)
+		}
+
+		want := fmt.Sprintf("/%d/%d/%d/", music.ID, fiction.ID, comics.ID)
+		if c := store.categories[comics.ID]; c.Path != want {
+			t.Errorf("expected the path %s, got %s", want, c.Path)
+		}
+
+		rr = request(http.MethodPost, fmt.Sprintf("/categories/%d/move", fiction.ID), adminToken, types.MoveCategoryPayload{})
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body)
+		}
+
+		if c := store.categories[fiction.ID]; c.ParentID != nil || c.Path != fmt.Sprintf("/%d/", fiction.ID) {
+			t.Errorf("expected fiction to be a root, got %+v", c)
+		}
+	})
+
+	t.Run("should fail to move a category under its descendant", func(t *testing.T) {
+		for _, parentID := range []int{fiction.ID, comics.ID} {
+			rr := request(http.MethodPost, fmt.Sprintf("/categories/%d/move", fiction.ID), adminToken, types.MoveCategoryPayload{ParentID: &parentID})
+			if rr.Code != http.StatusBadRequest {
+				t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+			}
+		}
+	})
+
+	t.Run("should assign categories to the product", func(t *testing.T) {
+		rr := request(http.MethodPut, "/products/42/categories", adminToken, types.ProductCategoriesPayload{CategoryIDs: []int{comics.ID, books.ID}})
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body)
+		}
+
+		rr = request(http.MethodGet, "/products/42/categories", "", nil)
+		var categories []types.Category
+		if err := json.NewDecoder(rr.Body).Decode(&categories); err != nil {
+			t.Fatal(err)
+		}
+		if len(categories) != 2 {
+			t.Errorf("expected 2 categories, got %+v", categories)
+		}
+
+		for path, status := range map[string]int{
+			"/products/42/categories":  http.StatusBadRequest,
+			"/products/404/categories": http.StatusNotFound,
+		} {
+			rr := request(http.MethodPut, path, adminToken, types.ProductCategoriesPayload{CategoryIDs: []int{999}})
+			if rr.Code != status {
+				t.Errorf("%s: expected status code %d, got %d", path, status, rr.Code)
+			}
+		}
+	})
+
+	t.Run("should only delete categories without children", func(t *testing.T) {
+		rr := request(http.MethodDelete, fmt.Sprintf("/categories/%d", fiction.ID), adminToken, nil)
+		if rr.Code != http.StatusConflict {
+			t.Errorf("expected status code %d, got %d", http.StatusConflict, rr.Code)
+		}
+
+		rr = request(http.MethodDelete, fmt.Sprintf("/categories/%d", comics.ID), adminToken, nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if _, ok := store.categories[comics.ID]; ok {
+			t.Error("expected the category to be deleted")
+		}
+		if ids := store.products[42]; len(ids) != 1 || ids[0] != books.ID {
+			t.Errorf("expected the category to be removed from the product, got %v", ids)
+		}
+
+		rr = request(http.MethodDelete, fmt.Sprintf("/categories/%d", comics.ID), adminToken, nil)
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("expected status code %d, got %d", http.StatusNotFound, rr.Code)
+		}
+	})
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+// mockCategoryStore keeps the categories in memory, with the paths
+// maintained like the MySQL store does.
+type mockCategoryStore struct {
+	categories map[int]*types.Category
+	products   map[int][]int
+	lastID     int
+}
+
+func (m *mockCategoryStore) GetCategories() ([]types.Category, error) {
+	var categories []types.Category
+	for id := 1; id <= m.lastID; id++ {
+		if c, ok := m.categories[id]; ok {
+			categories = append(categories, *c)
+		}
+	}
+
+	// the store orders them by name
+	sort.SliceStable(categories, func(i, j int) bool {
+		return categories[i].Name < categories[j].Name
+	})
+
+	return categories, nil
+}
+
+func (m *mockCategoryStore) GetCategoryByID(id int) (*types.Category, error) {
+	c, ok := m.categories[id]
+	if !ok {
+		return &types.Category{}, nil
+	}
+
+	copied := *c
+	return &copied, nil
+}
+
+func (m *mockCategoryStore) CreateCategory(c types.Category) (int, error) {
+	if m.slugTaken(c.Slug, 0) {
+		return 0, types.ErrSlugTaken
+	}
+
+	parentPath := "/"
+	if c.ParentID != nil {
+		parent, ok := m.categories[*c.ParentID]
+		if !ok {
+			return 0, types.ErrCategoryNotFound
+		}
+		parentPath = parent.Path
+	}
+
+	m.lastID++
+	c.ID = m.lastID
+	c.Path = childPath(parentPath, c.ID)
+	m.categories[c.ID] = &c
+	return c.ID, nil
+}
+
+func (m *mockCategoryStore) UpdateCategory(c types.Category) error {
+	if m.slugTaken(c.Slug, c.ID) {
+		return types.ErrSlugTaken
+	}
+
+	m.categories[c.ID].Name = c.Name
+	m.categories[c.ID].Slug = c.Slug
+	return nil
+}
+
+func (m *mockCategoryStore) MoveCategory(id int, parentID *int) error {
+	c, ok := m.categories[id]
+	if !ok {
+		return types.ErrCategoryNotFound
+	}
+
+	parentPath := "/"
+	if parentID != nil {
+		parent, ok := m.categories[*parentID]
+		if !ok {
+			return types.ErrCategoryNotFound
+		}
+		if strings.HasPrefix(parent.Path, c.Path) {
+			return types.ErrCategoryCycle
+		}
+		parentPath = parent.Path
+	}
+
+	c.ParentID = parentID
+	oldPath, newPath := c.Path, childPath(parentPath, id)
+	for _, d := range m.categories {
+		if strings.HasPrefix(d.Path, oldPath) {
+			d.Path = newPath + d.Path[len(oldPath):]
+		}
+	}
+	return nil
+}
+
+func (m *mockCategoryStore) DeleteCategory(id int) (bool, error) {
+	for _, c := range m.categories {
+		if c.ParentID != nil && *c.ParentID == id {
+			return false, nil
+		}
+	}
+
+	delete(m.categories, id)
+	for productID, ids := range m.products {
+		var kept []int
+		for _, categoryID := range ids {
+			if categoryID != id {
+				kept = append(kept, categoryID)
+			}
+		}
+		m.products[productID] = kept
+	}
+	return true, nil
+}
+
+func (m *mockCategoryStore) GetProductCategories(productID int) ([]types.Category, error) {
+	categories := []types.Category{}
+	for _, id := range m.products[productID] {
+		categories = append(categories, *m.categories[id])
+	}
+	return categories, nil
+}
+
+func (m *mockCategoryStore) SetProductCategories(productID int, categoryIDs []int) (bool, error) {
+	for _, id := range categoryIDs {
+		if _, ok := m.categories[id]; !ok {
+			return false, nil
+		}
+	}
+
+	m.products[productID] = uniqueIDs(categoryIDs)
+	return true, nil
+}
+
+func (m *mockCategoryStore) slugTaken(slug string, exceptID int) bool {
+	for _, c := range m.categories {
+		if c.Slug == slug && c.ID != exceptID {
+			return true
+		}
+	}
+	return false
+}
+
+type mockProductStore struct{}
+
+func (m *mockProductStore) GetProductByID(productID int) (*types.Product, error) {
+	if productID != 42 {
+		return &types.Product{}, nil
+	}
+	return &types.Product{ID: 42, Name: "Ogbono Cookbook"}, nil
+}
+
+func (m *mockProductStore) GetProducts(filter types.ProductFilter) (*types.ProductPage, error) {
+	return &types.ProductPage{}, nil
+}
+
+func (m *mockProductStore) CreateProduct(product types.CreateProductPayload) error {
+	return nil
+}
+
+func (m *mockProductStore) UpdateProduct(product types.Product) (bool, error) {
+	return false, nil
+}
+
+func (m *mockProductStore) DeleteProduct(id, version int) (bool, error) {
+	return false, nil
+}
+
+func (m *mockProductStore) GetProductsByID(ids []int) ([]types.Product, error) {
+	return []types.Product{}, nil
+}
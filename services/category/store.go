@@ -0,0 +1,276 @@
+// category/store.go
+package category
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/surfiniaburger/api-go/db"
+	"github.com/surfiniaburger/api-go/types"
+)
+
+const categoryColumns = "id, parentId, name, slug, path, createdAt"
+
+type Store struct {
+	db *sql.DB
+}
+
+func NewStore(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+func (s *Store) GetCategories() ([]types.Category, error) {
+	return s.queryCategories("SELECT " + categoryColumns + " FROM categories ORDER BY name, id")
+}
+
+func (s *Store) GetCategoryByID(id int) (*types.Category, error) {
+	categories, err := s.queryCategories("SELECT "+categoryColumns+" FROM categories WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(categories) == 0 {
+		return new(types.Category), nil
+	}
+
+	return &categories[0], nil
+}
+
+func (s *Store) CreateCategory(c types.Category) (int, error) {
+	var id int
+	err := db.WithTx(s.db, func(tx *sql.Tx) error {
+		parentPath := "/"
+		if c.ParentID != nil {
+			err := tx.QueryRow("SELECT path FROM categories WHERE id = ? FOR UPDATE", *c.ParentID).Scan(&parentPath)
+			if err == sql.ErrNoRows {
+				return types.ErrCategoryNotFound
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		res, err := tx.Exec("INSERT INTO categories (parentId, name, slug) VALUES (?, ?, ?)", c.ParentID, c.Name, c.Slug)
+		if db.IsDuplicateEntry(err) {
+			return types.ErrSlugTaken
+		}
+		if err != nil {
+			return err
+		}
+
+		lastID, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		id = int(lastID)
+
+		// the path holds the ID, which is only known once the row is inserted
+		_, err = tx.Exec("UPDATE categories SET path = ? WHERE id = ?", childPath(parentPath, id), id)
+		return err
+	})
+
+	return id, err
+}
+
+func (s *Store) UpdateCategory(c types.Category) error {
+	_, err := s.db.Exec("UPDATE categories SET name = ?, slug = ? WHERE id = ?", c.Name, c.Slug, c.ID)
+	if db.IsDuplicateEntry(err) {
+		return types.ErrSlugTaken
+	}
+
+	return err
+}
+
+// MoveCategory rewrites the path of the category and of every descendant, in
+// one statement since they all share the old path as a prefix.
+func (s *Store) MoveCategory(id int, parentID *int) error {
+	return db.WithTx(s.db, func(tx *sql.Tx) error {
+		var oldPath string
+		err := tx.QueryRow("SELECT path FROM categories WHERE id = ? FOR UPDATE", id).Scan(&oldPath)
+		if err == sql.ErrNoRows {
+			return types.ErrCategoryNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		parentPath := "/"
+		if parentID != nil {
+			err := tx.QueryRow("SELECT path FROM categories WHERE id = ? FOR UPDATE", *parentID).Scan(&parentPath)
+			if err == sql.ErrNoRows {
+				return types.ErrCategoryNotFound
+			}
+			if err != nil {
+				return err
+			}
+
+			if strings.HasPrefix(parentPath, oldPath) {
+				return types.ErrCategoryCycle
+			}
+		}
+
+		if _, err := tx.Exec("UPDATE categories SET parentId = ? WHERE id = ?", parentID, id); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(
+			"UPDATE categories SET path = CONCAT(?, SUBSTRING(path, ?)) WHERE path LIKE ?",
+			childPath(parentPath, id), len(oldPath)+1, db.EscapeLike(oldPath)+"%",
+		)
+		return err
+	})
+}
+
+func (s *Store) DeleteCategory(id int) (bool, error) {
+	deleted := false
+	err := db.WithTx(s.db, func(tx *sql.Tx) error {
+		// locks the children of the category, so none is added before it is
+		// deleted
+		var children int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM categories WHERE parentId = ? FOR UPDATE", id).Scan(&children); err != nil {
+			return err
+		}
+		if children > 0 {
+			return nil
+		}
+
+		if _, err := tx.Exec("DELETE FROM product_categories WHERE categoryId = ?", id); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec("DELETE FROM categories WHERE id = ?", id); err != nil {
+			return err
+		}
+
+		deleted = true
+		return nil
+	})
+
+	return deleted, err
+}
+
+func (s *Store) GetProductCategories(productID int) ([]types.Category, error) {
+	return s.queryCategories(
+		"SELECT c.id, c.parentId, c.name, c.slug, c.path, c.createdAt FROM categories c JOIN product_categories pc ON pc.categoryId = c.id WHERE pc.productId = ? ORDER BY c.name, c.id",
+		productID,
+	)
+}
+
+func (s *Store) SetProductCategories(productID int, categoryIDs []int) (bool, error) {
+	ids := uniqueIDs(categoryIDs)
+
+	saved := false
+	err := db.WithTx(s.db, func(tx *sql.Tx) error {
+		var exists int
+		err := tx.QueryRow("SELECT 1 FROM products WHERE id = ? AND deletedAt IS NULL FOR UPDATE", productID).Scan(&exists)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		args := make([]any, len(ids))
+		for i, id := range ids {
+			args[i] = id
+		}
+
+		if len(ids) > 0 {
+			placeholders := strings.Repeat(",?", len(ids)-1)
+
+			var found int
+			query := fmt.Sprintf("SELECT COUNT(*) FROM categories WHERE id IN (?%s) LOCK IN SHARE MODE", placeholders)
+			if err := tx.QueryRow(query, args...).Scan(&found); err != nil {
+				return err
+			}
+			if found != len(ids) {
+				return nil
+			}
+		}
+
+		if _, err := tx.Exec("DELETE FROM product_categories WHERE productId = ?", productID); err != nil {
+			return err
+		}
+
+		if len(ids) > 0 {
+			values := strings.TrimSuffix(strings.Repeat("(?, ?),", len(ids)), ",")
+			insertArgs := make([]any, 0, 2*len(ids))
+			for _, id := range ids {
+				insertArgs = append(insertArgs, productID, id)
+			}
+
+			if _, err := tx.Exec("INSERT INTO product_categories (productId, categoryId) VALUES "+values, insertArgs...); err != nil {
+				return err
+			}
+		}
+
+		saved = true
+		return nil
+	})
+
+	return saved, err
+}
+
+func (s *Store) queryCategories(query string, args ...any) ([]types.Category, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	categories := []types.Category{}
+	for rows.Next() {
+		c, err := scanRowsIntoCategory(rows)
+		if err != nil {
+			return nil, err
+		}
+		categories = append(categories, *c)
+	}
+
+	return categories, rows.Err()
+}
+
+func scanRowsIntoCategory(rows *sql.Rows) (*types.Category, error) {
+	c := new(types.Category)
+
+	var parentID sql.NullInt64
+	err := rows.Scan(
+		&c.ID,
+		&parentID,
+		&c.Name,
+		&c.Slug,
+		&c.Path,
+		&c.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if parentID.Valid {
+		id := int(parentID.Int64)
+		c.ParentID = &id
+	}
+
+	return c, nil
+}
+
+// childPath returns the path of the category with the ID under the parent
+// path, "/" for a root category.
+func childPath(parentPath string, id int) string {
+	return parentPath + strconv.Itoa(id) + "/"
+}
+
+func uniqueIDs(ids []int) []int {
+	seen := make(map[int]bool, len(ids))
+	unique := make([]int, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+
+	return unique
+}
@@ -0,0 +1,122 @@
+// impersonation/routes.go
+package impersonation
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/mux"
+	"github.com/surfiniaburger/api-go/configs"
+	"github.com/surfiniaburger/api-go/services/auth"
+	"github.com/surfiniaburger/api-go/types"
+	"github.com/surfiniaburger/api-go/utils"
+)
+
+type Handler struct {
+	store     types.ImpersonationStore
+	userStore types.UserGetter
+}
+
+func NewHandler(store types.ImpersonationStore, userStore types.UserGetter) *Handler {
+	return &Handler{store: store, userStore: userStore}
+}
+
+func (h *Handler) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/admin/users/{userID}/impersonate", auth.WithJWTAuth(auth.DenyImpersonation(h.handleImpersonate), h.userStore, auth.PermUsersImpersonate)).Methods(http.MethodPost)
+	router.HandleFunc("/admin/users/{userID}/impersonations", auth.WithJWTAuth(h.handleGetImpersonations, h.userStore, auth.PermUsersManage)).Methods(http.MethodGet)
+}
+
+// handleImpersonate gives the admin a short-lived access token of the user, to
+// see the API as they do. Every request made with it is logged along with the
+// admin, and actions only the user may take are refused.
+func (h *Handler) handleImpersonate(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(mux.Vars(r)["userID"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid user ID"))
+		return
+	}
+
+	var payload types.ImpersonatePayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	actorID := auth.GetUserIDFromContext(r.Context())
+	if userID == actorID {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("you cannot impersonate yourself"))
+		return
+	}
+
+	u, err := h.userStore.GetUserByID(userID)
+	if err != nil || u.DeletedAt != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("user %d not found", userID))
+		return
+	}
+
+	if err := auth.CheckUserStatus(u); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	allowed, err := auth.CanBeImpersonated(u.Role)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if !allowed {
+		utils.WriteError(w, http.StatusForbidden, fmt.Errorf("users with the %s role cannot be impersonated", u.Role))
+		return
+	}
+
+	expiration := time.Second * time.Duration(configs.Envs.ImpersonationExpirationInSeconds)
+	impersonation := types.Impersonation{
+		ActorID:   actorID,
+		UserID:    userID,
+		Reason:    payload.Reason,
+		ExpiresAt: time.Now().Add(expiration),
+	}
+
+	// the trail is written first, a token nobody knows about is never issued
+	if _, err := h.store.CreateImpersonation(impersonation); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	token, err := auth.CreateImpersonationJWT(actorID, userID, expiration)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	log.Printf("admin %d started impersonating user %d: %s", actorID, userID, payload.Reason)
+
+	utils.WriteJSON(w, http.StatusOK, types.ImpersonationResponse{Token: token, UserID: userID, ExpiresAt: impersonation.ExpiresAt})
+}
+
+func (h *Handler) handleGetImpersonations(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(mux.Vars(r)["userID"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid user ID"))
+		return
+	}
+
+	impersonations, err := h.store.GetImpersonations(userID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, impersonations)
+}
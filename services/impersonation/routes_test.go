@@ -0,0 +1,216 @@
+package impersonation
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/surfiniaburger/api-go/services/auth"
+	"github.com/surfiniaburger/api-go/services/auth/authtest"
+	"github.com/surfiniaburger/api-go/types"
+)
+
+func TestImpersonation(t *testing.T) {
+	auth.SetRevocationStore(auth.NewMemoryRevocationStore())
+
+	store := &mockImpersonationStore{}
+	userStore := &authtest.Users{
+		Roles:    map[int]string{1: "admin", 2: "admin"},
+		Statuses: map[int]string{},
+	}
+	handler := NewHandler(store, userStore)
+
+	router := mux.NewRouter()
+	handler.RegisterRoutes(router)
+
+	var subject, actor int
+	router.HandleFunc("/whoami", auth.WithJWTAuth(func(w http.ResponseWriter, r *http.Request) {
+		subject = auth.GetUserIDFromContext(r.Context())
+		actor = auth.GetActorIDFromContext(r.Context())
+	}, userStore)).Methods(http.MethodGet)
+	router.HandleFunc("/sensitive", auth.WithJWTAuth(auth.DenyImpersonation(func(w http.ResponseWriter, r *http.Request) {}), userStore)).Methods(http.MethodPost)
+
+	request := func(method, path, token string, payload any) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		if payload != nil {
+			if err := json.NewEncoder(&body).Encode(payload); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		req, err := http.NewRequest(method, path, &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	adminToken, err := auth.CreateJWT(1, auth.AMRPassword, auth.AMROTP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	impersonate := func(userID int) (*httptest.ResponseRecorder, types.ImpersonationResponse) {
+		rr := request(http.MethodPost, fmt.Sprintf("/admin/users/%d/impersonate", userID), adminToken, types.ImpersonatePayload{Reason: "ticket 1234"})
+
+		var response types.ImpersonationResponse
+		if rr.Code == http.StatusOK {
+			if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rr, response
+	}
+
+	t.Run("should act as the user and keep the admin as the actor", func(t *testing.T) {
+		rr, response := impersonate(42)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body)
+		}
+
+		if response.UserID != 42 || response.Token == "" {
+			t.Errorf("unexpected response %+v", response)
+		}
+
+		if len(store.impersonations) != 1 || store.impersonations[0].ActorID != 1 || store.impersonations[0].Reason != "ticket 1234" {
+			t.Errorf("unexpected impersonations %+v", store.impersonations)
+		}
+
+		rr = request(http.MethodGet, "/whoami", response.Token, nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body)
+		}
+
+		if subject != 42 || actor != 1 {
+			t.Errorf("expected user 42 acting for admin 1, got user %d and actor %d", subject, actor)
+		}
+	})
+
+	t.Run("should not set an actor without impersonation", func(t *testing.T) {
+		rr := request(http.MethodGet, "/whoami", adminToken, nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if subject != 1 || actor != 0 {
+			t.Errorf("expected user 1 without an actor, got user %d and actor %d", subject, actor)
+		}
+	})
+
+	t.Run("should deny sensitive actions while impersonating", func(t *testing.T) {
+		_, response := impersonate(42)
+
+		rr := request(http.MethodPost, "/sensitive", response.Token, nil)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected status code %d, got %d", http.StatusForbidden, rr.Code)
+		}
+
+		rr = request(http.MethodPost, "/admin/users/43/impersonate", response.Token, types.ImpersonatePayload{Reason: "chain"})
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected status code %d, got %d", http.StatusForbidden, rr.Code)
+		}
+	})
+
+	t.Run("should fail if the reason is missing", func(t *testing.T) {
+		rr := request(http.MethodPost, "/admin/users/42/impersonate", adminToken, types.ImpersonatePayload{})
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+
+	t.Run("should fail to impersonate yourself", func(t *testing.T) {
+		rr, _ := impersonate(1)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+
+	t.Run("should fail to impersonate another admin", func(t *testing.T) {
+		rr, _ := impersonate(2)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected status code %d, got %d", http.StatusForbidden, rr.Code)
+		}
+	})
+
+	t.Run("should fail to impersonate a suspended user", func(t *testing.T) {
+		userStore.Statuses[44] = types.UserStatusSuspended
+
+		rr, _ := impersonate(44)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+
+	t.Run("should fail if the user is not an admin", func(t *testing.T) {
+		token, err := auth.CreateJWT(42, auth.AMRPassword)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := request(http.MethodPost, "/admin/users/43/impersonate", token, types.ImpersonatePayload{Reason: "ticket 1234"})
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected status code %d, got %d", http.StatusForbidden, rr.Code)
+		}
+	})
+
+	t.Run("should stop working once the admin is suspended", func(t *testing.T) {
+		_, response := impersonate(42)
+
+		userStore.Statuses[1] = types.UserStatusSuspended
+		defer delete(userStore.Statuses, 1)
+
+		rr := request(http.MethodGet, "/whoami", response.Token, nil)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected status code %d, got %d", http.StatusForbidden, rr.Code)
+		}
+	})
+
+	t.Run("should list the impersonations of a user", func(t *testing.T) {
+		rr := request(http.MethodGet, "/admin/users/42/impersonations", adminToken, nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		var impersonations []types.Impersonation
+		if err := json.NewDecoder(rr.Body).Decode(&impersonations); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(impersonations) == 0 {
+			t.Error("expected impersonations of user 42")
+		}
+		for _, i := range impersonations {
+			if i.UserID != 42 {
+				t.Errorf("unexpected impersonation %+v", i)
+			}
+		}
+	})
+}
+
+type mockImpersonationStore struct {
+	impersonations []types.Impersonation
+}
+
+func (m *mockImpersonationStore) CreateImpersonation(i types.Impersonation) (int, error) {
+	i.ID = len(m.impersonations) + 1
+	m.impersonations = append(m.impersonations, i)
+	return i.ID, nil
+}
+
+func (m *mockImpersonationStore) GetImpersonations(userID int) ([]types.Impersonation, error) {
+	impersonations := []types.Impersonation{}
+	for i := len(m.impersonations) - 1; i >= 0; i-- {
+		if m.impersonations[i].UserID == userID {
+			impersonations = append(impersonations, m.impersonations[i])
+		}
+	}
+	return impersonations, nil
+}
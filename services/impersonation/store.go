@@ -0,0 +1,52 @@
+// impersonation/store.go
+package impersonation
+
+import (
+	"database/sql"
+
+	"github.com/surfiniaburger/api-go/types"
+)
+
+type Store struct {
+	db *sql.DB
+}
+
+func NewStore(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+func (s *Store) CreateImpersonation(i types.Impersonation) (int, error) {
+	res, err := s.db.Exec(
+		"INSERT INTO impersonations (actorId, userId, reason, expiresAt) VALUES (?, ?, ?, ?)",
+		i.ActorID, i.UserID, i.Reason, i.ExpiresAt,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+func (s *Store) GetImpersonations(userID int) ([]types.Impersonation, error) {
+	rows, err := s.db.Query("SELECT id, actorId, userId, reason, expiresAt, createdAt FROM impersonations WHERE userId = ? ORDER BY createdAt DESC, id DESC", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	impersonations := []types.Impersonation{}
+	for rows.Next() {
+		var i types.Impersonation
+		if err := rows.Scan(&i.ID, &i.ActorID, &i.UserID, &i.Reason, &i.ExpiresAt, &i.CreatedAt); err != nil {
+			return nil, err
+		}
+		impersonations = append(impersonations, i)
+	}
+
+	return impersonations, rows.Err()
+}
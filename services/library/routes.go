@@ -24,13 +24,13 @@ func NewBookHandler(bookStore types.BookStore, userStore types.UserStore) *BookH
 }
 
 func (h *BookHandler) RegisterRoutes(router *mux.Router) {
-	router.HandleFunc("/admin/library", auth.WithJWTAuth(h.handleCreateBook, h.userStore, "admin")).Methods(http.MethodPost)
-	router.HandleFunc("/admin/library/{id}", auth.WithJWTAuth(h.handleUpdateBook, h.userStore, "admin")).Methods(http.MethodPut)
-	router.HandleFunc("/admin/library/{id}", auth.WithJWTAuth(h.handleDeleteBook, h.userStore, "admin")).Methods(http.MethodDelete)
-	router.HandleFunc("/admin/library", auth.WithJWTAuth(h.handleGetAllBooks, h.userStore, "admin")).Methods(http.MethodGet)
+	router.HandleFunc("/admin/library", auth.WithJWTAuth(h.handleCreateBook, h.userStore, auth.PermBooksWrite)).Methods(http.MethodPost)
+	router.HandleFunc("/admin/library/{id}", auth.WithJWTAuth(h.handleUpdateBook, h.userStore, auth.PermBooksWrite)).Methods(http.MethodPut)
+	router.HandleFunc("/admin/library/{id}", auth.WithJWTAuth(h.handleDeleteBook, h.userStore, auth.PermBooksWrite)).Methods(http.MethodDelete)
+	router.HandleFunc("/admin/library", auth.WithJWTAuth(h.handleGetAllBooks, h.userStore, auth.PermBooksWrite)).Methods(http.MethodGet)
 
 	// User endpoint to get all books
-	router.HandleFunc("/library", auth.WithJWTAuth(h.handleGetAllBooksForUsers, h.userStore, "user")).Methods(http.MethodGet)
+	router.HandleFunc("/library", auth.WithJWTAuth(h.handleGetAllBooksForUsers, h.userStore, auth.PermBooksRead)).Methods(http.MethodGet)
 	// Route for users to get a specific book by bookid
 	router.HandleFunc("/library/{bookid}", h.handleGetBookByID).Methods(http.MethodGet)
 
@@ -38,19 +38,19 @@ func (h *BookHandler) RegisterRoutes(router *mux.Router) {
 	router.HandleFunc("/library/search", h.handleSearchBooks).Methods(http.MethodGet)
 
 	// Route for users to post a review on a book
-	router.HandleFunc("/library/{bookid}/reviews", auth.WithJWTAuth(h.handlePostReview, h.userStore, "user")).Methods(http.MethodPost)
+	router.HandleFunc("/library/{bookid}/reviews", auth.WithJWTAuth(h.handlePostReview, h.userStore, auth.PermReviewsWrite)).Methods(http.MethodPost)
 
 	// Route for users to get reviews for a book
 	router.HandleFunc("/library/{bookid}/reviews", h.handleGetReviews).Methods(http.MethodGet)
 
-	// Route for users to delete their own review
-	router.HandleFunc("/library/reviews/{reviewid}", auth.WithJWTAuth(h.handleDeleteUserReview, h.userStore, "user")).Methods(http.MethodDelete)
+	// Route for users to delete their own review, moderators can delete any review
+	router.HandleFunc("/library/reviews/{reviewid}", auth.WithJWTAuth(h.handleDeleteUserReview, h.userStore, auth.PermReviewsDeleteOwn)).Methods(http.MethodDelete)
 
 	// Admin route to delete any review
-	router.HandleFunc("/admin/library/{bookid}/reviews/{reviewid}", auth.WithJWTAuth(h.handleDeleteAdminReview, h.userStore, "admin")).Methods(http.MethodDelete)
+	router.HandleFunc("/admin/library/{bookid}/reviews/{reviewid}", auth.WithJWTAuth(h.handleDeleteAdminReview, h.userStore, auth.PermReviewsDelete)).Methods(http.MethodDelete)
 
 	// Route for users to add books to their favorites list
-	router.HandleFunc("/library/user/lists", auth.WithJWTAuth(h.handleAddToFavorites, h.userStore, "user")).Methods(http.MethodPost)
+	router.HandleFunc("/library/user/lists", auth.WithJWTAuth(h.handleAddToFavorites, h.userStore, auth.PermFavoritesWrite)).Methods(http.MethodPost)
 }
 
 func (h *BookHandler) handleCreateBook(w http.ResponseWriter, r *http.Request) {
@@ -222,7 +222,13 @@ func (h *BookHandler) handleDeleteUserReview(w http.ResponseWriter, r *http.Requ
 	userID := auth.GetUserIDFromContext(r.Context())
 	userIDStr := strconv.Itoa(userID) // Convert userID from int to string
 
-	err := h.bookStore.DeleteUserReview(userIDStr, reviewID)
+	// the query only matches reviews of the user unless they can delete any
+	var err error
+	if auth.HasPermission(r.Context(), auth.PermReviewsDelete) {
+		err = h.bookStore.DeleteReview(reviewID)
+	} else {
+		err = h.bookStore.DeleteUserReview(userIDStr, reviewID)
+	}
 	if err != nil {
 		if err == sql.ErrNoRows {
 			utils.WriteError(w, http.StatusNotFound, fmt.Errorf("review not found"))
@@ -0,0 +1,129 @@
+// notify/notifier.go
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/surfiniaburger/api-go/configs"
+	"github.com/surfiniaburger/api-go/types"
+)
+
+// NewNotifier returns the notifier selected by the configuration. There is no
+// email provider yet, notifications are only logged or written to a file for
+// local development.
+func NewNotifier(cfg configs.Config) (types.Notifier, error) {
+	switch cfg.Notifier {
+	case "log":
+		return &LogNotifier{}, nil
+	case "file":
+		return NewFileNotifier(cfg.NotifierFile), nil
+	default:
+		return nil, fmt.Errorf("unknown notifier: %s", cfg.Notifier)
+	}
+}
+
+// LogNotifier writes notifications to the application log.
+type LogNotifier struct{}
+
+func (n *LogNotifier) Notify(notification types.Notification) error {
+	log.Printf("notification %s to %s: %s\n%s", notification.Kind, notification.To, notification.Subject, notification.Body)
+	return nil
+}
+
+// FileNotifier appends notifications as JSON lines to a file.
+type FileNotifier struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewFileNotifier(path string) *FileNotifier {
+	return &FileNotifier{path: path}
+}
+
+func (n *FileNotifier) Notify(notification types.Notification) error {
+	line, err := json.Marshal(struct {
+		types.Notification
+		SentAt time.Time `json:"sentAt"`
+	}{notification, time.Now()})
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	f, err := os.OpenFile(n.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// PreferencesNotifier passes notifications on unless the user turned them off
+// in their preferences. Every notifier of the API is wrapped in one.
+type PreferencesNotifier struct {
+	next  types.Notifier
+	store types.PreferencesStore
+}
+
+func NewPreferencesNotifier(next types.Notifier, store types.PreferencesStore) *PreferencesNotifier {
+	return &PreferencesNotifier{next: next, store: store}
+}
+
+func (n *PreferencesNotifier) Notify(notification types.Notification) error {
+	// account notifications are sent without looking the preferences up
+	if notification.UserID != 0 && !isAccountNotification(notification.Kind) {
+		preferences, err := n.store.GetPreferences(notification.UserID)
+		if err != nil {
+			return fmt.Errorf("failed to get the preferences of user %d: %w", notification.UserID, err)
+		}
+
+		if !Wants(preferences.Notifications, notification.Kind) {
+			return nil
+		}
+	}
+
+	return n.next.Notify(notification)
+}
+
+// accountNotifications are needed to use the account, so they are always
+// sent. Any other kind is optional.
+var accountNotifications = map[string]bool{
+	types.NotificationPasswordReset:     true,
+	types.NotificationEmailVerification: true,
+	types.NotificationEmailChange:       true,
+	types.NotificationEmailChanged:      true,
+}
+
+func isAccountNotification(kind string) bool {
+	return accountNotifications[kind]
+}
+
+// Wants reports whether the settings let notifications of the kind through.
+// Account notifications cannot be turned off. An optional kind without a
+// setting is never sent, it has to be added to the settings first.
+func Wants(settings types.NotificationSettings, kind string) bool {
+	if isAccountNotification(kind) {
+		return true
+	}
+
+	switch kind {
+	case types.NotificationOrderUpdate:
+		return settings.OrderUpdates
+	case types.NotificationReviewReply:
+		return settings.ReviewReplies
+	case types.NotificationLoanReminder:
+		return settings.LoanReminders
+	default:
+		log.Printf("notification %s has no setting, not sent", kind)
+		return false
+	}
+}
@@ -0,0 +1,74 @@
+package notify
+
+import (
+	"testing"
+
+	"github.com/surfiniaburger/api-go/types"
+)
+
+func TestPreferencesNotifier(t *testing.T) {
+	next := &mockNotifier{}
+	store := &mockPreferencesStore{preferences: map[int]types.Preferences{
+		1: {UserID: 1, Notifications: types.NotificationSettings{OrderUpdates: false, ReviewReplies: true}},
+	}}
+	notifier := NewPreferencesNotifier(next, store)
+
+	tests := []struct {
+		notification types.Notification
+		sent         bool
+	}{
+		{types.Notification{Kind: types.NotificationOrderUpdate, UserID: 1}, false},
+		{types.Notification{Kind: types.NotificationReviewReply, UserID: 1}, true},
+		{types.Notification{Kind: types.NotificationLoanReminder, UserID: 1}, false},
+		{types.Notification{Kind: types.NotificationPasswordReset, UserID: 1}, true},
+		{types.Notification{Kind: types.NotificationOrderUpdate, UserID: 2}, true},
+		// kinds that are not known to be account notifications are optional
+		{types.Notification{Kind: "newsletter", UserID: 2}, false},
+		{types.Notification{Kind: "newsletter"}, true},
+	}
+
+	for _, test := range tests {
+		next.sent = nil
+		if err := notifier.Notify(test.notification); err != nil {
+			t.Fatal(err)
+		}
+
+		if sent := len(next.sent) == 1; sent != test.sent {
+			t.Errorf("%s to user %d: expected sent to be %v, got %v", test.notification.Kind, test.notification.UserID, test.sent, sent)
+		}
+	}
+
+	if store.lookups != 5 {
+		t.Errorf("expected the preferences to be looked up for optional notifications only, got %d lookups", store.lookups)
+	}
+}
+
+type mockNotifier struct {
+	sent []types.Notification
+}
+
+func (m *mockNotifier) Notify(notification types.Notification) error {
+	m.sent = append(m.sent, notification)
+	return nil
+}
+
+type mockPreferencesStore struct {
+	preferences map[int]types.Preferences
+	lookups     int
+}
+
+func (m *mockPreferencesStore) GetPreferences(userID int) (*types.Preferences, error) {
+	m.lookups++
+
+	p, ok := m.preferences[userID]
+	if !ok {
+		p = types.Preferences{UserID: userID, Notifications: types.NotificationSettings{OrderUpdates: true, ReviewReplies: true, LoanReminders: true}}
+	}
+
+	return &p, nil
+}
+
+func (m *mockPreferencesStore) UpdatePreferences(p types.Preferences) error {
+	m.preferences[p.UserID] = p
+	return nil
+}
@@ -0,0 +1,89 @@
+package oidc
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/surfiniaburger/api-go/configs"
+	"github.com/surfiniaburger/api-go/services/oidc/oidctest"
+)
+
+func TestProvider(t *testing.T) {
+	server, err := oidctest.NewServer("client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	cfg := configs.OIDCProvider{
+		Name:        "test",
+		Issuer:      server.Issuer(),
+		ClientID:    "client",
+		RedirectURL: "http://localhost/callback",
+		Scopes:      []string{"openid", "email"},
+	}
+	provider := NewProvider(cfg, http.DefaultClient)
+	ctx := context.Background()
+	user := oidctest.User{Subject: "1234", Email: "me@me.com", EmailVerified: true, GivenName: "Me"}
+
+	authorize := func(verifier, nonce string) string {
+		authURL, err := provider.AuthCodeURL(ctx, "state", nonce, verifier)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		code, state, err := server.Authorize(authURL, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if state != "state" {
+			t.Errorf("expected the state to be sent back, got %q", state)
+		}
+
+		return code
+	}
+
+	t.Run("should exchange the code for a verified ID token", func(t *testing.T) {
+		code := authorize("verifier", "nonce")
+
+		token, err := provider.Exchange(ctx, code, "verifier", "nonce")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if token.Subject != "1234" || token.Email != "me@me.com" || !token.EmailVerified || token.GivenName != "Me" {
+			t.Errorf("unexpected ID token %+v", token)
+		}
+
+		if _, err := provider.Exchange(ctx, code, "verifier", "nonce"); err == nil {
+			t.Error("expected a used code to be rejected")
+		}
+	})
+
+	t.Run("should fail with the wrong code verifier", func(t *testing.T) {
+		code := authorize("verifier", "nonce")
+
+		if _, err := provider.Exchange(ctx, code, "other", "nonce"); err == nil {
+			t.Error("expected the exchange to fail")
+		}
+	})
+
+	t.Run("should fail if the nonce does not match", func(t *testing.T) {
+		code := authorize("verifier", "nonce")
+
+		if _, err := provider.Exchange(ctx, code, "verifier", "other"); err == nil {
+			t.Error("expected the ID token to be rejected")
+		}
+	})
+
+	t.Run("should fail if the issuer does not match", func(t *testing.T) {
+		other := cfg
+		other.Issuer = server.Issuer() + "/"
+
+		if _, err := NewProvider(other, http.DefaultClient).AuthCodeURL(ctx, "state", "nonce", "verifier"); err == nil {
+			t.Error("expected discovery to fail")
+		}
+	})
+}
@@ -0,0 +1,50 @@
+// order/routes.go
+package order
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/surfiniaburger/api-go/services/auth"
+	"github.com/surfiniaburger/api-go/types"
+	"github.com/surfiniaburger/api-go/utils"
+)
+
+type Handler struct {
+	store     types.OrderStore
+	userStore types.UserGetter
+}
+
+func NewHandler(store types.OrderStore, userStore types.UserGetter) *Handler {
+	return &Handler{store: store, userStore: userStore}
+}
+
+func (h *Handler) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/orders/{orderID}", auth.WithJWTAuth(h.handleGetOrder, h.userStore, auth.PermOrdersReadOwn)).Methods(http.MethodGet)
+}
+
+// handleGetOrder returns an order with its items. Users without the
+// permission to read every order only find their own orders.
+func (h *Handler) handleGetOrder(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(mux.Vars(r)["orderID"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid order ID"))
+		return
+	}
+
+	order, err := h.store.GetOrderByID(orderID)
+	if err != nil || !auth.CanAccess(r.Context(), auth.PermOrdersRead, order.UserID) {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("order not found"))
+		return
+	}
+
+	items, err := h.store.GetOrderItems(order.ID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, types.OrderDetails{Order: *order, Items: items})
+}
@@ -0,0 +1,84 @@
+package order
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/surfiniaburger/api-go/services/auth"
+	"github.com/surfiniaburger/api-go/services/auth/authtest"
+	"github.com/surfiniaburger/api-go/types"
+)
+
+func TestGetOrder(t *testing.T) {
+	auth.SetRevocationStore(auth.NewMemoryRevocationStore())
+
+	handler := NewHandler(&mockOrderStore{}, &authtest.Users{Roles: map[int]string{adminUserID: "admin"}})
+	router := mux.NewRouter()
+	handler.RegisterRoutes(router)
+
+	request := func(userID int, path string) int {
+		token, err := auth.CreateJWT(userID, auth.AMRPassword, auth.AMROTP)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest(http.MethodGet, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	t.Run("should let users read their own orders only", func(t *testing.T) {
+		if code := request(1, "/orders/10"); code != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, code)
+		}
+
+		if code := request(2, "/orders/10"); code != http.StatusNotFound {
+			t.Errorf("expected status code %d, got %d", http.StatusNotFound, code)
+		}
+	})
+
+	t.Run("should let admins read any order", func(t *testing.T) {
+		if code := request(adminUserID, "/orders/10"); code != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, code)
+		}
+	})
+
+	t.Run("should fail with an unknown order", func(t *testing.T) {
+		if code := request(1, "/orders/11"); code != http.StatusNotFound {
+			t.Errorf("expected status code %d, got %d", http.StatusNotFound, code)
+		}
+	})
+}
+
+const adminUserID = 3
+
+type mockOrderStore struct{}
+
+func (m *mockOrderStore) CreateOrder(order types.Order) (int, error) {
+	return 0, nil
+}
+
+func (m *mockOrderStore) CreateOrderItem(orderItem types.OrderItem) error {
+	return nil
+}
+
+func (m *mockOrderStore) GetOrderByID(id int) (*types.Order, error) {
+	if id != 10 {
+		return nil, fmt.Errorf("order not found")
+	}
+
+	return &types.Order{ID: 10, UserID: 1, Total: 42}, nil
+}
+
+func (m *mockOrderStore) GetOrderItems(orderID int) ([]types.OrderItem, error) {
+	return []types.OrderItem{{ID: 1, OrderID: orderID, ProductID: 1, Quantity: 2, Price: 21}}, nil
+}
@@ -3,18 +3,25 @@ package order
 
 import (
 	"database/sql"
+	"fmt"
 
+	"github.com/surfiniaburger/api-go/db"
 	"github.com/surfiniaburger/api-go/types"
 )
 
 type Store struct {
-	db *sql.DB
+	db db.DBTX
 }
 
 func NewStore(db *sql.DB) *Store {
 	return &Store{db: db}
 }
 
+// WithTx returns a copy of the store whose queries run inside tx.
+func (s *Store) WithTx(tx *sql.Tx) *Store {
+	return &Store{db: tx}
+}
+
 func (s *Store) CreateOrder(order types.Order) (int, error) {
 	res, err := s.db.Exec("INSERT INTO orders (userId, total, status, address) VALUES (?, ?, ?, ?)", order.UserID, order.Total, order.Status, order.Address)
 	if err != nil {
@@ -30,6 +37,40 @@ func (s *Store) CreateOrder(order types.Order) (int, error) {
 }
 
 func (s *Store) CreateOrderItem(orderItem types.OrderItem) error {
-	_, err := s.db.Exec("INSERT INTO order_items (orderId, productId, quantity, price) VALUES (?, ?, ?, ?)", orderItem.OrderID, orderItem.ProductID, orderItem.Quantity, orderItem.Price)
+	_, err := s.db.Exec("INSERT INTO order_items (orderId, productId, variantId, quantity, price) VALUES (?, ?, ?, ?, ?)", orderItem.OrderID, orderItem.ProductID, orderItem.VariantID, orderItem.Quantity, orderItem.Price)
 	return err
 }
+
+func (s *Store) GetOrderByID(id int) (*types.Order, error) {
+	row := s.db.QueryRow("SELECT id, userId, total, status, address, createdAt FROM orders WHERE id = ?", id)
+
+	o := new(types.Order)
+	err := row.Scan(&o.ID, &o.UserID, &o.Total, &o.Status, &o.Address, &o.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("order not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+func (s *Store) GetOrderItems(orderID int) ([]types.OrderItem, error) {
+	rows, err := s.db.Query("SELECT id, orderId, productId, variantId, quantity, price, createdAt FROM order_items WHERE orderId = ? ORDER BY id", orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []types.OrderItem{}
+	for rows.Next() {
+		var item types.OrderItem
+		if err := rows.Scan(&item.ID, &item.OrderID, &item.ProductID, &item.VariantID, &item.Quantity, &item.Price, &item.CreatedAt); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
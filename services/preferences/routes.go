@@ -0,0 +1,65 @@
+// preferences/routes.go
+package preferences
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/mux"
+	"github.com/surfiniaburger/api-go/services/auth"
+	"github.com/surfiniaburger/api-go/types"
+	"github.com/surfiniaburger/api-go/utils"
+)
+
+type Handler struct {
+	store     types.PreferencesStore
+	userStore types.UserGetter
+}
+
+func NewHandler(store types.PreferencesStore, userStore types.UserGetter) *Handler {
+	return &Handler{store: store, userStore: userStore}
+}
+
+func (h *Handler) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/me/preferences", auth.WithJWTAuth(h.handleGetPreferences, h.userStore)).Methods(http.MethodGet)
+	router.HandleFunc("/me/preferences", auth.WithJWTAuth(h.handleUpdatePreferences, h.userStore)).Methods(http.MethodPut)
+}
+
+func (h *Handler) handleGetPreferences(w http.ResponseWriter, r *http.Request) {
+	preferences, err := h.store.GetPreferences(auth.GetUserIDFromContext(r.Context()))
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, preferences)
+}
+
+func (h *Handler) handleUpdatePreferences(w http.ResponseWriter, r *http.Request) {
+	var payload types.PreferencesPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	preferences := types.Preferences{
+		UserID:        auth.GetUserIDFromContext(r.Context()),
+		Locale:        payload.Locale,
+		Currency:      payload.Currency,
+		Notifications: *payload.Notifications,
+	}
+
+	if err := h.store.UpdatePreferences(preferences); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, preferences)
+}
@@ -0,0 +1,121 @@
+package preferences
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/surfiniaburger/api-go/services/auth"
+	"github.com/surfiniaburger/api-go/services/auth/authtest"
+	"github.com/surfiniaburger/api-go/types"
+)
+
+func TestPreferences(t *testing.T) {
+	auth.SetRevocationStore(auth.NewMemoryRevocationStore())
+
+	store := &mockPreferencesStore{preferences: map[int]types.Preferences{}}
+	handler := NewHandler(store, &authtest.Users{})
+
+	router := mux.NewRouter()
+	handler.RegisterRoutes(router)
+
+	request := func(method string, userID int, payload any) *httptest.ResponseRecorder {
+		token, err := auth.CreateJWT(userID, auth.AMRPassword)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		marshalled, err := json.Marshal(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest(method, "/me/preferences", bytes.NewBuffer(marshalled))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	decode := func(rr *httptest.ResponseRecorder) types.Preferences {
+		var p types.Preferences
+		if err := json.NewDecoder(rr.Body).Decode(&p); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	t.Run("should return the defaults until the user saves their preferences", func(t *testing.T) {
+		rr := request(http.MethodGet, 1, nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if p := decode(rr); p != Defaults(0) {
+			t.Errorf("expected the defaults, got %+v", p)
+		}
+	})
+
+	t.Run("should save the preferences of the user", func(t *testing.T) {
+		payload := types.PreferencesPayload{
+			Locale:        "fr-FR",
+			Currency:      "EUR",
+			Notifications: &types.NotificationSettings{ReviewReplies: true},
+		}
+
+		rr := request(http.MethodPut, 1, payload)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		want := types.Preferences{UserID: 1, Locale: "fr-FR", Currency: "EUR", Notifications: types.NotificationSettings{ReviewReplies: true}}
+		if store.preferences[1] != want {
+			t.Errorf("expected %+v to be saved, got %+v", want, store.preferences[1])
+		}
+
+		if p := decode(request(http.MethodGet, 1, nil)); p.Locale != "fr-FR" || p.Notifications.OrderUpdates {
+			t.Errorf("unexpected preferences %+v", p)
+		}
+
+		if p := decode(request(http.MethodGet, 2, nil)); p.Locale != "en" {
+			t.Errorf("expected the defaults for another user, got %+v", p)
+		}
+	})
+
+	t.Run("should fail with invalid preferences", func(t *testing.T) {
+		for _, payload := range []types.PreferencesPayload{
+			{Locale: "not a locale", Currency: "EUR", Notifications: &types.NotificationSettings{}},
+			{Locale: "en", Currency: "EURO", Notifications: &types.NotificationSettings{}},
+			{Locale: "en", Currency: "EUR"},
+		} {
+			if rr := request(http.MethodPut, 1, payload); rr.Code != http.StatusBadRequest {
+				t.Errorf("%+v: expected status code %d, got %d", payload, http.StatusBadRequest, rr.Code)
+			}
+		}
+	})
+}
+
+type mockPreferencesStore struct {
+	preferences map[int]types.Preferences
+}
+
+func (m *mockPreferencesStore) GetPreferences(userID int) (*types.Preferences, error) {
+	p, ok := m.preferences[userID]
+	if !ok {
+		p = Defaults(userID)
+	}
+
+	return &p, nil
+}
+
+func (m *mockPreferencesStore) UpdatePreferences(p types.Preferences) error {
+	m.preferences[p.UserID] = p
+	return nil
+}
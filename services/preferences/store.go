@@ -0,0 +1,54 @@
+// preferences/store.go
+package preferences
+
+import (
+	"database/sql"
+
+	"github.com/surfiniaburger/api-go/types"
+)
+
+type Store struct {
+	db *sql.DB
+}
+
+func NewStore(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+// Defaults returns the preferences of a user who never saved theirs, with
+// every notification turned on. They match the defaults of the table.
+func Defaults(userID int) types.Preferences {
+	return types.Preferences{
+		UserID:   userID,
+		Locale:   "en",
+		Currency: "USD",
+		Notifications: types.NotificationSettings{
+			OrderUpdates:  true,
+			ReviewReplies: true,
+			LoanReminders: true,
+		},
+	}
+}
+
+func (s *Store) GetPreferences(userID int) (*types.Preferences, error) {
+	p := Defaults(userID)
+	err := s.db.QueryRow("SELECT locale, currency, orderUpdates, reviewReplies, loanReminders FROM user_preferences WHERE userId = ?", userID).
+		Scan(&p.Locale, &p.Currency, &p.Notifications.OrderUpdates, &p.Notifications.ReviewReplies, &p.Notifications.LoanReminders)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+func (s *Store) UpdatePreferences(p types.Preferences) error {
+	_, err := s.db.Exec(`
+		INSERT INTO user_preferences (userId, locale, currency, orderUpdates, reviewReplies, loanReminders)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+			locale = VALUES(locale), currency = VALUES(currency), orderUpdates = VALUES(orderUpdates),
+			reviewReplies = VALUES(reviewReplies), loanReminders = VALUES(loanReminders)`,
+		p.UserID, p.Locale, p.Currency, p.Notifications.OrderUpdates, p.Notifications.ReviewReplies, p.Notifications.LoanReminders,
+	)
+	return err
+}
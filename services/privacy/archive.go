@@ -0,0 +1,54 @@
+package privacy
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io"
+
+	"github.com/surfiniaburger/api-go/types"
+)
+
+// WriteArchive writes the export as a ZIP archive with a JSON file for each
+// part, readable without any tooling.
+func WriteArchive(w io.Writer, export *types.UserDataExport) error {
+	files := []struct {
+		name string
+		data any
+	}{
+		{"profile.json", export.Profile},
+		{"addresses.json", export.Addresses},
+		{"orders.json", export.Orders},
+		{"reviews.json", export.Reviews},
+		{"favorites.json", export.Favorites},
+		{"preferences.json", export.Preferences},
+	}
+
+	archive := zip.NewWriter(w)
+	for _, file := range files {
+		f, err := archive.CreateHeader(&zip.FileHeader{
+			Name:     file.name,
+			Method:   zip.Deflate,
+			Modified: export.ExportedAt,
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := writeIndentedJSON(f, file.data); err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
+
+// WriteJSON writes the export as a single JSON document.
+func WriteJSON(w io.Writer, export *types.UserDataExport) error {
+	return writeIndentedJSON(w, export)
+}
+
+func writeIndentedJSON(w io.Writer, v any) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
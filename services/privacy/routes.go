@@ -0,0 +1,123 @@
+// privacy/routes.go
+package privacy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/surfiniaburger/api-go/services/auth"
+	"github.com/surfiniaburger/api-go/types"
+	"github.com/surfiniaburger/api-go/utils"
+)
+
+type Handler struct {
+	store     types.PrivacyStore
+	userStore types.UserGetter
+}
+
+func NewHandler(store types.PrivacyStore, userStore types.UserGetter) *Handler {
+	return &Handler{store: store, userStore: userStore}
+}
+
+func (h *Handler) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/me/export", auth.WithJWTAuth(auth.DenyImpersonation(h.handleExportMe), h.userStore)).Methods(http.MethodGet)
+
+	// admin routes, to answer the requests of users who cannot log in
+	router.HandleFunc("/admin/users/{userID}/export", auth.WithJWTAuth(h.handleExportUser, h.userStore, auth.PermUsersManage)).Methods(http.MethodGet)
+	router.HandleFunc("/admin/users/{userID}/erase", auth.WithJWTAuth(h.handleEraseUser, h.userStore, auth.PermUsersManage)).Methods(http.MethodPost)
+}
+
+// handleExportMe downloads the data of the authenticated user.
+func (h *Handler) handleExportMe(w http.ResponseWriter, r *http.Request) {
+	h.export(w, r, auth.GetUserIDFromContext(r.Context()))
+}
+
+func (h *Handler) handleExportUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(mux.Vars(r)["userID"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid user ID"))
+		return
+	}
+
+	if _, err := h.userStore.GetUserByID(userID); err != nil {
+		utils.WriteError(w, http.StatusNotFound, err)
+		return
+	}
+
+	log.Printf("admin %d exported the data of user %d", auth.GetUserIDFromContext(r.Context()), userID)
+
+	h.export(w, r, userID)
+}
+
+// handleEraseUser anonymizes a user for good. The user can no longer log in,
+// their orders are kept for accounting.
+func (h *Handler) handleEraseUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(mux.Vars(r)["userID"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid user ID"))
+		return
+	}
+
+	actorID := auth.GetUserIDFromContext(r.Context())
+	if userID == actorID {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("you cannot erase your own account"))
+		return
+	}
+
+	if _, err := h.userStore.GetUserByID(userID); err != nil {
+		utils.WriteError(w, http.StatusNotFound, err)
+		return
+	}
+
+	if err := h.store.EraseUser(userID); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// erased users are deleted, so WithJWTAuth already refuses the tokens
+	// they were issued
+	log.Printf("admin %d erased user %d", actorID, userID)
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "user erased"})
+}
+
+// export writes the data of the user as a JSON document, or a ZIP archive
+// with format=zip.
+func (h *Handler) export(w http.ResponseWriter, r *http.Request, userID int) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+
+	if format != "json" && format != "zip" {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid format: %s", format))
+		return
+	}
+
+	export, err := h.store.ExportUserData(userID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	filename := fmt.Sprintf("user-%d-export.%s", userID, format)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	if format == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+		w.WriteHeader(http.StatusOK)
+		err = WriteArchive(w, export)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		err = WriteJSON(w, export)
+	}
+
+	// the status is already sent, all we can do is log
+	if err != nil {
+		log.Printf("failed to write the export of user %d: %v", userID, err)
+	}
+}
@@ -0,0 +1,174 @@
+package privacy
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/surfiniaburger/api-go/services/auth"
+	"github.com/surfiniaburger/api-go/services/auth/authtest"
+	"github.com/surfiniaburger/api-go/types"
+)
+
+func TestPrivacy(t *testing.T) {
+	auth.SetRevocationStore(auth.NewMemoryRevocationStore())
+
+	store := &mockPrivacyStore{}
+	userStore := &authtest.Users{Roles: map[int]string{1: "admin"}, Deleted: store.isErased}
+	handler := NewHandler(store, userStore)
+
+	router := mux.NewRouter()
+	handler.RegisterRoutes(router)
+
+	request := func(method, path string, userID int, methods ...string) *httptest.ResponseRecorder {
+		token, err := auth.CreateJWT(userID, methods...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest(method, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("should export the data of the user as JSON", func(t *testing.T) {
+		rr := request(http.MethodGet, "/me/export", 42, auth.AMRPassword)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if disposition := rr.Header().Get("Content-Disposition"); disposition != `attachment; filename="user-42-export.json"` {
+			t.Errorf("unexpected Content-Disposition %q", disposition)
+		}
+
+		var export types.UserDataExport
+		if err := json.NewDecoder(rr.Body).Decode(&export); err != nil {
+			t.Fatal(err)
+		}
+
+		if export.Profile.ID != 42 || len(export.Orders) != 1 || len(export.Orders[0].Items) != 1 || len(export.Reviews) != 1 {
+			t.Errorf("unexpected export %+v", export)
+		}
+	})
+
+	t.Run("should export the data of the user as a ZIP archive", func(t *testing.T) {
+		rr := request(http.MethodGet, "/me/export?format=zip", 42, auth.AMRPassword)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		archive, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		files := make(map[string][]byte)
+		for _, f := range archive.File {
+			r, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			files[f.Name], err = io.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, name := range []string{"profile.json", "addresses.json", "orders.json", "reviews.json", "favorites.json", "preferences.json"} {
+			if _, ok := files[name]; !ok {
+				t.Errorf("expected %s in the archive", name)
+			}
+		}
+
+		var profile types.User
+		if err := json.Unmarshal(files["profile.json"], &profile); err != nil || profile.Email != "me@me.com" {
+			t.Errorf("unexpected profile %s: %v", files["profile.json"], err)
+		}
+
+		if rr := request(http.MethodGet, "/me/export?format=xml", 42, auth.AMRPassword); rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+
+	t.Run("should only let admins export and erase other users", func(t *testing.T) {
+		if rr := request(http.MethodGet, "/admin/users/7/export", 42, auth.AMRPassword); rr.Code != http.StatusForbidden {
+			t.Errorf("expected status code %d, got %d", http.StatusForbidden, rr.Code)
+		}
+
+		if rr := request(http.MethodPost, "/admin/users/7/erase", 42, auth.AMRPassword); rr.Code != http.StatusForbidden {
+			t.Errorf("expected status code %d, got %d", http.StatusForbidden, rr.Code)
+		}
+
+		if rr := request(http.MethodGet, "/admin/users/7/export", 1, auth.AMRPassword, auth.AMROTP); rr.Code != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if len(store.erased) != 0 {
+			t.Errorf("expected no user to be erased, got %v", store.erased)
+		}
+	})
+
+	t.Run("should erase a user", func(t *testing.T) {
+		if rr := request(http.MethodPost, "/admin/users/1/erase", 1, auth.AMRPassword, auth.AMROTP); rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+
+		if rr := request(http.MethodPost, "/admin/users/42/erase", 1, auth.AMRPassword, auth.AMROTP); rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if len(store.erased) != 1 || store.erased[0] != 42 {
+			t.Errorf("expected user 42 to be erased, got %v", store.erased)
+		}
+
+		if rr := request(http.MethodGet, "/me/export", 42, auth.AMRPassword); rr.Code != http.StatusForbidden {
+			t.Errorf("expected the erased user to be signed out, got %d", rr.Code)
+		}
+	})
+}
+
+type mockPrivacyStore struct {
+	erased []int
+}
+
+func (m *mockPrivacyStore) ExportUserData(userID int) (*types.UserDataExport, error) {
+	now := time.Now()
+	return &types.UserDataExport{
+		ExportedAt: now,
+		Profile:    types.User{ID: userID, Email: "me@me.com", Role: "user"},
+		Addresses:  []types.Address{},
+		Orders: []types.OrderDetails{{
+			Order: types.Order{ID: 1, UserID: userID, Total: 10, Status: "pending"},
+			Items: []types.OrderItem{{ID: 1, OrderID: 1, ProductID: 1, Quantity: 1, Price: 10}},
+		}},
+		Reviews:   []types.Review{{ReviewID: "1", UserID: fmt.Sprint(userID), BookID: "1", Rating: 5, Comment: "great"}},
+		Favorites: []types.Favorite{},
+	}, nil
+}
+
+func (m *mockPrivacyStore) EraseUser(userID int) error {
+	m.erased = append(m.erased, userID)
+	return nil
+}
+
+// isErased reports the users erased by the store, which are deleted from then
+// on.
+func (m *mockPrivacyStore) isErased(userID int) bool {
+	return slices.Contains(m.erased, userID)
+}
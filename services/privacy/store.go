@@ -0,0 +1,254 @@
+// privacy/store.go
+package privacy
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/surfiniaburger/api-go/db"
+	"github.com/surfiniaburger/api-go/services/preferences"
+	"github.com/surfiniaburger/api-go/types"
+)
+
+// personalTables hold data only kept for the user's account, removed when the
+// user is erased. Child tables come before the tables they reference.
+var personalTables = []string{
+	"favorites",
+	"addresses",
+	"mfa_recovery_codes",
+	"user_mfa",
+	"api_keys",
+	"sessions",
+	"refresh_tokens",
+	"user_identities",
+	"password_reset_tokens",
+	"email_verification_tokens",
+	"email_change_tokens",
+	"user_preferences",
+	"inventory_reservations",
+}
+
+type Store struct {
+	db *sql.DB
+}
+
+func NewStore(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+// ExportUserData reads everything inside one transaction so the parts of the
+// export are consistent with each other.
+func (s *Store) ExportUserData(userID int) (*types.UserDataExport, error) {
+	export := &types.UserDataExport{
+		ExportedAt: time.Now(),
+		Addresses:  []types.Address{},
+		Orders:     []types.OrderDetails{},
+		Reviews:    []types.Review{},
+		Favorites:  []types.Favorite{},
+	}
+
+	err := db.WithTx(s.db, func(tx *sql.Tx) error {
+		if err := exportProfile(tx, userID, &export.Profile); err != nil {
+			return err
+		}
+
+		if err := exportAddresses(tx, userID, &export.Addresses); err != nil {
+			return err
+		}
+
+		if err := exportOrders(tx, userID, &export.Orders); err != nil {
+			return err
+		}
+
+		if err := exportReviews(tx, userID, &export.Reviews); err != nil {
+			return err
+		}
+
+		if err := exportFavorites(tx, userID, &export.Favorites); err != nil {
+			return err
+		}
+
+		return exportPreferences(tx, userID, &export.Preferences)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return export, nil
+}
+
+func (s *Store) EraseUser(userID int) error {
+	return db.WithTx(s.db, func(tx *sql.Tx) error {
+		// login attempts are keyed by the email address, so they go before
+		// the address is overwritten
+		_, err := tx.Exec("DELETE FROM login_attempts WHERE attemptKey = (SELECT CONCAT('account:', LOWER(email)) FROM users WHERE id = ?)", userID)
+		if err != nil {
+			return err
+		}
+
+		for _, table := range personalTables {
+			if _, err := tx.Exec("DELETE FROM "+table+" WHERE userId = ?", userID); err != nil {
+				return fmt.Errorf("failed to erase %s: %w", table, err)
+			}
+		}
+
+		// ratings are kept so the averages of the books do not change, the
+		// comments may tell who wrote them
+		if _, err := tx.Exec("UPDATE reviews SET comment = '' WHERE userId = ?", userID); err != nil {
+			return err
+		}
+
+		// the row stays for the orders referencing it, the email address is
+		// replaced by a unique one nobody can receive mail at
+		res, err := tx.Exec(`
+			UPDATE users SET
+				firstName = '', lastName = '', email = CONCAT('erased-', id, '@erased.invalid'), password = '',
+				emailVerified = FALSE, deletedAt = COALESCE(deletedAt, NOW())
+			WHERE id = ?`,
+			userID,
+		)
+		if err != nil {
+			return err
+		}
+
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if affected != 1 {
+			return fmt.Errorf("user not found")
+		}
+
+		return nil
+	})
+}
+
+func exportProfile(tx *sql.Tx, userID int, u *types.User) error {
+	var deletedAt sql.NullTime
+	err := tx.QueryRow("SELECT id, firstName, lastName, email, role, createdAt, emailVerified, status, deletedAt FROM users WHERE id = ?", userID).
+		Scan(&u.ID, &u.FirstName, &u.LastName, &u.Email, &u.Role, &u.CreatedAt, &u.EmailVerified, &u.Status, &deletedAt)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("user not found")
+	}
+	if err != nil {
+		return err
+	}
+
+	if deletedAt.Valid {
+		u.DeletedAt = &deletedAt.Time
+	}
+
+	return nil
+}
+
+func exportPreferences(tx *sql.Tx, userID int, p *types.Preferences) error {
+	*p = preferences.Defaults(userID)
+	err := tx.QueryRow("SELECT locale, currency, orderUpdates, reviewReplies, loanReminders FROM user_preferences WHERE userId = ?", userID).
+		Scan(&p.Locale, &p.Currency, &p.Notifications.OrderUpdates, &p.Notifications.ReviewReplies, &p.Notifications.LoanReminders)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+
+	return err
+}
+
+func exportAddresses(tx *sql.Tx, userID int, addresses *[]types.Address) error {
+	rows, err := tx.Query("SELECT id, userId, line1, line2, city, region, postalCode, country, isDefaultShipping, isDefaultBilling, createdAt FROM addresses WHERE userId = ? ORDER BY id", userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a types.Address
+		err := rows.Scan(&a.ID, &a.UserID, &a.Line1, &a.Line2, &a.City, &a.Region, &a.PostalCode, &a.Country, &a.IsDefaultShipping, &a.IsDefaultBilling, &a.CreatedAt)
+		if err != nil {
+			return err
+		}
+		*addresses = append(*addresses, a)
+	}
+
+	return rows.Err()
+}
+
+func exportOrders(tx *sql.Tx, userID int, orders *[]types.OrderDetails) error {
+	rows, err := tx.Query("SELECT id, userId, total, status, address, createdAt FROM orders WHERE userId = ? ORDER BY id", userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	index := make(map[int]int)
+	for rows.Next() {
+		o := types.OrderDetails{Items: []types.OrderItem{}}
+		if err := rows.Scan(&o.ID, &o.UserID, &o.Total, &o.Status, &o.Address, &o.CreatedAt); err != nil {
+			return err
+		}
+		index[o.ID] = len(*orders)
+		*orders = append(*orders, o)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	itemRows, err := tx.Query(`
+		SELECT oi.id, oi.orderId, oi.productId, oi.variantId, oi.quantity, oi.price, oi.createdAt
+		FROM order_items oi JOIN orders o ON o.id = oi.orderId
+		WHERE o.userId = ? ORDER BY oi.id`,
+		userID,
+	)
+	if err != nil {
+		return err
+	}
+	defer itemRows.Close()
+
+	for itemRows.Next() {
+		var item types.OrderItem
+		if err := itemRows.Scan(&item.ID, &item.OrderID, &item.ProductID, &item.VariantID, &item.Quantity, &item.Price, &item.CreatedAt); err != nil {
+			return err
+		}
+
+		o := &(*orders)[index[item.OrderID]]
+		o.Items = append(o.Items, item)
+	}
+
+	return itemRows.Err()
+}
+
+func exportReviews(tx *sql.Tx, userID int, reviews *[]types.Review) error {
+	rows, err := tx.Query("SELECT reviewId, userId, bookId, rating, COALESCE(comment, ''), createdAt FROM reviews WHERE userId = ? ORDER BY reviewId", userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r types.Review
+		if err := rows.Scan(&r.ReviewID, &r.UserID, &r.BookID, &r.Rating, &r.Comment, &r.CreatedAt); err != nil {
+			return err
+		}
+		*reviews = append(*reviews, r)
+	}
+
+	return rows.Err()
+}
+
+func exportFavorites(tx *sql.Tx, userID int, favorites *[]types.Favorite) error {
+	rows, err := tx.Query("SELECT favoriteId, userId, bookId, createdAt FROM favorites WHERE userId = ? ORDER BY favoriteId", userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var f types.Favorite
+		if err := rows.Scan(&f.FavoriteID, &f.UserID, &f.BookID, &f.CreatedAt); err != nil {
+			return err
+		}
+		*favorites = append(*favorites, f)
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,84 @@
+package product
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	"github.com/surfiniaburger/api-go/types"
+)
+
+// sortOrder is how products are ordered for a sort option. The id breaks ties
+// so every product has a unique position to resume from.
+type sortOrder struct {
+	column string
+	desc   bool
+}
+
+var sortOrders = map[string]sortOrder{
+	types.ProductSortNewest:    {column: "createdAt", desc: true},
+	types.ProductSortPriceAsc:  {column: "price"},
+	types.ProductSortPriceDesc: {column: "price", desc: true},
+	types.ProductSortName:      {column: "name"},
+}
+
+// cursor is the position of the last product of a page in the order of the
+// sort, the next page starts right after it. Clients get it base64 encoded and
+// should not rely on its content.
+type cursor struct {
+	Sort      string    `json:"s"`
+	ID        int       `json:"i"`
+	CreatedAt time.Time `json:"c"`
+	Price     float64   `json:"p"`
+	Name      string    `json:"n"`
+}
+
+func newCursor(sort string, p types.Product) cursor {
+	c := cursor{Sort: sort, ID: p.ID}
+	switch sortOrders[sort].column {
+	case "createdAt":
+		c.CreatedAt = p.CreatedAt
+	case "price":
+		c.Price = p.Price
+	case "name":
+		c.Name = p.Name
+	}
+
+	return c
+}
+
+// value returns the value of the sort column at the cursor.
+func (c cursor) value() any {
+	switch sortOrders[c.Sort].column {
+	case "createdAt":
+		return c.CreatedAt
+	case "price":
+		return c.Price
+	default:
+		return c.Name
+	}
+}
+
+func encodeCursor(c cursor) (string, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// decodeCursor returns types.ErrInvalidCursor if s is not a cursor for the sort.
+func decodeCursor(s, sort string) (cursor, error) {
+	var c cursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, types.ErrInvalidCursor
+	}
+
+	if err := json.Unmarshal(data, &c); err != nil || c.Sort != sort || c.ID < 1 {
+		return c, types.ErrInvalidCursor
+	}
+
+	return c, nil
+}
@@ -0,0 +1,50 @@
+package product
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// etag returns the strong ETag of a product version.
+func etag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// matchesIfMatch reports whether the If-Match header of the request matches
+// the version. Weak tags never match, as required for If-Match.
+func matchesIfMatch(r *http.Request, version int) bool {
+	for _, tag := range strings.Split(r.Header.Get("If-Match"), ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag(version) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// mergePatch applies a JSON merge patch (RFC 7396) to a decoded JSON document:
+// members of the patch replace those of the document, objects are merged
+// recursively and null removes a member.
+func mergePatch(doc, patch any) any {
+	patchObject, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+
+	docObject, ok := doc.(map[string]any)
+	if !ok {
+		docObject = map[string]any{}
+	}
+
+	for name, value := range patchObject {
+		if value == nil {
+			delete(docObject, name)
+			continue
+		}
+		docObject[name] = mergePatch(docObject[name], value)
+	}
+
+	return docObject
+}
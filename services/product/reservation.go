@@ -0,0 +1,32 @@
+package product
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/surfiniaburger/api-go/types"
+)
+
+// PruneReservations periodically deletes the expired reservations until ctx
+// is done. It does not start if the interval is not above zero.
+func PruneReservations(ctx context.Context, store types.ReservationStore, interval time.Duration) {
+	if interval <= 0 {
+		log.Printf("not pruning reservations, invalid interval %s", interval)
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := store.PruneReservations(); err != nil {
+				log.Printf("failed to prune reservations: %v", err)
+			}
+		}
+	}
+}
@@ -2,8 +2,14 @@
 package product
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"mime"
 	"net/http"
+	"net/url"
 	"strconv"
 
 	"github.com/go-playground/validator/v10"
@@ -13,31 +19,54 @@ import (
 	"github.com/surfiniaburger/api-go/utils"
 )
 
+const (
+	defaultProductPageSize = 20
+	maxProductPageSize     = 100
+)
+
 type Handler struct {
-	store     types.ProductStore
-	userStore types.UserStore
+	store        types.ProductStore
+	variantStore types.VariantStore
+	userStore    types.UserGetter
 }
 
-func NewHandler(store types.ProductStore, userStore types.UserStore) *Handler {
-	return &Handler{store: store, userStore: userStore}
+func NewHandler(store types.ProductStore, variantStore types.VariantStore, userStore types.UserGetter) *Handler {
+	return &Handler{store: store, variantStore: variantStore, userStore: userStore}
 }
 
 func (h *Handler) RegisterRoutes(router *mux.Router) {
 	router.HandleFunc("/products", h.handleGetProducts).Methods(http.MethodGet)
 	router.HandleFunc("/products/{productID}", h.handleGetProduct).Methods(http.MethodGet)
+	router.HandleFunc("/products/{productID}/variants", h.handleGetVariants).Methods(http.MethodGet)
 
 	// admin routes
-	router.HandleFunc("/products", auth.WithJWTAuth(h.handleCreateProduct, h.userStore, "admin")).Methods(http.MethodPost)
+	router.HandleFunc("/products", auth.WithJWTAuth(h.handleCreateProduct, h.userStore, auth.PermProductsWrite)).Methods(http.MethodPost)
+	router.HandleFunc("/products/{productID}", auth.WithJWTAuth(h.handleUpdateProduct, h.userStore, auth.PermProductsWrite)).Methods(http.MethodPut)
+	router.HandleFunc("/products/{productID}", auth.WithJWTAuth(h.handlePatchProduct, h.userStore, auth.PermProductsWrite)).Methods(http.MethodPatch)
+	router.HandleFunc("/products/{productID}", auth.WithJWTAuth(h.handleDeleteProduct, h.userStore, auth.PermProductsWrite)).Methods(http.MethodDelete)
+	router.HandleFunc("/products/{productID}/variants", auth.WithJWTAuth(h.handleCreateVariant, h.userStore, auth.PermProductsWrite)).Methods(http.MethodPost)
+	router.HandleFunc("/products/{productID}/variants/{variantID}", auth.WithJWTAuth(h.handleUpdateVariant, h.userStore, auth.PermProductsWrite)).Methods(http.MethodPut)
+	router.HandleFunc("/products/{productID}/variants/{variantID}", auth.WithJWTAuth(h.handleDeleteVariant, h.userStore, auth.PermProductsWrite)).Methods(http.MethodDelete)
 }
 
 func (h *Handler) handleGetProducts(w http.ResponseWriter, r *http.Request) {
-	products, err := h.store.GetProducts()
+	filter, err := parseProductFilter(r.URL.Query())
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	page, err := h.store.GetProducts(filter)
+	if errors.Is(err, types.ErrInvalidCursor) {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
 	if err != nil {
 		utils.WriteError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	utils.WriteJSON(w, http.StatusOK, products)
+	utils.WriteJSON(w, http.StatusOK, page)
 }
 
 func (h *Handler) handleGetProduct(w http.ResponseWriter, r *http.Request) {
@@ -60,6 +89,18 @@ func (h *Handler) handleGetProduct(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if product.ID == 0 {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("product not found"))
+		return
+	}
+
+	product.Variants, err = h.variantStore.GetVariants(product.ID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag(product.Version))
 	utils.WriteJSON(w, http.StatusOK, product)
 }
 
@@ -84,3 +125,418 @@ func (h *Handler) handleCreateProduct(w http.ResponseWriter, r *http.Request) {
 
 	utils.WriteJSON(w, http.StatusCreated, product)
 }
+
+func parseProductFilter(query url.Values) (types.ProductFilter, error) {
+	filter := types.ProductFilter{
+		Search: query.Get("q"),
+		Sort:   query.Get("sort"),
+		Cursor: query.Get("cursor"),
+		Limit:  defaultProductPageSize,
+	}
+
+	if filter.Sort == "" {
+		filter.Sort = types.ProductSortNewest
+	}
+	if _, ok := sortOrders[filter.Sort]; !ok {
+		return filter, fmt.Errorf("invalid sort %s, expected one of %s, %s, %s or %s", filter.Sort,
+			types.ProductSortNewest, types.ProductSortPriceAsc, types.ProductSortPriceDesc, types.ProductSortName)
+	}
+
+	if len(filter.Search) > 255 {
+		return filter, fmt.Errorf("q must be at most 255 characters long")
+	}
+
+	var err error
+	if filter.MinPrice, err = parsePriceParam(query, "minPrice"); err != nil {
+		return filter, err
+	}
+	if filter.MaxPrice, err = parsePriceParam(query, "maxPrice"); err != nil {
+		return filter, err
+	}
+	if filter.MinPrice != nil && filter.MaxPrice != nil && *filter.MinPrice > *filter.MaxPrice {
+		return filter, fmt.Errorf("minPrice must not be greater than maxPrice")
+	}
+
+	if v := query.Get("inStock"); v != "" {
+		inStock, err := strconv.ParseBool(v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid inStock")
+		}
+		filter.InStock = inStock
+	}
+
+	filter.Category = query.Get("category")
+	if v := query.Get("includeDescendants"); v != "" {
+		includeDescendants, err := strconv.ParseBool(v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid includeDescendants")
+		}
+		if filter.Category == "" {
+			return filter, fmt.Errorf("includeDescendants requires a category")
+		}
+		filter.IncludeDescendants = includeDescendants
+	}
+
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxProductPageSize {
+			return filter, fmt.Errorf("limit must be between 1 and %d", maxProductPageSize)
+		}
+		filter.Limit = limit
+	}
+
+	return filter, nil
+}
+
+// parsePriceParam returns the price of the query parameter, or nil if it is
+// not set.
+func parsePriceParam(query url.Values, name string) (*float64, error) {
+	v := query.Get(name)
+	if v == "" {
+		return nil, nil
+	}
+
+	price, err := strconv.ParseFloat(v, 64)
+	if err != nil || price < 0 || math.IsNaN(price) || math.IsInf(price, 0) {
+		return nil, fmt.Errorf("invalid %s", name)
+	}
+
+	return &price, nil
+}
+
+// handleUpdateProduct replaces the product. The If-Match header must hold the
+// ETag of the product, so changes made since it was read are not overwritten.
+func (h *Handler) handleUpdateProduct(w http.ResponseWriter, r *http.Request) {
+	product, ok := h.getProductForUpdate(w, r)
+	if !ok {
+		return
+	}
+
+	var payload types.UpdateProductPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	h.saveProduct(w, product, payload)
+}
+
+// handlePatchProduct applies a JSON merge patch to the product, with the same
+// If-Match requirement as handleUpdateProduct.
+func (h *Handler) handlePatchProduct(w http.ResponseWriter, r *http.Request) {
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/merge-patch+json" {
+		utils.WriteError(w, http.StatusUnsupportedMediaType, fmt.Errorf("the patch must be an application/merge-patch+json document"))
+		return
+	}
+
+	product, ok := h.getProductForUpdate(w, r)
+	if !ok {
+		return
+	}
+
+	var patch any
+	if err := utils.ParseJSON(r, &patch); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if _, ok := patch.(map[string]any); !ok {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("the patch must be a JSON object"))
+		return
+	}
+
+	// the patch applies to the fields that can be updated, anything else in
+	// it such as the ID or the version is refused
+	current, err := json.Marshal(types.UpdateProductPayload{
+		Name:        product.Name,
+		Description: product.Description,
+		Image:       product.Image,
+		Price:       product.Price,
+	})
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	var doc any
+	if err := json.Unmarshal(current, &doc); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	patched, err := json.Marshal(mergePatch(doc, patch))
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	var payload types.UpdateProductPayload
+	decoder := json.NewDecoder(bytes.NewReader(patched))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid patch: %v", err))
+		return
+	}
+
+	h.saveProduct(w, product, payload)
+}
+
+// handleDeleteProduct hides the product from the catalog and checkout. Like
+// updates, it requires the If-Match header so a product is not deleted based
+// on a stale read.
+func (h *Handler) handleDeleteProduct(w http.ResponseWriter, r *http.Request) {
+	product, ok := h.getProductForUpdate(w, r)
+	if !ok {
+		return
+	}
+
+	deleted, err := h.store.DeleteProduct(product.ID, product.Version)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if !deleted {
+		utils.WriteError(w, http.StatusPreconditionFailed, fmt.Errorf("the product was changed, get it again"))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "product deleted"})
+}
+
+// getProductForUpdate returns the product of the route if the If-Match header
+// of the request matches it, writing the error response if it does not.
+func (h *Handler) getProductForUpdate(w http.ResponseWriter, r *http.Request) (*types.Product, bool) {
+	productID, err := strconv.Atoi(mux.Vars(r)["productID"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid product ID"))
+		return nil, false
+	}
+
+	product, err := h.store.GetProductByID(productID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return nil, false
+	}
+
+	if product.ID == 0 {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("product not found"))
+		return nil, false
+	}
+
+	if r.Header.Get("If-Match") == "" {
+		utils.WriteError(w, http.StatusPreconditionRequired, fmt.Errorf("the If-Match header must hold the ETag of the product"))
+		return nil, false
+	}
+
+	if !matchesIfMatch(r, product.Version) {
+		utils.WriteError(w, http.StatusPreconditionFailed, fmt.Errorf("the product was changed, get it again"))
+		return nil, false
+	}
+
+	return product, true
+}
+
+// saveProduct validates the new fields of the product and saves them if the
+// product did not change since it was read.
+func (h *Handler) saveProduct(w http.ResponseWriter, product *types.Product, payload types.UpdateProductPayload) {
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	product.Name = payload.Name
+	product.Description = payload.Description
+	product.Image = payload.Image
+	product.Price = payload.Price
+
+	updated, err := h.store.UpdateProduct(*product)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if !updated {
+		utils.WriteError(w, http.StatusPreconditionFailed, fmt.Errorf("the product was changed, get it again"))
+		return
+	}
+
+	product.Version++
+	w.Header().Set("ETag", etag(product.Version))
+	utils.WriteJSON(w, http.StatusOK, product)
+}
+
+func (h *Handler) handleGetVariants(w http.ResponseWriter, r *http.Request) {
+	product, ok := h.getProduct(w, r)
+	if !ok {
+		return
+	}
+
+	variants, err := h.variantStore.GetVariants(product.ID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, variants)
+}
+
+func (h *Handler) handleCreateVariant(w http.ResponseWriter, r *http.Request) {
+	product, ok := h.getProduct(w, r)
+	if !ok {
+		return
+	}
+
+	variant, ok := h.parseVariant(w, r, product.ID, 0)
+	if !ok {
+		return
+	}
+
+	id, err := h.variantStore.CreateVariant(*variant)
+	if errors.Is(err, types.ErrSKUTaken) {
+		utils.WriteError(w, http.StatusConflict, fmt.Errorf("the SKU %s is already in use", variant.SKU))
+		return
+	}
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	variant.ID = id
+	utils.WriteJSON(w, http.StatusCreated, variant)
+}
+
+func (h *Handler) handleUpdateVariant(w http.ResponseWriter, r *http.Request) {
+	existing, ok := h.getVariant(w, r)
+	if !ok {
+		return
+	}
+
+	variant, ok := h.parseVariant(w, r, existing.ProductID, existing.ID)
+	if !ok {
+		return
+	}
+	variant.CreatedAt = existing.CreatedAt
+
+	err := h.variantStore.UpdateVariant(*variant)
+	if errors.Is(err, types.ErrSKUTaken) {
+		utils.WriteError(w, http.StatusConflict, fmt.Errorf("the SKU %s is already in use", variant.SKU))
+		return
+	}
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, variant)
+}
+
+// handleDeleteVariant stops selling the variant, past orders keep
+// referencing it.
+func (h *Handler) handleDeleteVariant(w http.ResponseWriter, r *http.Request) {
+	variant, ok := h.getVariant(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.variantStore.DeleteVariant(variant.ProductID, variant.ID); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "variant deleted"})
+}
+
+// parseVariant reads the variant of the request body, writing the error
+// response if it is not valid or its options do not fit the other variants
+// of the product. variantID is 0 for a new variant.
+func (h *Handler) parseVariant(w http.ResponseWriter, r *http.Request, productID, variantID int) (*types.ProductVariant, bool) {
+	var payload types.VariantPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return nil, false
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return nil, false
+	}
+
+	variant := &types.ProductVariant{
+		ID:        variantID,
+		ProductID: productID,
+		SKU:       payload.SKU,
+		Options:   payload.Options,
+		Price:     payload.Price,
+		Quantity:  *payload.Quantity,
+	}
+	if variant.Options == nil {
+		variant.Options = map[string]string{}
+	}
+
+	variants, err := h.variantStore.GetVariants(productID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return nil, false
+	}
+
+	if err := checkVariantOptions(variants, *variant); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return nil, false
+	}
+
+	return variant, true
+}
+
+// getProduct returns the product of the route, writing the error response if
+// there is none.
+func (h *Handler) getProduct(w http.ResponseWriter, r *http.Request) (*types.Product, bool) {
+	productID, err := strconv.Atoi(mux.Vars(r)["productID"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid product ID"))
+		return nil, false
+	}
+
+	product, err := h.store.GetProductByID(productID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return nil, false
+	}
+
+	if product.ID == 0 {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("product not found"))
+		return nil, false
+	}
+
+	return product, true
+}
+
+// getVariant returns the variant of the route, writing the error response if
+// the product has no such variant.
+func (h *Handler) getVariant(w http.ResponseWriter, r *http.Request) (*types.ProductVariant, bool) {
+	product, ok := h.getProduct(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	variantID, err := strconv.Atoi(mux.Vars(r)["variantID"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid variant ID"))
+		return nil, false
+	}
+
+	variant, err := h.variantStore.GetVariant(product.ID, variantID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return nil, false
+	}
+
+	if variant.ID == 0 {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("variant not found"))
+		return nil, false
+	}
+
+	return variant, true
+}
@@ -2,19 +2,22 @@ package product
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/surfiniaburger/api-go/services/auth/authtest"
 	"github.com/surfiniaburger/api-go/types"
 )
 
 func TestProductServiceHandlers(t *testing.T) {
-	productStore := &mockProductStore{}
-	userStore := &mockUserStore{}
-	handler := NewHandler(productStore, userStore)
+	productStore := newMockProductStore()
+	userStore := &authtest.Users{}
+	handler := NewHandler(productStore, newMockVariantStore(), userStore)
 
 	t.Run("should handle get products", func(t *testing.T) {
 		req, err := http.NewRequest(http.MethodGet, "/products", nil)
@@ -34,6 +37,77 @@ func TestProductServiceHandlers(t *testing.T) {
 		}
 	})
 
+	t.Run("should page through the products matching the filters", func(t *testing.T) {
+		next, err := encodeCursor(newCursor(types.ProductSortPriceAsc, types.Product{ID: 7, Price: 12.5}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest(http.MethodGet, "/products?minPrice=10&maxPrice=20.5&inStock=true&q=book&category=books&includeDescendants=true&sort=price_asc&limit=5&cursor="+next, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		router := mux.NewRouter()
+		router.HandleFunc("/products", handler.handleGetProducts).Methods(http.MethodGet)
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body)
+		}
+
+		filter := productStore.filters[len(productStore.filters)-1]
+		if *filter.MinPrice != 10 || *filter.MaxPrice != 20.5 || !filter.InStock || filter.Search != "book" || filter.Category != "books" || !filter.IncludeDescendants || filter.Sort != types.ProductSortPriceAsc || filter.Limit != 5 || filter.Cursor != next {
+			t.Errorf("unexpected filter %+v", filter)
+		}
+	})
+
+	t.Run("should list the newest products by default", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "/products", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		router := mux.NewRouter()
+		router.HandleFunc("/products", handler.handleGetProducts).Methods(http.MethodGet)
+		router.ServeHTTP(rr, req)
+
+		var page types.ProductPage
+		if err := json.NewDecoder(rr.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+
+		filter := productStore.filters[len(productStore.filters)-1]
+		if filter.Sort != types.ProductSortNewest || filter.Limit != defaultProductPageSize || filter.MinPrice != nil || filter.InStock {
+			t.Errorf("unexpected filter %+v", filter)
+		}
+	})
+
+	t.Run("should fail with invalid filters", func(t *testing.T) {
+		next, err := encodeCursor(newCursor(types.ProductSortNewest, types.Product{ID: 7}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, query := range []string{"sort=popular", "limit=0", "limit=101", "minPrice=-1", "maxPrice=NaN", "minPrice=20&maxPrice=10", "inStock=maybe", "includeDescendants=true", "category=books&includeDescendants=maybe", "cursor=garbage", "sort=name&cursor=" + next} {
+			req, err := http.NewRequest(http.MethodGet, "/products?"+query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			router := mux.NewRouter()
+			router.HandleFunc("/products", handler.handleGetProducts).Methods(http.MethodGet)
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusBadRequest {
+				t.Errorf("%s: expected status code %d, got %d", query, http.StatusBadRequest, rr.Code)
+			}
+		}
+	})
+
 	t.Run("should fail if the product ID is not a number", func(t *testing.T) {
 		req, err := http.NewRequest(http.MethodGet, "/products/abc", nil)
 		if err != nil {
@@ -120,38 +194,452 @@ func TestProductServiceHandlers(t *testing.T) {
 	})
 }
 
-type mockProductStore struct{}
+func TestProductUpdates(t *testing.T) {
+	productStore := newMockProductStore()
+	handler := NewHandler(productStore, newMockVariantStore(), &authtest.Users{})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/products/{productID}", handler.handleGetProduct).Methods(http.MethodGet)
+	router.HandleFunc("/products/{productID}", handler.handleUpdateProduct).Methods(http.MethodPut)
+	router.HandleFunc("/products/{productID}", handler.handlePatchProduct).Methods(http.MethodPatch)
+	router.HandleFunc("/products/{productID}", handler.handleDeleteProduct).Methods(http.MethodDelete)
+
+	request := func(method, path, ifMatch, contentType, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	const mergePatch = "application/merge-patch+json"
+
+	t.Run("should return the version as the ETag", func(t *testing.T) {
+		rr := request(http.MethodGet, "/products/42", "", "", "")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if tag := rr.Header().Get("ETag"); tag != `"1"` {
+			t.Errorf("expected ETag %q, got %q", `"1"`, tag)
+		}
+
+		if rr := request(http.MethodGet, "/products/7", "", "", ""); rr.Code != http.StatusNotFound {
+			t.Errorf("expected status code %d, got %d", http.StatusNotFound, rr.Code)
+		}
+	})
+
+	t.Run("should require the ETag to update", func(t *testing.T) {
+		body := `{"name": "Dune Messiah", "price": 10.5}`
+
+		if rr := request(http.MethodPut, "/products/42", "", "", body); rr.Code != http.StatusPreconditionRequired {
+			t.Errorf("expected status code %d, got %d", http.StatusPreconditionRequired, rr.Code)
+		}
+
+		if rr := request(http.MethodPut, "/products/42", `"2"`, "", body); rr.Code != http.StatusPreconditionFailed {
+			t.Errorf("expected status code %d, got %d", http.StatusPreconditionFailed, rr.Code)
+		}
+
+		if rr := request(http.MethodPut, "/products/42", `W/"1"`, "", body); rr.Code != http.StatusPreconditionFailed {
+			t.Errorf("expected a weak ETag not to match, got %d", rr.Code)
+		}
+	})
+
+	t.Run("should replace the product", func(t *testing.T) {
+		rr := request(http.MethodPut, "/products/42", `"1"`, "", `{"name": "Dune Messiah", "price": 10.5}`)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body)
+		}
+
+		if tag := rr.Header().Get("ETag"); tag != `"2"` {
+			t.Errorf("expected ETag %q, got %q", `"2"`, tag)
+		}
+
+		p := productStore.products[42]
+		if p.Name != "Dune Messiah" || p.Description != "" || p.Price != 10.5 || p.Version != 2 {
+			t.Errorf("unexpected product %+v", p)
+		}
+
+		if rr := request(http.MethodPut, "/products/42", `"2"`, "", `{"name": "Dune Messiah"}`); rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d without a price, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+
+	t.Run("should apply a merge patch", func(t *testing.T) {
+		if rr := request(http.MethodPatch, "/products/42", `"2"`, "application/json", `{"price": 12}`); rr.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("expected status code %d, got %d", http.StatusUnsupportedMediaType, rr.Code)
+		}
+
+		rr := request(http.MethodPatch, "/products/42", `"1", "2"`, mergePatch, `{"price": 12, "image": null}`)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body)
+		}
+
+		p := productStore.products[42]
+		if p.Name != "Dune Messiah" || p.Price != 12 || p.Image != "" || p.Version != 3 {
+			t.Errorf("unexpected product %+v", p)
+		}
+
+		for _, patch := range []string{`{"id": 7}`, `{"name": null}`, `{"price": -1}`, `{"quantity": 3}`, `[]`} {
+			if rr := request(http.MethodPatch, "/products/42", "*", mergePatch, patch); rr.Code != http.StatusBadRequest {
+				t.Errorf("%s: expected status code %d, got %d", patch, http.StatusBadRequest, rr.Code)
+			}
+		}
+	})
+
+	t.Run("should soft delete the product", func(t *testing.T) {
+		if rr := request(http.MethodDelete, "/products/42", "", "", ""); rr.Code != http.StatusPreconditionRequired {
+			t.Errorf("expected status code %d, got %d", http.StatusPreconditionRequired, rr.Code)
+		}
+
+		if rr := request(http.MethodDelete, "/products/42", `"1"`, "", ""); rr.Code != http.StatusPreconditionFailed {
+			t.Errorf("expected status code %d, got %d", http.StatusPreconditionFailed, rr.Code)
+		}
+
+		if rr := request(http.MethodDelete, "/products/42", `"3"`, "", ""); rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if rr := request(http.MethodGet, "/products/42", "", "", ""); rr.Code != http.StatusNotFound {
+			t.Errorf("expected status code %d, got %d", http.StatusNotFound, rr.Code)
+		}
+
+		if rr := request(http.MethodDelete, "/products/42", `"3"`, "", ""); rr.Code != http.StatusNotFound {
+			t.Errorf("expected status code %d, got %d", http.StatusNotFound, rr.Code)
+		}
+	})
+}
+
+func TestProductVariants(t *testing.T) {
+	variantStore := newMockVariantStore()
+	handler := NewHandler(newMockProductStore(), variantStore, &authtest.Users{})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/products/{productID}", handler.handleGetProduct).Methods(http.MethodGet)
+	router.HandleFunc("/products/{productID}/variants", handler.handleGetVariants).Methods(http.MethodGet)
+	router.HandleFunc("/products/{productID}/variants", handler.handleCreateVariant).Methods(http.MethodPost)
+	router.HandleFunc("/products/{productID}/variants/{variantID}", handler.handleUpdateVariant).Methods(http.MethodPut)
+	router.HandleFunc("/products/{productID}/variants/{variantID}", handler.handleDeleteVariant).Methods(http.MethodDelete)
+
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("should return the variants with the product", func(t *testing.T) {
+		rr := request(http.MethodGet, "/products/42", "")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		var p types.Product
+		if err := json.NewDecoder(rr.Body).Decode(&p); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(p.Variants) != 1 || p.Variants[0].SKU != "P42" {
+			t.Errorf("expected the variant P42, got %+v", p.Variants)
+		}
+	})
+
+	t.Run("should require the same options for every variant", func(t *testing.T) {
+		rr := request(http.MethodPost, "/products/42/variants", `{"sku": "DUNE-HC", "options": {"cover": "hard"}, "quantity": 3}`)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+
+		rr = request(http.MethodPut, "/products/42/variants/1", `{"sku": "DUNE-PB", "options": {"cover": "paperback"}, "quantity": 12}`)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body)
+		}
+
+		rr = request(http.MethodPost, "/products/42/variants", `{"sku": "DUNE-HC", "options": {"cover": "hard"}, "price": 24.5, "quantity": 3}`)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("expected status code %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body)
+		}
+
+		v := variantStore.variants[2]
+		if v.ProductID != 42 || v.SKU != "DUNE-HC" || v.Options["cover"] != "hard" || v.Price == nil || *v.Price != 24.5 || v.Quantity != 3 {
+			t.Errorf("unexpected variant %+v", v)
+		}
+	})
+
+	t.Run("should fail with invalid variants", func(t *testing.T) {
+		for _, test := range []struct {
+			body   string
+			status int
+		}{
+			{`{"sku": "DUNE-HC2", "options": {"cover": "hard"}, "quantity": 1}`, http.StatusBadRequest},
+			{`{"sku": "DUNE-XL", "options": {"cover": "hard", "size": "XL"}, "quantity": 1}`, http.StatusBadRequest},
+			{`{"sku": "DUNE-AU", "options": {"format": "audio"}, "quantity": 1}`, http.StatusBadRequest},
+			{`{"sku": "DUNE-SC", "options": {"cover": "soft"}}`, http.StatusBadRequest},
+			{`{"sku": "DUNE-SC", "options": {"cover": "soft"}, "price": 0, "quantity": 1}`, http.StatusBadRequest},
+			{`{"sku": "DUNE-HC", "options": {"cover": "soft"}, "quantity": 1}`, http.StatusConflict},
+			{`{"sku": "DUNE-SC", "options": {"cover": "soft"}, "price": 19.99, "quantity": 1}`, http.StatusCreated},
+		} {
+			if rr := request(http.MethodPost, "/products/42/variants", test.body); rr.Code != test.status {
+				t.Errorf("%s: expected status code %d, got %d", test.body, test.status, rr.Code)
+			}
+		}
+
+		if rr := request(http.MethodPost, "/products/7/variants", `{"sku": "X", "quantity": 1}`); rr.Code != http.StatusNotFound {
+			t.Errorf("expected status code %d, got %d", http.StatusNotFound, rr.Code)
+		}
+	})
+
+	t.Run("should delete the variant", func(t *testing.T) {
+		if rr := request(http.MethodDelete, "/products/42/variants/2", ""); rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if rr := request(http.MethodDelete, "/products/42/variants/2", ""); rr.Code != http.StatusNotFound {
+			t.Errorf("expected status code %d, got %d", http.StatusNotFound, rr.Code)
+		}
+
+		rr := request(http.MethodGet, "/products/42/variants", "")
+		var variants []types.ProductVariant
+		if err := json.NewDecoder(rr.Body).Decode(&variants); err != nil {
+			t.Fatal(err)
+		}
+		if len(variants) != 2 {
+			t.Errorf("expected 2 variants left, got %+v", variants)
+		}
+	})
+}
+
+func TestMergePatch(t *testing.T) {
+	// examples from RFC 7396
+	tests := []struct {
+		doc, patch, want string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+	}
+
+	for _, test := range tests {
+		var doc, patch any
+		if err := json.Unmarshal([]byte(test.doc), &doc); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal([]byte(test.patch), &patch); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := json.Marshal(mergePatch(doc, patch))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(got) != test.want {
+			t.Errorf("%s + %s: expected %s, got %s", test.doc, test.patch, test.want, got)
+		}
+	}
+}
+
+func TestProductCursor(t *testing.T) {
+	createdAt := time.Date(2024, 10, 28, 9, 0, 0, 0, time.UTC)
+	product := types.Product{ID: 42, Name: "Dune", Price: 9.99, CreatedAt: createdAt}
+
+	tests := []struct {
+		sort  string
+		value any
+	}{
+		{types.ProductSortNewest, createdAt},
+		{types.ProductSortPriceAsc, 9.99},
+		{types.ProductSortPriceDesc, 9.99},
+		{types.ProductSortName, "Dune"},
+	}
+
+	for _, test := range tests {
+		encoded, err := encodeCursor(newCursor(test.sort, product))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c, err := decodeCursor(encoded, test.sort)
+		if err != nil {
+			t.Fatalf("%s: %v", test.sort, err)
+		}
+
+		if c.ID != 42 || c.value() != test.value {
+			t.Errorf("%s: expected product 42 at %v, got %d at %v", test.sort, test.value, c.ID, c.value())
+		}
+	}
+}
+
+func TestPruneReservations(t *testing.T) {
+	// an invalid interval would make the ticker panic, the store is not used
+	done := make(chan struct{})
+	go func() {
+		PruneReservations(context.Background(), nil, 0)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("expected pruning not to start with an invalid interval")
+	}
+}
+
+type mockProductStore struct {
+	filters  []types.ProductFilter
+	products map[int]types.Product
+}
+
+func newMockProductStore() *mockProductStore {
+	return &mockProductStore{products: map[int]types.Product{
+		42: {ID: 42, Name: "Dune", Description: "A novel", Image: "dune.jpg", Price: 9.99, Quantity: 12, Version: 1},
+	}}
+}
 
 func (m *mockProductStore) GetProductByID(productID int) (*types.Product, error) {
-	return &types.Product{}, nil
+	p, ok := m.products[productID]
+	if !ok {
+		return &types.Product{}, nil
+	}
+
+	return &p, nil
 }
 
-func (m *mockProductStore) GetProducts() ([]*types.Product, error) {
-	return []*types.Product{}, nil
+func (m *mockProductStore) GetProducts(filter types.ProductFilter) (*types.ProductPage, error) {
+	m.filters = append(m.filters, filter)
+	if filter.Cursor != "" {
+		if _, err := decodeCursor(filter.Cursor, filter.Sort); err != nil {
+			return nil, err
+		}
+	}
+
+	return &types.ProductPage{Products: []types.Product{}}, nil
 }
 
 func (m *mockProductStore) CreateProduct(product types.CreateProductPayload) error {
 	return nil
 }
 
-func (m *mockProductStore) UpdateProduct(product types.Product) error {
-	return nil
+func (m *mockProductStore) UpdateProduct(product types.Product) (bool, error) {
+	current, ok := m.products[product.ID]
+	if !ok || current.Version != product.Version {
+		return false, nil
+	}
+
+	product.Version++
+	m.products[product.ID] = product
+	return true, nil
+}
+
+func (m *mockProductStore) DeleteProduct(id, version int) (bool, error) {
+	current, ok := m.products[id]
+	if !ok || current.Version != version {
+		return false, nil
+	}
+
+	delete(m.products, id)
+	return true, nil
 }
 
 func (m *mockProductStore) GetProductsByID(ids []int) ([]types.Product, error) {
 	return []types.Product{}, nil
 }
 
-type mockUserStore struct{}
+// mockVariantStore starts with a single variant of product 42 without
+// options, as products are created.
+type mockVariantStore struct {
+	variants map[int]types.ProductVariant
+	lastID   int
+}
+
+func newMockVariantStore() *mockVariantStore {
+	return &mockVariantStore{
+		variants: map[int]types.ProductVariant{
+			1: {ID: 1, ProductID: 42, SKU: "P42", Options: map[string]string{}, Quantity: 12},
+		},
+		lastID: 1,
+	}
+}
+
+func (m *mockVariantStore) GetVariants(productID int) ([]types.ProductVariant, error) {
+	variants := []types.ProductVariant{}
+	for id := 1; id <= m.lastID; id++ {
+		if v, ok := m.variants[id]; ok && v.ProductID == productID {
+			variants = append(variants, v)
+		}
+	}
+
+	return variants, nil
+}
+
+func (m *mockVariantStore) GetVariantsByID(ids []int) ([]types.ProductVariant, error) {
+	variants := []types.ProductVariant{}
+	for _, id := range ids {
+		if v, ok := m.variants[id]; ok {
+			variants = append(variants, v)
+		}
+	}
 
-func (m *mockUserStore) GetUserByID(userID int) (*types.User, error) {
-	return &types.User{}, nil
+	return variants, nil
 }
 
-func (m *mockUserStore) CreateUser(user types.User) error {
+func (m *mockVariantStore) GetVariant(productID, id int) (*types.ProductVariant, error) {
+	v, ok := m.variants[id]
+	if !ok || v.ProductID != productID {
+		return &types.ProductVariant{}, nil
+	}
+
+	return &v, nil
+}
+
+func (m *mockVariantStore) CreateVariant(v types.ProductVariant) (int, error) {
+	if m.skuTaken(v.SKU, 0) {
+		return 0, types.ErrSKUTaken
+	}
+
+	m.lastID++
+	v.ID = m.lastID
+	m.variants[v.ID] = v
+	return v.ID, nil
+}
+
+func (m *mockVariantStore) UpdateVariant(v types.ProductVariant) error {
+	if m.skuTaken(v.SKU, v.ID) {
+		return types.ErrSKUTaken
+	}
+
+	m.variants[v.ID] = v
+	return nil
+}
+
+func (m *mockVariantStore) DeleteVariant(productID, id int) error {
+	delete(m.variants, id)
 	return nil
 }
 
-func (m *mockUserStore) GetUserByEmail(email string) (*types.User, error) {
-	return &types.User{}, nil
+func (m *mockVariantStore) skuTaken(sku string, exceptID int) bool {
+	for _, v := range m.variants {
+		if v.SKU == sku && v.ID != exceptID {
+			return true
+		}
+	}
+
+	return false
 }
@@ -3,25 +3,49 @@ package product
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
+	"time"
 
+	"github.com/surfiniaburger/api-go/db"
 	"github.com/surfiniaburger/api-go/types"
 )
 
+// productColumns reads the quantity of a product as the stock of its
+// variants, and how much of it is held by reservations that did not expire.
+const productColumns = "id, name, description, image, price, " +
+	"(SELECT COALESCE(SUM(v.quantity), 0) FROM product_variants v WHERE v.productId = products.id AND v.deletedAt IS NULL) AS quantity, " +
+	"(SELECT COALESCE(SUM(r.quantity), 0) FROM inventory_reservations r JOIN product_variants v ON v.id = r.variantId WHERE v.productId = products.id AND v.deletedAt IS NULL AND r.expiresAt > NOW()) AS reserved, " +
+	"version, createdAt"
+
+// variantColumns reads a product_variants table aliased v.
+const variantColumns = "v.id, v.productId, v.sku, v.options, v.price, v.quantity, " + reservedByVariant + " AS reserved, v.createdAt"
+
+// reservedByVariant is the quantity of the variant v held by reservations that
+// did not expire.
+const reservedByVariant = "(SELECT COALESCE(SUM(r.quantity), 0) FROM inventory_reservations r WHERE r.variantId = v.id AND r.expiresAt > NOW())"
+
 type Store struct {
-	db *sql.DB
+	db db.DBTX
 }
 
 func NewStore(db *sql.DB) *Store {
 	return &Store{db: db}
 }
 
+// WithTx returns a copy of the store whose queries run inside tx.
+func (s *Store) WithTx(tx *sql.Tx) *Store {
+	return &Store{db: tx}
+}
+
 func (s *Store) GetProductByID(productID int) (*types.Product, error) {
-	rows, err := s.db.Query("SELECT * FROM products WHERE id = ?", productID)
+	rows, err := s.db.Query("SELECT "+productColumns+" FROM products WHERE id = ? AND deletedAt IS NULL", productID)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	p := new(types.Product)
 	for rows.Next() {
@@ -31,12 +55,17 @@ func (s *Store) GetProductByID(productID int) (*types.Product, error) {
 		}
 	}
 
-	return p, nil
+	return p, rows.Err()
 }
 
 func (s *Store) GetProductsByID(productIDs []int) ([]types.Product, error) {
+	products := []types.Product{}
+	if len(productIDs) == 0 {
+		return products, nil
+	}
+
 	placeholders := strings.Repeat(",?", len(productIDs)-1)
-	query := fmt.Sprintf("SELECT * FROM products WHERE id IN (?%s)", placeholders)
+	query := fmt.Sprintf("SELECT "+productColumns+" FROM products WHERE id IN (?%s) AND deletedAt IS NULL", placeholders)
 
 	// Convert productIDs to []interface{}
 	args := make([]interface{}, len(productIDs))
@@ -48,8 +77,8 @@ func (s *Store) GetProductsByID(productIDs []int) ([]types.Product, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	products := []types.Product{}
 	for rows.Next() {
 		p, err := scanRowsIntoProduct(rows)
 		if err != nil {
@@ -59,45 +88,472 @@ func (s *Store) GetProductsByID(productIDs []int) ([]types.Product, error) {
 		products = append(products, *p)
 	}
 
-	return products, nil
-
+	return products, rows.Err()
 }
 
-func (s *Store) GetProducts() ([]*types.Product, error) {
-	rows, err := s.db.Query("SELECT * FROM products")
+// GetProducts pages through the products with a keyset on the sort column and
+// the id, so a page costs the same however deep it is and products added in
+// the meantime do not shift the following pages.
+func (s *Store) GetProducts(filter types.ProductFilter) (*types.ProductPage, error) {
+	order, ok := sortOrders[filter.Sort]
+	if !ok {
+		return nil, fmt.Errorf("unknown sort: %s", filter.Sort)
+	}
+
+	var conditions []string
+	var args []any
+	if filter.MinPrice != nil {
+		conditions = append(conditions, "price >= ?")
+		args = append(args, *filter.MinPrice)
+	}
+	if filter.MaxPrice != nil {
+		conditions = append(conditions, "price <= ?")
+		args = append(args, *filter.MaxPrice)
+	}
+	if filter.InStock {
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM product_variants v WHERE v.productId = products.id AND v.quantity > "+reservedByVariant+" AND v.deletedAt IS NULL)")
+	}
+	if filter.Search != "" {
+		conditions = append(conditions, "name LIKE ?")
+		args = append(args, "%"+db.EscapeLike(filter.Search)+"%")
+	}
+	if filter.Category != "" {
+		if filter.IncludeDescendants {
+			// the descendants are the categories under the path of the root
+			conditions = append(conditions, "id IN (SELECT pc.productId FROM product_categories pc JOIN categories c ON c.id = pc.categoryId JOIN categories root ON c.path LIKE CONCAT(root.path, '%') WHERE root.slug = ?)")
+		} else {
+			conditions = append(conditions, "id IN (SELECT pc.productId FROM product_categories pc JOIN categories c ON c.id = pc.categoryId WHERE c.slug = ?)")
+		}
+		args = append(args, filter.Category)
+	}
+
+	page := &types.ProductPage{Products: []types.Product{}}
+	total, err := s.estimateProducts(conditions, args)
 	if err != nil {
 		return nil, err
 	}
+	page.TotalEstimate = total
+
+	direction, compare := "ASC", ">"
+	if order.desc {
+		direction, compare = "DESC", "<"
+	}
+
+	if filter.Cursor != "" {
+		c, err := decodeCursor(filter.Cursor, filter.Sort)
+		if err != nil {
+			return nil, err
+		}
+
+		conditions = append(conditions, fmt.Sprintf("(%[1]s %[2]s ? OR (%[1]s = ? AND id %[2]s ?))", order.column, compare))
+		args = append(args, c.value(), c.value(), c.ID)
+	}
+
+	// deleted products are only kept for the orders referencing them
+	where := " WHERE " + strings.Join(append(conditions, "deletedAt IS NULL"), " AND ")
+
+	// one more product than asked tells whether there is a next page
+	query := fmt.Sprintf("SELECT "+productColumns+" FROM products%s ORDER BY %s %s, id %s LIMIT ?", where, order.column, direction, direction)
+	rows, err := s.db.Query(query, append(args, filter.Limit+1)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	products := make([]*types.Product, 0)
 	for rows.Next() {
 		p, err := scanRowsIntoProduct(rows)
 		if err != nil {
 			return nil, err
 		}
+		page.Products = append(page.Products, *p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page.Products) > filter.Limit {
+		page.Products = page.Products[:filter.Limit]
+
+		page.NextCursor, err = encodeCursor(newCursor(filter.Sort, page.Products[filter.Limit-1]))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return page, nil
+}
 
-		products = append(products, p)
+// estimateProducts counts the products matching the conditions. Counting the
+// whole catalog would scan the table on every page, so it is taken from the
+// table statistics instead, which are only approximate and include the
+// deleted products.
+func (s *Store) estimateProducts(conditions []string, args []any) (int, error) {
+	var total int
+	if len(conditions) == 0 {
+		err := s.db.QueryRow("SELECT COALESCE(TABLE_ROWS, 0) FROM information_schema.TABLES WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'products'").Scan(&total)
+		if err == sql.ErrNoRows {
+			return 0, nil
+		}
+		return total, err
 	}
 
-	return products, nil
+	err := s.db.QueryRow("SELECT COUNT(*) FROM products WHERE deletedAt IS NULL AND "+strings.Join(conditions, " AND "), args...).Scan(&total)
+	return total, err
 }
 
 func (s *Store) CreateProduct(product types.CreateProductPayload) error {
-	_, err := s.db.Exec("INSERT INTO products (name, price, image, description, quantity) VALUES (?, ?, ?, ?, ?)", product.Name, product.Price, product.Image, product.Description, product.Quantity)
+	return s.inTx(func(s *Store) error {
+		res, err := s.db.Exec("INSERT INTO products (name, price, image, description) VALUES (?, ?, ?, ?)", product.Name, product.Price, product.Image, product.Description)
+		if err != nil {
+			return err
+		}
+
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		sku := product.SKU
+		if sku == "" {
+			sku = fmt.Sprintf("P%d", id)
+		}
+
+		_, err = s.CreateVariant(types.ProductVariant{ProductID: int(id), SKU: sku, Quantity: product.Quantity})
+		return err
+	})
+}
+
+func (s *Store) UpdateProduct(product types.Product) (bool, error) {
+	res, err := s.db.Exec(
+		"UPDATE products SET name = ?, price = ?, image = ?, description = ?, version = version + 1 WHERE id = ? AND version = ? AND deletedAt IS NULL",
+		product.Name, product.Price, product.Image, product.Description, product.ID, product.Version,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected == 1, nil
+}
+
+func (s *Store) DeleteProduct(id, version int) (bool, error) {
+	res, err := s.db.Exec("UPDATE products SET deletedAt = NOW(), version = version + 1 WHERE id = ? AND version = ? AND deletedAt IS NULL", id, version)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected == 1, nil
+}
+
+// DecrementStock reduces the stock of a variant by quantity in a single
+// conditional update, so concurrent checkouts can never drive it below zero
+// or take the stock reserved by others. It returns types.ErrInsufficientStock
+// if there is not enough stock left.
+func (s *Store) DecrementStock(variantID int, quantity int) error {
+	res, err := s.db.Exec(
+		"UPDATE product_variants v JOIN products p ON p.id = v.productId SET v.quantity = v.quantity - ? "+
+			"WHERE v.id = ? AND v.quantity - "+reservedByVariant+" >= ? AND v.deletedAt IS NULL AND p.deletedAt IS NULL",
+		quantity, variantID, quantity,
+	)
 	if err != nil {
 		return err
 	}
 
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return fmt.Errorf("variant %d: %w", variantID, types.ErrInsufficientStock)
+	}
+
 	return nil
 }
 
-func (s *Store) UpdateProduct(product types.Product) error {
-	_, err := s.db.Exec("UPDATE products SET name = ?, price = ?, image = ?, description = ?, quantity = ? WHERE id = ?", product.Name, product.Price, product.Image, product.Description, product.Quantity, product.ID)
+func (s *Store) GetVariants(productID int) ([]types.ProductVariant, error) {
+	return s.queryVariants("SELECT "+variantColumns+" FROM product_variants v WHERE v.productId = ? AND v.deletedAt IS NULL ORDER BY v.id", productID)
+}
+
+func (s *Store) GetVariantsByID(ids []int) ([]types.ProductVariant, error) {
+	if len(ids) == 0 {
+		return []types.ProductVariant{}, nil
+	}
+
+	placeholders := strings.Repeat(",?", len(ids)-1)
+	query := fmt.Sprintf(
+		"SELECT "+variantColumns+" FROM product_variants v JOIN products p ON p.id = v.productId WHERE v.id IN (?%s) AND v.deletedAt IS NULL AND p.deletedAt IS NULL",
+		placeholders,
+	)
+
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+
+	return s.queryVariants(query, args...)
+}
+
+func (s *Store) GetVariant(productID, id int) (*types.ProductVariant, error) {
+	variants, err := s.queryVariants("SELECT "+variantColumns+" FROM product_variants v WHERE v.id = ? AND v.productId = ? AND v.deletedAt IS NULL", id, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(variants) == 0 {
+		return new(types.ProductVariant), nil
+	}
+
+	return &variants[0], nil
+}
+
+func (s *Store) CreateVariant(v types.ProductVariant) (int, error) {
+	options, err := marshalOptions(v.Options)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := s.db.Exec("INSERT INTO product_variants (productId, sku, options, price, quantity) VALUES (?, ?, ?, ?, ?)", v.ProductID, v.SKU, options, v.Price, v.Quantity)
+	if db.IsDuplicateEntry(err) {
+		return 0, types.ErrSKUTaken
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+func (s *Store) UpdateVariant(v types.ProductVariant) error {
+	options, err := marshalOptions(v.Options)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	_, err = s.db.Exec(
+		"UPDATE product_variants SET sku = ?, options = ?, price = ?, quantity = ? WHERE id = ? AND productId = ? AND deletedAt IS NULL",
+		v.SKU, options, v.Price, v.Quantity, v.ID, v.ProductID,
+	)
+	if db.IsDuplicateEntry(err) {
+		return types.ErrSKUTaken
+	}
+
+	return err
+}
+
+func (s *Store) DeleteVariant(productID, id int) error {
+	_, err := s.db.Exec("UPDATE product_variants SET deletedAt = NOW() WHERE id = ? AND productId = ? AND deletedAt IS NULL", id, productID)
+	return err
+}
+
+// ReserveItems checks the stock of the variants under the same row locks as
+// DecrementStock, so a reservation and a checkout cannot both take the last
+// units.
+func (s *Store) ReserveItems(userID int, sessionID string, items []types.CartCheckoutItem, ttl time.Duration) ([]types.Reservation, error) {
+	// the same variant may be in the cart more than once
+	quantities := make(map[int]int)
+	for _, item := range items {
+		quantities[item.VariantID] += item.Quantity
+	}
+
+	// lock the variant rows in a consistent order, like the checkout does
+	variantIDs := make([]int, 0, len(quantities))
+	for id := range quantities {
+		variantIDs = append(variantIDs, id)
+	}
+	sort.Ints(variantIDs)
+
+	var reservations []types.Reservation
+	err := s.inTx(func(s *Store) error {
+		if err := s.ReleaseReservations(userID, sessionID); err != nil {
+			return err
+		}
+
+		var expiresAt time.Time
+		if err := s.db.QueryRow("SELECT NOW() + INTERVAL ? SECOND", int(ttl.Seconds())).Scan(&expiresAt); err != nil {
+			return err
+		}
+
+		for _, id := range variantIDs {
+			var left int
+			err := s.db.QueryRow(
+				"SELECT v.quantity - "+reservedByVariant+" FROM product_variants v JOIN products p ON p.id = v.productId WHERE v.id = ? AND v.deletedAt IS NULL AND p.deletedAt IS NULL FOR UPDATE",
+				id,
+			).Scan(&left)
+			if err != nil && err != sql.ErrNoRows {
+				return err
+			}
+			if err == sql.ErrNoRows || left < quantities[id] {
+				return fmt.Errorf("variant %d: %w", id, types.ErrInsufficientStock)
+			}
+
+			_, err = s.db.Exec("INSERT INTO inventory_reservations (userId, sessionId, variantId, quantity, expiresAt) VALUES (?, ?, ?, ?, ?)", userID, sessionID, id, quantities[id], expiresAt)
+			if err != nil {
+				return err
+			}
+		}
+
+		var err error
+		reservations, err = s.GetReservations(userID, sessionID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return reservations, nil
+}
+
+func (s *Store) GetReservations(userID int, sessionID string) ([]types.Reservation, error) {
+	rows, err := s.db.Query(`
+		SELECT r.userId, r.sessionId, v.productId, r.variantId, r.quantity, r.expiresAt, r.createdAt
+		FROM inventory_reservations r JOIN product_variants v ON v.id = r.variantId
+		WHERE r.userId = ? AND r.sessionId = ? AND r.expiresAt > NOW() ORDER BY r.variantId`,
+		userID, sessionID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reservations := []types.Reservation{}
+	for rows.Next() {
+		var r types.Reservation
+		if err := rows.Scan(&r.UserID, &r.SessionID, &r.ProductID, &r.VariantID, &r.Quantity, &r.ExpiresAt, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		reservations = append(reservations, r)
+	}
+
+	return reservations, rows.Err()
+}
+
+func (s *Store) ReleaseReservations(userID int, sessionID string) error {
+	_, err := s.db.Exec("DELETE FROM inventory_reservations WHERE userId = ? AND sessionId = ?", userID, sessionID)
+	return err
+}
+
+// ReleaseReservedItems lowers the reservations of the session by the
+// quantities ordered, deleting those that are used up, so DecrementStock can
+// take the stock they held.
+func (s *Store) ReleaseReservedItems(userID int, sessionID string, items []types.CartCheckoutItem) error {
+	for _, item := range items {
+		_, err := s.db.Exec(
+			"UPDATE inventory_reservations SET quantity = quantity - LEAST(quantity, ?) WHERE userId = ? AND sessionId = ? AND variantId = ?",
+			item.Quantity, userID, sessionID, item.VariantID,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := s.db.Exec("DELETE FROM inventory_reservations WHERE userId = ? AND sessionId = ? AND quantity = 0", userID, sessionID)
+	return err
+}
+
+// PruneReservations deletes the expired reservations. They already stopped
+// holding stock when they expired, so this only keeps the table small.
+func (s *Store) PruneReservations() error {
+	_, err := s.db.Exec("DELETE FROM inventory_reservations WHERE expiresAt <= NOW()")
+	return err
+}
+
+func (s *Store) queryVariants(query string, args ...any) ([]types.ProductVariant, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	variants := []types.ProductVariant{}
+	for rows.Next() {
+		v, err := scanRowsIntoVariant(rows)
+		if err != nil {
+			return nil, err
+		}
+		variants = append(variants, *v)
+	}
+
+	return variants, rows.Err()
+}
+
+// inTx runs fn inside a transaction, the one of the store if it already runs
+// inside one.
+func (s *Store) inTx(fn func(s *Store) error) error {
+	conn, ok := s.db.(*sql.DB)
+	if !ok {
+		return fn(s)
+	}
+
+	return db.WithTx(conn, func(tx *sql.Tx) error {
+		return fn(s.WithTx(tx))
+	})
+}
+
+func scanRowsIntoVariant(rows *sql.Rows) (*types.ProductVariant, error) {
+	v := new(types.ProductVariant)
+
+	var options []byte
+	var price sql.NullFloat64
+	err := rows.Scan(
+		&v.ID,
+		&v.ProductID,
+		&v.SKU,
+		&options,
+		&price,
+		&v.Quantity,
+		&v.Reserved,
+		&v.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	v.Available = available(v.Quantity, v.Reserved)
+
+	if err := json.Unmarshal(options, &v.Options); err != nil {
+		return nil, fmt.Errorf("invalid options of variant %d: %w", v.ID, err)
+	}
+
+	if price.Valid {
+		v.Price = &price.Float64
+	}
+
+	return v, nil
+}
+
+// available is the stock that is not reserved. Reservations are checked
+// against the stock when they are made, but the stock may be lowered by an
+// admin afterwards.
+func available(quantity, reserved int) int {
+	if reserved > quantity {
+		return 0
+	}
+
+	return quantity - reserved
+}
+
+// marshalOptions returns the JSON object stored for the options, {} if there
+// are none.
+func marshalOptions(options map[string]string) ([]byte, error) {
+	if options == nil {
+		options = map[string]string{}
+	}
+
+	return json.Marshal(options)
 }
 
 func scanRowsIntoProduct(rows *sql.Rows) (*types.Product, error) {
@@ -110,11 +566,14 @@ func scanRowsIntoProduct(rows *sql.Rows) (*types.Product, error) {
 		&product.Image,
 		&product.Price,
 		&product.Quantity,
+		&product.Reserved,
+		&product.Version,
 		&product.CreatedAt,
 	)
 	if err != nil {
 		return nil, err
 	}
+	product.Available = available(product.Quantity, product.Reserved)
 
 	return product, nil
 }
@@ -0,0 +1,73 @@
+package product
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/surfiniaburger/api-go/types"
+)
+
+// checkVariantOptions checks that the variant has a value for the same option
+// axes as the other variants of the product, and that none of them already
+// has the same values.
+func checkVariantOptions(variants []types.ProductVariant, variant types.ProductVariant) error {
+	for _, other := range variants {
+		if other.ID == variant.ID {
+			continue
+		}
+
+		if !sameAxes(variant.Options, other.Options) {
+			return fmt.Errorf("the variants of the product have the options %s, got %s", formatAxes(other.Options), formatAxes(variant.Options))
+		}
+
+		if sameOptions(variant.Options, other.Options) {
+			return fmt.Errorf("variant %d already has these options", other.ID)
+		}
+	}
+
+	return nil
+}
+
+func sameAxes(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for axis := range a {
+		if _, ok := b[axis]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+func sameOptions(a, b map[string]string) bool {
+	if !sameAxes(a, b) {
+		return false
+	}
+
+	for axis, value := range a {
+		if b[axis] != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// formatAxes lists the names of the options for error messages.
+func formatAxes(options map[string]string) string {
+	if len(options) == 0 {
+		return "none"
+	}
+
+	axes := make([]string, 0, len(options))
+	for axis := range options {
+		axes = append(axes, axis)
+	}
+	sort.Strings(axes)
+
+	return strings.Join(axes, ", ")
+}
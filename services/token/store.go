@@ -0,0 +1,403 @@
+// token/store.go
+package token
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/surfiniaburger/api-go/db"
+	"github.com/surfiniaburger/api-go/types"
+)
+
+const sessionColumns = "id, userId, userAgent, ip, amr, lastSeenAt, revokedAt, createdAt"
+
+type Store struct {
+	db *sql.DB
+}
+
+func NewStore(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+func (s *Store) CreateRefreshToken(token types.RefreshToken) error {
+	_, err := s.db.Exec("INSERT INTO refresh_tokens (userId, familyId, tokenHash, expiresAt) VALUES (?, ?, ?, ?)", token.UserID, token.FamilyID, token.TokenHash, token.ExpiresAt)
+	return err
+}
+
+func (s *Store) GetRefreshTokenByHash(hash string) (*types.RefreshToken, error) {
+	row := s.db.QueryRow("SELECT id, userId, familyId, tokenHash, expiresAt, revokedAt, createdAt FROM refresh_tokens WHERE tokenHash = ?", hash)
+
+	t := new(types.RefreshToken)
+	var revokedAt sql.NullTime
+	err := row.Scan(&t.ID, &t.UserID, &t.FamilyID, &t.TokenHash, &t.ExpiresAt, &revokedAt, &t.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("refresh token not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if revokedAt.Valid {
+		t.RevokedAt = &revokedAt.Time
+	}
+
+	return t, nil
+}
+
+func (s *Store) RevokeRefreshToken(id int) (bool, error) {
+	// only the first caller gets to revoke the token, a concurrent or later
+	// attempt sees zero affected rows and is treated as a reuse
+	res, err := s.db.Exec("UPDATE refresh_tokens SET revokedAt = NOW() WHERE id = ? AND revokedAt IS NULL", id)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected == 1, nil
+}
+
+func (s *Store) RevokeTokenFamily(familyID string) error {
+	_, err := s.db.Exec("UPDATE refresh_tokens SET revokedAt = NOW() WHERE familyId = ? AND revokedAt IS NULL", familyID)
+	return err
+}
+
+func (s *Store) RevokeUserRefreshTokens(userID int) error {
+	_, err := s.db.Exec("UPDATE refresh_tokens SET revokedAt = NOW() WHERE userId = ? AND revokedAt IS NULL", userID)
+	return err
+}
+
+func (s *Store) CreateSession(session types.Session) error {
+	_, err := s.db.Exec("INSERT INTO sessions (id, userId, userAgent, ip, amr) VALUES (?, ?, ?, ?, ?)",
+		session.ID, session.UserID, session.UserAgent, session.IP, strings.Join(session.AMR, " "))
+	return err
+}
+
+func (s *Store) GetSession(id string) (*types.Session, error) {
+	rows, err := s.db.Query("SELECT "+sessionColumns+" FROM sessions WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return &types.Session{}, rows.Err()
+	}
+
+	return scanRowsIntoSession(rows)
+}
+
+func (s *Store) GetUserSessions(userID int, activeSince time.Time) ([]types.Session, error) {
+	rows, err := s.db.Query(`
+		SELECT `+sessionColumns+` FROM sessions
+		WHERE userId = ? AND revokedAt IS NULL AND lastSeenAt >= ?
+		ORDER BY lastSeenAt DESC`, userID, activeSince)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []types.Session{}
+	for rows.Next() {
+		session, err := scanRowsIntoSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, *session)
+	}
+
+	return sessions, rows.Err()
+}
+
+func (s *Store) TouchSession(id string, seenAt time.Time) error {
+	_, err := s.db.Exec("UPDATE sessions SET lastSeenAt = ? WHERE id = ?", seenAt, id)
+	return err
+}
+
+func (s *Store) RevokeSession(userID int, id string) (bool, error) {
+	res, err := s.db.Exec("UPDATE sessions SET revokedAt = NOW() WHERE id = ? AND userId = ? AND revokedAt IS NULL", id, userID)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected == 1, nil
+}
+
+func (s *Store) RevokeUserSessions(userID int) error {
+	_, err := s.db.Exec("UPDATE sessions SET revokedAt = NOW() WHERE userId = ? AND revokedAt IS NULL", userID)
+	return err
+}
+
+func scanRowsIntoSession(rows *sql.Rows) (*types.Session, error) {
+	session := new(types.Session)
+	var amr string
+	var revokedAt sql.NullTime
+	err := rows.Scan(&session.ID, &session.UserID, &session.UserAgent, &session.IP, &amr, &session.LastSeenAt, &revokedAt, &session.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	session.AMR = strings.Fields(amr)
+
+	if revokedAt.Valid {
+		session.RevokedAt = &revokedAt.Time
+	}
+
+	return session, nil
+}
+
+func (s *Store) RevokeToken(jti string, userID int, expiresAt time.Time) error {
+	_, err := s.db.Exec("INSERT IGNORE INTO revoked_tokens (jti, userId, expiresAt) VALUES (?, ?, ?)", jti, userID, expiresAt)
+	return err
+}
+
+func (s *Store) RevokeUserTokens(userID int, issuedBefore time.Time, expiresAt time.Time) error {
+	_, err := s.db.Exec(`
+		INSERT INTO user_token_revocations (userId, revokedBefore, expiresAt)
+		VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE revokedBefore = VALUES(revokedBefore), expiresAt = VALUES(expiresAt)`,
+		userID, issuedBefore, expiresAt)
+	return err
+}
+
+func (s *Store) IsTokenRevoked(jti string, userID int, issuedAt time.Time) (bool, error) {
+	var revoked bool
+	err := s.db.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM revoked_tokens WHERE jti = ?)
+		    OR EXISTS(SELECT 1 FROM user_token_revocations WHERE userId = ? AND revokedBefore > ?)`,
+		jti, userID, issuedAt).Scan(&revoked)
+	if err != nil {
+		return false, err
+	}
+
+	return revoked, nil
+}
+
+func (s *Store) PruneExpired(now time.Time) error {
+	if _, err := s.db.Exec("DELETE FROM revoked_tokens WHERE expiresAt < ?", now); err != nil {
+		return err
+	}
+
+	_, err := s.db.Exec("DELETE FROM user_token_revocations WHERE expiresAt < ?", now)
+	return err
+}
+
+func (s *Store) CreateOIDCState(state types.OIDCLoginState) error {
+	// anyone can start a login, so expired states are cleaned up as new
+	// ones come in
+	if _, err := s.db.Exec("DELETE FROM oidc_login_states WHERE expiresAt < NOW()"); err != nil {
+		return err
+	}
+
+	_, err := s.db.Exec("INSERT INTO oidc_login_states (stateHash, provider, codeVerifier, nonce, expiresAt) VALUES (?, ?, ?, ?, ?)", state.StateHash, state.Provider, state.CodeVerifier, state.Nonce, state.ExpiresAt)
+	return err
+}
+
+func (s *Store) UseOIDCState(hash string) (*types.OIDCLoginState, error) {
+	state := new(types.OIDCLoginState)
+	err := db.WithTx(s.db, func(tx *sql.Tx) error {
+		row := tx.QueryRow("SELECT stateHash, provider, codeVerifier, nonce, expiresAt, createdAt FROM oidc_login_states WHERE stateHash = ? FOR UPDATE", hash)
+		err := row.Scan(&state.StateHash, &state.Provider, &state.CodeVerifier, &state.Nonce, &state.ExpiresAt, &state.CreatedAt)
+		if err == sql.ErrNoRows {
+			state = &types.OIDCLoginState{}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("DELETE FROM oidc_login_states WHERE stateHash = ?", hash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+func (s *Store) CreatePasswordResetToken(token types.PasswordResetToken) error {
+	_, err := s.db.Exec("INSERT INTO password_reset_tokens (userId, tokenHash, expiresAt) VALUES (?, ?, ?)", token.UserID, token.TokenHash, token.ExpiresAt)
+	return err
+}
+
+func (s *Store) GetPasswordResetTokenByHash(hash string) (*types.PasswordResetToken, error) {
+	row := s.db.QueryRow("SELECT id, userId, tokenHash, expiresAt, usedAt, createdAt FROM password_reset_tokens WHERE tokenHash = ?", hash)
+
+	t := new(types.PasswordResetToken)
+	var usedAt sql.NullTime
+	err := row.Scan(&t.ID, &t.UserID, &t.TokenHash, &t.ExpiresAt, &usedAt, &t.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("password reset token not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if usedAt.Valid {
+		t.UsedAt = &usedAt.Time
+	}
+
+	return t, nil
+}
+
+func (s *Store) UsePasswordResetToken(id int, password string) (bool, error) {
+	used := false
+	err := db.WithTx(s.db, func(tx *sql.Tx) error {
+		res, err := tx.Exec("UPDATE password_reset_tokens SET usedAt = NOW() WHERE id = ? AND usedAt IS NULL", id)
+		if err != nil {
+			return err
+		}
+
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected != 1 {
+			return nil
+		}
+
+		_, err = tx.Exec("UPDATE users SET password = ? WHERE id = (SELECT userId FROM password_reset_tokens WHERE id = ?)", password, id)
+		if err != nil {
+			return err
+		}
+
+		used = true
+		return nil
+	})
+
+	return used, err
+}
+
+func (s *Store) CreateEmailVerificationToken(token types.EmailVerificationToken) error {
+	_, err := s.db.Exec("INSERT INTO email_verification_tokens (userId, tokenHash, expiresAt) VALUES (?, ?, ?)", token.UserID, token.TokenHash, token.ExpiresAt)
+	return err
+}
+
+func (s *Store) GetEmailVerificationTokenByHash(hash string) (*types.EmailVerificationToken, error) {
+	row := s.db.QueryRow("SELECT id, userId, tokenHash, expiresAt, usedAt, createdAt FROM email_verification_tokens WHERE tokenHash = ?", hash)
+	return scanEmailVerificationToken(row)
+}
+
+func (s *Store) GetLatestEmailVerificationToken(userID int) (*types.EmailVerificationToken, error) {
+	row := s.db.QueryRow("SELECT id, userId, tokenHash, expiresAt, usedAt, createdAt FROM email_verification_tokens WHERE userId = ? ORDER BY createdAt DESC, id DESC LIMIT 1", userID)
+	return scanEmailVerificationToken(row)
+}
+
+func (s *Store) UseEmailVerificationToken(id int) (bool, error) {
+	used := false
+	err := db.WithTx(s.db, func(tx *sql.Tx) error {
+		res, err := tx.Exec("UPDATE email_verification_tokens SET usedAt = NOW() WHERE id = ? AND usedAt IS NULL", id)
+		if err != nil {
+			return err
+		}
+
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected != 1 {
+			return nil
+		}
+
+		_, err = tx.Exec("UPDATE users SET emailVerified = TRUE WHERE id = (SELECT userId FROM email_verification_tokens WHERE id = ?)", id)
+		if err != nil {
+			return err
+		}
+
+		used = true
+		return nil
+	})
+
+	return used, err
+}
+
+func (s *Store) CreateEmailChangeToken(token types.EmailChangeToken) error {
+	_, err := s.db.Exec("INSERT INTO email_change_tokens (userId, newEmail, tokenHash, expiresAt) VALUES (?, ?, ?, ?)", token.UserID, token.NewEmail, token.TokenHash, token.ExpiresAt)
+	return err
+}
+
+func (s *Store) GetEmailChangeTokenByHash(hash string) (*types.EmailChangeToken, error) {
+	row := s.db.QueryRow("SELECT id, userId, newEmail, tokenHash, expiresAt, usedAt, createdAt FROM email_change_tokens WHERE tokenHash = ?", hash)
+
+	t := new(types.EmailChangeToken)
+	var usedAt sql.NullTime
+	err := row.Scan(&t.ID, &t.UserID, &t.NewEmail, &t.TokenHash, &t.ExpiresAt, &usedAt, &t.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("email change token not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if usedAt.Valid {
+		t.UsedAt = &usedAt.Time
+	}
+
+	return t, nil
+}
+
+func (s *Store) UseEmailChangeToken(id int) (bool, error) {
+	used := false
+	err := db.WithTx(s.db, func(tx *sql.Tx) error {
+		res, err := tx.Exec("UPDATE email_change_tokens SET usedAt = NOW() WHERE id = ? AND usedAt IS NULL", id)
+		if err != nil {
+			return err
+		}
+
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected != 1 {
+			return nil
+		}
+
+		// the user confirmed the new address by following the link sent to it
+		_, err = tx.Exec("UPDATE users u JOIN email_change_tokens t ON t.userId = u.id SET u.email = t.newEmail, u.emailVerified = TRUE WHERE t.id = ?", id)
+		if db.IsDuplicateEntry(err) {
+			return types.ErrEmailTaken
+		}
+		if err != nil {
+			return err
+		}
+
+		used = true
+		return nil
+	})
+
+	return used, err
+}
+
+func (s *Store) RevokeUserEmailChangeTokens(userID int) error {
+	_, err := s.db.Exec("UPDATE email_change_tokens SET usedAt = NOW() WHERE userId = ? AND usedAt IS NULL", userID)
+	return err
+}
+
+func scanEmailVerificationToken(row *sql.Row) (*types.EmailVerificationToken, error) {
+	t := new(types.EmailVerificationToken)
+	var usedAt sql.NullTime
+	err := row.Scan(&t.ID, &t.UserID, &t.TokenHash, &t.ExpiresAt, &usedAt, &t.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("email verification token not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if usedAt.Valid {
+		t.UsedAt = &usedAt.Time
+	}
+
+	return t, nil
+}
@@ -0,0 +1,194 @@
+package user
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/surfiniaburger/api-go/services/auth"
+	"github.com/surfiniaburger/api-go/types"
+	"github.com/surfiniaburger/api-go/utils"
+)
+
+const (
+	defaultUserPageSize = 50
+	maxUserPageSize     = 100
+)
+
+// handleGetUsers lists the users matching the filters in the query string,
+// ordered by ID. Deleted users are left out unless includeDeleted is true.
+func (h *Handler) handleGetUsers(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseUserFilter(r.URL.Query())
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	page, err := h.store.GetUsers(filter)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, page)
+}
+
+// handleSuspendUser stops a user from logging in and signs them out
+// everywhere until they are reactivated.
+func (h *Handler) handleSuspendUser(w http.ResponseWriter, r *http.Request) {
+	u, ok := h.getManagedUser(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.store.SetUserStatus(u.ID, types.UserStatusSuspended); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := h.revokeUserSessions(u.ID); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	log.Printf("admin %d suspended user %d", auth.GetUserIDFromContext(r.Context()), u.ID)
+
+	u.Status = types.UserStatusSuspended
+	utils.WriteJSON(w, http.StatusOK, u)
+}
+
+func (h *Handler) handleReactivateUser(w http.ResponseWriter, r *http.Request) {
+	u, ok := h.getManagedUser(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.store.SetUserStatus(u.ID, types.UserStatusActive); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	log.Printf("admin %d reactivated user %d", auth.GetUserIDFromContext(r.Context()), u.ID)
+
+	u.Status = types.UserStatusActive
+	utils.WriteJSON(w, http.StatusOK, u)
+}
+
+// handleDeleteUser soft deletes a user. Their data is kept, e.g. for the
+// orders they placed, but they can no longer log in.
+func (h *Handler) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	u, ok := h.getManagedUser(w, r)
+	if !ok {
+		return
+	}
+
+	deleted, err := h.store.DeleteUser(u.ID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if !deleted {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("user not found"))
+		return
+	}
+
+	if err := h.revokeUserSessions(u.ID); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	log.Printf("admin %d deleted user %d", auth.GetUserIDFromContext(r.Context()), u.ID)
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "user deleted"})
+}
+
+// getManagedUser returns the user named in the path, who must not be deleted
+// or the admin making the request. It writes the error response if it fails.
+func (h *Handler) getManagedUser(w http.ResponseWriter, r *http.Request) (*types.User, bool) {
+	userID, err := strconv.Atoi(mux.Vars(r)["userID"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid user ID"))
+		return nil, false
+	}
+
+	if userID == auth.GetUserIDFromContext(r.Context()) {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("you cannot change your own account"))
+		return nil, false
+	}
+
+	u, err := h.store.GetUserByID(userID)
+	if err != nil || u.DeletedAt != nil {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("user not found"))
+		return nil, false
+	}
+
+	return u, true
+}
+
+func parseUserFilter(query url.Values) (types.UserFilter, error) {
+	filter := types.UserFilter{
+		Role:   query.Get("role"),
+		Status: query.Get("status"),
+		Email:  query.Get("email"),
+		Limit:  defaultUserPageSize,
+	}
+
+	if filter.Status != "" && filter.Status != types.UserStatusActive && filter.Status != types.UserStatusSuspended {
+		return filter, fmt.Errorf("invalid status: %s", filter.Status)
+	}
+
+	var err error
+	if filter.CreatedAfter, err = parseTimeParam(query, "createdAfter"); err != nil {
+		return filter, err
+	}
+	if filter.CreatedBefore, err = parseTimeParam(query, "createdBefore"); err != nil {
+		return filter, err
+	}
+
+	if v := query.Get("includeDeleted"); v != "" {
+		includeDeleted, err := strconv.ParseBool(v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid includeDeleted")
+		}
+		filter.IncludeDeleted = includeDeleted
+	}
+
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxUserPageSize {
+			return filter, fmt.Errorf("limit must be between 1 and %d", maxUserPageSize)
+		}
+		filter.Limit = limit
+	}
+
+	if v := query.Get("offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return filter, fmt.Errorf("invalid offset")
+		}
+		filter.Offset = offset
+	}
+
+	return filter, nil
+}
+
+// parseTimeParam returns the RFC 3339 time of the query parameter, or nil if
+// it is not set.
+func parseTimeParam(query url.Values, name string) (*time.Time, error) {
+	v := query.Get(name)
+	if v == "" {
+		return nil, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s, expected an RFC 3339 time", name)
+	}
+
+	return &t, nil
+}
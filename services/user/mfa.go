@@ -0,0 +1,221 @@
+// user/mfa.go
+package user
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/surfiniaburger/api-go/configs"
+	"github.com/surfiniaburger/api-go/services/auth"
+	"github.com/surfiniaburger/api-go/types"
+	"github.com/surfiniaburger/api-go/utils"
+)
+
+const recoveryCodeCount = 10
+
+// handleEnrollMFA creates a new TOTP secret for the user. MFA is only enabled
+// once the user proves they added it to their authenticator app by confirming
+// a code.
+func (h *Handler) handleEnrollMFA(w http.ResponseWriter, r *http.Request) {
+	u, err := h.store.GetUserByID(auth.GetUserIDFromContext(r.Context()))
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	mfa, err := h.mfaStore.GetMFA(u.ID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if mfa.Enabled {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("multi-factor authentication is already enabled"))
+		return
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := h.mfaStore.SaveMFASecret(u.ID, secret); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, types.MFAEnrollResponse{
+		Secret: secret,
+		URI:    auth.TOTPURI(secret, configs.Envs.MFAIssuer, u.Email),
+	})
+}
+
+// handleConfirmMFA enables MFA with a first code from the authenticator app.
+// It answers with the recovery codes, which are never shown again, and with
+// new tokens as the other sessions of the user are signed out.
+func (h *Handler) handleConfirmMFA(w http.ResponseWriter, r *http.Request) {
+	var payload types.MFACodePayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	userID := auth.GetUserIDFromContext(r.Context())
+
+	mfa, err := h.mfaStore.GetMFA(userID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if mfa.Enabled || mfa.Secret == "" {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("no pending multi-factor authentication enrollment"))
+		return
+	}
+
+	if !h.useTOTPCode(mfa, payload.Code) {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid code"))
+		return
+	}
+
+	codes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = auth.HashRecoveryCode(code)
+	}
+
+	if err := h.mfaStore.EnableMFA(userID, hashes); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// read before the session of the request ends below
+	method, err := h.firstFactor(r)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// refreshing a token marks it as MFA, so the sessions and refresh tokens
+	// from before MFA was enabled must not be usable anymore
+	if err := h.endUserSessions(userID); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	tokens, err := h.startSession(r, userID, method, auth.AMROTP)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, types.MFAConfirmResponse{RecoveryCodes: codes, TokenResponse: *tokens})
+}
+
+// handleLoginMFA completes a login started at /login with a TOTP code or one
+// of the recovery codes. Wrong codes count as failed logins of the account,
+// so guessing them is throttled and ends up locking the account like
+// guessing the password does.
+func (h *Handler) handleLoginMFA(w http.ResponseWriter, r *http.Request) {
+	var payload types.LoginMFAPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	userID, method, err := auth.ValidateMFAChallenge(payload.MFAToken)
+	if err != nil {
+		log.Printf("invalid MFA challenge: %v", err)
+		utils.WriteError(w, http.StatusUnauthorized, fmt.Errorf("invalid or expired MFA token"))
+		return
+	}
+
+	// the user may have been suspended since passing the first factor
+	u, ok := h.checkUserStatus(w, userID)
+	if !ok {
+		return
+	}
+
+	ip := clientIP(r)
+	if !h.checkLoginThrottle(w, u.Email, ip) {
+		return
+	}
+
+	mfa, err := h.mfaStore.GetMFA(userID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if !mfa.Enabled {
+		utils.WriteError(w, http.StatusUnauthorized, fmt.Errorf("invalid or expired MFA token"))
+		return
+	}
+
+	var valid bool
+	if payload.RecoveryCode != "" {
+		valid, err = h.mfaStore.UseRecoveryCode(userID, auth.HashRecoveryCode(payload.RecoveryCode))
+		if err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		if valid {
+			log.Printf("user %d logged in with a recovery code", userID)
+		}
+	} else {
+		valid = h.useTOTPCode(mfa, payload.Code)
+	}
+
+	if !valid {
+		log.Printf("failed second factor for user %d from %s", userID, ip)
+		h.recordLoginFailure(u.Email, ip)
+		utils.WriteError(w, http.StatusUnauthorized, fmt.Errorf("invalid code"))
+		return
+	}
+
+	tokens, err := h.startSession(r, userID, method, auth.AMROTP)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, tokens)
+}
+
+// useTOTPCode checks the code and records its time step as used, so the same
+// code cannot be replayed while it is still valid.
+func (h *Handler) useTOTPCode(mfa *types.UserMFA, code string) bool {
+	step, ok := auth.ValidateTOTP(mfa.Secret, code, h.now())
+	if !ok {
+		return false
+	}
+
+	used, err := h.mfaStore.UseTOTPStep(mfa.UserID, step)
+	if err != nil {
+		log.Printf("failed to record TOTP code of user %d: %v", mfa.UserID, err)
+		return false
+	}
+
+	return used
+}
@@ -0,0 +1,175 @@
+package user
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/mux"
+	"github.com/surfiniaburger/api-go/services/auth"
+	"github.com/surfiniaburger/api-go/services/oidc"
+	"github.com/surfiniaburger/api-go/types"
+	"github.com/surfiniaburger/api-go/utils"
+)
+
+// oidcStateExpiration is how long a user has to log in at the provider.
+const oidcStateExpiration = 10 * time.Minute
+
+// handleOIDCLogin starts a login at an OpenID Connect provider. The frontend
+// sends the user to the returned URL and keeps the state, to check it is the
+// one the provider sends back before posting it to the callback.
+func (h *Handler) handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	provider, ok := h.providers[mux.Vars(r)["provider"]]
+	if !ok {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("unknown provider"))
+		return
+	}
+
+	state, err := auth.RandomString(32)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	nonce, err := auth.RandomString(16)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	verifier, err := auth.RandomString(32)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	authURL, err := provider.AuthCodeURL(r.Context(), state, nonce, verifier)
+	if err != nil {
+		log.Printf("failed to start login with %s: %v", provider.Name(), err)
+		utils.WriteError(w, http.StatusBadGateway, fmt.Errorf("provider unavailable"))
+		return
+	}
+
+	err = h.oidcStateStore.CreateOIDCState(types.OIDCLoginState{
+		StateHash:    auth.HashToken(state),
+		Provider:     provider.Name(),
+		CodeVerifier: verifier,
+		Nonce:        nonce,
+		ExpiresAt:    time.Now().Add(oidcStateExpiration),
+	})
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, types.OIDCAuthorizationResponse{AuthorizationURL: authURL, State: state})
+}
+
+// handleOIDCCallback completes a login at a provider with the code it sent
+// back, logging in the user the provider account is linked to.
+func (h *Handler) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	provider, ok := h.providers[mux.Vars(r)["provider"]]
+	if !ok {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("unknown provider"))
+		return
+	}
+
+	var payload types.OIDCCallbackPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	// states are single use so a code cannot be redeemed twice through us
+	state, err := h.oidcStateStore.UseOIDCState(auth.HashToken(payload.State))
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if state.StateHash == "" || state.Provider != provider.Name() || time.Now().After(state.ExpiresAt) {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid or expired state"))
+		return
+	}
+
+	idToken, err := provider.Exchange(r.Context(), payload.Code, state.CodeVerifier, state.Nonce)
+	if err != nil {
+		log.Printf("failed login with %s: %v", provider.Name(), err)
+		utils.WriteError(w, http.StatusUnauthorized, fmt.Errorf("login with %s failed", provider.Name()))
+		return
+	}
+
+	userID, ok := h.linkIdentity(w, provider.Name(), idToken)
+	if !ok {
+		return
+	}
+
+	h.completeLogin(w, r, userID, auth.AMRFederated)
+}
+
+// linkIdentity returns the user the provider account belongs to. An account
+// seen for the first time is linked to the user with the same email address,
+// or a new user if there is none, but only once the provider verified the
+// address. It writes the error response if it fails.
+func (h *Handler) linkIdentity(w http.ResponseWriter, provider string, idToken *oidc.IDToken) (int, bool) {
+	identity, err := h.identityStore.GetIdentity(provider, idToken.Subject)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return 0, false
+	}
+
+	if identity.ID != 0 {
+		return identity.UserID, true
+	}
+
+	if idToken.Email == "" || !idToken.EmailVerified {
+		utils.WriteError(w, http.StatusForbidden, fmt.Errorf("%s did not verify your email address", provider))
+		return 0, false
+	}
+
+	identity = &types.UserIdentity{Provider: provider, Subject: idToken.Subject, Email: idToken.Email}
+
+	u, err := h.store.GetUserByEmail(idToken.Email)
+	if err == nil {
+		// someone could have registered the address without owning it and
+		// would keep access through the password, so only accounts that
+		// proved they own the address are linked
+		if !u.EmailVerified {
+			utils.WriteError(w, http.StatusConflict, fmt.Errorf("an account with this email address exists, verify it before logging in with %s", provider))
+			return 0, false
+		}
+
+		identity.UserID = u.ID
+		if err := h.identityStore.CreateIdentity(*identity); err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, err)
+			return 0, false
+		}
+
+		log.Printf("linked %s account %s to user %d", provider, idToken.Subject, u.ID)
+		return u.ID, true
+	}
+
+	// users created by a provider have no password until they reset it
+	userID, err := h.identityStore.CreateUserWithIdentity(types.User{
+		FirstName:     idToken.GivenName,
+		LastName:      idToken.FamilyName,
+		Email:         idToken.Email,
+		Role:          "user",
+		EmailVerified: true,
+	}, *identity)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return 0, false
+	}
+
+	log.Printf("created user %d for %s account %s", userID, provider, idToken.Subject)
+	return userID, true
+}
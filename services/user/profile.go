@@ -0,0 +1,269 @@
+package user
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/surfiniaburger/api-go/configs"
+	"github.com/surfiniaburger/api-go/services/auth"
+	"github.com/surfiniaburger/api-go/types"
+	"github.com/surfiniaburger/api-go/utils"
+)
+
+func (h *Handler) handleGetMe(w http.ResponseWriter, r *http.Request) {
+	u, err := h.store.GetUserByID(auth.GetUserIDFromContext(r.Context()))
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, u)
+}
+
+// handleUpdateMe changes the name of the user. Fields left out are kept.
+func (h *Handler) handleUpdateMe(w http.ResponseWriter, r *http.Request) {
+	var payload types.UpdateProfilePayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	u, err := h.store.GetUserByID(auth.GetUserIDFromContext(r.Context()))
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if payload.FirstName != nil {
+		u.FirstName = *payload.FirstName
+	}
+	if payload.LastName != nil {
+		u.LastName = *payload.LastName
+	}
+
+	if err := h.store.UpdateUser(*u); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, u)
+}
+
+// handleChangePassword sets a new password after checking the current one.
+// Every other session is signed out, pending email changes are dropped and
+// the caller gets new tokens.
+func (h *Handler) handleChangePassword(w http.ResponseWriter, r *http.Request) {
+	token := auth.GetTokenFromContext(r.Context())
+	if token == nil {
+		utils.WriteError(w, http.StatusForbidden, fmt.Errorf("the password can only be changed with an access token"))
+		return
+	}
+
+	var payload types.ChangePasswordPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	u, err := h.store.GetUserByID(token.UserID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if !auth.ComparePasswords(u.Password, []byte(payload.CurrentPassword)) {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid current password"))
+		return
+	}
+
+	if err := auth.CheckPassword(payload.NewPassword); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	hashedPassword, err := auth.HashPassword(payload.NewPassword)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := h.store.UpdatePassword(u.ID, hashedPassword); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// a link sent before the password changed must not take over the account
+	if err := h.emailChangeStore.RevokeUserEmailChangeTokens(u.ID); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// the new tokens are issued right away, so only the sessions are ended
+	// rather than every token issued up to now
+	if err := h.endUserSessions(u.ID); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := auth.RevokeToken(token); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	methods := []string{auth.AMRPassword}
+	if token.MFA {
+		methods = append(methods, auth.AMROTP)
+	}
+
+	tokens, err := h.startSession(r, u.ID, methods...)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, tokens)
+}
+
+// handleChangeEmail sends a confirmation link to the new address. The address
+// only changes once the link is followed, proving the user owns it.
+func (h *Handler) handleChangeEmail(w http.ResponseWriter, r *http.Request) {
+	var payload types.ChangeEmailPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	u, err := h.store.GetUserByID(auth.GetUserIDFromContext(r.Context()))
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if !auth.ComparePasswords(u.Password, []byte(payload.Password)) {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid password"))
+		return
+	}
+
+	if strings.EqualFold(payload.Email, u.Email) {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("this is already your email address"))
+		return
+	}
+
+	// checked again when confirming as someone may register the address
+	// in the meantime
+	if _, err := h.store.GetUserByEmail(payload.Email); err == nil {
+		utils.WriteError(w, http.StatusConflict, types.ErrEmailTaken)
+		return
+	}
+
+	token, hash, err := auth.NewOpaqueToken()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	expiration := time.Second * time.Duration(configs.Envs.EmailVerificationExpirationInSeconds)
+	err = h.emailChangeStore.CreateEmailChangeToken(types.EmailChangeToken{
+		UserID:    u.ID,
+		NewEmail:  payload.Email,
+		TokenHash: hash,
+		ExpiresAt: time.Now().Add(expiration),
+	})
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	err = h.notifier.Notify(types.Notification{
+		Kind:    types.NotificationEmailChange,
+		UserID:  u.ID,
+		To:      payload.Email,
+		Subject: "Confirm your new email address",
+		Body: fmt.Sprintf("Use the link below to make this your email address. It expires in %s.\n\n%s/api/v1/confirm-email?token=%s",
+			expiration, configs.Envs.PublicHost, token),
+	})
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusAccepted, map[string]string{"message": "a confirmation link has been sent to the new address"})
+}
+
+// handleConfirmEmailChange changes the email address of the user the token
+// was sent for and lets them know at their previous address.
+func (h *Handler) handleConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("missing token"))
+		return
+	}
+
+	t, err := h.emailChangeStore.GetEmailChangeTokenByHash(auth.HashToken(token))
+	if err != nil || t.UsedAt != nil || time.Now().After(t.ExpiresAt) {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid or expired confirmation token"))
+		return
+	}
+
+	// read first to let the user know at the address they had
+	u, err := h.store.GetUserByID(t.UserID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// the token is only spent if the address is changed with it, so the link
+	// still works once an address taken in the meantime is freed
+	used, err := h.emailChangeStore.UseEmailChangeToken(t.ID)
+	if errors.Is(err, types.ErrEmailTaken) {
+		utils.WriteError(w, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if !used {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid or expired confirmation token"))
+		return
+	}
+
+	log.Printf("user %d changed their email address", u.ID)
+
+	err = h.notifier.Notify(types.Notification{
+		Kind:    types.NotificationEmailChanged,
+		UserID:  u.ID,
+		To:      u.Email,
+		Subject: "Your email address was changed",
+		Body:    fmt.Sprintf("The email address of your account was changed to %s. If you did not do this, contact us right away.", t.NewEmail),
+	})
+	if err != nil {
+		log.Printf("failed to notify user %d of their email change: %v", u.ID, err)
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "email address changed"})
+}
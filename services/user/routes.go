@@ -2,32 +2,111 @@
 package user
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"net"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/gorilla/mux"
 	"github.com/surfiniaburger/api-go/configs"
 	"github.com/surfiniaburger/api-go/services/auth"
+	"github.com/surfiniaburger/api-go/services/oidc"
 	"github.com/surfiniaburger/api-go/types"
 	"github.com/surfiniaburger/api-go/utils"
 )
 
 type Handler struct {
-	store types.UserStore
+	store            types.UserStore
+	tokenStore       types.RefreshTokenStore
+	sessionStore     types.SessionStore
+	resetStore       types.PasswordResetStore
+	verifyStore      types.EmailVerificationStore
+	emailChangeStore types.EmailChangeStore
+	mfaStore         types.MFAStore
+	identityStore    types.IdentityStore
+	oidcStateStore   types.OIDCStateStore
+	notifier         types.Notifier
+	limiter          *auth.LoginLimiter
+	// providers are the OpenID Connect providers users can log in with,
+	// indexed by name
+	providers map[string]*oidc.Provider
+	// now is the clock used to check TOTP codes and throttle logins
+	now func() time.Time
 }
 
-func NewHandler(store types.UserStore) *Handler {
-	return &Handler{store: store}
+// HandlerConfig holds the dependencies of the handler. Several of them are
+// usually the same store, naming them keeps their order from mattering.
+type HandlerConfig struct {
+	Users              types.UserStore
+	RefreshTokens      types.RefreshTokenStore
+	Sessions           types.SessionStore
+	PasswordResets     types.PasswordResetStore
+	EmailVerifications types.EmailVerificationStore
+	EmailChanges       types.EmailChangeStore
+	MFA                types.MFAStore
+	LoginAttempts      types.LoginAttemptStore
+	Identities         types.IdentityStore
+	OIDCStates         types.OIDCStateStore
+	Notifier           types.Notifier
+}
+
+func NewHandler(cfg HandlerConfig) *Handler {
+	return &Handler{
+		store:            cfg.Users,
+		tokenStore:       cfg.RefreshTokens,
+		sessionStore:     cfg.Sessions,
+		resetStore:       cfg.PasswordResets,
+		verifyStore:      cfg.EmailVerifications,
+		emailChangeStore: cfg.EmailChanges,
+		mfaStore:         cfg.MFA,
+		identityStore:    cfg.Identities,
+		oidcStateStore:   cfg.OIDCStates,
+		notifier:         cfg.Notifier,
+		limiter:          auth.NewLoginLimiter(cfg.LoginAttempts, configs.Envs),
+		providers:        oidc.NewProviders(configs.Envs.OIDCProviders),
+		now:              time.Now,
+	}
 }
 
 func (h *Handler) RegisterRoutes(router *mux.Router) {
 	router.HandleFunc("/login", h.handleLogin).Methods("POST")
 	router.HandleFunc("/register", h.handleRegister).Methods("POST")
+	router.HandleFunc("/token/refresh", h.handleRefreshToken).Methods("POST")
+	router.HandleFunc("/logout", auth.WithJWTAuth(h.handleLogout, h.store)).Methods(http.MethodPost)
+	router.HandleFunc("/forgot-password", h.handleForgotPassword).Methods(http.MethodPost)
+	router.HandleFunc("/reset-password", h.handleResetPassword).Methods(http.MethodPost)
+	router.HandleFunc("/verify-email", h.handleVerifyEmail).Methods(http.MethodGet)
+	router.HandleFunc("/verify-email/resend", auth.WithJWTAuth(h.handleResendVerificationEmail, h.store)).Methods(http.MethodPost)
+	router.HandleFunc("/login/mfa", h.handleLoginMFA).Methods(http.MethodPost)
+	router.HandleFunc("/login/oidc/{provider}", h.handleOIDCLogin).Methods(http.MethodGet)
+	router.HandleFunc("/login/oidc/{provider}/callback", h.handleOIDCCallback).Methods(http.MethodPost)
+	router.HandleFunc("/me/mfa/enroll", auth.WithMFAEnrollmentAuth(auth.DenyImpersonation(h.handleEnrollMFA), h.store)).Methods(http.MethodPost)
+	router.HandleFunc("/me/mfa/confirm", auth.WithMFAEnrollmentAuth(auth.DenyImpersonation(h.handleConfirmMFA), h.store)).Methods(http.MethodPost)
+	router.HandleFunc("/me/sessions", auth.WithJWTAuth(h.handleGetSessions, h.store)).Methods(http.MethodGet)
+	router.HandleFunc("/me/sessions/{sessionID}", auth.WithJWTAuth(auth.DenyImpersonation(h.handleRevokeSession), h.store)).Methods(http.MethodDelete)
+
+	router.HandleFunc("/me", auth.WithJWTAuth(h.handleGetMe, h.store)).Methods(http.MethodGet)
+	router.HandleFunc("/me", auth.WithJWTAuth(auth.DenyImpersonation(h.handleUpdateMe), h.store)).Methods(http.MethodPatch)
+	router.HandleFunc("/me/password", auth.WithJWTAuth(auth.DenyImpersonation(h.handleChangePassword), h.store)).Methods(http.MethodPost)
+	router.HandleFunc("/me/email", auth.WithJWTAuth(auth.DenyImpersonation(h.handleChangeEmail), h.store)).Methods(http.MethodPost)
+	router.HandleFunc("/confirm-email", h.handleConfirmEmailChange).Methods(http.MethodGet)
+
+	router.HandleFunc("/users/{userID}", auth.WithJWTAuth(h.handleGetUser, h.store, auth.PermUsersReadOwn)).Methods(http.MethodGet)
 
 	// admin routes
-	router.HandleFunc("/users/{userID}", auth.WithJWTAuth(h.handleGetUser, h.store)).Methods(http.MethodGet)
+	router.HandleFunc("/admin/users", auth.WithJWTAuth(h.handleGetUsers, h.store, auth.PermUsersRead)).Methods(http.MethodGet)
+	router.HandleFunc("/admin/users/{userID}", auth.WithJWTAuth(h.handleDeleteUser, h.store, auth.PermUsersManage)).Methods(http.MethodDelete)
+	router.HandleFunc("/admin/users/{userID}/suspend", auth.WithJWTAuth(h.handleSuspendUser, h.store, auth.PermUsersManage)).Methods(http.MethodPost)
+	router.HandleFunc("/admin/users/{userID}/reactivate", auth.WithJWTAuth(h.handleReactivateUser, h.store, auth.PermUsersManage)).Methods(http.MethodPost)
+	router.HandleFunc("/admin/users/{userID}/revoke-tokens", auth.WithJWTAuth(h.handleRevokeUserTokens, h.store, auth.PermUsersManage)).Methods(http.MethodPost)
+	router.HandleFunc("/admin/users/{userID}/sessions", auth.WithJWTAuth(h.handleRevokeUserTokens, h.store, auth.PermUsersManage)).Methods(http.MethodDelete)
+	router.HandleFunc("/admin/users/{userID}/unlock", auth.WithJWTAuth(h.handleUnlockUser, h.store, auth.PermUsersManage)).Methods(http.MethodPost)
+	router.HandleFunc("/admin/users/{userID}/role", auth.WithJWTAuth(h.handleUpdateRole, h.store, auth.PermUsersManage)).Methods(http.MethodPatch)
 }
 
 func (h *Handler) handleLogin(w http.ResponseWriter, r *http.Request) {
@@ -43,27 +122,657 @@ func (h *Handler) handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ip := clientIP(r)
+	if !h.checkLoginThrottle(w, user.Email, ip) {
+		return
+	}
+
 	u, err := h.store.GetUserByEmail(user.Email)
 	if err != nil {
-		fmt.Println("User retrieval failed:", err)
+		log.Printf("failed login for unknown email from %s", ip)
+		h.recordLoginFailure(user.Email, ip)
 		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("not found, invalid email or password"))
 		return
 	}
 
 	if !auth.ComparePasswords(u.Password, []byte(user.Password)) {
-		fmt.Println("Password mismatch")
+		log.Printf("failed login for user %d from %s", u.ID, ip)
+		h.recordLoginFailure(user.Email, ip)
 		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid email or password"))
 		return
 	}
 
-	secret := []byte(configs.Envs.JWTSecret)
-	token, err := auth.CreateJWT(secret, u.ID)
+	h.rehashPassword(u, user.Password)
+
+	h.completeLogin(w, r, u.ID, auth.AMRPassword)
+}
+
+// rehashPassword upgrades the hash of the password the user just logged in
+// with if it was made with another algorithm or weaker parameters than new
+// passwords are. Failing to do so does not prevent the login.
+func (h *Handler) rehashPassword(u *types.User, password string) {
+	if !auth.PasswordNeedsRehash(u.Password) {
+		return
+	}
+
+	hashedPassword, err := auth.HashPassword(password)
+	if err != nil {
+		log.Printf("failed to rehash the password of user %d: %v", u.ID, err)
+		return
+	}
+
+	if err := h.store.UpdatePassword(u.ID, hashedPassword); err != nil {
+		log.Printf("failed to rehash the password of user %d: %v", u.ID, err)
+	}
+}
+
+// completeLogin issues the tokens of a user who passed their first factor,
+// or the challenge for their second factor if they enabled MFA.
+func (h *Handler) completeLogin(w http.ResponseWriter, r *http.Request, userID int, method string) {
+	if _, ok := h.checkUserStatus(w, userID); !ok {
+		return
+	}
+
+	mfa, err := h.mfaStore.GetMFA(userID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// the first factor was right but the user still has to pass their
+	// second factor at /login/mfa
+	if mfa.Enabled {
+		challenge, err := auth.CreateMFAChallenge(userID, method)
+		if err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		utils.WriteJSON(w, http.StatusOK, types.MFAChallengeResponse{MFARequired: true, MFAToken: challenge})
+		return
+	}
+
+	tokens, err := h.startSession(r, userID, method)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, tokens)
+}
+
+// handleRefreshToken exchanges a refresh token for a new access token and a
+// new refresh token. Every refresh token can be used once, presenting one that
+// was already used revokes its whole family as it was most likely stolen.
+func (h *Handler) handleRefreshToken(w http.ResponseWriter, r *http.Request) {
+	var payload types.RefreshTokenPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	t, err := h.tokenStore.GetRefreshTokenByHash(auth.HashToken(payload.RefreshToken))
+	if err != nil {
+		utils.WriteError(w, http.StatusUnauthorized, fmt.Errorf("invalid refresh token"))
+		return
+	}
+
+	if t.RevokedAt != nil {
+		h.revokeReusedFamily(t)
+		utils.WriteError(w, http.StatusUnauthorized, fmt.Errorf("invalid refresh token"))
+		return
+	}
+
+	if time.Now().After(t.ExpiresAt) {
+		utils.WriteError(w, http.StatusUnauthorized, fmt.Errorf("refresh token expired"))
+		return
+	}
+
+	session, err := h.sessionStore.GetSession(t.FamilyID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if session.RevokedAt != nil {
+		utils.WriteError(w, http.StatusUnauthorized, fmt.Errorf("session revoked"))
+		return
+	}
+
+	rotated, err := h.tokenStore.RevokeRefreshToken(t.ID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// someone else used the token between our read and the revocation
+	if !rotated {
+		h.revokeReusedFamily(t)
+		utils.WriteError(w, http.StatusUnauthorized, fmt.Errorf("invalid refresh token"))
+		return
+	}
+
+	u, err := h.store.GetUserByID(t.UserID)
+	if err != nil {
+		utils.WriteError(w, http.StatusUnauthorized, fmt.Errorf("invalid refresh token"))
+		return
+	}
+
+	if err := auth.CheckUserStatus(u); err != nil {
+		utils.WriteError(w, http.StatusForbidden, err)
+		return
+	}
+
+	// the tokens claim the methods the session was started with, sessions
+	// from before they were recorded get the ones of a password login
+	methods := session.AMR
+	if len(methods) == 0 {
+		methods, err = h.legacySessionMethods(t.UserID)
+		if err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	// refresh tokens issued before sessions were tracked start one now
+	if session.ID == "" {
+		err = h.createSession(r, t.UserID, t.FamilyID, methods...)
+	} else {
+		err = h.sessionStore.TouchSession(session.ID, time.Now())
+	}
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	tokens, err := h.issueTokens(t.UserID, t.FamilyID, methods...)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, tokens)
+}
+
+// handleLogout revokes the access token of the request and ends its session.
+// Tokens without a session revoke the family of the given refresh token.
+func (h *Handler) handleLogout(w http.ResponseWriter, r *http.Request) {
+	var payload types.LogoutPayload
+	if err := utils.ParseJSON(r, &payload); err != nil && !errors.Is(err, io.EOF) {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	token := auth.GetTokenFromContext(r.Context())
+	if token == nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("only access tokens can be logged out, revoke API keys instead"))
+		return
+	}
+
+	if err := auth.RevokeToken(token); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	userID := auth.GetUserIDFromContext(r.Context())
+	if token.SessionID != "" {
+		if _, err := h.revokeSession(userID, token.SessionID); err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	if payload.RefreshToken != "" {
+
+		t, err := h.tokenStore.GetRefreshTokenByHash(auth.HashToken(payload.RefreshToken))
+		if err == nil && t.UserID == userID {
+			if err := h.tokenStore.RevokeTokenFamily(t.FamilyID); err != nil {
+				utils.WriteError(w, http.StatusInternalServerError, err)
+				return
+			}
+		}
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "logged out"})
+}
+
+// handleRevokeUserTokens lets an admin sign a user out everywhere, e.g. after
+// the account was compromised or its role changed.
+func (h *Handler) handleRevokeUserTokens(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(mux.Vars(r)["userID"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid user ID"))
+		return
+	}
+
+	if _, err := h.store.GetUserByID(userID); err != nil {
+		utils.WriteError(w, http.StatusNotFound, err)
+		return
+	}
+
+	if err := h.revokeUserSessions(userID); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "user tokens revoked"})
+}
+
+// handleUnlockUser lifts the login lockout of a user before it expires.
+func (h *Handler) handleUnlockUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(mux.Vars(r)["userID"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid user ID"))
+		return
+	}
+
+	u, err := h.store.GetUserByID(userID)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, err)
+		return
+	}
+
+	if err := h.limiter.Unlock(u.Email); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "user unlocked"})
+}
+
+// handleUpdateRole changes the role of a user. Admins cannot change their own
+// role so there is always someone left to undo a mistake.
+func (h *Handler) handleUpdateRole(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(mux.Vars(r)["userID"])
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid user ID"))
+		return
+	}
+
+	var payload types.UpdateRolePayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	exists, err := auth.RoleExists(payload.Role)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if !exists {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("unknown role: %s", payload.Role))
+		return
+	}
+
+	actorID := auth.GetUserIDFromContext(r.Context())
+	if userID == actorID {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("you cannot change your own role"))
+		return
+	}
+
+	u, err := h.store.GetUserByID(userID)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, err)
+		return
+	}
+
+	if u.Role != payload.Role {
+		if err := h.store.UpdateRole(userID, payload.Role, actorID); err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		log.Printf("admin %d changed the role of user %d from %s to %s", actorID, userID, u.Role, payload.Role)
+		u.Role = payload.Role
+	}
+
+	utils.WriteJSON(w, http.StatusOK, u)
+}
+
+// handleForgotPassword sends a password reset link to the user. It always
+// answers the same way so it cannot be used to find out who has an account.
+func (h *Handler) handleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var payload types.ForgotPasswordPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	response := map[string]string{"message": "if the email is registered, a password reset link has been sent"}
+
+	u, err := h.store.GetUserByEmail(payload.Email)
+	if err != nil || u.DeletedAt != nil {
+		utils.WriteJSON(w, http.StatusOK, response)
+		return
+	}
+
+	token, hash, err := auth.NewOpaqueToken()
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	expiration := time.Second * time.Duration(configs.Envs.PasswordResetExpirationInSeconds)
+	err = h.resetStore.CreatePasswordResetToken(types.PasswordResetToken{
+		UserID:    u.ID,
+		TokenHash: hash,
+		ExpiresAt: time.Now().Add(expiration),
+	})
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	err = h.notifier.Notify(types.Notification{
+		Kind:    types.NotificationPasswordReset,
+		UserID:  u.ID,
+		To:      u.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Use the link below to choose a new password. It expires in %s.\n\n%s/reset-password?token=%s",
+			expiration, configs.Envs.PublicHost, token),
+	})
+	if err != nil {
+		log.Printf("failed to send password reset to user %d: %v", u.ID, err)
+	}
+
+	utils.WriteJSON(w, http.StatusOK, response)
+}
+
+// handleResetPassword sets a new password using a reset token, signs the user
+// out everywhere and drops their pending email changes.
+func (h *Handler) handleResetPassword(w http.ResponseWriter, r *http.Request) {
+	var payload types.ResetPasswordPayload
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validate.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid payload: %v", errors))
+		return
+	}
+
+	// checked before the token is used so the user can pick another password
+	if err := auth.CheckPassword(payload.Password); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	t, err := h.resetStore.GetPasswordResetTokenByHash(auth.HashToken(payload.Token))
+	if err != nil || t.UsedAt != nil || time.Now().After(t.ExpiresAt) {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid or expired password reset token"))
+		return
+	}
+
+	hashedPassword, err := auth.HashPassword(payload.Password)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// the token is only spent if the password is changed with it
+	used, err := h.resetStore.UsePasswordResetToken(t.ID, hashedPassword)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if !used {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid or expired password reset token"))
+		return
+	}
+
+	if err := h.revokeUserSessions(t.UserID); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := h.emailChangeStore.RevokeUserEmailChangeTokens(t.UserID); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "password has been reset"})
+}
+
+// handleVerifyEmail confirms the email address of the user the token was sent to.
+func (h *Handler) handleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("missing token"))
+		return
+	}
+
+	t, err := h.verifyStore.GetEmailVerificationTokenByHash(auth.HashToken(token))
+	if err != nil || t.UsedAt != nil || time.Now().After(t.ExpiresAt) {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid or expired verification token"))
+		return
+	}
+
+	// the token is only spent if the address is marked verified with it
+	used, err := h.verifyStore.UseEmailVerificationToken(t.ID)
 	if err != nil {
 		utils.WriteError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	utils.WriteJSON(w, http.StatusOK, map[string]string{"token": token})
+	if !used {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid or expired verification token"))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "email address verified"})
+}
+
+// handleResendVerificationEmail sends a new verification email to the
+// authenticated user, at most once per resend interval.
+func (h *Handler) handleResendVerificationEmail(w http.ResponseWriter, r *http.Request) {
+	u, err := h.store.GetUserByID(auth.GetUserIDFromContext(r.Context()))
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if u.EmailVerified {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("email address already verified"))
+		return
+	}
+
+	interval := time.Second * time.Duration(configs.Envs.EmailVerificationResendIntervalInSeconds)
+	if latest, err := h.verifyStore.GetLatestEmailVerificationToken(u.ID); err == nil {
+		if wait := time.Until(latest.CreatedAt.Add(interval)); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			utils.WriteError(w, http.StatusTooManyRequests, fmt.Errorf("a verification email was sent recently, please try again later"))
+			return
+		}
+	}
+
+	if err := h.sendVerificationEmail(u.ID, u.Email); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "verification email sent"})
+}
+
+func (h *Handler) sendVerificationEmail(userID int, email string) error {
+	token, hash, err := auth.NewOpaqueToken()
+	if err != nil {
+		return err
+	}
+
+	expiration := time.Second * time.Duration(configs.Envs.EmailVerificationExpirationInSeconds)
+	err = h.verifyStore.CreateEmailVerificationToken(types.EmailVerificationToken{
+		UserID:    userID,
+		TokenHash: hash,
+		ExpiresAt: time.Now().Add(expiration),
+	})
+	if err != nil {
+		return err
+	}
+
+	return h.notifier.Notify(types.Notification{
+		Kind:    types.NotificationEmailVerification,
+		UserID:  userID,
+		To:      email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Use the link below to verify your email address. It expires in %s.\n\n%s/api/v1/verify-email?token=%s",
+			expiration, configs.Envs.PublicHost, token),
+	})
+}
+
+// checkLoginThrottle refuses the login attempt if the account or the IP has
+// to wait after failed attempts. It writes the error response if it fails.
+func (h *Handler) checkLoginThrottle(w http.ResponseWriter, email, ip string) bool {
+	err := h.limiter.Check(email, ip, h.now())
+	if err == nil {
+		return true
+	}
+
+	var throttled *auth.LoginThrottledError
+	if !errors.As(err, &throttled) {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return false
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(throttled.RetryAfter.Seconds())+1))
+	if throttled.Locked {
+		utils.WriteError(w, http.StatusLocked, throttled)
+	} else {
+		utils.WriteError(w, http.StatusTooManyRequests, throttled)
+	}
+	return false
+}
+
+func (h *Handler) recordLoginFailure(email, ip string) {
+	if err := h.limiter.RecordFailure(email, ip, h.now()); err != nil {
+		log.Printf("failed to record failed login: %v", err)
+	}
+}
+
+// forgetLoginFailures resets the failed logins of a user who is fully
+// authenticated. The right password alone is not enough, otherwise every
+// password success would give a new budget for guessing the second factor.
+func (h *Handler) forgetLoginFailures(userID int) {
+	u, err := h.store.GetUserByID(userID)
+	if err == nil {
+		err = h.limiter.RecordSuccess(u.Email)
+	}
+
+	if err != nil {
+		log.Printf("failed to reset login attempts of user %d: %v", userID, err)
+	}
+}
+
+// clientIP returns the address of the client. X-Forwarded-For is ignored as
+// clients can forge it.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// revokeUserSessions ends every session of the user and revokes all of their
+// access and refresh tokens.
+func (h *Handler) revokeUserSessions(userID int) error {
+	if err := h.endUserSessions(userID); err != nil {
+		return err
+	}
+
+	return auth.RevokeAllUserTokens(userID)
+}
+
+// endUserSessions revokes every session and refresh token of the user. Unlike
+// revokeUserSessions it leaves access tokens issued right after alone, only
+// those of the ended sessions are rejected.
+func (h *Handler) endUserSessions(userID int) error {
+	if err := h.sessionStore.RevokeUserSessions(userID); err != nil {
+		return err
+	}
+
+	return h.tokenStore.RevokeUserRefreshTokens(userID)
+}
+
+// checkUserStatus returns the user unless they were suspended or deleted, in
+// which case they cannot log in. It writes the error response if it fails.
+func (h *Handler) checkUserStatus(w http.ResponseWriter, userID int) (*types.User, bool) {
+	u, err := h.store.GetUserByID(userID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return nil, false
+	}
+
+	if err := auth.CheckUserStatus(u); err != nil {
+		log.Printf("refused login of user %d: %v", userID, err)
+		utils.WriteError(w, http.StatusForbidden, err)
+		return nil, false
+	}
+
+	return u, true
+}
+
+func (h *Handler) revokeReusedFamily(t *types.RefreshToken) {
+	log.Printf("refresh token %d of user %d was reused, revoking family %s", t.ID, t.UserID, t.FamilyID)
+
+	if err := h.tokenStore.RevokeTokenFamily(t.FamilyID); err != nil {
+		log.Printf("failed to revoke token family %s: %v", t.FamilyID, err)
+	}
+}
+
+// issueTokens creates a short-lived access token and a refresh token that
+// belong to the session of the given refresh token family. methods are the
+// authentication methods the user passed, recorded in the access token.
+func (h *Handler) issueTokens(userID int, familyID string, methods ...string) (*types.TokenResponse, error) {
+	token, err := auth.CreateSessionJWT(userID, familyID, methods...)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, hash, err := auth.NewOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+
+	expiration := time.Second * time.Duration(configs.Envs.RefreshTokenExpirationInSeconds)
+	err = h.tokenStore.CreateRefreshToken(types.RefreshToken{
+		UserID:    userID,
+		FamilyID:  familyID,
+		TokenHash: hash,
+		ExpiresAt: time.Now().Add(expiration),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.TokenResponse{
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresIn:    configs.Envs.JWTExpirationInSeconds,
+	}, nil
 }
 
 func (h *Handler) handleRegister(w http.ResponseWriter, r *http.Request) {
@@ -79,6 +788,11 @@ func (h *Handler) handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := auth.CheckPassword(user.Password); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
 	// check if user exists
 	_, err := h.store.GetUserByEmail(user.Email)
 	if err == nil {
@@ -93,23 +807,30 @@ func (h *Handler) handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Set default role if not provided
-	if user.Role == "" {
-		user.Role = "user"
-	}
-
-	err = h.store.CreateUser(types.User{
+	// everyone registers as a user, admins are made with the role API or
+	// the admin CLI
+	userID, err := h.store.CreateUser(types.User{
 		FirstName: user.FirstName,
 		LastName:  user.LastName,
 		Email:     user.Email,
 		Password:  hashedPassword,
-		Role:      user.Role,
+		Role:      "user",
 	})
+	if errors.Is(err, types.ErrEmailTaken) {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("user with email %s already exists", user.Email))
+		return
+	}
 	if err != nil {
 		utils.WriteError(w, http.StatusInternalServerError, err)
 		return
 	}
 
+	// the account is usable right away, a failure to send the email can be
+	// fixed by asking for a new one
+	if err := h.sendVerificationEmail(userID, user.Email); err != nil {
+		log.Printf("failed to send verification email to user %d: %v", userID, err)
+	}
+
 	// Respond with success status
 	response := map[string]string{
 		"status":  "success",
@@ -133,6 +854,11 @@ func (h *Handler) handleGetUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !auth.CanAccess(r.Context(), auth.PermUsersRead, userID) {
+		utils.WriteError(w, http.StatusForbidden, fmt.Errorf("permission denied"))
+		return
+	}
+
 	user, err := h.store.GetUserByID(userID)
 	if err != nil {
 		utils.WriteError(w, http.StatusInternalServerError, err)
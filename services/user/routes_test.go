@@ -1,17 +1,30 @@
 package user
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/mux"
+	"github.com/surfiniaburger/api-go/configs"
+	"github.com/surfiniaburger/api-go/services/auth"
+	"github.com/surfiniaburger/api-go/services/oidc"
+	"github.com/surfiniaburger/api-go/services/oidc/oidctest"
 	"github.com/surfiniaburger/api-go/types"
 )
 
 func TestUserServiceHandlers(t *testing.T) {
 	userStore := &mockUserStore{}
-	handler := NewHandler(userStore)
+	tokenStore := newMockRefreshTokenStore()
+	handler := newTestHandler(HandlerConfig{Users: userStore, RefreshTokens: tokenStore})
 
 	t.Run("should fail if the user ID is not a number", func(t *testing.T) {
 		req, err := http.NewRequest(http.MethodGet, "/user/abcd", nil)
@@ -32,38 +45,2088 @@ func TestUserServiceHandlers(t *testing.T) {
 	})
 
 	t.Run("should handle get user by ID", func(t *testing.T) {
-		req, err := http.NewRequest(http.MethodGet, "/user/42", nil)
+		auth.SetRevocationStore(auth.NewMemoryRevocationStore())
+
+		token, err := auth.CreateJWT(42)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		router := mux.NewRouter()
+		router.HandleFunc("/user/{userID}", auth.WithJWTAuth(handler.handleGetUser, userStore, auth.PermUsersReadOwn)).Methods(http.MethodGet)
+
+		for path, code := range map[string]int{"/user/42": http.StatusOK, "/user/43": http.StatusForbidden} {
+			req, err := http.NewRequest(http.MethodGet, path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != code {
+				t.Errorf("expected status code %d for %s, got %d", code, path, rr.Code)
+			}
+		}
+	})
+}
+
+func TestRoles(t *testing.T) {
+	auth.SetRevocationStore(auth.NewMemoryRevocationStore())
+
+	userStore := &mockUserStore{roles: map[int]string{1: "admin"}}
+	handler := newTestHandler(HandlerConfig{Users: userStore})
+
+	router := mux.NewRouter()
+	handler.RegisterRoutes(router)
+
+	request := func(method, path, token string, payload any) *httptest.ResponseRecorder {
+		marshalled, err := json.Marshal(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest(method, path, bytes.NewBuffer(marshalled))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("should ignore the role when registering", func(t *testing.T) {
+		rr := request(http.MethodPost, "/register", "", map[string]string{
+			"firstName": "John",
+			"lastName":  "Doe",
+			"email":     "unknown@me.com",
+			"password":  "password",
+			"role":      "admin",
+		})
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("expected status code %d, got %d", http.StatusCreated, rr.Code)
+		}
+
+		if len(userStore.created) != 1 || userStore.created[0].Role != "user" {
+			t.Errorf("expected a user account, got %+v", userStore.created)
+		}
+	})
+
+	adminToken, err := auth.CreateJWT(1, auth.AMRPassword, auth.AMROTP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userToken, err := auth.CreateJWT(2, auth.AMRPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("should only let admins change roles", func(t *testing.T) {
+		rr := request(http.MethodPatch, "/admin/users/2/role", userToken, types.UpdateRolePayload{Role: "admin"})
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected status code %d, got %d", http.StatusForbidden, rr.Code)
+		}
+	})
+
+	t.Run("should reject invalid roles and changing your own role", func(t *testing.T) {
+		rr := request(http.MethodPatch, "/admin/users/2/role", adminToken, types.UpdateRolePayload{Role: "root"})
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+
+		rr = request(http.MethodPatch, "/admin/users/1/role", adminToken, types.UpdateRolePayload{Role: "user"})
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+
+	t.Run("should change the role and record the admin", func(t *testing.T) {
+		rr := request(http.MethodPatch, "/admin/users/2/role", adminToken, types.UpdateRolePayload{Role: "admin"})
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if userStore.roles[2] != "admin" || len(userStore.roleChanges) != 1 || userStore.roleChanges[0] != 1 {
+			t.Errorf("expected user 2 to be made admin by user 1, got %v %v", userStore.roles, userStore.roleChanges)
+		}
+	})
+}
+
+func TestAdminUsers(t *testing.T) {
+	auth.SetRevocationStore(auth.NewMemoryRevocationStore())
+
+	hashedPassword, err := auth.HashPassword("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userStore := &mockUserStore{password: hashedPassword, roles: map[int]string{1: "admin"}}
+	tokenStore := newMockRefreshTokenStore()
+	handler := newTestHandler(HandlerConfig{Users: userStore, RefreshTokens: tokenStore})
+
+	router := mux.NewRouter()
+	handler.RegisterRoutes(router)
+
+	request := func(method, path, token string, payload any) *httptest.ResponseRecorder {
+		marshalled, err := json.Marshal(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest(method, path, bytes.NewBuffer(marshalled))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	login := func() *httptest.ResponseRecorder {
+		return request(http.MethodPost, "/login", "", types.LoginUserPayload{Email: "me@me.com", Password: "password"})
+	}
+
+	adminToken, err := auth.CreateJWT(1, auth.AMRPassword, auth.AMROTP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("should only let admins list users", func(t *testing.T) {
+		userToken, err := auth.CreateJWT(42, auth.AMRPassword)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := request(http.MethodGet, "/admin/users", userToken, nil)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected status code %d, got %d", http.StatusForbidden, rr.Code)
+		}
+	})
+
+	t.Run("should list users matching the filters", func(t *testing.T) {
+		rr := request(http.MethodGet, "/admin/users?role=user&email=me%40&createdAfter=2024-10-01T00:00:00Z&limit=10&offset=20", adminToken, nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		var page types.UserPage
+		if err := json.NewDecoder(rr.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+
+		filter := userStore.filters[len(userStore.filters)-1]
+		if filter.Role != "user" || filter.Email != "me@" || filter.CreatedAfter == nil || filter.CreatedBefore != nil || filter.Limit != 10 || filter.Offset != 20 || filter.IncludeDeleted {
+			t.Errorf("unexpected filter %+v", filter)
+		}
+
+		if page.Total != 1 || len(page.Users) != 1 || page.Limit != 10 {
+			t.Errorf("unexpected page %+v", page)
+		}
+
+		for _, query := range []string{"limit=1000", "status=banned", "createdBefore=yesterday", "offset=-1"} {
+			if rr := request(http.MethodGet, "/admin/users?"+query, adminToken, nil); rr.Code != http.StatusBadRequest {
+				t.Errorf("%s: expected status code %d, got %d", query, http.StatusBadRequest, rr.Code)
+			}
+		}
+	})
+
+	t.Run("should not let admins suspend or delete themselves", func(t *testing.T) {
+		if rr := request(http.MethodPost, "/admin/users/1/suspend", adminToken, nil); rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+
+		if rr := request(http.MethodDelete, "/admin/users/1", adminToken, nil); rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+
+	t.Run("should sign out suspended users until they are reactivated", func(t *testing.T) {
+		rr := login()
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		var tokens types.TokenResponse
+		if err := json.NewDecoder(rr.Body).Decode(&tokens); err != nil {
+			t.Fatal(err)
+		}
+
+		if rr := request(http.MethodPost, "/admin/users/42/suspend", adminToken, nil); rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if rr := request(http.MethodGet, "/me", tokens.Token, nil); rr.Code != http.StatusForbidden {
+			t.Errorf("expected the access token to be rejected, got %d", rr.Code)
+		}
+
+		rr = request(http.MethodPost, "/token/refresh", "", types.RefreshTokenPayload{RefreshToken: tokens.RefreshToken})
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected the refresh token to be rejected, got %d", rr.Code)
+		}
+
+		if rr := login(); rr.Code != http.StatusForbidden {
+			t.Errorf("expected the login to be refused, got %d", rr.Code)
+		}
+
+		if rr := request(http.MethodPost, "/admin/users/42/reactivate", adminToken, nil); rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if rr := login(); rr.Code != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+	})
+
+	t.Run("should soft delete users", func(t *testing.T) {
+		if rr := request(http.MethodDelete, "/admin/users/42", adminToken, nil); rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if rr := login(); rr.Code != http.StatusForbidden {
+			t.Errorf("expected the login to be refused, got %d", rr.Code)
+		}
+
+		if rr := request(http.MethodDelete, "/admin/users/42", adminToken, nil); rr.Code != http.StatusNotFound {
+			t.Errorf("expected status code %d, got %d", http.StatusNotFound, rr.Code)
+		}
+
+		if rr := request(http.MethodPost, "/admin/users/42/reactivate", adminToken, nil); rr.Code != http.StatusNotFound {
+			t.Errorf("expected status code %d, got %d", http.StatusNotFound, rr.Code)
+		}
+	})
+}
+
+func TestRefreshToken(t *testing.T) {
+	userStore := &mockUserStore{}
+	tokenStore := newMockRefreshTokenStore()
+	handler := newTestHandler(HandlerConfig{Users: userStore, RefreshTokens: tokenStore})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/token/refresh", handler.handleRefreshToken).Methods(http.MethodPost)
+
+	refresh := func(token string) *httptest.ResponseRecorder {
+		marshalled, err := json.Marshal(types.RefreshTokenPayload{RefreshToken: token})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest(http.MethodPost, "/token/refresh", bytes.NewBuffer(marshalled))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	tokenStore.CreateRefreshToken(types.RefreshToken{
+		UserID:    42,
+		FamilyID:  "family",
+		TokenHash: auth.HashToken("first"),
+		ExpiresAt: time.Now().Add(time.Hour),
+	})
+
+	t.Run("should fail with an unknown refresh token", func(t *testing.T) {
+		rr := refresh("unknown")
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected status code %d, got %d", http.StatusUnauthorized, rr.Code)
+		}
+	})
+
+	var rotated types.TokenResponse
+
+	t.Run("should rotate the refresh token", func(t *testing.T) {
+		rr := refresh("first")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if err := json.NewDecoder(rr.Body).Decode(&rotated); err != nil {
+			t.Fatal(err)
+		}
+
+		if rotated.Token == "" || rotated.RefreshToken == "" || rotated.RefreshToken == "first" {
+			t.Errorf("expected a new access and refresh token, got %+v", rotated)
+		}
+	})
+
+	t.Run("should revoke the family when a refresh token is reused", func(t *testing.T) {
+		rr := refresh("first")
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected status code %d, got %d", http.StatusUnauthorized, rr.Code)
+		}
+
+		rr = refresh(rotated.RefreshToken)
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected status code %d, got %d", http.StatusUnauthorized, rr.Code)
+		}
+	})
+
+	t.Run("should fail with an expired refresh token", func(t *testing.T) {
+		tokenStore.CreateRefreshToken(types.RefreshToken{
+			UserID:    42,
+			FamilyID:  "other",
+			TokenHash: auth.HashToken("expired"),
+			ExpiresAt: time.Now().Add(-time.Minute),
+		})
+
+		rr := refresh("expired")
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected status code %d, got %d", http.StatusUnauthorized, rr.Code)
+		}
+	})
+}
+
+func TestPasswordReset(t *testing.T) {
+	auth.SetRevocationStore(auth.NewMemoryRevocationStore())
+
+	userStore := &mockUserStore{}
+	resetStore := newMockPasswordResetStore()
+	resetStore.users = userStore
+	notifier := &mockNotifier{}
+	handler := newTestHandler(HandlerConfig{Users: userStore, PasswordResets: resetStore, Notifier: notifier})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/forgot-password", handler.handleForgotPassword).Methods(http.MethodPost)
+	router.HandleFunc("/reset-password", handler.handleResetPassword).Methods(http.MethodPost)
+	router.HandleFunc("/login", handler.handleLogin).Methods(http.MethodPost)
+	router.HandleFunc("/me", auth.WithJWTAuth(handler.handleGetMe, userStore)).Methods(http.MethodGet)
+
+	post := func(path string, payload any) *httptest.ResponseRecorder {
+		marshalled, err := json.Marshal(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest(http.MethodPost, path, bytes.NewBuffer(marshalled))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("should not reveal unknown emails", func(t *testing.T) {
+		rr := post("/forgot-password", types.ForgotPasswordPayload{Email: "unknown@me.com"})
+		if rr.Code != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if len(notifier.sent) != 0 {
+			t.Errorf("expected no notification, got %d", len(notifier.sent))
+		}
+	})
+
+	var token string
+
+	t.Run("should send a reset link", func(t *testing.T) {
+		rr := post("/forgot-password", types.ForgotPasswordPayload{Email: "me@me.com"})
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if len(notifier.sent) != 1 || notifier.sent[0].To != "me@me.com" {
+			t.Fatalf("expected a notification to me@me.com, got %+v", notifier.sent)
+		}
+
+		_, token, _ = strings.Cut(notifier.sent[0].Body, "token=")
+		if token == "" {
+			t.Fatal("expected the notification to contain the token")
+		}
+	})
+
+	t.Run("should keep the token if the password is refused", func(t *testing.T) {
+		rr := post("/reset-password", types.ResetPasswordPayload{Token: token, Password: "short"})
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+
+		if _, ok := userStore.passwords[42]; ok {
+			t.Error("expected the password to be unchanged")
+		}
+	})
+
+	t.Run("should keep the token if the password cannot be saved", func(t *testing.T) {
+		resetStore.fail = true
+		defer func() { resetStore.fail = false }()
+
+		rr := post("/reset-password", types.ResetPasswordPayload{Token: token, Password: "new password"})
+		if rr.Code != http.StatusInternalServerError {
+			t.Fatalf("expected status code %d, got %d", http.StatusInternalServerError, rr.Code)
+		}
+
+		if resetStore.tokens[0].UsedAt != nil {
+			t.Error("expected the token to be unused")
+		}
+	})
+
+	t.Run("should reset the password once", func(t *testing.T) {
+		rr := post("/reset-password", types.ResetPasswordPayload{Token: token, Password: "new password"})
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if !auth.ComparePasswords(userStore.passwords[42], []byte("new password")) {
+			t.Error("expected the password to be updated")
+		}
+
+		rr = post("/reset-password", types.ResetPasswordPayload{Token: token, Password: "other password"})
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+
+	t.Run("should accept a login right after the reset", func(t *testing.T) {
+		userStore.password = userStore.passwords[42]
+
+		rr := post("/login", types.LoginUserPayload{Email: "me@me.com", Password: "new password"})
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		var tokens types.TokenResponse
+		if err := json.NewDecoder(rr.Body).Decode(&tokens); err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest(http.MethodGet, "/me", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+tokens.Token)
+
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+	})
+
+	t.Run("should fail with an expired token", func(t *testing.T) {
+		resetStore.CreatePasswordResetToken(types.PasswordResetToken{
+			UserID:    42,
+			TokenHash: auth.HashToken("expired"),
+			ExpiresAt: time.Now().Add(-time.Minute),
+		})
+
+		rr := post("/reset-password", types.ResetPasswordPayload{Token: "expired", Password: "new password"})
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+}
+
+func TestPasswordRehash(t *testing.T) {
+	auth.SetRevocationStore(auth.NewMemoryRevocationStore())
+
+	legacy := &auth.PasswordHasher{Algorithm: auth.PasswordAlgorithmBcrypt, BcryptCost: 4}
+	hashedPassword, err := legacy.Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userStore := &mockUserStore{password: hashedPassword}
+	handler := newTestHandler(HandlerConfig{Users: userStore})
+
+	router := mux.NewRouter()
+	handler.RegisterRoutes(router)
+
+	post := func(path string, payload any) *httptest.ResponseRecorder {
+		marshalled, err := json.Marshal(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest(http.MethodPost, path, bytes.NewBuffer(marshalled))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("should rehash a bcrypt password on login", func(t *testing.T) {
+		rr := post("/login", types.LoginUserPayload{Email: "me@me.com", Password: "password"})
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		rehashed := userStore.passwords[42]
+		if !strings.HasPrefix(rehashed, "$argon2id$") || !auth.ComparePasswords(rehashed, []byte("password")) {
+			t.Errorf("expected an argon2id hash of the password, got %q", rehashed)
+		}
+	})
+
+	t.Run("should not rehash after a failed login", func(t *testing.T) {
+		delete(userStore.passwords, 42)
+
+		if rr := post("/login", types.LoginUserPayload{Email: "me@me.com", Password: "wrong"}); rr.Code != http.StatusBadRequest {
+			t.Fatalf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+
+		if _, ok := userStore.passwords[42]; ok {
+			t.Error("expected the password to be unchanged")
+		}
+	})
+
+	t.Run("should refuse passwords the policy does not allow", func(t *testing.T) {
+		rr := post("/register", types.RegisterUserPayload{FirstName: "John", LastName: "Doe", Email: "unknown@me.com", Password: "asd"})
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+
+		if len(userStore.created) != 0 {
+			t.Errorf("expected no user to be created, got %+v", userStore.created)
+		}
+	})
+}
+
+func TestMFA(t *testing.T) {
+	auth.SetRevocationStore(auth.NewMemoryRevocationStore())
+
+	hashedPassword, err := auth.HashPassword("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userStore := &mockUserStore{password: hashedPassword}
+	mfaStore := newMockMFAStore()
+	handler := newTestHandler(HandlerConfig{Users: userStore, MFA: mfaStore})
+
+	now := time.Date(2024, 10, 19, 12, 0, 0, 0, time.UTC)
+	handler.now = func() time.Time { return now }
+
+	router := mux.NewRouter()
+	router.HandleFunc("/login", handler.handleLogin).Methods(http.MethodPost)
+	router.HandleFunc("/login/mfa", handler.handleLoginMFA).Methods(http.MethodPost)
+	router.HandleFunc("/me/mfa/enroll", auth.WithMFAEnrollmentAuth(handler.handleEnrollMFA, userStore)).Methods(http.MethodPost)
+	router.HandleFunc("/me/mfa/confirm", auth.WithMFAEnrollmentAuth(handler.handleConfirmMFA, userStore)).Methods(http.MethodPost)
+
+	post := func(path, token string, payload any) *httptest.ResponseRecorder {
+		marshalled, err := json.Marshal(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest(http.MethodPost, path, bytes.NewBuffer(marshalled))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	login := types.LoginUserPayload{Email: "me@me.com", Password: "password"}
+
+	var tokens types.TokenResponse
+	t.Run("should log in with the password only before enrolling", func(t *testing.T) {
+		rr := post("/login", "", login)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if err := json.NewDecoder(rr.Body).Decode(&tokens); err != nil {
+			t.Fatal(err)
+		}
+
+		if tokens.Token == "" {
+			t.Error("expected an access token")
+		}
+	})
+
+	var enrollment types.MFAEnrollResponse
+	var recoveryCodes []string
+
+	t.Run("should enroll and confirm with a code", func(t *testing.T) {
+		rr := post("/me/mfa/enroll", tokens.Token, nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if err := json.NewDecoder(rr.Body).Decode(&enrollment); err != nil {
+			t.Fatal(err)
+		}
+
+		rr = post("/me/mfa/confirm", tokens.Token, types.MFACodePayload{Code: "000000"})
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+
+		code, _ := auth.TOTPCode(enrollment.Secret, auth.TOTPStep(now))
+		rr = post("/me/mfa/confirm", tokens.Token, types.MFACodePayload{Code: code})
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		var confirmed types.MFAConfirmResponse
+		if err := json.NewDecoder(rr.Body).Decode(&confirmed); err != nil {
+			t.Fatal(err)
+		}
+		recoveryCodes = confirmed.RecoveryCodes
+
+		if len(recoveryCodes) != recoveryCodeCount || confirmed.Token == "" {
+			t.Errorf("expected recovery codes and new tokens, got %+v", confirmed)
+		}
+	})
+
+	challenge := func() string {
+		rr := post("/login", "", login)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		var response types.MFAChallengeResponse
+		if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+
+		if !response.MFARequired || response.MFAToken == "" {
+			t.Fatalf("expected an MFA challenge, got %+v", response)
+		}
+
+		return response.MFAToken
+	}
+
+	t.Run("should not accept the challenge as an access token", func(t *testing.T) {
+		rr := post("/me/mfa/enroll", challenge(), nil)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected status code %d, got %d", http.StatusForbidden, rr.Code)
+		}
+	})
+
+	t.Run("should complete the login with a new code once", func(t *testing.T) {
+		// the code used to confirm the enrollment cannot be used again
+		code, _ := auth.TOTPCode(enrollment.Secret, auth.TOTPStep(now))
+		rr := post("/login/mfa", "", types.LoginMFAPayload{MFAToken: challenge(), Code: code})
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected status code %d, got %d", http.StatusUnauthorized, rr.Code)
+		}
+
+		now = now.Add(30 * time.Second)
+		code, _ = auth.TOTPCode(enrollment.Secret, auth.TOTPStep(now))
+		rr = post("/login/mfa", "", types.LoginMFAPayload{MFAToken: challenge(), Code: code})
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		rr = post("/login/mfa", "", types.LoginMFAPayload{MFAToken: challenge(), Code: code})
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected status code %d, got %d", http.StatusUnauthorized, rr.Code)
+		}
+	})
+
+	t.Run("should complete the login with a recovery code once", func(t *testing.T) {
+		// the replayed code above counts as a failed login
+		now = now.Add(time.Minute)
+
+		rr := post("/login/mfa", "", types.LoginMFAPayload{MFAToken: challenge(), RecoveryCode: recoveryCodes[0]})
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		rr = post("/login/mfa", "", types.LoginMFAPayload{MFAToken: challenge(), RecoveryCode: recoveryCodes[0]})
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected status code %d, got %d", http.StatusUnauthorized, rr.Code)
+		}
+	})
+
+	t.Run("should keep counting failed logins until the second factor is passed", func(t *testing.T) {
+		wrong := types.LoginUserPayload{Email: "me@me.com", Password: "wrong"}
+
+		// past the lockout, so the earlier failures are forgotten
+		now = now.Add(time.Hour)
+		if rr := post("/login", "", wrong); rr.Code != http.StatusBadRequest {
+			t.Fatalf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+
+		now = now.Add(2 * time.Second)
+		challenge()
+		if rr := post("/login", "", wrong); rr.Code != http.StatusBadRequest {
+			t.Fatalf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+
+		// the second failure doubled the wait to 2 seconds
+		now = now.Add(time.Second)
+		if rr := post("/login", "", login); rr.Code != http.StatusTooManyRequests {
+			t.Errorf("expected status code %d, got %d", http.StatusTooManyRequests, rr.Code)
+		}
+	})
+
+	t.Run("should throttle and lock out guessing the code", func(t *testing.T) {
+		now = now.Add(time.Hour)
+		token := challenge()
+
+		wrong, _ := auth.TOTPCode(enrollment.Secret, auth.TOTPStep(now)+100)
+		rr := post("/login/mfa", "", types.LoginMFAPayload{MFAToken: token, Code: wrong})
+		if rr.Code != http.StatusUnauthorized {
+			t.Fatalf("expected status code %d, got %d", http.StatusUnauthorized, rr.Code)
+		}
+
+		code, _ := auth.TOTPCode(enrollment.Secret, auth.TOTPStep(now))
+		rr = post("/login/mfa", "", types.LoginMFAPayload{MFAToken: token, Code: code})
+		if rr.Code != http.StatusTooManyRequests {
+			t.Errorf("expected status code %d, got %d", http.StatusTooManyRequests, rr.Code)
+		}
+
+		for i := 1; i < int(configs.Envs.LoginMaxAccountFailures); i++ {
+			now = now.Add(time.Minute)
+			post("/login/mfa", "", types.LoginMFAPayload{MFAToken: token, Code: wrong})
+		}
+
+		now = now.Add(time.Minute)
+		code, _ = auth.TOTPCode(enrollment.Secret, auth.TOTPStep(now))
+		rr = post("/login/mfa", "", types.LoginMFAPayload{MFAToken: token, Code: code})
+		if rr.Code != http.StatusLocked {
+			t.Errorf("expected status code %d, got %d", http.StatusLocked, rr.Code)
+		}
+	})
+}
+
+func TestLoginLockout(t *testing.T) {
+	auth.SetRevocationStore(auth.NewMemoryRevocationStore())
+
+	hashedPassword, err := auth.HashPassword("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userStore := &mockUserStore{password: hashedPassword}
+	handler := newTestHandler(HandlerConfig{Users: userStore})
+
+	now := time.Date(2024, 10, 19, 12, 0, 0, 0, time.UTC)
+	handler.now = func() time.Time { return now }
+
+	router := mux.NewRouter()
+	router.HandleFunc("/login", handler.handleLogin).Methods(http.MethodPost)
+	router.HandleFunc("/admin/users/{userID}/unlock", handler.handleUnlockUser).Methods(http.MethodPost)
+
+	login := func(password string) *httptest.ResponseRecorder {
+		marshalled, err := json.Marshal(types.LoginUserPayload{Email: "me@me.com", Password: password})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest(http.MethodPost, "/login", bytes.NewBuffer(marshalled))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = "1.2.3.4:1234"
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("should ask to back off after a failed login", func(t *testing.T) {
+		if rr := login("wrong"); rr.Code != http.StatusBadRequest {
+			t.Fatalf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+
+		rr := login("password")
+		if rr.Code != http.StatusTooManyRequests {
+			t.Fatalf("expected status code %d, got %d", http.StatusTooManyRequests, rr.Code)
+		}
+
+		if rr.Header().Get("Retry-After") == "" {
+			t.Error("expected a Retry-After header")
+		}
+	})
+
+	t.Run("should lock the account after too many failures", func(t *testing.T) {
+		for i := 1; i < 10; i++ {
+			now = now.Add(time.Minute)
+			if rr := login("wrong"); rr.Code != http.StatusBadRequest {
+				t.Fatalf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+			}
+		}
+
+		now = now.Add(time.Minute)
+		rr := login("password")
+		if rr.Code != http.StatusLocked {
+			t.Fatalf("expected status code %d, got %d", http.StatusLocked, rr.Code)
+		}
+
+		if rr.Header().Get("Retry-After") != "841" {
+			t.Errorf("expected to retry after 841 seconds, got %q", rr.Header().Get("Retry-After"))
+		}
+	})
+
+	t.Run("should let an admin unlock the account", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodPost, "/admin/users/42/unlock", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if rr := login("password"); rr.Code != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+	})
+}
+
+func TestSessions(t *testing.T) {
+	auth.SetRevocationStore(auth.NewMemoryRevocationStore())
+
+	hashedPassword, err := auth.HashPassword("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userStore := &mockUserStore{password: hashedPassword, roles: map[int]string{1: "admin"}}
+	tokenStore := newMockRefreshTokenStore()
+	sessionStore := newMockSessionStore()
+	handler := newTestHandler(HandlerConfig{Users: userStore, RefreshTokens: tokenStore, Sessions: sessionStore})
+
+	auth.SetSessionStore(sessionStore)
+	defer auth.SetSessionStore(nil)
+
+	router := mux.NewRouter()
+	handler.RegisterRoutes(router)
+
+	request := func(method, path, token string, payload any) *httptest.ResponseRecorder {
+		marshalled, err := json.Marshal(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest(method, path, bytes.NewBuffer(marshalled))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("User-Agent", "test-agent")
+		req.RemoteAddr = "1.2.3.4:1234"
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	login := func() types.TokenResponse {
+		rr := request(http.MethodPost, "/login", "", types.LoginUserPayload{Email: "me@me.com", Password: "password"})
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		var tokens types.TokenResponse
+		if err := json.NewDecoder(rr.Body).Decode(&tokens); err != nil {
+			t.Fatal(err)
+		}
+
+		return tokens
+	}
+
+	laptop := login()
+	phone := login()
+
+	var sessions []types.Session
+	t.Run("should list the sessions of the user", func(t *testing.T) {
+		rr := request(http.MethodGet, "/me/sessions", laptop.Token, nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if err := json.NewDecoder(rr.Body).Decode(&sessions); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(sessions) != 2 {
+			t.Fatalf("expected 2 sessions, got %d", len(sessions))
+		}
+
+		current := 0
+		for _, s := range sessions {
+			if s.UserAgent != "test-agent" || s.IP != "1.2.3.4" {
+				t.Errorf("expected the device of the session to be recorded, got %+v", s)
+			}
+			if s.Current {
+				current++
+			}
+		}
+
+		if current != 1 {
+			t.Errorf("expected exactly one current session, got %d", current)
+		}
+	})
+
+	t.Run("should reject the tokens of a revoked session", func(t *testing.T) {
+		var phoneSession string
+		for _, s := range sessions {
+			if !s.Current {
+				phoneSession = s.ID
+			}
+		}
+
+		if rr := request(http.MethodDelete, "/me/sessions/unknown", laptop.Token, nil); rr.Code != http.StatusNotFound {
+			t.Errorf("expected status code %d, got %d", http.StatusNotFound, rr.Code)
+		}
+
+		if rr := request(http.MethodDelete, "/me/sessions/"+phoneSession, laptop.Token, nil); rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if rr := request(http.MethodGet, "/me/sessions", phone.Token, nil); rr.Code != http.StatusForbidden {
+			t.Errorf("expected status code %d, got %d", http.StatusForbidden, rr.Code)
+		}
+
+		rr := request(http.MethodPost, "/token/refresh", "", types.RefreshTokenPayload{RefreshToken: phone.RefreshToken})
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected status code %d, got %d", http.StatusUnauthorized, rr.Code)
+		}
+
+		if rr := request(http.MethodGet, "/me/sessions", laptop.Token, nil); rr.Code != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+	})
+
+	t.Run("should let an admin end every session of a user", func(t *testing.T) {
+		admin, err := auth.CreateJWT(1, auth.AMRPassword, auth.AMROTP)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if rr := request(http.MethodDelete, "/admin/users/42/sessions", laptop.Token, nil); rr.Code != http.StatusForbidden {
+			t.Errorf("expected status code %d, got %d", http.StatusForbidden, rr.Code)
+		}
+
+		if rr := request(http.MethodDelete, "/admin/users/42/sessions", admin, nil); rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		sessions, _ := sessionStore.GetUserSessions(42, time.Time{})
+		if len(sessions) != 0 {
+			t.Errorf("expected every session to be revoked, got %d", len(sessions))
+		}
+
+		rr := request(http.MethodPost, "/token/refresh", "", types.RefreshTokenPayload{RefreshToken: laptop.RefreshToken})
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected status code %d, got %d", http.StatusUnauthorized, rr.Code)
+		}
+	})
+}
+
+func TestOIDCLogin(t *testing.T) {
+	server, err := oidctest.NewServer("client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	userStore := &mockUserStore{}
+	identityStore := newMockIdentityStore(userStore)
+	mfaStore := newMockMFAStore()
+	handler := newTestHandler(HandlerConfig{Users: userStore, MFA: mfaStore, Identities: identityStore})
+	handler.providers = oidc.NewProviders([]configs.OIDCProvider{{
+		Name:        "test",
+		Issuer:      server.Issuer(),
+		ClientID:    "client",
+		RedirectURL: "http://localhost/callback",
+		Scopes:      []string{"openid", "email", "profile"},
+	}})
+
+	router := mux.NewRouter()
+	handler.RegisterRoutes(router)
+
+	request := func(method, path string, payload any) *httptest.ResponseRecorder {
+		marshalled, err := json.Marshal(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest(method, path, bytes.NewBuffer(marshalled))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// login goes through the whole flow as the provider account and returns
+	// the response of the callback
+	login := func(account oidctest.User) *httptest.ResponseRecorder {
+		rr := request(http.MethodGet, "/login/oidc/test", nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		var authorization types.OIDCAuthorizationResponse
+		if err := json.NewDecoder(rr.Body).Decode(&authorization); err != nil {
+			t.Fatal(err)
+		}
+
+		code, state, err := server.Authorize(authorization.AuthorizationURL, account)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if state != authorization.State {
+			t.Fatalf("expected state %q, got %q", authorization.State, state)
+		}
+
+		return request(http.MethodPost, "/login/oidc/test/callback", types.OIDCCallbackPayload{Code: code, State: state})
+	}
+
+	t.Run("should fail with an unknown provider", func(t *testing.T) {
+		if rr := request(http.MethodGet, "/login/oidc/other", nil); rr.Code != http.StatusNotFound {
+			t.Errorf("expected status code %d, got %d", http.StatusNotFound, rr.Code)
+		}
+	})
+
+	t.Run("should fail with an unknown state", func(t *testing.T) {
+		rr := request(http.MethodPost, "/login/oidc/test/callback", types.OIDCCallbackPayload{Code: "code", State: "state"})
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+
+	t.Run("should create a user for a new account", func(t *testing.T) {
+		rr := login(oidctest.User{Subject: "new", Email: "unknown@me.com", EmailVerified: true, GivenName: "New"})
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body)
+		}
+
+		var tokens types.TokenResponse
+		if err := json.NewDecoder(rr.Body).Decode(&tokens); err != nil {
+			t.Fatal(err)
+		}
+
+		if tokens.Token == "" || tokens.RefreshToken == "" {
+			t.Errorf("expected tokens, got %+v", tokens)
+		}
+
+		if len(userStore.created) != 1 || !userStore.created[0].EmailVerified || userStore.created[0].FirstName != "New" {
+			t.Errorf("expected a verified user to be created, got %+v", userStore.created)
+		}
+
+		// the second login uses the linked account
+		if rr := login(oidctest.User{Subject: "new", Email: "unknown@me.com", EmailVerified: true}); rr.Code != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if len(userStore.created) != 1 {
+			t.Errorf("expected no other user to be created, got %d", len(userStore.created))
+		}
+	})
+
+	t.Run("should not link an unverified email address", func(t *testing.T) {
+		rr := login(oidctest.User{Subject: "unverified", Email: "me@me.com"})
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected status code %d, got %d", http.StatusForbidden, rr.Code)
+		}
+
+		// the local account did not verify the address either
+		rr = login(oidctest.User{Subject: "existing", Email: "me@me.com", EmailVerified: true})
+		if rr.Code != http.StatusConflict {
+			t.Errorf("expected status code %d, got %d", http.StatusConflict, rr.Code)
+		}
+	})
+
+	t.Run("should link an existing user by email and require their second factor", func(t *testing.T) {
+		userStore.SetEmailVerified(42)
+		mfaStore.mfa[42] = &types.UserMFA{UserID: 42, Enabled: true}
+
+		rr := login(oidctest.User{Subject: "existing", Email: "me@me.com", EmailVerified: true})
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		var challenge types.MFAChallengeResponse
+		if err := json.NewDecoder(rr.Body).Decode(&challenge); err != nil {
+			t.Fatal(err)
+		}
+
+		if !challenge.MFARequired {
+			t.Error("expected an MFA challenge")
+		}
+
+		identity, _ := identityStore.GetIdentity("test", "existing")
+		if identity.UserID != 42 {
+			t.Errorf("expected the account to be linked to user 42, got %d", identity.UserID)
+		}
+	})
+
+	t.Run("should keep the federated login when refreshing the tokens", func(t *testing.T) {
+		mfaStore.recoveryCodes[42] = map[string]bool{auth.HashRecoveryCode("recovery"): true}
+
+		rr := login(oidctest.User{Subject: "existing", Email: "me@me.com", EmailVerified: true})
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		var challenge types.MFAChallengeResponse
+		if err := json.NewDecoder(rr.Body).Decode(&challenge); err != nil {
+			t.Fatal(err)
+		}
+
+		rr = request(http.MethodPost, "/login/mfa", types.LoginMFAPayload{MFAToken: challenge.MFAToken, RecoveryCode: "recovery"})
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body)
+		}
+
+		var tokens types.TokenResponse
+		if err := json.NewDecoder(rr.Body).Decode(&tokens); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []string{auth.AMRFederated, auth.AMROTP}
+		if amr := tokenAMR(t, tokens.Token); !slices.Equal(amr, expected) {
+			t.Errorf("expected methods %v, got %v", expected, amr)
+		}
+
+		rr = request(http.MethodPost, "/token/refresh", types.RefreshTokenPayload{RefreshToken: tokens.RefreshToken})
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body)
+		}
+
+		if err := json.NewDecoder(rr.Body).Decode(&tokens); err != nil {
+			t.Fatal(err)
+		}
+
+		if amr := tokenAMR(t, tokens.Token); !slices.Equal(amr, expected) {
+			t.Errorf("expected methods %v after refreshing, got %v", expected, amr)
+		}
+	})
+}
+
+// tokenAMR returns the authentication methods claimed by an access token.
+func tokenAMR(t *testing.T, token string) []string {
+	t.Helper()
+
+	var claims auth.Claims
+	if _, _, err := jwt.NewParser().ParseUnverified(token, &claims); err != nil {
+		t.Fatal(err)
+	}
+
+	return claims.AMR
+}
+
+func TestProfile(t *testing.T) {
+	auth.SetRevocationStore(auth.NewMemoryRevocationStore())
+
+	hashedPassword, err := auth.HashPassword("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userStore := &mockUserStore{password: hashedPassword}
+	emailChanges := newMockEmailChangeStore(userStore)
+	notifier := &mockNotifier{}
+	handler := newTestHandler(HandlerConfig{Users: userStore, EmailChanges: emailChanges, Notifier: notifier})
+
+	router := mux.NewRouter()
+	handler.RegisterRoutes(router)
+
+	token, err := auth.CreateJWT(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(method, path string, payload any) *httptest.ResponseRecorder {
+		marshalled, err := json.Marshal(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest(method, path, bytes.NewBuffer(marshalled))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("should get the profile of the user", func(t *testing.T) {
+		rr := request(http.MethodGet, "/me", nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		var u types.User
+		if err := json.NewDecoder(rr.Body).Decode(&u); err != nil {
+			t.Fatal(err)
+		}
+
+		if u.ID != 42 {
+			t.Errorf("expected user 42, got %d", u.ID)
+		}
+	})
+
+	t.Run("should only update the given fields", func(t *testing.T) {
+		if rr := request(http.MethodPatch, "/me", map[string]string{"firstName": ""}); rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+
+		rr := request(http.MethodPatch, "/me", map[string]string{"firstName": "Jane"})
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if len(userStore.updated) != 1 || userStore.updated[0].FirstName != "Jane" || userStore.updated[0].Email != "me@me.com" {
+			t.Errorf("unexpected update %+v", userStore.updated)
+		}
+	})
+
+	t.Run("should change the password with the current one", func(t *testing.T) {
+		rr := request(http.MethodPost, "/me/password", types.ChangePasswordPayload{CurrentPassword: "wrong", NewPassword: "new-password"})
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+
+		rr = request(http.MethodPost, "/me/password", types.ChangePasswordPayload{CurrentPassword: "password", NewPassword: "new-password"})
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		var tokens types.TokenResponse
+		if err := json.NewDecoder(rr.Body).Decode(&tokens); err != nil {
+			t.Fatal(err)
+		}
+
+		if !auth.ComparePasswords(userStore.passwords[42], []byte("new-password")) {
+			t.Error("expected the new password to be saved")
+		}
+
+		// the old token was revoked along with every other session
+		if rr := request(http.MethodGet, "/me", nil); rr.Code != http.StatusForbidden {
+			t.Errorf("expected status code %d, got %d", http.StatusForbidden, rr.Code)
+		}
+		token = tokens.Token
+	})
+
+	t.Run("should drop pending email changes when the password changes", func(t *testing.T) {
+		notifier.sent = nil
+
+		rr := request(http.MethodPost, "/me/email", types.ChangeEmailPayload{Email: "unknown@me.com", Password: "new-password"})
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("expected status code %d, got %d", http.StatusAccepted, rr.Code)
+		}
+		_, confirmation, _ := strings.Cut(notifier.sent[0].Body, "token=")
+
+		rr = request(http.MethodPost, "/me/password", types.ChangePasswordPayload{CurrentPassword: "new-password", NewPassword: "new-password"})
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		var tokens types.TokenResponse
+		if err := json.NewDecoder(rr.Body).Decode(&tokens); err != nil {
+			t.Fatal(err)
+		}
+		token = tokens.Token
+
+		if rr := request(http.MethodGet, "/confirm-email?token="+confirmation, nil); rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+
+		if userStore.emails[42] != "" {
+			t.Errorf("expected the email address to be kept, got %q", userStore.emails[42])
+		}
+	})
+
+	t.Run("should keep the link if the address was taken in the meantime", func(t *testing.T) {
+		notifier.sent = nil
+		emailChanges.taken = "unknown@me.com"
+		defer func() { emailChanges.taken = "" }()
+
+		rr := request(http.MethodPost, "/me/email", types.ChangeEmailPayload{Email: "unknown@me.com", Password: "new-password"})
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("expected status code %d, got %d", http.StatusAccepted, rr.Code)
+		}
+
+		_, confirmation, _ := strings.Cut(notifier.sent[0].Body, "token=")
+		if rr := request(http.MethodGet, "/confirm-email?token="+confirmation, nil); rr.Code != http.StatusConflict {
+			t.Errorf("expected status code %d, got %d", http.StatusConflict, rr.Code)
+		}
+
+		if userStore.emails[42] != "" {
+			t.Errorf("expected the email address to be kept, got %q", userStore.emails[42])
+		}
+
+		if pending := emailChanges.tokens[len(emailChanges.tokens)-1]; pending.UsedAt != nil {
+			t.Error("expected the confirmation link to be kept")
+		}
+	})
+
+	t.Run("should change the email address once confirmed", func(t *testing.T) {
+		notifier.sent = nil
+
+		if rr := request(http.MethodPost, "/me/email", types.ChangeEmailPayload{Email: "other@me.com", Password: "new-password"}); rr.Code != http.StatusConflict {
+			t.Errorf("expected status code %d, got %d", http.StatusConflict, rr.Code)
+		}
+
+		rr := request(http.MethodPost, "/me/email", types.ChangeEmailPayload{Email: "unknown@me.com", Password: "new-password"})
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("expected status code %d, got %d", http.StatusAccepted, rr.Code)
+		}
+
+		if len(notifier.sent) != 1 || notifier.sent[0].To != "unknown@me.com" {
+			t.Fatalf("expected a confirmation to the new address, got %+v", notifier.sent)
+		}
+
+		if userStore.emails[42] != "" {
+			t.Error("expected the email address to change only once confirmed")
+		}
+
+		_, confirmation, _ := strings.Cut(notifier.sent[0].Body, "token=")
+		rr = request(http.MethodGet, "/confirm-email?token="+confirmation, nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if userStore.emails[42] != "unknown@me.com" {
+			t.Errorf("expected the email address to be changed, got %q", userStore.emails[42])
+		}
+
+		if len(notifier.sent) != 2 || notifier.sent[1].To != "me@me.com" {
+			t.Errorf("expected a notice to the previous address, got %+v", notifier.sent)
+		}
+
+		if rr := request(http.MethodGet, "/confirm-email?token="+confirmation, nil); rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+}
+
+func TestEmailVerification(t *testing.T) {
+	userStore := &mockUserStore{}
+	verifyStore := newMockEmailVerificationStore(userStore)
+	notifier := &mockNotifier{}
+	handler := newTestHandler(HandlerConfig{Users: userStore, EmailVerifications: verifyStore, Notifier: notifier})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/register", handler.handleRegister).Methods(http.MethodPost)
+	router.HandleFunc("/verify-email", handler.handleVerifyEmail).Methods(http.MethodGet)
+	router.HandleFunc("/verify-email/resend", handler.handleResendVerificationEmail).Methods(http.MethodPost)
+
+	var token string
+
+	t.Run("should send a verification email on registration", func(t *testing.T) {
+		marshalled, err := json.Marshal(types.RegisterUserPayload{
+			FirstName: "ade",
+			LastName:  "burger",
+			Email:     "unknown@me.com",
+			Password:  "ogbono soup",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest(http.MethodPost, "/register", bytes.NewBuffer(marshalled))
 		if err != nil {
 			t.Fatal(err)
 		}
 
 		rr := httptest.NewRecorder()
-		router := mux.NewRouter()
+		router.ServeHTTP(rr, req)
 
-		router.HandleFunc("/user/{userID}", handler.handleGetUser).Methods(http.MethodGet)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("expected status code %d, got %d", http.StatusCreated, rr.Code)
+		}
+
+		if len(userStore.created) != 1 || userStore.created[0].EmailVerified {
+			t.Fatalf("expected an unverified user to be created, got %+v", userStore.created)
+		}
+
+		if len(notifier.sent) != 1 || notifier.sent[0].Kind != types.NotificationEmailVerification || notifier.sent[0].UserID != 43 {
+			t.Fatalf("expected a verification email for user 43, got %+v", notifier.sent)
+		}
+
+		_, token, _ = strings.Cut(notifier.sent[0].Body, "token=")
+	})
+
+	t.Run("should throttle resending the verification email", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodPost, "/verify-email/resend", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = req.WithContext(context.WithValue(req.Context(), auth.UserKey, 43))
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusTooManyRequests {
+			t.Errorf("expected status code %d, got %d", http.StatusTooManyRequests, rr.Code)
+		}
+
+		if rr.Header().Get("Retry-After") == "" {
+			t.Error("expected a Retry-After header")
+		}
+	})
+
+	t.Run("should keep the token if the address cannot be verified", func(t *testing.T) {
+		verifyStore.fail = true
+		defer func() { verifyStore.fail = false }()
+
+		req, err := http.NewRequest(http.MethodGet, "/verify-email?token="+token, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusInternalServerError {
+			t.Errorf("expected status code %d, got %d", http.StatusInternalServerError, rr.Code)
+		}
+
+		if userStore.verified[43] || verifyStore.tokens[0].UsedAt != nil {
+			t.Error("expected the token to be kept and the user to stay unverified")
+		}
+	})
+
+	t.Run("should verify the email address once", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "/verify-email?token="+token, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
 
+		rr := httptest.NewRecorder()
 		router.ServeHTTP(rr, req)
 
 		if rr.Code != http.StatusOK {
-			t.Errorf("expected status code %d, got %d", http.StatusOK, rr.Code)
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if !userStore.verified[43] {
+			t.Error("expected the user to be verified")
+		}
+
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
 		}
 	})
 }
 
-type mockUserStore struct{}
+func TestTruncateUserAgent(t *testing.T) {
+	long := strings.Repeat("é", maxUserAgentLength+10)
+
+	tests := []struct {
+		userAgent string
+		expected  string
+	}{
+		{"test-agent", "test-agent"},
+		{long, strings.Repeat("é", maxUserAgentLength)},
+		{"agent\xff", "agent"},
+	}
+
+	for _, test := range tests {
+		if truncated := truncateUserAgent(test.userAgent); truncated != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.userAgent, test.expected, truncated)
+		}
+	}
+}
+
+// newTestHandler creates a handler with a mock for every dependency the
+// config leaves out. The user store is required.
+func newTestHandler(cfg HandlerConfig) *Handler {
+	userStore := cfg.Users.(*mockUserStore)
+	if cfg.RefreshTokens == nil {
+		cfg.RefreshTokens = newMockRefreshTokenStore()
+	}
+	if cfg.Sessions == nil {
+		cfg.Sessions = newMockSessionStore()
+	}
+	if cfg.PasswordResets == nil {
+		cfg.PasswordResets = newMockPasswordResetStore()
+	}
+	if cfg.EmailVerifications == nil {
+		cfg.EmailVerifications = newMockEmailVerificationStore(userStore)
+	}
+	if cfg.EmailChanges == nil {
+		cfg.EmailChanges = newMockEmailChangeStore(userStore)
+	}
+	if cfg.MFA == nil {
+		cfg.MFA = newMockMFAStore()
+	}
+	if cfg.LoginAttempts == nil {
+		cfg.LoginAttempts = auth.NewMemoryLoginAttemptStore()
+	}
+	if cfg.Identities == nil {
+		cfg.Identities = newMockIdentityStore(userStore)
+	}
+	if cfg.OIDCStates == nil {
+		cfg.OIDCStates = newMockOIDCStateStore()
+	}
+	if cfg.Notifier == nil {
+		cfg.Notifier = &mockNotifier{}
+	}
+
+	return NewHandler(cfg)
+}
+
+type mockUserStore struct {
+	// password is the hashed password of every user returned by email
+	password  string
+	passwords map[int]string
+	verified  map[int]bool
+	roles     map[int]string
+	emails    map[int]string
+	// roleChanges records the actor of every role change
+	roleChanges []int
+	created     []types.User
+	updated     []types.User
+	statuses    map[int]string
+	deleted     map[int]bool
+	// filters records the filter of every user listing
+	filters []types.UserFilter
+}
+
+func (m *mockUserStore) GetUsers(filter types.UserFilter) (*types.UserPage, error) {
+	m.filters = append(m.filters, filter)
+
+	u, _ := m.GetUserByID(42)
+	return &types.UserPage{Users: []types.User{*u}, Total: 1, Limit: filter.Limit, Offset: filter.Offset}, nil
+}
+
+func (m *mockUserStore) SetUserStatus(userID int, status string) error {
+	if m.statuses == nil {
+		m.statuses = make(map[int]string)
+	}
+
+	m.statuses[userID] = status
+	return nil
+}
+
+func (m *mockUserStore) DeleteUser(userID int) (bool, error) {
+	if m.deleted[userID] {
+		return false, nil
+	}
+
+	if m.deleted == nil {
+		m.deleted = make(map[int]bool)
+	}
+
+	m.deleted[userID] = true
+	return true, nil
+}
+
+// status sets the status and deletion time of a user the mock returns.
+func (m *mockUserStore) status(u *types.User) *types.User {
+	u.Status = types.UserStatusActive
+	if status, ok := m.statuses[u.ID]; ok {
+		u.Status = status
+	}
+
+	if m.deleted[u.ID] {
+		deletedAt := time.Now()
+		u.DeletedAt = &deletedAt
+	}
+
+	return u
+}
 
 func (m *mockUserStore) UpdateUser(u types.User) error {
+	m.updated = append(m.updated, u)
+	return nil
+}
+
+func (m *mockUserStore) UpdatePassword(userID int, password string) error {
+	if m.passwords == nil {
+		m.passwords = make(map[int]string)
+	}
+
+	m.passwords[userID] = password
 	return nil
 }
 
 func (m *mockUserStore) GetUserByEmail(email string) (*types.User, error) {
-	return &types.User{}, nil
+	if email == "unknown@me.com" {
+		return nil, fmt.Errorf("user not found")
+	}
+
+	return m.status(&types.User{ID: 42, Email: email, Password: m.password, EmailVerified: m.verified[42]}), nil
+}
+
+func (m *mockUserStore) CreateUser(u types.User) (int, error) {
+	m.created = append(m.created, u)
+	return 42 + len(m.created), nil
 }
 
-func (m *mockUserStore) CreateUser(u types.User) error {
+// SetEmailVerified is called by the email verification store when a token is
+// used.
+func (m *mockUserStore) SetEmailVerified(userID int) error {
+	if m.verified == nil {
+		m.verified = make(map[int]bool)
+	}
+
+	m.verified[userID] = true
 	return nil
 }
 
 func (m *mockUserStore) GetUserByID(id int) (*types.User, error) {
-	return &types.User{}, nil
+	role, ok := m.roles[id]
+	if !ok {
+		role = "user"
+	}
+
+	email, ok := m.emails[id]
+	if !ok {
+		email = "me@me.com"
+	}
+
+	password, ok := m.passwords[id]
+	if !ok {
+		password = m.password
+	}
+
+	return m.status(&types.User{ID: id, Email: email, Password: password, Role: role, EmailVerified: m.verified[id]}), nil
+}
+
+func (m *mockUserStore) UpdateRole(userID int, role string, actorID int) error {
+	if m.roles == nil {
+		m.roles = make(map[int]string)
+	}
+
+	m.roles[userID] = role
+	m.roleChanges = append(m.roleChanges, actorID)
+	return nil
+}
+
+type mockRefreshTokenStore struct {
+	tokens []*types.RefreshToken
+}
+
+func newMockRefreshTokenStore() *mockRefreshTokenStore {
+	return &mockRefreshTokenStore{}
+}
+
+func (m *mockRefreshTokenStore) CreateRefreshToken(t types.RefreshToken) error {
+	t.ID = len(m.tokens) + 1
+	m.tokens = append(m.tokens, &t)
+	return nil
+}
+
+func (m *mockRefreshTokenStore) GetRefreshTokenByHash(hash string) (*types.RefreshToken, error) {
+	for _, t := range m.tokens {
+		if t.TokenHash == hash {
+			copied := *t
+			return &copied, nil
+		}
+	}
+
+	return nil, fmt.Errorf("refresh token not found")
+}
+
+func (m *mockRefreshTokenStore) RevokeRefreshToken(id int) (bool, error) {
+	for _, t := range m.tokens {
+		if t.ID == id && t.RevokedAt == nil {
+			now := time.Now()
+			t.RevokedAt = &now
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (m *mockRefreshTokenStore) RevokeUserRefreshTokens(userID int) error {
+	for _, t := range m.tokens {
+		if t.UserID == userID && t.RevokedAt == nil {
+			now := time.Now()
+			t.RevokedAt = &now
+		}
+	}
+
+	return nil
+}
+
+func (m *mockRefreshTokenStore) RevokeTokenFamily(familyID string) error {
+	for _, t := range m.tokens {
+		if t.FamilyID == familyID && t.RevokedAt == nil {
+			now := time.Now()
+			t.RevokedAt = &now
+		}
+	}
+
+	return nil
+}
+
+// mockPasswordResetStore sets the passwords of the users store when a token
+// is used, if it has one.
+type mockPasswordResetStore struct {
+	tokens []*types.PasswordResetToken
+	users  *mockUserStore
+	// fail makes using a token fail like a database error would
+	fail bool
+}
+
+func newMockPasswordResetStore() *mockPasswordResetStore {
+	return &mockPasswordResetStore{}
+}
+
+func (m *mockPasswordResetStore) CreatePasswordResetToken(t types.PasswordResetToken) error {
+	t.ID = len(m.tokens) + 1
+	m.tokens = append(m.tokens, &t)
+	return nil
+}
+
+func (m *mockPasswordResetStore) GetPasswordResetTokenByHash(hash string) (*types.PasswordResetToken, error) {
+	for _, t := range m.tokens {
+		if t.TokenHash == hash {
+			copied := *t
+			return &copied, nil
+		}
+	}
+
+	return nil, fmt.Errorf("password reset token not found")
+}
+
+func (m *mockPasswordResetStore) UsePasswordResetToken(id int, password string) (bool, error) {
+	if m.fail {
+		return false, fmt.Errorf("failed to use password reset token")
+	}
+
+	for _, t := range m.tokens {
+		if t.ID == id && t.UsedAt == nil {
+			now := time.Now()
+			t.UsedAt = &now
+
+			if m.users != nil {
+				m.users.UpdatePassword(t.UserID, password)
+			}
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+type mockNotifier struct {
+	sent []types.Notification
+}
+
+func (m *mockNotifier) Notify(n types.Notification) error {
+	m.sent = append(m.sent, n)
+	return nil
+}
+
+// mockEmailVerificationStore marks the users of the users store verified when
+// a token is used.
+type mockEmailVerificationStore struct {
+	tokens []*types.EmailVerificationToken
+	users  *mockUserStore
+	// fail makes using a token fail like a database error would
+	fail bool
+}
+
+func newMockEmailVerificationStore(users *mockUserStore) *mockEmailVerificationStore {
+	return &mockEmailVerificationStore{users: users}
+}
+
+func (m *mockEmailVerificationStore) CreateEmailVerificationToken(t types.EmailVerificationToken) error {
+	t.ID = len(m.tokens) + 1
+	t.CreatedAt = time.Now()
+	m.tokens = append(m.tokens, &t)
+	return nil
+}
+
+func (m *mockEmailVerificationStore) GetEmailVerificationTokenByHash(hash string) (*types.EmailVerificationToken, error) {
+	for _, t := range m.tokens {
+		if t.TokenHash == hash {
+			copied := *t
+			return &copied, nil
+		}
+	}
+
+	return nil, fmt.Errorf("email verification token not found")
+}
+
+func (m *mockEmailVerificationStore) GetLatestEmailVerificationToken(userID int) (*types.EmailVerificationToken, error) {
+	for i := len(m.tokens) - 1; i >= 0; i-- {
+		if m.tokens[i].UserID == userID {
+			copied := *m.tokens[i]
+			return &copied, nil
+		}
+	}
+
+	return nil, fmt.Errorf("email verification token not found")
+}
+
+func (m *mockEmailVerificationStore) UseEmailVerificationToken(id int) (bool, error) {
+	if m.fail {
+		return false, fmt.Errorf("failed to use email verification token")
+	}
+
+	for _, t := range m.tokens {
+		if t.ID == id && t.UsedAt == nil {
+			now := time.Now()
+			t.UsedAt = &now
+			m.users.SetEmailVerified(t.UserID)
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// mockEmailChangeStore sets the emails of the users store when a token is
+// used.
+type mockEmailChangeStore struct {
+	tokens []*types.EmailChangeToken
+	users  *mockUserStore
+	// taken is an address another user registered in the meantime
+	taken string
+}
+
+func newMockEmailChangeStore(users *mockUserStore) *mockEmailChangeStore {
+	return &mockEmailChangeStore{users: users}
+}
+
+func (m *mockEmailChangeStore) CreateEmailChangeToken(t types.EmailChangeToken) error {
+	t.ID = len(m.tokens) + 1
+	m.tokens = append(m.tokens, &t)
+	return nil
+}
+
+func (m *mockEmailChangeStore) GetEmailChangeTokenByHash(hash string) (*types.EmailChangeToken, error) {
+	for _, t := range m.tokens {
+		if t.TokenHash == hash {
+			copied := *t
+			return &copied, nil
+		}
+	}
+
+	return nil, fmt.Errorf("email change token not found")
+}
+
+func (m *mockEmailChangeStore) UseEmailChangeToken(id int) (bool, error) {
+	for _, t := range m.tokens {
+		if t.ID == id && t.UsedAt == nil {
+			if t.NewEmail == m.taken {
+				return false, types.ErrEmailTaken
+			}
+
+			now := time.Now()
+			t.UsedAt = &now
+
+			if m.users.emails == nil {
+				m.users.emails = make(map[int]string)
+			}
+			m.users.emails[t.UserID] = t.NewEmail
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (m *mockEmailChangeStore) RevokeUserEmailChangeTokens(userID int) error {
+	now := time.Now()
+	for _, t := range m.tokens {
+		if t.UserID == userID && t.UsedAt == nil {
+			t.UsedAt = &now
+		}
+	}
+
+	return nil
+}
+
+type mockMFAStore struct {
+	mfa           map[int]*types.UserMFA
+	recoveryCodes map[int]map[string]bool
+}
+
+func newMockMFAStore() *mockMFAStore {
+	return &mockMFAStore{
+		mfa:           make(map[int]*types.UserMFA),
+		recoveryCodes: make(map[int]map[string]bool),
+	}
+}
+
+func (m *mockMFAStore) GetMFA(userID int) (*types.UserMFA, error) {
+	if mfa, ok := m.mfa[userID]; ok {
+		copied := *mfa
+		return &copied, nil
+	}
+
+	return &types.UserMFA{UserID: userID}, nil
+}
+
+func (m *mockMFAStore) SaveMFASecret(userID int, secret string) error {
+	m.mfa[userID] = &types.UserMFA{UserID: userID, Secret: secret}
+	return nil
+}
+
+func (m *mockMFAStore) EnableMFA(userID int, recoveryCodeHashes []string) error {
+	m.mfa[userID].Enabled = true
+
+	m.recoveryCodes[userID] = make(map[string]bool)
+	for _, hash := range recoveryCodeHashes {
+		m.recoveryCodes[userID][hash] = true
+	}
+
+	return nil
+}
+
+func (m *mockMFAStore) UseTOTPStep(userID int, step int64) (bool, error) {
+	mfa := m.mfa[userID]
+	if mfa.LastUsedStep >= step {
+		return false, nil
+	}
+
+	mfa.LastUsedStep = step
+	return true, nil
+}
+
+func (m *mockMFAStore) UseRecoveryCode(userID int, hash string) (bool, error) {
+	if !m.recoveryCodes[userID][hash] {
+		return false, nil
+	}
+
+	delete(m.recoveryCodes[userID], hash)
+	return true, nil
+}
+
+type mockSessionStore struct {
+	sessions map[string]*types.Session
+}
+
+func newMockSessionStore() *mockSessionStore {
+	return &mockSessionStore{sessions: make(map[string]*types.Session)}
+}
+
+func (m *mockSessionStore) CreateSession(s types.Session) error {
+	if _, ok := m.sessions[s.ID]; ok {
+		return fmt.Errorf("duplicate session %s", s.ID)
+	}
+
+	now := time.Now()
+	s.CreatedAt = now
+	s.LastSeenAt = now
+	m.sessions[s.ID] = &s
+	return nil
+}
+
+func (m *mockSessionStore) GetSession(id string) (*types.Session, error) {
+	if s, ok := m.sessions[id]; ok {
+		copied := *s
+		return &copied, nil
+	}
+
+	return &types.Session{}, nil
+}
+
+func (m *mockSessionStore) GetUserSessions(userID int, activeSince time.Time) ([]types.Session, error) {
+	sessions := []types.Session{}
+	for _, s := range m.sessions {
+		if s.UserID == userID && s.RevokedAt == nil && !s.LastSeenAt.Before(activeSince) {
+			sessions = append(sessions, *s)
+		}
+	}
+
+	return sessions, nil
+}
+
+func (m *mockSessionStore) TouchSession(id string, seenAt time.Time) error {
+	if s, ok := m.sessions[id]; ok {
+		s.LastSeenAt = seenAt
+	}
+
+	return nil
+}
+
+func (m *mockSessionStore) RevokeSession(userID int, id string) (bool, error) {
+	s, ok := m.sessions[id]
+	if !ok || s.UserID != userID || s.RevokedAt != nil {
+		return false, nil
+	}
+
+	now := time.Now()
+	s.RevokedAt = &now
+	return true, nil
+}
+
+func (m *mockSessionStore) RevokeUserSessions(userID int) error {
+	for _, s := range m.sessions {
+		if s.UserID == userID && s.RevokedAt == nil {
+			now := time.Now()
+			s.RevokedAt = &now
+		}
+	}
+
+	return nil
+}
+
+type mockIdentityStore struct {
+	users      *mockUserStore
+	identities []types.UserIdentity
+}
+
+func newMockIdentityStore(users *mockUserStore) *mockIdentityStore {
+	return &mockIdentityStore{users: users}
+}
+
+func (m *mockIdentityStore) GetIdentity(provider, subject string) (*types.UserIdentity, error) {
+	for _, i := range m.identities {
+		if i.Provider == provider && i.Subject == subject {
+			return &i, nil
+		}
+	}
+
+	return &types.UserIdentity{}, nil
+}
+
+func (m *mockIdentityStore) CreateIdentity(i types.UserIdentity) error {
+	i.ID = len(m.identities) + 1
+	m.identities = append(m.identities, i)
+	return nil
+}
+
+func (m *mockIdentityStore) CreateUserWithIdentity(u types.User, i types.UserIdentity) (int, error) {
+	userID, err := m.users.CreateUser(u)
+	if err != nil {
+		return 0, err
+	}
+
+	i.UserID = userID
+	return userID, m.CreateIdentity(i)
+}
+
+type mockOIDCStateStore struct {
+	states map[string]types.OIDCLoginState
+}
+
+func newMockOIDCStateStore() *mockOIDCStateStore {
+	return &mockOIDCStateStore{states: make(map[string]types.OIDCLoginState)}
+}
+
+func (m *mockOIDCStateStore) CreateOIDCState(state types.OIDCLoginState) error {
+	m.states[state.StateHash] = state
+	return nil
+}
+
+func (m *mockOIDCStateStore) UseOIDCState(hash string) (*types.OIDCLoginState, error) {
+	state, ok := m.states[hash]
+	if !ok {
+		return &types.OIDCLoginState{}, nil
+	}
+
+	delete(m.states, hash)
+	return &state, nil
 }
@@ -0,0 +1,157 @@
+package user
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/surfiniaburger/api-go/configs"
+	"github.com/surfiniaburger/api-go/services/auth"
+	"github.com/surfiniaburger/api-go/types"
+	"github.com/surfiniaburger/api-go/utils"
+)
+
+// maxUserAgentLength is the size of the userAgent column, in characters.
+const maxUserAgentLength = 255
+
+// handleGetSessions lists the devices the user is logged in on, marking the
+// one making the request.
+func (h *Handler) handleGetSessions(w http.ResponseWriter, r *http.Request) {
+	userID := auth.GetUserIDFromContext(r.Context())
+
+	// a session without a usable refresh token is over even if it was
+	// never revoked
+	expiration := time.Second * time.Duration(configs.Envs.RefreshTokenExpirationInSeconds)
+	sessions, err := h.sessionStore.GetUserSessions(userID, time.Now().Add(-expiration))
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if token := auth.GetTokenFromContext(r.Context()); token != nil {
+		for i := range sessions {
+			sessions[i].Current = sessions[i].ID == token.SessionID
+		}
+	}
+
+	utils.WriteJSON(w, http.StatusOK, sessions)
+}
+
+// handleRevokeSession signs the user out of one of their devices. Its access
+// tokens are rejected from now on and its refresh tokens are revoked.
+func (h *Handler) handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	userID := auth.GetUserIDFromContext(r.Context())
+	sessionID := mux.Vars(r)["sessionID"]
+
+	revoked, err := h.revokeSession(userID, sessionID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if !revoked {
+		utils.WriteError(w, http.StatusNotFound, fmt.Errorf("session not found"))
+		return
+	}
+
+	log.Printf("user %d revoked session %s", userID, sessionID)
+	utils.WriteJSON(w, http.StatusOK, map[string]string{"message": "session revoked"})
+}
+
+// startSession registers a new session for the device making the request and
+// issues its first tokens.
+func (h *Handler) startSession(r *http.Request, userID int, methods ...string) (*types.TokenResponse, error) {
+	sessionID, err := auth.NewTokenFamilyID()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := h.createSession(r, userID, sessionID, methods...); err != nil {
+		return nil, err
+	}
+
+	h.forgetLoginFailures(userID)
+
+	return h.issueTokens(userID, sessionID, methods...)
+}
+
+// createSession records the session along with the methods the user logged
+// in with, so refreshing its tokens does not change what they claim.
+func (h *Handler) createSession(r *http.Request, userID int, sessionID string, methods ...string) error {
+	return h.sessionStore.CreateSession(types.Session{
+		ID:        sessionID,
+		UserID:    userID,
+		UserAgent: truncateUserAgent(r.UserAgent()),
+		IP:        clientIP(r),
+		AMR:       methods,
+	})
+}
+
+// legacySessionMethods are the methods claimed for sessions started before
+// they were recorded, which are taken for password logins. Refresh tokens of
+// users with MFA enabled can only be obtained by passing the second factor,
+// older ones are revoked when enabling it.
+func (h *Handler) legacySessionMethods(userID int) ([]string, error) {
+	mfa, err := h.mfaStore.GetMFA(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	methods := []string{auth.AMRPassword}
+	if mfa.Enabled {
+		methods = append(methods, auth.AMROTP)
+	}
+
+	return methods, nil
+}
+
+// firstFactor returns the method the user logged in with to start the session
+// of the request, a password for sessions from before it was recorded.
+func (h *Handler) firstFactor(r *http.Request) (string, error) {
+	token := auth.GetTokenFromContext(r.Context())
+	if token == nil || token.SessionID == "" {
+		return auth.AMRPassword, nil
+	}
+
+	session, err := h.sessionStore.GetSession(token.SessionID)
+	if err != nil {
+		return "", err
+	}
+
+	if len(session.AMR) == 0 {
+		return auth.AMRPassword, nil
+	}
+
+	return session.AMR[0], nil
+}
+
+// truncateUserAgent fits the user agent in the userAgent column. The database
+// rejects invalid UTF-8, so the header is cleaned and never cut in the middle
+// of a character.
+func truncateUserAgent(userAgent string) string {
+	userAgent = strings.ToValidUTF8(userAgent, "")
+
+	characters := 0
+	for i := range userAgent {
+		if characters == maxUserAgentLength {
+			return userAgent[:i]
+		}
+		characters++
+	}
+
+	return userAgent
+}
+
+// revokeSession ends a session of the user along with its refresh tokens. It
+// returns false if the user has no such session or it was already revoked.
+func (h *Handler) revokeSession(userID int, sessionID string) (bool, error) {
+	revoked, err := h.sessionStore.RevokeSession(userID, sessionID)
+	if err != nil || !revoked {
+		return revoked, err
+	}
+
+	return true, h.tokenStore.RevokeTokenFamily(sessionID)
+}
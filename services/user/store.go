@@ -4,10 +4,15 @@ package user
 import (
 	"database/sql"
 	"fmt"
+	"strings"
+	"time"
 
+	"github.com/surfiniaburger/api-go/db"
 	"github.com/surfiniaburger/api-go/types"
 )
 
+const userColumns = "id, firstName, lastName, email, password, role, createdAt, emailVerified, status, deletedAt"
+
 type Store struct {
 	db *sql.DB
 }
@@ -16,23 +21,27 @@ func NewStore(db *sql.DB) *Store {
 	return &Store{db: db}
 }
 
-func (s *Store) CreateUser(user types.User) error {
-
-	// Ensure the role is either 'user' or 'admin'
-	if user.Role != "user" && user.Role != "admin" {
-		return fmt.Errorf("invalid role: %s", user.Role)
+// CreateUser inserts the user. The role must be one of the roles table, which
+// the users_role_fk foreign key enforces.
+func (s *Store) CreateUser(user types.User) (int, error) {
+	res, err := s.db.Exec("INSERT INTO users (firstName, lastName, email, password, role, emailVerified) VALUES (?, ?, ?, ?, ?, ?)", user.FirstName, user.LastName, user.Email, user.Password, user.Role, user.EmailVerified)
+	if db.IsDuplicateEntry(err) {
+		return 0, types.ErrEmailTaken
+	}
+	if err != nil {
+		return 0, err
 	}
 
-	_, err := s.db.Exec("INSERT INTO users (firstName, lastName, email, password, role) VALUES (?, ?, ?, ?, ?)", user.FirstName, user.LastName, user.Email, user.Password, user.Role)
+	id, err := res.LastInsertId()
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	return nil
+	return int(id), nil
 }
 
 func (s *Store) GetUserByEmail(email string) (*types.User, error) {
-	rows, err := s.db.Query("SELECT * FROM users WHERE email = ?", email)
+	rows, err := s.db.Query("SELECT "+userColumns+" FROM users WHERE email = ?", email)
 	if err != nil {
 		return nil, err
 	}
@@ -51,7 +60,7 @@ func (s *Store) GetUserByEmail(email string) (*types.User, error) {
 }
 
 func (s *Store) GetUserByID(id int) (*types.User, error) {
-	rows, err := s.db.Query("SELECT id, firstName, lastName, email, password, role, createdAt FROM users WHERE id = ?", id)
+	rows, err := s.db.Query("SELECT "+userColumns+" FROM users WHERE id = ?", id)
 	if err != nil {
 		return nil, err
 	}
@@ -71,9 +80,328 @@ func (s *Store) GetUserByID(id int) (*types.User, error) {
 	return u, nil
 }
 
+func (s *Store) UpdatePassword(userID int, password string) error {
+	_, err := s.db.Exec("UPDATE users SET password = ? WHERE id = ?", password, userID)
+	return err
+}
+
+func (s *Store) UpdateUser(user types.User) error {
+	_, err := s.db.Exec("UPDATE users SET firstName = ?, lastName = ? WHERE id = ?", user.FirstName, user.LastName, user.ID)
+	return err
+}
+
+func (s *Store) UpdateRole(userID int, role string, actorID int) error {
+	actor := sql.NullInt64{Int64: int64(actorID), Valid: actorID != 0}
+
+	return db.WithTx(s.db, func(tx *sql.Tx) error {
+		var oldRole string
+		err := tx.QueryRow("SELECT role FROM users WHERE id = ? FOR UPDATE", userID).Scan(&oldRole)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("user not found")
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec("UPDATE users SET role = ? WHERE id = ?", role, userID); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("INSERT INTO role_changes (userId, actorId, oldRole, newRole) VALUES (?, ?, ?, ?)", userID, actor, oldRole, role)
+		return err
+	})
+}
+
+func (s *Store) GetUsers(filter types.UserFilter) (*types.UserPage, error) {
+	var conditions []string
+	var args []any
+	if filter.Role != "" {
+		conditions = append(conditions, "role = ?")
+		args = append(args, filter.Role)
+	}
+	if filter.Status != "" {
+		conditions = append(conditions, "status = ?")
+		args = append(args, filter.Status)
+	}
+	if filter.Email != "" {
+		conditions = append(conditions, "email LIKE ?")
+		args = append(args, "%"+db.EscapeLike(filter.Email)+"%")
+	}
+	if filter.CreatedAfter != nil {
+		conditions = append(conditions, "createdAt >= ?")
+		args = append(args, *filter.CreatedAfter)
+	}
+	if filter.CreatedBefore != nil {
+		conditions = append(conditions, "createdAt < ?")
+		args = append(args, *filter.CreatedBefore)
+	}
+	if !filter.IncludeDeleted {
+		conditions = append(conditions, "deletedAt IS NULL")
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	page := &types.UserPage{Users: []types.User{}, Limit: filter.Limit, Offset: filter.Offset}
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM users"+where, args...).Scan(&page.Total); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query("SELECT "+userColumns+" FROM users"+where+" ORDER BY id LIMIT ? OFFSET ?", append(args, filter.Limit, filter.Offset)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		u, err := scanRowsIntoUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		page.Users = append(page.Users, *u)
+	}
+
+	return page, rows.Err()
+}
+
+func (s *Store) SetUserStatus(userID int, status string) error {
+	_, err := s.db.Exec("UPDATE users SET status = ? WHERE id = ?", status, userID)
+	return err
+}
+
+func (s *Store) DeleteUser(userID int) (bool, error) {
+	res, err := s.db.Exec("UPDATE users SET deletedAt = NOW() WHERE id = ? AND deletedAt IS NULL", userID)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected == 1, nil
+}
+
+func (s *Store) GetRoles() ([]types.Role, error) {
+	rows, err := s.db.Query(`
+		SELECT r.name, COALESCE(r.parent, ''), rp.permission
+		FROM roles r LEFT JOIN role_permissions rp ON rp.role = r.name
+		ORDER BY r.name, rp.permission`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []types.Role{}
+	for rows.Next() {
+		var name, parent string
+		var permission sql.NullString
+		if err := rows.Scan(&name, &parent, &permission); err != nil {
+			return nil, err
+		}
+
+		if len(roles) == 0 || roles[len(roles)-1].Name != name {
+			roles = append(roles, types.Role{Name: name, Parent: parent, Permissions: []string{}})
+		}
+
+		if permission.Valid {
+			last := &roles[len(roles)-1]
+			last.Permissions = append(last.Permissions, permission.String)
+		}
+	}
+
+	return roles, rows.Err()
+}
+
+// CountUsersByRole returns the number of users with the role.
+func (s *Store) CountUsersByRole(role string) (int, error) {
+	var count int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM users WHERE role = ?", role).Scan(&count)
+	return count, err
+}
+
+func (s *Store) GetIdentity(provider, subject string) (*types.UserIdentity, error) {
+	row := s.db.QueryRow("SELECT id, userId, provider, subject, email, createdAt FROM user_identities WHERE provider = ? AND subject = ?", provider, subject)
+
+	i := new(types.UserIdentity)
+	err := row.Scan(&i.ID, &i.UserID, &i.Provider, &i.Subject, &i.Email, &i.CreatedAt)
+	if err == sql.ErrNoRows {
+		return &types.UserIdentity{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return i, nil
+}
+
+func (s *Store) CreateIdentity(identity types.UserIdentity) error {
+	_, err := s.db.Exec("INSERT INTO user_identities (userId, provider, subject, email) VALUES (?, ?, ?, ?)", identity.UserID, identity.Provider, identity.Subject, identity.Email)
+	return err
+}
+
+func (s *Store) CreateUserWithIdentity(user types.User, identity types.UserIdentity) (int, error) {
+	var userID int
+	err := db.WithTx(s.db, func(tx *sql.Tx) error {
+		res, err := tx.Exec("INSERT INTO users (firstName, lastName, email, password, role, emailVerified) VALUES (?, ?, ?, ?, ?, ?)", user.FirstName, user.LastName, user.Email, user.Password, user.Role, user.EmailVerified)
+		if err != nil {
+			return err
+		}
+
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		userID = int(id)
+
+		_, err = tx.Exec("INSERT INTO user_identities (userId, provider, subject, email) VALUES (?, ?, ?, ?)", userID, identity.Provider, identity.Subject, identity.Email)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return userID, nil
+}
+
+func (s *Store) GetMFA(userID int) (*types.UserMFA, error) {
+	row := s.db.QueryRow("SELECT userId, secret, enabled, lastUsedStep, confirmedAt FROM user_mfa WHERE userId = ?", userID)
+
+	m := new(types.UserMFA)
+	var confirmedAt sql.NullTime
+	err := row.Scan(&m.UserID, &m.Secret, &m.Enabled, &m.LastUsedStep, &confirmedAt)
+	if err == sql.ErrNoRows {
+		return &types.UserMFA{UserID: userID}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if confirmedAt.Valid {
+		m.ConfirmedAt = &confirmedAt.Time
+	}
+
+	return m, nil
+}
+
+func (s *Store) SaveMFASecret(userID int, secret string) error {
+	// an enabled enrollment is never overwritten, the handler refuses to
+	// enroll again before we get here
+	_, err := s.db.Exec(`
+		INSERT INTO user_mfa (userId, secret) VALUES (?, ?)
+		ON DUPLICATE KEY UPDATE secret = IF(enabled, secret, VALUES(secret))`,
+		userID, secret,
+	)
+	return err
+}
+
+func (s *Store) EnableMFA(userID int, recoveryCodeHashes []string) error {
+	return db.WithTx(s.db, func(tx *sql.Tx) error {
+		res, err := tx.Exec("UPDATE user_mfa SET enabled = TRUE, confirmedAt = NOW() WHERE userId = ? AND enabled = FALSE", userID)
+		if err != nil {
+			return err
+		}
+
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if affected != 1 {
+			return fmt.Errorf("no pending MFA enrollment")
+		}
+
+		if _, err := tx.Exec("DELETE FROM mfa_recovery_codes WHERE userId = ?", userID); err != nil {
+			return err
+		}
+
+		for _, hash := range recoveryCodeHashes {
+			if _, err := tx.Exec("INSERT INTO mfa_recovery_codes (userId, codeHash) VALUES (?, ?)", userID, hash); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (s *Store) UseTOTPStep(userID int, step int64) (bool, error) {
+	res, err := s.db.Exec("UPDATE user_mfa SET lastUsedStep = ? WHERE userId = ? AND lastUsedStep < ?", step, userID, step)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected == 1, nil
+}
+
+func (s *Store) UseRecoveryCode(userID int, hash string) (bool, error) {
+	res, err := s.db.Exec("UPDATE mfa_recovery_codes SET usedAt = NOW() WHERE userId = ? AND codeHash = ? AND usedAt IS NULL", userID, hash)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected == 1, nil
+}
+
+func (s *Store) GetLoginAttempts(key string) (*types.LoginAttempts, error) {
+	row := s.db.QueryRow("SELECT attemptKey, failures, lastFailureAt FROM login_attempts WHERE attemptKey = ?", key)
+
+	a := new(types.LoginAttempts)
+	err := row.Scan(&a.Key, &a.Failures, &a.LastFailureAt)
+	if err == sql.ErrNoRows {
+		return &types.LoginAttempts{Key: key}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func (s *Store) RecordLoginFailure(key string, at time.Time, resetBefore time.Time) (*types.LoginAttempts, error) {
+	// assignments are evaluated in order, so failures still sees the previous
+	// lastFailureAt
+	_, err := s.db.Exec(`
+		INSERT INTO login_attempts (attemptKey, failures, lastFailureAt) VALUES (?, 1, ?)
+		ON DUPLICATE KEY UPDATE
+			failures = IF(lastFailureAt < ?, 1, failures + 1),
+			lastFailureAt = VALUES(lastFailureAt)`,
+		key, at, resetBefore,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetLoginAttempts(key)
+}
+
+func (s *Store) ResetLoginAttempts(key string) error {
+	_, err := s.db.Exec("DELETE FROM login_attempts WHERE attemptKey = ?", key)
+	return err
+}
+
+func (s *Store) PruneLoginAttempts(before time.Time) error {
+	_, err := s.db.Exec("DELETE FROM login_attempts WHERE lastFailureAt < ?", before)
+	return err
+}
+
 func scanRowsIntoUser(rows *sql.Rows) (*types.User, error) {
 	user := new(types.User)
 
+	var deletedAt sql.NullTime
 	err := rows.Scan(
 		&user.ID,
 		&user.FirstName,
@@ -82,10 +410,17 @@ func scanRowsIntoUser(rows *sql.Rows) (*types.User, error) {
 		&user.Password,
 		&user.Role,
 		&user.CreatedAt,
+		&user.EmailVerified,
+		&user.Status,
+		&deletedAt,
 	)
 	if err != nil {
 		return nil, err
 	}
 
+	if deletedAt.Valid {
+		user.DeletedAt = &deletedAt.Time
+	}
+
 	return user, nil
 }
@@ -1,9 +1,36 @@
 package types
 
 import (
+	"errors"
 	"time"
 )
 
+// ErrInsufficientStock is returned when a product does not have enough stock
+// left to satisfy a stock decrement.
+var ErrInsufficientStock = errors.New("insufficient stock")
+
+// ErrInvalidCursor is returned when a pagination cursor was not issued by the
+// API or was issued for another sort order.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ErrSKUTaken is returned when a SKU is already used by another variant.
+var ErrSKUTaken = errors.New("SKU already in use")
+
+// ErrSlugTaken is returned when a slug is already used by another category.
+var ErrSlugTaken = errors.New("slug already in use")
+
+// ErrCategoryNotFound is returned when the parent of a category does not
+// exist.
+var ErrCategoryNotFound = errors.New("category not found")
+
+// ErrCategoryCycle is returned when a category would be moved under itself or
+// one of its descendants.
+var ErrCategoryCycle = errors.New("a category cannot be moved under itself or its descendants")
+
+// ErrEmailTaken is returned when an email address is already used by another
+// user.
+var ErrEmailTaken = errors.New("email address already in use")
+
 type User struct {
 	ID        int       `json:"id"`
 	FirstName string    `json:"firstName"`
@@ -12,6 +39,71 @@ type User struct {
 	Password  string    `json:"-"`
 	Role      string    `json:"role"` // Add this field
 	CreatedAt time.Time `json:"createdAt"`
+
+	EmailVerified bool `json:"emailVerified"`
+	// Status is UserStatusActive or UserStatusSuspended. Suspended and
+	// deleted users cannot log in.
+	Status    string     `json:"status"`
+	DeletedAt *time.Time `json:"deletedAt"`
+}
+
+const (
+	UserStatusActive    = "active"
+	UserStatusSuspended = "suspended"
+)
+
+// UserFilter selects the users listed to admins. Zero fields match every
+// user, Email matches part of the address.
+type UserFilter struct {
+	Role           string
+	Status         string
+	Email          string
+	CreatedAfter   *time.Time
+	CreatedBefore  *time.Time
+	IncludeDeleted bool
+	Limit          int
+	Offset         int
+}
+
+// UserPage is a page of users, Total is the number of users matching the
+// filter across all pages.
+type UserPage struct {
+	Users  []User `json:"users"`
+	Total  int    `json:"total"`
+	Limit  int    `json:"limit"`
+	Offset int    `json:"offset"`
+}
+
+const (
+	ProductSortNewest    = "newest"
+	ProductSortPriceAsc  = "price_asc"
+	ProductSortPriceDesc = "price_desc"
+	ProductSortName      = "name"
+)
+
+// ProductFilter selects a page of the products. Zero fields match every
+// product, Search matches part of the name. Category is the slug of a
+// category, its descendants are included if IncludeDescendants is set. Cursor
+// is the NextCursor of the previous page, empty for the first one.
+type ProductFilter struct {
+	MinPrice           *float64
+	MaxPrice           *float64
+	InStock            bool
+	Search             string
+	Category           string
+	IncludeDescendants bool
+	Sort               string
+	Cursor             string
+	Limit              int
+}
+
+// ProductPage is a page of products. NextCursor is empty on the last page and
+// TotalEstimate is the approximate number of products matching the filter
+// across all pages.
+type ProductPage struct {
+	Products      []Product `json:"products"`
+	NextCursor    string    `json:"next_cursor"`
+	TotalEstimate int       `json:"total_estimate"`
 }
 
 type Product struct {
@@ -20,14 +112,105 @@ type Product struct {
 	Description string  `json:"description"`
 	Image       string  `json:"image"`
 	Price       float64 `json:"price"`
-	// note that this isn't the best way to handle quantity
-	// because it's not atomic (in ACID), but it's good enough for this example
+	// Quantity is the stock of all the variants of the product, Reserved the
+	// part of it held by reservations and Available the rest
+	Quantity  int `json:"quantity"`
+	Reserved  int `json:"reserved"`
+	Available int `json:"available"`
+	// Version is incremented by every change, it is the ETag of the product
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+	// Variants is only set when a single product is read
+	Variants []ProductVariant `json:"variants,omitempty"`
+}
+
+// ProductVariant is a sellable version of a product, e.g. a shirt in a size
+// and a color. Every variant of a product has a value for the same option
+// axes, a product without axes has a single variant with no options.
+type ProductVariant struct {
+	ID        int               `json:"id"`
+	ProductID int               `json:"productID"`
+	SKU       string            `json:"sku"`
+	Options   map[string]string `json:"options"`
+	// Price overrides the price of the product if set
+	Price *float64 `json:"price"`
+	// Quantity is a snapshot, stock changes must go through
+	// ProductTxStore.DecrementStock to stay consistent under concurrency
 	Quantity  int       `json:"quantity"`
+	Reserved  int       `json:"reserved"`
+	Available int       `json:"available"`
 	CreatedAt time.Time `json:"createdAt"`
 }
 
+// Reservation holds stock of a variant for the cart of a user until it
+// expires, so it cannot be sold to someone else in the meantime. Every login
+// session of the user has its own cart.
+type Reservation struct {
+	UserID    int       `json:"-"`
+	SessionID string    `json:"-"`
+	ProductID int       `json:"productID"`
+	VariantID int       `json:"variantID"`
+	Quantity  int       `json:"quantity"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ReservationStore compares the expiry of the reservations with the clock of
+// the database, like the stock checks of the checkout do.
+type ReservationStore interface {
+	// ReserveItems replaces the reservations of the session of the user with
+	// the items, all of them expiring after ttl. sessionID is empty for tokens
+	// without a session. It returns ErrInsufficientStock if a variant does not
+	// have enough stock left that is not reserved by another cart.
+	ReserveItems(userID int, sessionID string, items []CartCheckoutItem, ttl time.Duration) ([]Reservation, error)
+	// GetReservations returns the reservations of the session of the user
+	// that did not expire.
+	GetReservations(userID int, sessionID string) ([]Reservation, error)
+	ReleaseReservations(userID int, sessionID string) error
+	// PruneReservations deletes the expired reservations.
+	PruneReservations() error
+}
+
+// Category is a node of the product taxonomy. Path lists the IDs from the
+// root down to the category, e.g. "/1/4/9/", so the descendants of a category
+// are the categories whose path starts with its own.
+type Category struct {
+	ID        int         `json:"id"`
+	ParentID  *int        `json:"parentID"`
+	Name      string      `json:"name"`
+	Slug      string      `json:"slug"`
+	Path      string      `json:"path"`
+	CreatedAt time.Time   `json:"createdAt"`
+	Children  []*Category `json:"children,omitempty"`
+}
+
+type CategoryStore interface {
+	GetCategories() ([]Category, error)
+	// GetCategoryByID returns a zero category if there is none with the ID.
+	GetCategoryByID(id int) (*Category, error)
+	// CreateCategory returns ErrSlugTaken if the slug is used and
+	// ErrCategoryNotFound if the parent does not exist.
+	CreateCategory(Category) (int, error)
+	// UpdateCategory saves the name and the slug of the category. It returns
+	// ErrSlugTaken if the slug is used by another category.
+	UpdateCategory(Category) error
+	// MoveCategory moves the category and its subtree under the parent, or to
+	// the root if parentID is nil. It returns ErrCategoryNotFound if the
+	// parent does not exist and ErrCategoryCycle if it is the category or one
+	// of its descendants.
+	MoveCategory(id int, parentID *int) error
+	// DeleteCategory deletes the category and removes it from its products.
+	// It returns false if the category has children.
+	DeleteCategory(id int) (bool, error)
+	GetProductCategories(productID int) ([]Category, error)
+	// SetProductCategories replaces the categories of the product. It returns
+	// false if the product or one of the categories does not exist.
+	SetProductCategories(productID int, categoryIDs []int) (bool, error)
+}
+
 type CartCheckoutItem struct {
 	ProductID int `json:"productID"`
+	VariantID int `json:"variantID"`
 	Quantity  int `json:"quantity"`
 }
 
@@ -40,27 +223,389 @@ type Order struct {
 	CreatedAt time.Time `json:"createdAt"`
 }
 
+// OrderDetails is an order along with its items.
+type OrderDetails struct {
+	Order
+	Items []OrderItem `json:"items"`
+}
+
 type OrderItem struct {
 	ID        int       `json:"id"`
 	OrderID   int       `json:"orderID"`
 	ProductID int       `json:"productID"`
+	VariantID int       `json:"variantID"`
 	Quantity  int       `json:"quantity"`
 	Price     float64   `json:"price"`
 	CreatedAt time.Time `json:"createdAt"`
 }
 
+// RefreshToken is an opaque, server-side refresh token. Only the hash of the
+// token is stored. Tokens obtained by rotating each other share a FamilyID.
+type RefreshToken struct {
+	ID        int        `json:"id"`
+	UserID    int        `json:"userID"`
+	FamilyID  string     `json:"familyID"`
+	TokenHash string     `json:"-"`
+	ExpiresAt time.Time  `json:"expiresAt"`
+	RevokedAt *time.Time `json:"revokedAt"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+// Session is a device a user logged in from. A session lasts as long as the
+// refresh token family started at login and shares its ID.
+type Session struct {
+	ID         string     `json:"id"`
+	UserID     int        `json:"userID"`
+	UserAgent  string     `json:"userAgent"`
+	IP         string     `json:"ip"`
+	LastSeenAt time.Time  `json:"lastSeenAt"`
+	RevokedAt  *time.Time `json:"revokedAt"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	// Current is set on the session of the request listing the sessions
+	Current bool `json:"current"`
+	// AMR are the methods the user logged in with, claimed again by the
+	// tokens issued when refreshing. Empty for sessions from before they
+	// were recorded.
+	AMR []string `json:"-"`
+}
+
+// UserIdentity links a user to their account at an OpenID Connect provider,
+// identified by the sub claim of the provider.
+type UserIdentity struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"userID"`
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"subject"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// OIDCLoginState is kept from sending a user to a provider until they come
+// back. Only the hash of the state parameter is stored.
+type OIDCLoginState struct {
+	StateHash    string    `json:"-"`
+	Provider     string    `json:"provider"`
+	CodeVerifier string    `json:"-"`
+	Nonce        string    `json:"-"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// PasswordResetToken is a single-use token sent to a user who forgot their
+// password. Only the hash of the token is stored.
+type PasswordResetToken struct {
+	ID        int        `json:"id"`
+	UserID    int        `json:"userID"`
+	TokenHash string     `json:"-"`
+	ExpiresAt time.Time  `json:"expiresAt"`
+	UsedAt    *time.Time `json:"usedAt"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+// EmailVerificationToken is sent to a new user to confirm they own their email
+// address. Only the hash of the token is stored.
+type EmailVerificationToken struct {
+	ID        int        `json:"id"`
+	UserID    int        `json:"userID"`
+	TokenHash string     `json:"-"`
+	ExpiresAt time.Time  `json:"expiresAt"`
+	UsedAt    *time.Time `json:"usedAt"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+// EmailChangeToken is sent to the new address of a user changing their email
+// address. Only the hash of the token is stored.
+type EmailChangeToken struct {
+	ID        int        `json:"id"`
+	UserID    int        `json:"userID"`
+	NewEmail  string     `json:"newEmail"`
+	TokenHash string     `json:"-"`
+	ExpiresAt time.Time  `json:"expiresAt"`
+	UsedAt    *time.Time `json:"usedAt"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+// UserMFA is the TOTP enrollment of a user. Secret is set as soon as the user
+// starts enrolling, Enabled only once they confirmed a first code.
+type UserMFA struct {
+	UserID       int        `json:"userID"`
+	Secret       string     `json:"-"`
+	Enabled      bool       `json:"enabled"`
+	LastUsedStep int64      `json:"-"`
+	ConfirmedAt  *time.Time `json:"confirmedAt"`
+}
+
+const (
+	NotificationPasswordReset     = "password_reset"
+	NotificationEmailVerification = "email_verification"
+	NotificationEmailChange       = "email_change"
+	NotificationEmailChanged      = "email_changed"
+	// users can turn the notifications below off in their preferences
+	NotificationOrderUpdate  = "order_update"
+	NotificationReviewReply  = "review_reply"
+	NotificationLoanReminder = "loan_reminder"
+)
+
+// Notification is a message for a user, e.g. an email. Kind identifies what
+// the notification is about.
+type Notification struct {
+	Kind    string `json:"kind"`
+	UserID  int    `json:"userID"`
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+type Notifier interface {
+	Notify(Notification) error
+}
+
+// NotificationSettings are the optional notifications a user receives.
+// Account notifications such as password resets are always sent.
+type NotificationSettings struct {
+	OrderUpdates  bool `json:"orderUpdates"`
+	ReviewReplies bool `json:"reviewReplies"`
+	LoanReminders bool `json:"loanReminders"`
+}
+
+type Preferences struct {
+	UserID        int                  `json:"-"`
+	Locale        string               `json:"locale"`
+	Currency      string               `json:"currency"`
+	Notifications NotificationSettings `json:"notifications"`
+}
+
+type PreferencesStore interface {
+	// GetPreferences returns the defaults if the user never saved theirs.
+	GetPreferences(userID int) (*Preferences, error)
+	UpdatePreferences(Preferences) error
+}
+
+// UserGetter looks users up by ID, which is all the authentication
+// middleware and the handlers behind it need of a UserStore.
+type UserGetter interface {
+	GetUserByID(id int) (*User, error)
+}
+
 type UserStore interface {
+	UserGetter
 	GetUserByEmail(email string) (*User, error)
-	GetUserByID(id int) (*User, error)
-	CreateUser(User) error
+	CreateUser(User) (int, error)
+	// UpdateUser saves the first and last name of the user.
+	UpdateUser(User) error
+	UpdatePassword(userID int, password string) error
+	// UpdateRole changes the role of the user and records the change in the
+	// audit trail. actorID is the admin making the change, 0 for the CLI.
+	UpdateRole(userID int, role string, actorID int) error
+	GetUsers(UserFilter) (*UserPage, error)
+	SetUserStatus(userID int, status string) error
+	// DeleteUser marks the user as deleted, keeping their data. It returns
+	// false if the user was already deleted.
+	DeleteUser(userID int) (bool, error)
+}
+
+// Role is a named set of permissions. A role with a parent also has every
+// permission of the parent.
+type Role struct {
+	Name        string   `json:"name"`
+	Parent      string   `json:"parent,omitempty"`
+	Permissions []string `json:"permissions"`
+}
+
+type RoleStore interface {
+	GetRoles() ([]Role, error)
+}
+
+type RefreshTokenStore interface {
+	CreateRefreshToken(RefreshToken) error
+	GetRefreshTokenByHash(hash string) (*RefreshToken, error)
+	// RevokeRefreshToken revokes a single token. It returns false if the token
+	// was already revoked, which means it is being reused.
+	RevokeRefreshToken(id int) (bool, error)
+	RevokeTokenFamily(familyID string) error
+	RevokeUserRefreshTokens(userID int) error
+}
+
+type SessionStore interface {
+	CreateSession(Session) error
+	// GetSession returns a zero Session if there is no session with the ID.
+	GetSession(id string) (*Session, error)
+	// GetUserSessions returns the sessions of the user that are not revoked
+	// and were used since activeSince, most recently used first.
+	GetUserSessions(userID int, activeSince time.Time) ([]Session, error)
+	TouchSession(id string, seenAt time.Time) error
+	// RevokeSession revokes a session of the user. It returns false if the
+	// user has no such session or it was already revoked.
+	RevokeSession(userID int, id string) (bool, error)
+	RevokeUserSessions(userID int) error
+}
+
+type IdentityStore interface {
+	// GetIdentity returns a zero UserIdentity if the account is not linked.
+	GetIdentity(provider, subject string) (*UserIdentity, error)
+	// CreateIdentity links the account to an existing user.
+	CreateIdentity(UserIdentity) error
+	// CreateUserWithIdentity creates a user and links the account to them in
+	// one transaction.
+	CreateUserWithIdentity(User, UserIdentity) (int, error)
+}
+
+type OIDCStateStore interface {
+	CreateOIDCState(OIDCLoginState) error
+	// UseOIDCState deletes and returns the state. It returns a zero
+	// OIDCLoginState if the state does not exist or was already used.
+	UseOIDCState(hash string) (*OIDCLoginState, error)
+}
+
+type PasswordResetStore interface {
+	CreatePasswordResetToken(PasswordResetToken) error
+	GetPasswordResetTokenByHash(hash string) (*PasswordResetToken, error)
+	// UsePasswordResetToken marks the token as used and sets the hashed
+	// password of its user in one transaction. It returns false, changing
+	// nothing, if the token was already used.
+	UsePasswordResetToken(id int, password string) (bool, error)
+}
+
+type EmailVerificationStore interface {
+	CreateEmailVerificationToken(EmailVerificationToken) error
+	GetEmailVerificationTokenByHash(hash string) (*EmailVerificationToken, error)
+	// GetLatestEmailVerificationToken returns the most recently created token
+	// of the user, used to throttle resends.
+	GetLatestEmailVerificationToken(userID int) (*EmailVerificationToken, error)
+	// UseEmailVerificationToken marks the token as used and the email address
+	// of its user as verified in one transaction. It returns false, changing
+	// nothing, if the token was already used.
+	UseEmailVerificationToken(id int) (bool, error)
+}
+
+type EmailChangeStore interface {
+	CreateEmailChangeToken(EmailChangeToken) error
+	GetEmailChangeTokenByHash(hash string) (*EmailChangeToken, error)
+	// UseEmailChangeToken marks the token as used and changes the email
+	// address of its user in one transaction. It returns false, changing
+	// nothing, if the token was already used, and ErrEmailTaken, keeping the
+	// token, if another user has the address.
+	UseEmailChangeToken(id int) (bool, error)
+	// RevokeUserEmailChangeTokens marks every pending email change token of
+	// the user as used.
+	RevokeUserEmailChangeTokens(userID int) error
+}
+
+type MFAStore interface {
+	// GetMFA returns the enrollment of the user, a zero UserMFA if they never
+	// enrolled. An error means the enrollment could not be looked up.
+	GetMFA(userID int) (*UserMFA, error)
+	// SaveMFASecret starts a new, not yet enabled, enrollment.
+	SaveMFASecret(userID int, secret string) error
+	// EnableMFA enables the pending enrollment and replaces the recovery codes.
+	EnableMFA(userID int, recoveryCodeHashes []string) error
+	// UseTOTPStep records a TOTP code as used. It returns false if a code of
+	// the same or a later time step was already used.
+	UseTOTPStep(userID int, step int64) (bool, error)
+	// UseRecoveryCode marks the recovery code as used. It returns false if the
+	// code does not exist or was already used.
+	UseRecoveryCode(userID int, hash string) (bool, error)
+}
+
+// APIKey lets scripts authenticate as a user. Only the hash of the key is
+// stored, Prefix is the start of the key shown to tell keys apart.
+type APIKey struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"userID"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	KeyHash    string     `json:"-"`
+	Scopes     []string   `json:"scopes"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	RevokedAt  *time.Time `json:"revokedAt"`
+	CreatedAt  time.Time  `json:"createdAt"`
+}
+
+type APIKeyStore interface {
+	CreateAPIKey(APIKey) (int, error)
+	GetAPIKeyByHash(hash string) (*APIKey, error)
+	GetUserAPIKeys(userID int) ([]APIKey, error)
+	// RevokeAPIKey revokes a key of the user. It returns false if the user
+	// has no such key or it was already revoked.
+	RevokeAPIKey(userID, id int) (bool, error)
+	TouchAPIKey(id int, usedAt time.Time) error
+}
+
+// Impersonation records an admin obtaining a token to act as a user.
+type Impersonation struct {
+	ID        int       `json:"id"`
+	ActorID   int       `json:"actorID"`
+	UserID    int       `json:"userID"`
+	Reason    string    `json:"reason"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type ImpersonationStore interface {
+	CreateImpersonation(Impersonation) (int, error)
+	// GetImpersonations returns the impersonations of the user, the most
+	// recent first.
+	GetImpersonations(userID int) ([]Impersonation, error)
+}
+
+// LoginAttempts counts the recent failed logins of an account or an IP.
+type LoginAttempts struct {
+	Key           string    `json:"key"`
+	Failures      int       `json:"failures"`
+	LastFailureAt time.Time `json:"lastFailureAt"`
+}
+
+type LoginAttemptStore interface {
+	// GetLoginAttempts returns a zero LoginAttempts if there were no failures.
+	GetLoginAttempts(key string) (*LoginAttempts, error)
+	// RecordLoginFailure adds a failure at the given time. The count starts
+	// over if the previous failure happened before resetBefore.
+	RecordLoginFailure(key string, at time.Time, resetBefore time.Time) (*LoginAttempts, error)
+	ResetLoginAttempts(key string) error
+	PruneLoginAttempts(before time.Time) error
+}
+
+// TokenRevocationStore is a denylist of access tokens that must be rejected
+// before they expire. Entries can be dropped once the tokens they cover expire.
+type TokenRevocationStore interface {
+	RevokeToken(jti string, userID int, expiresAt time.Time) error
+	// RevokeUserTokens revokes every token of the user issued before
+	// issuedBefore.
+	RevokeUserTokens(userID int, issuedBefore time.Time, expiresAt time.Time) error
+	IsTokenRevoked(jti string, userID int, issuedAt time.Time) (bool, error)
+	PruneExpired(now time.Time) error
 }
 
 type ProductStore interface {
 	GetProductByID(id int) (*Product, error)
 	GetProductsByID(ids []int) ([]Product, error)
-	GetProducts() ([]*Product, error)
+	// GetProducts returns a page of the products matching the filter. It
+	// returns ErrInvalidCursor if the cursor of the filter is not valid.
+	GetProducts(ProductFilter) (*ProductPage, error)
 	CreateProduct(CreateProductPayload) error
-	UpdateProduct(Product) error
+	// UpdateProduct saves the product if its version is still product.Version
+	// and increments the version. It returns false if the product changed or
+	// was deleted in the meantime.
+	UpdateProduct(Product) (bool, error)
+	// DeleteProduct hides the product if its version is still version. The
+	// row is kept for the orders referencing it.
+	DeleteProduct(id, version int) (bool, error)
+}
+
+type VariantStore interface {
+	// GetVariants returns the variants of the product, oldest first.
+	GetVariants(productID int) ([]ProductVariant, error)
+	// GetVariantsByID leaves out the variants of deleted products.
+	GetVariantsByID(ids []int) ([]ProductVariant, error)
+	// GetVariant returns a zero variant if the product has no such variant.
+	GetVariant(productID, id int) (*ProductVariant, error)
+	// CreateVariant and UpdateVariant return ErrSKUTaken if the SKU is used
+	// by another variant.
+	CreateVariant(ProductVariant) (int, error)
+	UpdateVariant(ProductVariant) error
+	// DeleteVariant hides the variant, the row is kept for the orders
+	// referencing it.
+	DeleteVariant(productID, id int) error
 }
 
 type BookStore interface {
@@ -81,24 +626,170 @@ type BookStore interface {
 	AddToFavorites(userID, bookID string) error
 }
 
+// Address is an entry of a user's address book. Orders keep a copy of the
+// address they were placed with, so it can be edited or deleted afterwards.
+type Address struct {
+	ID                int       `json:"id"`
+	UserID            int       `json:"userID"`
+	Line1             string    `json:"line1"`
+	Line2             string    `json:"line2"`
+	City              string    `json:"city"`
+	Region            string    `json:"region"`
+	PostalCode        string    `json:"postalCode"`
+	Country           string    `json:"country"`
+	IsDefaultShipping bool      `json:"isDefaultShipping"`
+	IsDefaultBilling  bool      `json:"isDefaultBilling"`
+	CreatedAt         time.Time `json:"createdAt"`
+}
+
+type AddressStore interface {
+	// CreateAddress and UpdateAddress clear the default flags set on the
+	// address from the other addresses of the user.
+	CreateAddress(Address) (int, error)
+	// GetAddress returns an address of the user, or a zero Address if the
+	// user has no such address.
+	GetAddress(userID, id int) (*Address, error)
+	GetUserAddresses(userID int) ([]Address, error)
+	UpdateAddress(Address) error
+	// DeleteAddress returns false if the user has no such address. If it
+	// was a default address, the oldest remaining address of the user takes
+	// over the flag.
+	DeleteAddress(userID, id int) (bool, error)
+}
+
 type OrderStore interface {
 	CreateOrder(Order) (int, error)
 	CreateOrderItem(OrderItem) error
+	GetOrderByID(id int) (*Order, error)
+	GetOrderItems(orderID int) ([]OrderItem, error)
 }
+
+// ProductTxStore holds the product operations that must run inside a checkout
+// transaction.
+type ProductTxStore interface {
+	// DecrementStock fails with ErrInsufficientStock if the stock left is
+	// reserved, the items reserved by the cart must be released first.
+	DecrementStock(variantID int, quantity int) error
+	// ReleaseReservedItems takes the quantities of the items off the
+	// reservations of the session of the user. The rest stays reserved until
+	// it expires.
+	ReleaseReservedItems(userID int, sessionID string, items []CartCheckoutItem) error
+}
+
+// CheckoutStore runs fn inside a single database transaction. The stores passed
+// to fn share that transaction; if fn returns an error everything is rolled back.
+type CheckoutStore interface {
+	RunInTx(fn func(products ProductTxStore, orders OrderStore) error) error
+}
+
+// CreateProductPayload creates a product with a single variant holding the
+// quantity. The SKU of the variant is P followed by the product ID if it is
+// left out.
 type CreateProductPayload struct {
 	Name        string  `json:"name" validate:"required"`
 	Description string  `json:"description"`
 	Image       string  `json:"image"`
 	Price       float64 `json:"price" validate:"required"`
 	Quantity    int     `json:"quantity" validate:"required"`
+	SKU         string  `json:"sku" validate:"omitempty,max=64,printascii"`
+}
+
+// UpdateProductPayload replaces the fields of a product, it is also the
+// document JSON merge patches apply to.
+type UpdateProductPayload struct {
+	Name        string  `json:"name" validate:"required,max=255"`
+	Description string  `json:"description"`
+	Image       string  `json:"image" validate:"max=255"`
+	Price       float64 `json:"price" validate:"required,gt=0"`
+}
+
+// VariantPayload creates or replaces a variant. Options holds the value of
+// each option axis of the product.
+type VariantPayload struct {
+	SKU      string            `json:"sku" validate:"required,max=64,printascii"`
+	Options  map[string]string `json:"options" validate:"max=5,dive,keys,required,max=30,endkeys,required,max=50"`
+	Price    *float64          `json:"price" validate:"omitnil,gt=0"`
+	Quantity *int              `json:"quantity" validate:"required,min=0"`
+}
+
+// CreateCategoryPayload creates a category under the parent, or a root
+// category if ParentID is nil. The slug is made from the name if it is left
+// out.
+type CreateCategoryPayload struct {
+	Name     string `json:"name" validate:"required,max=100"`
+	Slug     string `json:"slug" validate:"max=100"`
+	ParentID *int   `json:"parentID"`
+}
+
+type UpdateCategoryPayload struct {
+	Name string `json:"name" validate:"required,max=100"`
+	Slug string `json:"slug" validate:"max=100"`
+}
+
+type MoveCategoryPayload struct {
+	// ParentID is the new parent, null to make the category a root
+	ParentID *int `json:"parentID"`
+}
+
+type ProductCategoriesPayload struct {
+	CategoryIDs []int `json:"categoryIDs" validate:"required,max=50,dive,gt=0"`
 }
 
 type RegisterUserPayload struct {
 	FirstName string `json:"firstName" validate:"required"`
 	LastName  string `json:"lastName" validate:"required"`
 	Email     string `json:"email" validate:"required,email"`
-	Password  string `json:"password" validate:"required,min=3,max=130"`
-	Role      string `json:"role"`
+	Password  string `json:"password" validate:"required,max=130"`
+}
+
+type UpdateProfilePayload struct {
+	FirstName *string `json:"firstName" validate:"omitnil,min=1,max=255"`
+	LastName  *string `json:"lastName" validate:"omitnil,min=1,max=255"`
+}
+
+type ChangePasswordPayload struct {
+	CurrentPassword string `json:"currentPassword" validate:"required"`
+	NewPassword     string `json:"newPassword" validate:"required,max=130"`
+}
+
+type ChangeEmailPayload struct {
+	Email    string `json:"email" validate:"required,email"`
+	Password string `json:"password" validate:"required"`
+}
+
+// AddressPayload creates or replaces an address. The default flags are left as
+// they are when omitted.
+type AddressPayload struct {
+	Line1             string `json:"line1" validate:"required,max=255"`
+	Line2             string `json:"line2" validate:"max=255"`
+	City              string `json:"city" validate:"required,max=100"`
+	Region            string `json:"region" validate:"max=100"`
+	PostalCode        string `json:"postalCode" validate:"required,max=20"`
+	Country           string `json:"country" validate:"required,iso3166_1_alpha2"`
+	IsDefaultShipping *bool  `json:"isDefaultShipping"`
+	IsDefaultBilling  *bool  `json:"isDefaultBilling"`
+}
+
+type ImpersonatePayload struct {
+	// Reason is kept in the audit trail, e.g. the support ticket
+	Reason string `json:"reason" validate:"required,max=255"`
+}
+
+type ImpersonationResponse struct {
+	Token     string    `json:"token"`
+	UserID    int       `json:"userID"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// PreferencesPayload replaces every preference of the user.
+type PreferencesPayload struct {
+	Locale        string                `json:"locale" validate:"required,bcp47_language_tag"`
+	Currency      string                `json:"currency" validate:"required,iso4217"`
+	Notifications *NotificationSettings `json:"notifications" validate:"required"`
+}
+
+type UpdateRolePayload struct {
+	Role string `json:"role" validate:"required"`
 }
 
 type LoginUserPayload struct {
@@ -106,8 +797,87 @@ type LoginUserPayload struct {
 	Password string `json:"password" validate:"required"`
 }
 
+type ForgotPasswordPayload struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type ResetPasswordPayload struct {
+	Token    string `json:"token" validate:"required"`
+	Password string `json:"password" validate:"required,max=130"`
+}
+
+type RefreshTokenPayload struct {
+	RefreshToken string `json:"refreshToken" validate:"required"`
+}
+
+type LogoutPayload struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+type OIDCCallbackPayload struct {
+	Code  string `json:"code" validate:"required"`
+	State string `json:"state" validate:"required"`
+}
+
+type OIDCAuthorizationResponse struct {
+	AuthorizationURL string `json:"authorizationURL"`
+	State            string `json:"state"`
+}
+
+type MFACodePayload struct {
+	Code string `json:"code" validate:"required"`
+}
+
+// LoginMFAPayload completes a login with either a TOTP code or a recovery code.
+type LoginMFAPayload struct {
+	MFAToken     string `json:"mfaToken" validate:"required"`
+	Code         string `json:"code" validate:"required_without=RecoveryCode"`
+	RecoveryCode string `json:"recoveryCode"`
+}
+
+type MFAChallengeResponse struct {
+	MFARequired bool   `json:"mfaRequired"`
+	MFAToken    string `json:"mfaToken"`
+}
+
+type MFAEnrollResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// MFAConfirmResponse carries the recovery codes, which are only shown once.
+type MFAConfirmResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+	TokenResponse
+}
+
+type CreateAPIKeyPayload struct {
+	Name   string   `json:"name" validate:"required,max=100"`
+	Scopes []string `json:"scopes" validate:"required,min=1,dive,required"`
+}
+
+// CreateAPIKeyResponse carries the key, which is only shown once.
+type CreateAPIKeyResponse struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+type TokenResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
+	ExpiresIn    int64  `json:"expiresIn"`
+}
+
 type CartCheckoutPayload struct {
 	Items []CartCheckoutItem `json:"items" validate:"required"`
+	// AddressID is the address to ship to, the default shipping address of
+	// the user if left out.
+	AddressID int `json:"addressID"`
+}
+
+// ReservationPayload lists the items of the cart to reserve stock for.
+type ReservationPayload struct {
+	Items []CartCheckoutItem `json:"items" validate:"required,min=1,max=100"`
 }
 
 type CreateBookPayload struct {
@@ -159,6 +929,33 @@ type Review struct {
 	CreatedAt string `json:"createdAt"`
 }
 
+type Favorite struct {
+	FavoriteID string `json:"favoriteid"`
+	UserID     string `json:"userid"`
+	BookID     string `json:"bookid"`
+	CreatedAt  string `json:"createdAt"`
+}
+
+// UserDataExport is everything stored about a user, handed out to them when
+// they ask for their data.
+type UserDataExport struct {
+	ExportedAt  time.Time      `json:"exportedAt"`
+	Profile     User           `json:"profile"`
+	Addresses   []Address      `json:"addresses"`
+	Orders      []OrderDetails `json:"orders"`
+	Reviews     []Review       `json:"reviews"`
+	Favorites   []Favorite     `json:"favorites"`
+	Preferences Preferences    `json:"preferences"`
+}
+
+type PrivacyStore interface {
+	ExportUserData(userID int) (*UserDataExport, error)
+	// EraseUser anonymizes the user and their reviews and removes the rest
+	// of their personal data in a single transaction. Orders are kept for
+	// accounting.
+	EraseUser(userID int) error
+}
+
 type FavoritePayload struct {
 	BookID string `json:"bookid" validate:"required"`
 }